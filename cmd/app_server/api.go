@@ -0,0 +1,380 @@
+package main
+
+// HTTP/JSON API mirroring the websocket operations, for batch tools and scripts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/stts-se/segment_checker/dbapi"
+	"github.com/stts-se/segment_checker/modules"
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// apiRoute is an HTTP API endpoint, with documentation
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	// QueryParams maps query parameter names to descriptions
+	QueryParams map[string]string
+	// Request is an instance of the request body type, or nil if the request has no body
+	Request interface{}
+	// Response is an instance of the response body type
+	Response interface{}
+	Handler  http.HandlerFunc
+}
+
+var apiRoutes = []apiRoute{
+	{Method: "GET", Path: "/api/v1/segments", Summary: "List segments (as annotations) matching the request status",
+		QueryParams: map[string]string{
+			"request_status": "Request status (unchecked, checked, rejected, deleted, replaced, any, or a status of the project, by default ok, skip, bad sample or text verified); all segments are listed if empty",
+			"url":            "Only list the segments of this audio URL, ordered by start time (optional)",
+			"meta":           "Only list the segments with a metadata value, as <key>:<value> (optional, repeatable)",
+			"text":           "Only list the segments with a text matching the regular expression (optional)",
+			"segment_type":   "Only list the segments of this segment type (optional)",
+		},
+		Response: []protocol.AnnotationPayload{}, Handler: apiListSegments},
+	{Method: "GET", Path: "/api/v1/segments/{id}", Summary: "Get one segment (as an annotation)",
+		Response: protocol.AnnotationPayload{}, Handler: apiGetSegment},
+	{Method: "PUT", Path: "/api/v1/segments/{id}/annotation", Summary: "Save an annotation for the segment",
+		QueryParams: map[string]string{"user_name": "User saving the annotation, who must hold the lock for the segment, and be the source of the current status (defaults to the current status source)"},
+		Request:     protocol.AnnotationPayload{}, Response: protocol.AnnotationPayload{}, Handler: apiSaveAnnotation},
+	{Method: "POST", Path: "/api/v1/segments/{id}/lock", Summary: "Lock the segment for a user",
+		QueryParams: map[string]string{"user_name": "User name"},
+		Response:    protocol.UnlockPayload{}, Handler: apiLock},
+	{Method: "POST", Path: "/api/v1/segments/{id}/unlock", Summary: "Unlock the segment for a user",
+		QueryParams: map[string]string{"user_name": "User name"},
+		Response:    protocol.UnlockPayload{}, Handler: apiUnlock},
+	{Method: "POST", Path: "/api/v1/unlock_all", Summary: "Unlock all segments locked by a user",
+		QueryParams: map[string]string{"user_name": "User name"},
+		Response:    map[string]int{}, Handler: apiUnlockAll},
+	{Method: "POST", Path: "/api/v1/next", Summary: "Get the next segment matching the query",
+		QueryParams: map[string]string{"lock": "Lock the segment for the query user (true/false)"},
+		Request:     protocol.QueryPayload{}, Response: protocol.AnnotationPayload{}, Handler: apiNext},
+	{Method: "POST", Path: "/api/v1/edit", Summary: "Split, merge or insert segments. The new segments get ids and a derivation tracing back to the edited segments, and split or merged segments get status replaced.",
+		Request: protocol.EditPayload{}, Response: protocol.EditResultPayload{}, Handler: apiEdit},
+	{Method: "GET", Path: "/api/v1/export", Summary: "Export the final segments (as annotations, including derived segments), in the order of the source data",
+		QueryParams: map[string]string{
+			"format": "json (default) or tsv",
+			"all":    "Include segments with status replaced, rejected or deleted (true/false, default false)",
+		},
+		Response: []protocol.AnnotationPayload{}, Handler: apiExport},
+	{Method: "GET", Path: "/api/v1/stats", Summary: "Project statistics",
+		Response: map[string]int{}, Handler: apiStats},
+	{Method: "GET", Path: "/api/v1/project", Summary: "Project settings, from project.json in the project folder (with defaults filled in)",
+		Response: protocol.ProjectConfig{}, Handler: apiProjectConfig},
+	{Method: "GET", Path: "/api/v1/segment_types", Summary: "The segment types used in the project, with their default context and allowed labels",
+		Response: []protocol.SegmentTypePayload{}, Handler: apiSegmentTypes},
+	{Method: "GET", Path: "/api/v1/cache_stats", Summary: "Audio chunk cache statistics (hits, misses, evictions, size)",
+		Response: modules.ChunkCacheStats{}, Handler: apiCacheStats},
+	{Method: "GET", Path: "/api/v1/hello", Summary: "Server protocol version and capabilities (same as the websocket hello message)",
+		Response: protocol.HelloPayload{}, Handler: apiHello},
+	{Method: "GET", Path: "/api/v1/peaks", Summary: "Min/max waveform peaks for an audio URL, at the coarsest resolution giving at least the requested number of peaks",
+		QueryParams: map[string]string{
+			"url":     "Audio URL (as in the source data)",
+			"width":   "Requested number of peaks (1-10000)",
+			"start":   "Start time in milliseconds (optional, requires end; default: the whole recording)",
+			"end":     "End time in milliseconds",
+			"channel": "Audio channel, starting at 1 (optional; default: the project default)",
+		},
+		Response: protocol.PeaksPayload{}, Handler: apiPeaks},
+	{Method: "GET", Path: "/api/v1/audio", Summary: "Audio for a time span of an audio URL (up to 2 minutes), for reviewing longer parts of a recording. The audio timing is returned in X-Audio-* headers.",
+		QueryParams: map[string]string{
+			"url":     "Audio URL (as in the source data)",
+			"start":   "Start time in milliseconds (default 0)",
+			"end":     "End time in milliseconds (default: the end of the recording, or 10 minutes after start)",
+			"channel": "Audio channel, starting at 1 (optional; default: the project default)",
+		},
+		Response: []byte{}, Handler: apiAudioSpan},
+	{Method: "GET", Path: "/api/v1/segments/{id}/spectrogram", Summary: "Spectrogram for the segment's audio chunk (with context), as a PNG image (with the alignment in X-Spectrogram-* headers) or as an intensity matrix (JSON)",
+		QueryParams: map[string]string{
+			"format":        "png (default) or json",
+			"context":       "Left/right context in milliseconds (default: the same as for the audio chunk)",
+			"window_ms":     "Analysis window length in milliseconds (default 5)",
+			"step_ms":       "Time step in milliseconds (default 2)",
+			"min_freq":      "Lowest frequency in Hz (default 0)",
+			"max_freq":      "Highest frequency in Hz (default 8000)",
+			"dynamic_range": "Dynamic range in dB (default 50)",
+		},
+		Response: protocol.Spectrogram{}, Handler: apiSpectrogram},
+	{Method: "GET", Path: "/api/v1/segments/{id}/contours", Summary: "Pitch and intensity contours for the segment's audio chunk (with context)",
+		QueryParams: map[string]string{
+			"context":       "Left/right context in milliseconds (default: the same as for the audio chunk)",
+			"step_ms":       "Time step in milliseconds (default 10)",
+			"pitch_floor":   "Lowest pitch in Hz (default 75)",
+			"pitch_ceiling": "Highest pitch in Hz (default 600)",
+		},
+		Response: protocol.Contours{}, Handler: apiContours},
+}
+
+// httpStatus returns the http status code for an error code
+func httpStatus(code protocol.ErrorCode) int {
+	switch code {
+	case protocol.ErrorNotFound, protocol.ErrorNoMatch:
+		return http.StatusNotFound
+	case protocol.ErrorLocked, protocol.ErrorNotLocked, protocol.ErrorConflict:
+		return http.StatusConflict
+	case protocol.ErrorInvalidIndex, protocol.ErrorInvalidPayload:
+		return http.StatusBadRequest
+	case protocol.ErrorUnauthorized:
+		return http.StatusForbidden
+	case protocol.ErrorExtractionFailed:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// print serverMsg to server log, send error message as json to client, with an http status code matching the error code
+func apiError(w http.ResponseWriter, code protocol.ErrorCode, serverMsg string, clientMsg string) {
+	apiErrorDetails(w, code, nil, serverMsg, clientMsg)
+}
+
+// print error to server log, send it as json to client, with the error code and details from the (dbapi) error
+func apiDBError(w http.ResponseWriter, err error, msgPrefix string) {
+	msg := fmt.Sprintf("%s : %v", msgPrefix, err)
+	apiErrorDetails(w, dbapi.ErrorCode(err), dbapi.ErrorDetails(err), msg, msg)
+}
+
+func apiErrorDetails(w http.ResponseWriter, code protocol.ErrorCode, details map[string]string, serverMsg string, clientMsg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(code))
+	jsonError(w, code, details, serverMsg, clientMsg)
+}
+
+// send payload as json to client
+func apiPayload(w http.ResponseWriter, payload interface{}) {
+	resJSON, err := json.Marshal(payload)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal result : %v", err)
+		apiError(w, protocol.ErrorInternal, msg, msg)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\n", string(resJSON))
+}
+
+// read the request body into v
+func apiReadBody(r *http.Request, v interface{}) error {
+	bts, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("couldn't read request body : %v", err)
+	}
+	err = protocol.UnmarshalStrict(bts, v)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal request body : %v", err)
+	}
+	return nil
+}
+
+// metaParam returns the metadata filter from the (repeatable) meta parameter, with values of the form <key>:<value>
+func metaParam(r *http.Request) (map[string]string, error) {
+	res := map[string]string{}
+	for _, s := range r.URL.Query()["meta"] {
+		kv := strings.SplitN(s, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return res, fmt.Errorf("invalid meta filter %s (expected <key>:<value>)", s)
+		}
+		res[kv[0]] = kv[1]
+	}
+	return res, nil
+}
+
+// GET /api/v1/segments?request_status=<status>&url=<url>&meta=<key>:<value>&text=<regexp>&segment_type=<type>
+func apiListSegments(w http.ResponseWriter, r *http.Request) {
+	requestStatus := getParam("request_status", r)
+	filter := dbapi.Filter{SegmentType: getParam("segment_type", r)}
+	var err error
+	filter.Meta, err = metaParam(r)
+	if err != nil {
+		msg := fmt.Sprintf("%v", err)
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+	if text := getParam("text", r); text != "" {
+		filter.Text, err = regexp.Compile(text)
+		if err != nil {
+			msg := fmt.Sprintf("invalid text search : %v", err)
+			apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+			return
+		}
+	}
+	if url := getParam("url", r); url != "" {
+		apiPayload(w, db.SegmentsForURL(url, requestStatus, filter))
+		return
+	}
+	apiPayload(w, db.ListSegments(requestStatus, filter))
+}
+
+// GET /api/v1/segments/{id}
+func apiGetSegment(w http.ResponseWriter, r *http.Request) {
+	id := getParam("id", r)
+	res, err := db.GetSegment(id)
+	if err != nil {
+		apiDBError(w, err, "Couldn't get segment")
+		return
+	}
+	apiPayload(w, res)
+}
+
+// PUT /api/v1/segments/{id}/annotation
+func apiSaveAnnotation(w http.ResponseWriter, r *http.Request) {
+	// the body must be read before any form values are parsed
+	var annotation protocol.AnnotationPayload
+	err := apiReadBody(r, &annotation)
+	if err != nil {
+		msg := fmt.Sprintf("%v", err)
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+	id := getParam("id", r)
+	if annotation.ID != id {
+		msg := fmt.Sprintf("Mismatching ids for annotation/request : %v/%v", annotation.ID, id)
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+	user := getParam("user_name", r)
+	if user == "" {
+		user = annotation.CurrentStatus.Source
+	}
+	err = db.SaveIfLockedBy(annotation, user)
+	if err != nil {
+		apiDBError(w, err, "Failed to save annotation")
+		return
+	}
+	pushStats()
+	res, err := db.GetSegment(id)
+	if err != nil {
+		apiDBError(w, err, "Couldn't get segment")
+		return
+	}
+	apiPayload(w, res)
+}
+
+// POST /api/v1/segments/{id}/lock?user_name=<user>
+func apiLock(w http.ResponseWriter, r *http.Request) {
+	id := getParam("id", r)
+	user := getParam("user_name", r)
+	if user == "" {
+		msg := "User name not provided for lock"
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+	if _, err := db.GetSegment(id); err != nil {
+		apiDBError(w, err, "Couldn't lock segment")
+		return
+	}
+	err := db.Lock(id, user)
+	if err != nil {
+		apiDBError(w, err, "Couldn't lock segment")
+		return
+	}
+	pushStats()
+	apiPayload(w, protocol.UnlockPayload{SegmentID: id, UserName: user})
+}
+
+// POST /api/v1/segments/{id}/unlock?user_name=<user>
+func apiUnlock(w http.ResponseWriter, r *http.Request) {
+	id := getParam("id", r)
+	user := getParam("user_name", r)
+	if user == "" {
+		msg := "User name not provided for unlock"
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+	err := db.Unlock(id, user)
+	if err != nil {
+		apiDBError(w, err, "Couldn't unlock segment")
+		return
+	}
+	pushStats()
+	apiPayload(w, protocol.UnlockPayload{SegmentID: id, UserName: user})
+}
+
+// POST /api/v1/unlock_all?user_name=<user>
+func apiUnlockAll(w http.ResponseWriter, r *http.Request) {
+	user := getParam("user_name", r)
+	if user == "" {
+		msg := "User name not provided for unlock"
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+	n, err := db.UnlockAll(user)
+	if err != nil {
+		apiDBError(w, err, "Failed to unlock")
+		return
+	}
+	pushStats()
+	apiPayload(w, map[string]int{"unlocked": n})
+}
+
+// POST /api/v1/next?lock=true, with a query payload as request body
+func apiNext(w http.ResponseWriter, r *http.Request) {
+	var query protocol.QueryPayload
+	err := apiReadBody(r, &query)
+	if err != nil {
+		msg := fmt.Sprintf("%v", err)
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+	if err := validateQuery(&query); err != nil {
+		msg := fmt.Sprintf("%v", err)
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+	lock, _ := strconv.ParseBool(getParam("lock", r))
+	segment, err := db.GetNextSegment(query, "", lock)
+	if err != nil {
+		apiDBError(w, err, "Couldn't get next segment")
+		return
+	}
+	if lock {
+		pushStats()
+	}
+	apiPayload(w, segment)
+}
+
+// GET /api/v1/cache_stats
+func apiCacheStats(w http.ResponseWriter, r *http.Request) {
+	cache := chunkExtractor.Cache()
+	if cache == nil {
+		apiPayload(w, modules.ChunkCacheStats{})
+		return
+	}
+	apiPayload(w, cache.Stats())
+}
+
+// GET /api/v1/hello
+func apiHello(w http.ResponseWriter, r *http.Request) {
+	apiPayload(w, protocol.HelloPayload{
+		ProtocolVersion: protocol.ProtocolVersion,
+		Capabilities:    serverCapabilities(),
+	})
+}
+
+// GET /api/v1/project
+func apiProjectConfig(w http.ResponseWriter, r *http.Request) {
+	apiPayload(w, db.Config())
+}
+
+// GET /api/v1/segment_types
+func apiSegmentTypes(w http.ResponseWriter, r *http.Request) {
+	apiPayload(w, db.SegmentTypes())
+}
+
+// GET /api/v1/stats
+func apiStats(w http.ResponseWriter, r *http.Request) {
+	res, err := db.Stats()
+	if err != nil {
+		msg := fmt.Sprintf("Failed to create stats : %v", err)
+		apiError(w, protocol.ErrorInternal, msg, msg)
+		return
+	}
+	apiPayload(w, res)
+}
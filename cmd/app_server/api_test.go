@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stts-se/segment_checker/modules"
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// apiRequest sends a request to the test server, with the body as JSON (if not nil), and returns the status code and the response body
+func apiRequest(t *testing.T, srv *httptest.Server, method, path string, body interface{}) (int, []byte) {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		reqBody, err = json.Marshal(body)
+		if err != nil {
+			t.Fatalf("couldn't marshal request body: %v", err)
+		}
+	}
+	req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatalf("couldn't create request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	bts, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("couldn't read response: %v", err)
+	}
+	return resp.StatusCode, bts
+}
+
+// errorCode returns the error code of an error response
+func errorCode(bts []byte) protocol.ErrorCode {
+	var msg Message
+	json.Unmarshal(bts, &msg)
+	return msg.Code
+}
+
+// testAnnotation returns an annotation of the source segment, with the status set by the user
+func testAnnotation(t *testing.T, id, status, user string) protocol.AnnotationPayload {
+	seg, ok := db.SourceSegment(id)
+	if !ok {
+		t.Fatalf("no source segment %s", id)
+	}
+	res := protocol.AnnotationPayload{SegmentPayload: seg}
+	res.SetCurrentStatus(protocol.Status{Name: status, Source: user, Timestamp: "2020-01-01 00:00:00"})
+	return res
+}
+
+func TestAPISaveAnnotation(t *testing.T) {
+	dir := newTestProject(t, "", testSegment("s1", "/audio/a.wav", 0, 100), testSegment("s2", "/audio/a.wav", 200, 300))
+	defer os.RemoveAll(dir)
+	srv := newTestServer()
+	defer srv.Close()
+
+	if status, bts := apiRequest(t, srv, "POST", "/api/v1/segments/s1/lock?user_name=user1", nil); status != http.StatusOK {
+		t.Fatalf("expected status %d for lock, got %d: %s", http.StatusOK, status, bts)
+	}
+	if status, bts := apiRequest(t, srv, "POST", "/api/v1/segments/s2/lock?user_name=user2", nil); status != http.StatusOK {
+		t.Fatalf("expected status %d for lock, got %d: %s", http.StatusOK, status, bts)
+	}
+
+	for _, test := range []struct {
+		name       string
+		path       string
+		annotation protocol.AnnotationPayload
+		expStatus  int
+		expCode    protocol.ErrorCode
+	}{
+		{name: "locked by another user", path: "/api/v1/segments/s2/annotation?user_name=user1", annotation: testAnnotation(t, "s2", "ok", "user1"), expStatus: http.StatusConflict, expCode: protocol.ErrorLocked},
+		{name: "user not matching the status source", path: "/api/v1/segments/s1/annotation?user_name=user1", annotation: testAnnotation(t, "s1", "ok", "user2"), expStatus: http.StatusBadRequest, expCode: protocol.ErrorInvalidPayload},
+		{name: "status source not holding the lock", path: "/api/v1/segments/s1/annotation", annotation: testAnnotation(t, "s1", "ok", "user2"), expStatus: http.StatusConflict, expCode: protocol.ErrorLocked},
+		{name: "mismatching ids", path: "/api/v1/segments/s2/annotation?user_name=user1", annotation: testAnnotation(t, "s1", "ok", "user1"), expStatus: http.StatusBadRequest, expCode: protocol.ErrorInvalidPayload},
+		{name: "unknown status", path: "/api/v1/segments/s1/annotation?user_name=user1", annotation: testAnnotation(t, "s1", "great", "user1"), expStatus: http.StatusBadRequest, expCode: protocol.ErrorInvalidPayload},
+		{name: "locked by the user", path: "/api/v1/segments/s1/annotation?user_name=user1", annotation: testAnnotation(t, "s1", "ok", "user1"), expStatus: http.StatusOK},
+		{name: "user from the status source", path: "/api/v1/segments/s1/annotation", annotation: testAnnotation(t, "s1", "skip", "user1"), expStatus: http.StatusOK},
+	} {
+		status, bts := apiRequest(t, srv, "PUT", test.path, test.annotation)
+		if status != test.expStatus {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.expStatus, status, bts)
+		}
+		if code := errorCode(bts); code != test.expCode {
+			t.Errorf("%s: expected error code %q, got %q", test.name, test.expCode, code)
+		}
+	}
+	anno, _ := db.GetSegment("s1")
+	if anno.CurrentStatus.Name != "skip" || anno.CurrentStatus.Source != "user1" {
+		t.Errorf("expected s1 to be saved with status skip by user1, got %#v", anno.CurrentStatus)
+	}
+
+	// after unlocking, the segment can't be saved
+	if status, bts := apiRequest(t, srv, "POST", "/api/v1/segments/s1/unlock?user_name=user1", nil); status != http.StatusOK {
+		t.Fatalf("expected status %d for unlock, got %d: %s", http.StatusOK, status, bts)
+	}
+	status, bts := apiRequest(t, srv, "PUT", "/api/v1/segments/s1/annotation?user_name=user1", testAnnotation(t, "s1", "ok", "user1"))
+	if status != http.StatusConflict || errorCode(bts) != protocol.ErrorNotLocked {
+		t.Errorf("expected status %d with error code %s for an unlocked segment, got %d: %s", http.StatusConflict, protocol.ErrorNotLocked, status, bts)
+	}
+}
+
+func TestAPILocks(t *testing.T) {
+	dir := newTestProject(t, "", testSegment("s1", "/audio/a.wav", 0, 100), testSegment("s2", "/audio/a.wav", 200, 300))
+	defer os.RemoveAll(dir)
+	srv := newTestServer()
+	defer srv.Close()
+
+	for _, test := range []struct {
+		method    string
+		path      string
+		expStatus int
+		expCode   protocol.ErrorCode
+	}{
+		{method: "POST", path: "/api/v1/segments/s1/lock?user_name=user1", expStatus: http.StatusOK},
+		{method: "POST", path: "/api/v1/segments/s1/lock?user_name=user2", expStatus: http.StatusConflict, expCode: protocol.ErrorLocked},
+		{method: "POST", path: "/api/v1/segments/s1/lock", expStatus: http.StatusBadRequest, expCode: protocol.ErrorInvalidPayload},
+		{method: "POST", path: "/api/v1/segments/s3/lock?user_name=user1", expStatus: http.StatusNotFound, expCode: protocol.ErrorNotFound},
+		{method: "POST", path: "/api/v1/segments/s1/unlock?user_name=user2", expStatus: http.StatusConflict, expCode: protocol.ErrorLocked},
+		{method: "POST", path: "/api/v1/segments/s2/unlock?user_name=user1", expStatus: http.StatusConflict, expCode: protocol.ErrorNotLocked},
+		{method: "POST", path: "/api/v1/segments/s1/unlock?user_name=user1", expStatus: http.StatusOK},
+		{method: "GET", path: "/api/v1/segments/s3", expStatus: http.StatusNotFound, expCode: protocol.ErrorNotFound},
+	} {
+		status, bts := apiRequest(t, srv, test.method, test.path, nil)
+		if status != test.expStatus {
+			t.Errorf("%s %s: expected status %d, got %d: %s", test.method, test.path, test.expStatus, status, bts)
+		}
+		if code := errorCode(bts); code != test.expCode {
+			t.Errorf("%s %s: expected error code %q, got %q", test.method, test.path, test.expCode, code)
+		}
+	}
+}
+
+func TestAPINext(t *testing.T) {
+	dir := newTestProject(t, "", testSegment("s1", "/audio/a.wav", 0, 100), testSegment("s2", "/audio/a.wav", 200, 300))
+	defer os.RemoveAll(dir)
+	srv := newTestServer()
+	defer srv.Close()
+
+	query := protocol.QueryPayload{UserName: "user1", RequestStatus: "unchecked", StepSize: 1}
+	status, bts := apiRequest(t, srv, "POST", "/api/v1/next?lock=true", query)
+	var anno protocol.AnnotationPayload
+	if err := json.Unmarshal(bts, &anno); status != http.StatusOK || err != nil || anno.ID != "s1" {
+		t.Fatalf("expected segment s1, got %d: %s", status, bts)
+	}
+	if lockedBy, _ := db.LockedBy("s1"); lockedBy != "user1" {
+		t.Errorf("expected s1 to be locked by user1, got %q", lockedBy)
+	}
+	// the locked segment is skipped for other users
+	query.UserName = "user2"
+	status, bts = apiRequest(t, srv, "POST", "/api/v1/next", query)
+	if err := json.Unmarshal(bts, &anno); status != http.StatusOK || err != nil || anno.ID != "s2" {
+		t.Errorf("expected segment s2, got %d: %s", status, bts)
+	}
+	query.StepSize = 0
+	status, bts = apiRequest(t, srv, "POST", "/api/v1/next", query)
+	if status != http.StatusBadRequest || errorCode(bts) != protocol.ErrorInvalidPayload {
+		t.Errorf("expected status %d with error code %s for a query without step size, got %d: %s", http.StatusBadRequest, protocol.ErrorInvalidPayload, status, bts)
+	}
+	query = protocol.QueryPayload{UserName: "user2", RequestStatus: "ok", StepSize: 1}
+	status, bts = apiRequest(t, srv, "POST", "/api/v1/next", query)
+	if status != http.StatusNotFound || errorCode(bts) != protocol.ErrorNoMatch {
+		t.Errorf("expected status %d with error code %s for no matching segment, got %d: %s", http.StatusNotFound, protocol.ErrorNoMatch, status, bts)
+	}
+
+	var list []protocol.AnnotationPayload
+	status, bts = apiRequest(t, srv, "GET", "/api/v1/segments?request_status=unchecked", nil)
+	if err := json.Unmarshal(bts, &list); status != http.StatusOK || err != nil || len(list) != 2 {
+		t.Errorf("expected 2 unchecked segments, got %d: %s", status, bts)
+	}
+}
+
+func TestAPIAudioSpan(t *testing.T) {
+	dir := newTestProject(t, "", testSegment("s1", "/audio/a.wav", 0, 100), testSegment("s2", "/audio/b.wav", 0, 100))
+	defer os.RemoveAll(dir)
+	writeTestWav(t, dir, "a.wav", 2000)
+	prevExtractor := chunkExtractor
+	defer func() { chunkExtractor = prevExtractor }()
+	var err error
+	chunkExtractor, err = modules.NewChunkExtractor()
+	if err != nil {
+		t.Fatalf("got error from NewChunkExtractor: %v", err)
+	}
+	srv := newTestServer()
+	defer srv.Close()
+
+	for _, test := range []struct {
+		path      string
+		expStatus int
+		expCode   protocol.ErrorCode
+	}{
+		{path: "/api/v1/audio?url=/audio/a.wav&start=1000&end=1500", expStatus: http.StatusOK},
+		{path: "/api/v1/audio?url=/audio/a.wav", expStatus: http.StatusOK},
+		{path: "/api/v1/audio?url=/audio/c.wav", expStatus: http.StatusNotFound, expCode: protocol.ErrorNotFound},
+		{path: "/api/v1/audio?url=/audio/a.wav&start=-1&end=1000", expStatus: http.StatusBadRequest, expCode: protocol.ErrorInvalidPayload},
+		{path: "/api/v1/audio?url=/audio/a.wav&start=1000&end=1000", expStatus: http.StatusBadRequest, expCode: protocol.ErrorInvalidPayload},
+		{path: fmt.Sprintf("/api/v1/audio?url=/audio/a.wav&start=1000&end=%d", 1000+maxSpanLength+1), expStatus: http.StatusBadRequest, expCode: protocol.ErrorInvalidPayload},
+		// b.wav doesn't exist: a span that is too long is rejected before the audio is read
+		{path: fmt.Sprintf("/api/v1/audio?url=/audio/b.wav&start=0&end=%d", maxSpanLength+1), expStatus: http.StatusBadRequest, expCode: protocol.ErrorInvalidPayload},
+		{path: "/api/v1/audio?url=/audio/b.wav&start=0&end=1000", expStatus: http.StatusBadGateway, expCode: protocol.ErrorExtractionFailed},
+	} {
+		status, bts := apiRequest(t, srv, "GET", test.path, nil)
+		if status != test.expStatus {
+			t.Errorf("%s: expected status %d, got %d: %s", test.path, test.expStatus, status, bts)
+		}
+		if test.expCode != "" && errorCode(bts) != test.expCode {
+			t.Errorf("%s: expected error code %q, got %q", test.path, test.expCode, errorCode(bts))
+		}
+	}
+
+	// 500 ms at 16 kHz, 16 bit mono, with a 44 byte header
+	req, _ := http.NewRequest("GET", srv.URL+"/api/v1/audio?url=/audio/a.wav&start=1000&end=1500", nil)
+	req.Header.Set("Range", "bytes=44-")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	bts, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || len(bts) != 8000*2 {
+		t.Errorf("expected status %d with %d bytes for a range request, got %d with %d bytes", http.StatusPartialContent, 8000*2, resp.StatusCode, len(bts))
+	}
+	if offset := resp.Header.Get("X-Audio-Offset"); offset != "1000" {
+		t.Errorf("expected X-Audio-Offset 1000, got %q", offset)
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	exp := map[protocol.ErrorCode]int{
+		protocol.ErrorLocked:           http.StatusConflict,
+		protocol.ErrorNotLocked:        http.StatusConflict,
+		protocol.ErrorNotFound:         http.StatusNotFound,
+		protocol.ErrorNoMatch:          http.StatusNotFound,
+		protocol.ErrorInvalidIndex:     http.StatusBadRequest,
+		protocol.ErrorInvalidPayload:   http.StatusBadRequest,
+		protocol.ErrorConflict:         http.StatusConflict,
+		protocol.ErrorUnauthorized:     http.StatusForbidden,
+		protocol.ErrorExtractionFailed: http.StatusBadGateway,
+		protocol.ErrorIdleTimeout:      http.StatusInternalServerError,
+		protocol.ErrorVersionMismatch:  http.StatusInternalServerError,
+		protocol.ErrorInternal:         http.StatusInternalServerError,
+	}
+	for code := range protocol.ErrorCodes {
+		if got, ok := exp[code]; !ok || httpStatus(code) != got {
+			t.Errorf("expected http status %d for error code %s, got %d", exp[code], code, httpStatus(code))
+		}
+	}
+}
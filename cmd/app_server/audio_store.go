@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	"github.com/stts-se/segment_checker/log"
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// audioStoreTTL is the time an audio chunk is available for download at /audio_chunk/{id}
+const audioStoreTTL = 5 * time.Minute
+
+// audioStoreMaxSize is the max total size, in bytes, of the audio chunks available for download. When the store is full, the oldest chunks are removed first.
+const audioStoreMaxSize = 100 * 1024 * 1024
+
+type storedAudio struct {
+	bts      []byte
+	fileType string
+	created  time.Time
+	expires  time.Time
+}
+
+// audioStore holds short-lived audio chunks for the url audio transport
+type audioStore struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	maxSize int
+	size    int
+	chunks  map[string]storedAudio
+	// order holds the ids of the chunks, oldest first
+	order []string
+}
+
+func newAudioStore(ttl time.Duration, maxSize int) *audioStore {
+	return &audioStore{ttl: ttl, maxSize: maxSize, chunks: make(map[string]storedAudio)}
+}
+
+var chunkStore = newAudioStore(audioStoreTTL, audioStoreMaxSize)
+
+// add stores the audio, and returns the id to use for downloading it. If needed, the oldest chunks are removed to make room for the audio.
+func (s *audioStore) add(bts []byte, fileType string) (string, error) {
+	if len(bts) > s.maxSize {
+		return "", fmt.Errorf("audio chunk of %d bytes is larger than the audio store (%d bytes)", len(bts), s.maxSize)
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("couldn't create uuid : %v", err)
+	}
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.purge(now)
+	for s.size+len(bts) > s.maxSize {
+		s.removeOldest()
+	}
+	s.chunks[id.String()] = storedAudio{bts: bts, fileType: fileType, created: now, expires: now.Add(s.ttl)}
+	s.order = append(s.order, id.String())
+	s.size += len(bts)
+	return id.String(), nil
+}
+
+func (s *audioStore) get(id string) (storedAudio, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.purge(time.Now())
+	res, ok := s.chunks[id]
+	return res, ok
+}
+
+// purge removes expired chunks; the caller must hold the mutex
+func (s *audioStore) purge(now time.Time) {
+	// the chunks expire in the order they were added
+	for len(s.order) > 0 && now.After(s.chunks[s.order[0]].expires) {
+		s.removeOldest()
+	}
+}
+
+// removeOldest removes the oldest chunk; the caller must hold the mutex
+func (s *audioStore) removeOldest() {
+	id := s.order[0]
+	s.order = s.order[1:]
+	s.size -= len(s.chunks[id].bts)
+	delete(s.chunks, id)
+}
+
+// GET /audio_chunk/{id}
+func serveAudioChunk(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	chunk, ok := chunkStore.get(id)
+	if !ok {
+		msg := fmt.Sprintf("No audio chunk with id %s (it may have expired)", id)
+		log.Error(msg)
+		http.Error(w, msg, http.StatusNotFound)
+		return
+	}
+	if contentType := mime.TypeByExtension("." + chunk.fileType); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	// ServeContent handles Range requests
+	http.ServeContent(w, r, id+"."+chunk.fileType, chunk.created, bytes.NewReader(chunk.bts))
+}
+
+// selectAudioTransport returns the first audio transport requested by the client that is supported by the server, or base64 if there is none
+func selectAudioTransport(clientTransports []string) string {
+	for _, t := range clientTransports {
+		for _, supported := range protocol.AudioTransports {
+			if t == supported {
+				return t
+			}
+		}
+	}
+	return protocol.AudioTransportBase64
+}
+
+// sendAudioChunk sends the audio chunk to the client, using the audio transport selected for the client in the handshake
+func sendAudioChunk(conn *websocket.Conn, chunk protocol.AudioChunk, bts []byte) error {
+	// the handshake is required before any other messages, so the transport has always been selected
+	transport, ok := audioTransports.Load(conn)
+	if !ok {
+		return fmt.Errorf("no audio transport selected for the client")
+	}
+	switch transport {
+	case protocol.AudioTransportBinary:
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return fmt.Errorf("couldn't create uuid : %v", err)
+		}
+		chunk.AudioID = id.String()
+		wsPayload(conn, "audio_chunk", chunk)
+		frame := append([]byte(chunk.AudioID), bts...)
+		return wsWriteMessage(conn, websocket.BinaryMessage, frame)
+	case protocol.AudioTransportURL:
+		id, err := chunkStore.add(bts, chunk.FileType)
+		if err != nil {
+			return err
+		}
+		chunk.AudioURL = "/audio_chunk/" + id
+		wsPayload(conn, "audio_chunk", chunk)
+		return nil
+	case protocol.AudioTransportBase64:
+		chunk.Audio = base64.StdEncoding.EncodeToString(bts)
+		wsPayload(conn, "audio_chunk", chunk)
+		return nil
+	default:
+		return fmt.Errorf("unknown audio transport %v", transport)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAudioStoreMaxSize(t *testing.T) {
+	store := newAudioStore(time.Minute, 100)
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		id, err := store.add(make([]byte, 40), "wav")
+		if err != nil {
+			t.Fatalf("got error from add: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	// the oldest chunk is removed to make room for the third chunk
+	if _, ok := store.get(ids[0]); ok {
+		t.Errorf("expected the oldest chunk to be removed")
+	}
+	for _, id := range ids[1:] {
+		if _, ok := store.get(id); !ok {
+			t.Errorf("expected chunk %s to be available", id)
+		}
+	}
+	if store.size != 80 || len(store.chunks) != 2 || len(store.order) != 2 {
+		t.Errorf("expected 2 chunks of 80 bytes, got %d chunks (%d in order) of %d bytes", len(store.chunks), len(store.order), store.size)
+	}
+
+	// a chunk filling the store removes all other chunks
+	id, err := store.add(make([]byte, 100), "wav")
+	if err != nil {
+		t.Fatalf("got error from add: %v", err)
+	}
+	if _, ok := store.get(id); !ok || len(store.chunks) != 1 || store.size != 100 {
+		t.Errorf("expected only the last chunk to be available, got %d chunks of %d bytes", len(store.chunks), store.size)
+	}
+	if _, err := store.add(make([]byte, 101), "wav"); err == nil {
+		t.Errorf("expected error for a chunk larger than the store")
+	}
+}
+
+func TestAudioStoreTTL(t *testing.T) {
+	store := newAudioStore(50*time.Millisecond, 100)
+	id, err := store.add(make([]byte, 40), "wav")
+	if err != nil {
+		t.Fatalf("got error from add: %v", err)
+	}
+	if _, ok := store.get(id); !ok {
+		t.Errorf("expected chunk %s to be available", id)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := store.get(id); ok {
+		t.Errorf("expected chunk %s to be expired", id)
+	}
+	if store.size != 0 || len(store.order) != 0 {
+		t.Errorf("expected an empty store, got %d chunks of %d bytes", len(store.order), store.size)
+	}
+}
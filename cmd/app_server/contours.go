@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// contourParams reads the contour options from the request's query parameters
+func contourParams(r *http.Request) (protocol.ContourOptions, error) {
+	res := protocol.ContourOptions{}
+	for name, v := range map[string]*float64{
+		"step_ms":       &res.StepMs,
+		"pitch_floor":   &res.PitchFloor,
+		"pitch_ceiling": &res.PitchCeiling,
+	} {
+		s := getParam(name, r)
+		if s == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return res, fmt.Errorf("invalid %s : %v", name, err)
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return res, fmt.Errorf("invalid %s : %s", name, s)
+		}
+		*v = f
+	}
+	return res, nil
+}
+
+// GET /api/v1/segments/{id}/contours?context=<ms>&step_ms=<ms>&pitch_floor=<hz>&pitch_ceiling=<hz>
+func apiContours(w http.ResponseWriter, r *http.Request) {
+	id := getParam("id", r)
+	annotation, err := db.GetSegment(id)
+	if err != nil {
+		apiDBError(w, err, "Couldn't get segment")
+		return
+	}
+	opts, err := contourParams(r)
+	if err != nil {
+		msg := fmt.Sprintf("%v", err)
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+	context, err := contextParam(r)
+	if err != nil {
+		msg := fmt.Sprintf("%v", err)
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+
+	contours, err := chunkExtractor.ContoursWithContext(splitRequest(annotation, context), opts)
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't compute contours : %v", err)
+		apiErrorDetails(w, protocol.ErrorExtractionFailed, map[string]string{"segment_id": id, "url": annotation.URL}, msg, msg)
+		return
+	}
+	apiPayload(w, contours)
+}
@@ -0,0 +1,229 @@
+package main
+
+// API documentation: OpenAPI description of the HTTP API, and a catalogue of websocket message types
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// wsMessageDoc describes a websocket message type
+type wsMessageDoc struct {
+	MessageType string `json:"message_type"`
+	// Sender is "client" or "server"
+	Sender      string `json:"sender"`
+	Description string `json:"description"`
+	// Payload is an instance of the payload type, or nil if the message has no payload
+	Payload interface{} `json:"-"`
+	// PayloadSchema is generated from Payload
+	PayloadSchema *protocol.Schema `json:"payload_schema,omitempty"`
+}
+
+var wsMessages = []wsMessageDoc{
+	{MessageType: "hello", Sender: "client", Description: "Protocol version and client capabilities; must be the first message sent by the client", Payload: protocol.HelloPayload{}},
+	{MessageType: "keep_alive", Sender: "client", Description: "Signal that the user is still active (no payload)"},
+	{MessageType: "stats", Sender: "client", Description: "Request project statistics (no payload)"},
+	{MessageType: "saveunlockandnext", Sender: "client", Description: "Save an annotation (if any), get the next segment matching the query, and unlock the current segment",
+		Payload: AnnotationUnlockAndQueryPayload{}},
+	{MessageType: "unlock", Sender: "client", Description: "Unlock a segment", Payload: protocol.UnlockPayload{}},
+	{MessageType: "unlock_all", Sender: "client", Description: "Unlock all segments for a user (segment_id is ignored)", Payload: protocol.UnlockPayload{}},
+	{MessageType: "edit", Sender: "client", Description: "Split, merge or insert segments. The first new segment is locked for the user and sent as an audio_chunk, and the edited segments are unlocked.", Payload: protocol.EditPayload{}},
+	{MessageType: "peaks", Sender: "client", Description: "Request min/max waveform peaks for an audio URL (the whole recording, or a time range)", Payload: protocol.PeaksRequestPayload{}},
+
+	{MessageType: "hello", Sender: "server", Description: "Protocol version and server capabilities, sent in reply to the client's hello", Payload: protocol.HelloPayload{}},
+	{MessageType: "project_name", Sender: "server", Description: "Project name, sent after the hello message", Payload: ""},
+	{MessageType: "project_config", Sender: "server", Description: "Project settings (with defaults filled in), sent after the project name. The client's save buttons are created from the statuses.", Payload: protocol.ProjectConfig{}},
+	{MessageType: "segment_types", Sender: "server", Description: "The segment types used in the project, with their default context and allowed labels, sent after the project name", Payload: []protocol.SegmentTypePayload{}},
+	{MessageType: "stats", Sender: "server", Description: "Project statistics", Payload: map[string]int{}},
+	{MessageType: "audio_chunk", Sender: "server", Description: "Segment with audio for the requested segment. Depending on the audio transport selected in the hello handshake, the audio is base64 encoded in the audio field (base64), sent in a following binary frame prefixed by the audio_id (binary), or downloadable from audio_url (url)", Payload: protocol.AudioChunk{}},
+	{MessageType: "no_audio_chunk", Sender: "server", Description: "No segment was found for the query", Payload: ""},
+	{MessageType: "explicit_unlock_completed", Sender: "server", Description: "Unlock completed", Payload: ""},
+	{MessageType: "peaks", Sender: "server", Description: "Min/max waveform peaks, in reply to a peaks request", Payload: protocol.PeaksPayload{}},
+	{MessageType: "edited", Sender: "server", Description: "The result of an edit, sent before the audio_chunk for the first new segment", Payload: protocol.EditResultPayload{}},
+	{MessageType: "idle_warning", Sender: "server", Description: "The client will soon be disconnected due to inactivity", Payload: ""},
+}
+
+func init() {
+	for i, msg := range wsMessages {
+		if msg.Payload != nil {
+			wsMessages[i].PayloadSchema = protocol.SchemaOf(msg.Payload)
+		}
+	}
+}
+
+var pathParamRE = regexp.MustCompile(`{([^}]+)}`)
+
+// openAPISchemaRef returns a reference to a named struct type (adding the type's schema to components), or an inline schema for other types
+func openAPISchemaRef(v interface{}, components map[string]*protocol.Schema) *protocol.Schema {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct {
+		return &protocol.Schema{Type: "array", Items: openAPISchemaRef(reflect.Zero(t.Elem()).Interface(), components)}
+	}
+	if t.Kind() == reflect.Struct && t.Name() != "" {
+		components[t.Name()] = protocol.SchemaOf(v)
+		return &protocol.Schema{Ref: "#/components/schemas/" + t.Name()}
+	}
+	return protocol.SchemaOf(v)
+}
+
+func jsonContent(schema *protocol.Schema) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+func openAPISpec() map[string]interface{} {
+	components := map[string]*protocol.Schema{}
+	components["Message"] = protocol.SchemaOf(Message{})
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content":     jsonContent(&protocol.Schema{Ref: "#/components/schemas/Message"}),
+	}
+
+	paths := map[string]map[string]interface{}{}
+	for _, route := range apiRoutes {
+		params := []map[string]interface{}{}
+		for _, m := range pathParamRE.FindAllStringSubmatch(route.Path, -1) {
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true, "schema": protocol.Schema{Type: "string"},
+			})
+		}
+		queryParams := []string{}
+		for name := range route.QueryParams {
+			queryParams = append(queryParams, name)
+		}
+		sort.Strings(queryParams)
+		for _, name := range queryParams {
+			params = append(params, map[string]interface{}{
+				"name": name, "in": "query", "description": route.QueryParams[name], "schema": protocol.Schema{Type: "string"},
+			})
+		}
+		op := map[string]interface{}{
+			"summary":    route.Summary,
+			"parameters": params,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "OK",
+					"content":     jsonContent(openAPISchemaRef(route.Response, components)),
+				},
+				"default": errorResponse,
+			},
+		}
+		if route.Request != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(openAPISchemaRef(route.Request, components)),
+			}
+		}
+		if _, ok := paths[route.Path]; !ok {
+			paths[route.Path] = map[string]interface{}{}
+		}
+		paths[route.Path][strings.ToLower(route.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Segment checker",
+			"description": "HTTP API for the segment checker. The browser client uses websocket messages, listed in x-websocket-messages. Websocket messages are sent as a Message, with the payload JSON encoded into the payload string.",
+			"version":     "1",
+		},
+		"paths":                paths,
+		"components":           map[string]interface{}{"schemas": components},
+		"x-websocket-messages": wsMessages,
+		"x-error-codes":        protocol.ErrorCodes,
+	}
+}
+
+// GET /doc/openapi.json
+func generateOpenAPI(w http.ResponseWriter, r *http.Request) {
+	resJSON, err := json.MarshalIndent(openAPISpec(), "", "  ")
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal result : %v", err)
+		httpError(w, msg, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\n", string(resJSON))
+}
+
+// GET /doc/schemas.json
+func generateSchemas(w http.ResponseWriter, r *http.Request) {
+	resJSON, err := json.MarshalIndent(protocol.Schemas(), "", "  ")
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal result : %v", err)
+		httpError(w, msg, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\n", string(resJSON))
+}
+
+func schemaHTML(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	bts, err := json.MarshalIndent(protocol.SchemaOf(v), "", "  ")
+	if err != nil {
+		return html.EscapeString(fmt.Sprintf("%v", err))
+	}
+	return fmt.Sprintf("<details><summary>%s</summary><pre>%s</pre></details>", html.EscapeString(reflect.TypeOf(v).String()), html.EscapeString(string(bts)))
+}
+
+// GET /doc/
+func generateDoc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><head><title>%s</title></head><body>\n", "Segment checker: Doc")
+
+	fmt.Fprintf(w, "<h2>HTTP API</h2>\n")
+	fmt.Fprintf(w, "<p>OpenAPI description: <a href='/doc/openapi.json'>/doc/openapi.json</a></p>\n")
+	fmt.Fprintf(w, "<p>JSON Schemas for the file and wire formats: <a href='/doc/schemas.json'>/doc/schemas.json</a></p>\n")
+	fmt.Fprintf(w, "<table border='1' cellpadding='4'><tr><th>Method</th><th>Path</th><th>Summary</th><th>Query params</th><th>Request</th><th>Response</th></tr>\n")
+	for _, route := range apiRoutes {
+		params := []string{}
+		for name, desc := range route.QueryParams {
+			params = append(params, fmt.Sprintf("<b>%s</b>: %s", html.EscapeString(name), html.EscapeString(desc)))
+		}
+		sort.Strings(params)
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+			route.Method, html.EscapeString(route.Path), html.EscapeString(route.Summary), strings.Join(params, "<br/>"), schemaHTML(route.Request), schemaHTML(route.Response))
+	}
+	fmt.Fprintf(w, "</table>\n")
+
+	fmt.Fprintf(w, "<h2>Websocket messages</h2>\n")
+	fmt.Fprintf(w, "<p>Connect to /ws/{client_id}/{user_name}, and send a hello message with protocol version %d. Messages are sent as a Message, with the payload JSON encoded into the payload string. Recoverable errors are sent in the error field, non-recoverable errors in the fatal field, along with an error code.</p>\n", protocol.ProtocolVersion)
+	fmt.Fprintf(w, "%s\n", schemaHTML(Message{}))
+	fmt.Fprintf(w, "<table border='1' cellpadding='4'><tr><th>Message type</th><th>Sender</th><th>Description</th><th>Payload</th></tr>\n")
+	for _, msg := range wsMessages {
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(msg.MessageType), msg.Sender, html.EscapeString(msg.Description), schemaHTML(msg.Payload))
+	}
+	fmt.Fprintf(w, "</table>\n")
+
+	fmt.Fprintf(w, "<h2>Error codes</h2>\n")
+	fmt.Fprintf(w, "<p>Errors (HTTP and websocket) are sent as a Message with a machine-readable code, and optional details.</p>\n")
+	codes := []string{}
+	for code := range protocol.ErrorCodes {
+		codes = append(codes, string(code))
+	}
+	sort.Strings(codes)
+	fmt.Fprintf(w, "<table border='1' cellpadding='4'><tr><th>Code</th><th>Description</th></tr>\n")
+	for _, code := range codes {
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td></tr>\n", code, html.EscapeString(protocol.ErrorCodes[protocol.ErrorCode(code)]))
+	}
+	fmt.Fprintf(w, "</table>\n")
+
+	fmt.Fprintf(w, "<h2>All routes</h2>\n")
+	for _, url := range walkedURLs {
+		fmt.Fprintf(w, "%s<br/>\n", html.EscapeString(url))
+	}
+	fmt.Fprintf(w, "</body></html>")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/stts-se/segment_checker/log"
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// edit performs the edit operation, checking inserted segments against the audio window of the segment (with the explicit context if set, or else the default context)
+func edit(payload protocol.EditPayload) (protocol.EditResultPayload, error) {
+	var window protocol.Chunk
+	if payload.Operation == protocol.EditInsert && len(payload.SegmentIDs) == 1 {
+		segment, err := db.GetSegment(payload.SegmentIDs[0])
+		if err != nil {
+			return protocol.EditResultPayload{}, err
+		}
+		request := splitRequest(segment, payload.Context)
+		window = chunkExtractor.Window(request.URL, request.Chunk, request.LeftContext, request.RightContext)
+	}
+	return db.Edit(payload, window)
+}
+
+// wsEdit performs the edit operation, and loads the first new segment (locked for the user). The edited segments are unlocked.
+func wsEdit(conn *websocket.Conn, payload protocol.EditPayload) {
+	res, err := edit(payload)
+	if err != nil {
+		wsDBError(conn, err, "Edit failed")
+		return
+	}
+	wsPayload(conn, "edited", res)
+
+	for _, id := range payload.SegmentIDs {
+		if lockedBy, locked := db.LockedBy(id); locked && lockedBy == payload.UserName {
+			if err := db.Unlock(id, payload.UserName); err != nil {
+				log.Warning("Couldn't unlock edited segment %s : %v", id, err)
+			}
+		}
+	}
+	first := res.Segments[0]
+	if err := db.Lock(first.ID, payload.UserName); err != nil {
+		wsDBError(conn, err, "Couldn't lock new segment")
+		return
+	}
+	segment, err := db.GetSegment(first.ID)
+	if err != nil {
+		wsDBError(conn, err, "Couldn't get new segment")
+		return
+	}
+	load(conn, segment, payload.Context)
+}
+
+// POST /api/v1/edit, with an edit payload as request body
+func apiEdit(w http.ResponseWriter, r *http.Request) {
+	var payload protocol.EditPayload
+	err := apiReadBody(r, &payload)
+	if err != nil {
+		msg := fmt.Sprintf("%v", err)
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+	res, err := edit(payload)
+	if err != nil {
+		apiDBError(w, err, "Edit failed")
+		return
+	}
+	pushStats()
+	apiPayload(w, res)
+}
+
+// exportColumns are the columns of the tsv export
+var exportColumns = []string{"id", "url", "segment_type", "channel", "start", "end", "status", "labels", "comment", "operation", "parents", "sources", "meta", "text"}
+
+// GET /api/v1/export?format=<json|tsv>&all=<true|false>
+func apiExport(w http.ResponseWriter, r *http.Request) {
+	all, _ := strconv.ParseBool(getParam("all", r))
+	segments := db.Export(all)
+	switch format := getParam("format", r); format {
+	case "", "json":
+		apiPayload(w, segments)
+	case "tsv":
+		w.Header().Set("Content-Type", "text/tab-separated-values; charset=utf-8")
+		writer := csv.NewWriter(w)
+		writer.Comma = '\t'
+		writer.Write(exportColumns)
+		for _, seg := range segments {
+			operation, parents, sources := "", "", seg.ID
+			if d := seg.Derivation; d != nil {
+				operation, parents, sources = d.Operation, strings.Join(d.Parents, ","), strings.Join(d.Sources, ",")
+			}
+			meta := ""
+			if len(seg.Meta) > 0 {
+				bts, err := json.Marshal(seg.Meta)
+				if err != nil {
+					log.Error("Couldn't marshal metadata for segment %s : %v", seg.ID, err)
+				}
+				meta = string(bts)
+			}
+			writer.Write([]string{
+				seg.ID,
+				seg.URL,
+				seg.SegmentType,
+				fmt.Sprintf("%d", db.Channel(seg.SegmentPayload)),
+				fmt.Sprintf("%d", seg.Chunk.Start),
+				fmt.Sprintf("%d", seg.Chunk.End),
+				seg.CurrentStatus.Name,
+				strings.Join(seg.Labels, ","),
+				seg.Comment,
+				operation,
+				parents,
+				sources,
+				meta,
+				seg.Text,
+			})
+		}
+		writer.Flush()
+	default:
+		msg := fmt.Sprintf("Unknown export format %s", format)
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+	}
+}
@@ -30,6 +30,7 @@ type ClientID struct {
 
 // Message for sending to client
 type Message struct {
+	ClientID    string `json:"client_id,omitempty"`
 	MessageType string `json:"message_type"`
 	Payload     string `json:"payload"`
 
@@ -41,6 +42,12 @@ type Message struct {
 
 	// Info is for informational messages, nothing is disabled or cleared
 	Info string `json:"info,omitempty"`
+
+	// Code is a machine-readable error code, for errors and messages of type no_audio_chunk
+	Code protocol.ErrorCode `json:"code,omitempty"`
+
+	// Details holds structured error details, such as the segment id and the user holding a lock
+	Details map[string]string `json:"details,omitempty"`
 }
 
 type AnnotationUnlockAndQueryPayload struct {
@@ -66,11 +73,24 @@ func httpError(w http.ResponseWriter, serverMsg string, clientMsg string, errCod
 	http.Error(w, clientMsg, errCode)
 }
 
-// print serverMsg to server log, send client message over websocket
-func wsError(conn *websocket.Conn, serverMsg string, clientMsg string) {
+// print serverMsg to server log, send client message with error code over websocket
+func wsError(conn *websocket.Conn, code protocol.ErrorCode, serverMsg string, clientMsg string) {
+	wsErrorDetails(conn, code, nil, serverMsg, clientMsg)
+}
+
+// print error to server log, send it to the client with the error code and details from the (dbapi) error
+func wsDBError(conn *websocket.Conn, err error, msgPrefix string) {
+	msg := fmt.Sprintf("%s : %v", msgPrefix, err)
+	wsErrorDetails(conn, dbapi.ErrorCode(err), dbapi.ErrorDetails(err), msg, msg)
+}
+
+// print serverMsg to server log, send client message with error code and details over websocket
+func wsErrorDetails(conn *websocket.Conn, code protocol.ErrorCode, details map[string]string, serverMsg string, clientMsg string) {
 	log.Error(serverMsg)
 	payload := Message{
-		Error: clientMsg,
+		Error:   clientMsg,
+		Code:    code,
+		Details: details,
 	}
 	resJSON, err := json.Marshal(payload)
 	if err != nil {
@@ -78,7 +98,7 @@ func wsError(conn *websocket.Conn, serverMsg string, clientMsg string) {
 		log.Error(msg)
 		return
 	}
-	err = conn.WriteMessage(websocket.TextMessage, resJSON)
+	err = wsWrite(conn, resJSON)
 	if err != nil {
 		log.Error("Couldn't write to conn: %v", err)
 	}
@@ -86,10 +106,11 @@ func wsError(conn *websocket.Conn, serverMsg string, clientMsg string) {
 }
 
 // print serverMsg to server log, send client message as non-recoverable error message over websocket
-func wsFatal(conn *websocket.Conn, serverMsg string, clientMsg string) {
+func wsFatal(conn *websocket.Conn, code protocol.ErrorCode, serverMsg string, clientMsg string) {
 	log.Error(serverMsg)
 	payload := Message{
 		Fatal: clientMsg,
+		Code:  code,
 	}
 	resJSON, err := json.Marshal(payload)
 	if err != nil {
@@ -97,7 +118,7 @@ func wsFatal(conn *websocket.Conn, serverMsg string, clientMsg string) {
 		log.Error(msg)
 		return
 	}
-	err = conn.WriteMessage(websocket.TextMessage, resJSON)
+	err = wsWrite(conn, resJSON)
 	if err != nil {
 		log.Error("Couldn't write to conn: %v", err)
 	}
@@ -105,10 +126,12 @@ func wsFatal(conn *websocket.Conn, serverMsg string, clientMsg string) {
 }
 
 // print serverMsg to server log, send error message as json to client
-func jsonError(w http.ResponseWriter, serverMsg string, clientMsg string) {
+func jsonError(w http.ResponseWriter, code protocol.ErrorCode, details map[string]string, serverMsg string, clientMsg string) {
 	log.Error(serverMsg)
 	payload := Message{
-		Error: clientMsg,
+		Error:   clientMsg,
+		Code:    code,
+		Details: details,
 	}
 	resJSON, err := json.Marshal(payload)
 	if err != nil {
@@ -124,18 +147,54 @@ func jsonError(w http.ResponseWriter, serverMsg string, clientMsg string) {
 var clientMutex sync.RWMutex
 var clients = make(map[ClientID]*websocket.Conn)
 
+// listeners counts the running listenToClient goroutines, including the removal of the client when the connection is closed
+var listeners sync.WaitGroup
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
 
+// the keep alive periods are variables, so that tests can use shorter periods
+var (
+	// Time allowed to write a message to the client
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next message (or pong) from the client
+	pongWait = 60 * time.Second
+
+	// Send pings to the client with this period (must be less than pongWait)
+	pingPeriod = (pongWait * 9) / 10
+
+	// How often to check if the client has been idle for too long
+	idleCheckPeriod = 5 * time.Second
+)
+
+// gorilla/websocket connections support one concurrent writer only, so each connection has its own write mutex
+var writeMutexes sync.Map // *websocket.Conn -> *sync.Mutex
+
+var audioTransports sync.Map // *websocket.Conn -> string (audio transport selected in the handshake)
+
+// wsWrite writes a text message to the websocket, making sure that only one goroutine writes to the connection at a time
+func wsWrite(conn *websocket.Conn, bts []byte) error {
+	return wsWriteMessage(conn, websocket.TextMessage, bts)
+}
+
+func wsWriteMessage(conn *websocket.Conn, messageType int, bts []byte) error {
+	mutex, _ := writeMutexes.LoadOrStore(conn, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	defer mutex.(*sync.Mutex).Unlock()
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteMessage(messageType, bts)
+}
+
 func wsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	clientID := vars["client_id"]
 	if clientID == "" {
 		msg := "Expected client ID, got empty string"
-		jsonError(w, msg, msg)
+		jsonError(w, protocol.ErrorInvalidPayload, nil, msg, msg)
 		return
 	}
 	userName := vars["user_name"]
@@ -143,27 +202,32 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to upgrade HTTP request to websocket : %v", err)
-		jsonError(w, msg, msg)
+		jsonError(w, protocol.ErrorInternal, nil, msg, msg)
 		return
 	}
 
-	for clID := range clients {
-		if clID.UserName == userName {
+	// check and register under the same lock, so that two connections for the same user can't both be added
+	clID := ClientID{ID: clientID, UserName: userName}
+	clientMutex.Lock()
+	for existing := range clients {
+		if existing.UserName == userName {
+			clientMutex.Unlock()
 			msg := fmt.Sprintf("User %s is already logged in", userName)
-			wsFatal(ws, msg, msg)
+			wsFatal(ws, protocol.ErrorConflict, msg, msg)
 			//ws.Close() // the client will close the websocket if needed (to avoid double error messages from server)
 			return
 		}
 	}
-
-	clID := ClientID{ID: clientID, UserName: userName}
-	clientMutex.Lock()
 	clients[clID] = ws
 	clientMutex.Unlock()
 	log.Info("Added websocket for client id %s", clID)
 
 	// listen forever
-	go listenToClient(ws, clID)
+	listeners.Add(1)
+	go func() {
+		defer listeners.Done()
+		listenToClient(ws, clID)
+	}()
 }
 
 func wsPayload(conn *websocket.Conn, msgType string, payload interface{}) {
@@ -181,15 +245,40 @@ func wsPayload(conn *websocket.Conn, msgType string, payload interface{}) {
 	jsnMsg, err := json.Marshal(resp)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to marshal struct into JSON : %v", err)
-		wsError(conn, msg, msg)
+		wsError(conn, protocol.ErrorInternal, msg, msg)
 		return
 	}
-	err = conn.WriteMessage(websocket.TextMessage, jsnMsg)
+	err = wsWrite(conn, jsnMsg)
 	if err != nil {
 		log.Error("Couldn't write to conn: %v", err)
 	}
 }
 
+// wsNoAudioChunk sends a no_audio_chunk message to the client, with the error code and details from the (dbapi) error
+func wsNoAudioChunk(conn *websocket.Conn, msg string, err error) {
+	bts, mErr := json.Marshal(msg)
+	if mErr != nil {
+		log.Error("failed to marshal struct into JSON : %v", mErr)
+		return
+	}
+	resp := Message{
+		MessageType: "no_audio_chunk",
+		Payload:     string(bts),
+		Code:        dbapi.ErrorCode(err),
+		Details:     dbapi.ErrorDetails(err),
+	}
+	jsnMsg, mErr := json.Marshal(resp)
+	if mErr != nil {
+		msg := fmt.Sprintf("Failed to marshal struct into JSON : %v", mErr)
+		wsError(conn, protocol.ErrorInternal, msg, msg)
+		return
+	}
+	wErr := wsWrite(conn, jsnMsg)
+	if wErr != nil {
+		log.Error("Couldn't write to conn: %v", wErr)
+	}
+}
+
 func wsInfo(conn *websocket.Conn, msg string) {
 	resp := Message{
 		//ClientID:    msg.ClientID,
@@ -199,72 +288,226 @@ func wsInfo(conn *websocket.Conn, msg string) {
 	jsnMsg, err := json.Marshal(resp)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to marshal struct into JSON : %v", err)
-		wsError(conn, msg, msg)
+		wsError(conn, protocol.ErrorInternal, msg, msg)
 		return
 	}
-	err = conn.WriteMessage(websocket.TextMessage, jsnMsg)
+	err = wsWrite(conn, jsnMsg)
 	if err != nil {
 		log.Error("Couldn't write to conn: %v", err)
 	}
 }
 
-func listenToClient(conn *websocket.Conn, clientID ClientID) {
-	//wsInfo(conn, "Websocket created on server")
+// removeClient closes the connection, removes the client from the list of connected clients, and releases the user's locks
+func removeClient(conn *websocket.Conn, clientID ClientID) {
+	conn.Close()
+	clientMutex.Lock()
+	delete(clients, clientID)
+	clientMutex.Unlock()
+	writeMutexes.Delete(conn)
+	audioTransports.Delete(conn)
+	log.Info("Removed websocket for client id %s", clientID)
+
+	n, err := db.UnlockAll(clientID.UserName)
+	if err != nil {
+		log.Error("Failed to unlock segments for user %s : %v", clientID.UserName, err)
+	} else if n > 0 {
+		log.Info("Unlocked %d segment%s for disconnected user %s", n, pluralS(n), clientID.UserName)
+	}
+	pushStats()
+}
+
+// keepAlive pings the client at regular intervals, and disconnects the client if it has been idle for too long.
+// Each message received from the client should be signalled on the activity channel. keepAlive returns when done is closed.
+func keepAlive(conn *websocket.Conn, clientID ClientID, activity <-chan bool, done <-chan bool) {
+	pingTicker := time.NewTicker(pingPeriod)
+	defer pingTicker.Stop()
+	idleTicker := time.NewTicker(idleCheckPeriod)
+	defer idleTicker.Stop()
+
+	lastActivity := time.Now()
+	warned := false
+	for {
+		select {
+		case <-done:
+			return
+		case <-activity:
+			lastActivity = time.Now()
+			warned = false
+		case <-pingTicker.C:
+			err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait))
+			if err != nil {
+				log.Error("Couldn't ping client %s : %v", clientID, err)
+				// closing the connection will make listenToClient remove the client
+				conn.Close()
+				return
+			}
+		case <-idleTicker.C:
+			if *cfg.IdleTimeout <= 0 {
+				continue
+			}
+			idle := time.Since(lastActivity)
+			if idle >= *cfg.IdleTimeout {
+				serverMsg := fmt.Sprintf("Disconnecting client %s after %v of inactivity", clientID, *cfg.IdleTimeout)
+				clientMsg := fmt.Sprintf("Disconnected after %v of inactivity", *cfg.IdleTimeout)
+				wsFatal(conn, protocol.ErrorIdleTimeout, serverMsg, clientMsg)
+				conn.Close()
+				return
+			}
+			if !warned && idle >= *cfg.IdleTimeout-*cfg.IdleWarning {
+				remaining := (*cfg.IdleTimeout - idle).Round(time.Second)
+				msg := fmt.Sprintf("You will be disconnected in %v due to inactivity", remaining)
+				wsPayload(conn, "idle_warning", msg)
+				warned = true
+			}
+		}
+	}
+}
+
+// serverCapabilities returns the server's capabilities, sent to the client in the hello message
+func serverCapabilities() protocol.Capabilities {
+	res := protocol.Capabilities{
+		AudioFormats:    db.AudioFormats(),
+		Features:        []string{"keep_alive", "error_codes", "rest_api"},
+		AudioTransports: protocol.AudioTransports,
+	}
+	for _, msg := range wsMessages {
+		if msg.Sender == "client" {
+			res.MessageTypes = append(res.MessageTypes, msg.MessageType)
+		}
+	}
+	return res
+}
+
+// handshake checks the client's protocol version, and replies with the server's hello message, the project name, the project config and the segment types.
+// If the client version is not supported, a fatal error is sent to the client, and false is returned.
+func handshake(conn *websocket.Conn, clientID ClientID, clientHello protocol.HelloPayload) bool {
+	log.Info("Client %s uses protocol version %d, with capabilities %#v", clientID, clientHello.ProtocolVersion, clientHello.Capabilities)
+	if clientHello.ProtocolVersion < protocol.MinProtocolVersion {
+		msg := fmt.Sprintf("The client is outdated (protocol version %d, the server requires version %d or later). Please reload the page.", clientHello.ProtocolVersion, protocol.MinProtocolVersion)
+		wsFatal(conn, protocol.ErrorVersionMismatch, fmt.Sprintf("Client %s : %s", clientID, msg), msg)
+		return false
+	}
+	if clientHello.ProtocolVersion > protocol.ProtocolVersion {
+		msg := fmt.Sprintf("The client is newer than the server (protocol version %d, the server supports version %d). Please reload the page.", clientHello.ProtocolVersion, protocol.ProtocolVersion)
+		wsFatal(conn, protocol.ErrorVersionMismatch, fmt.Sprintf("Client %s : %s", clientID, msg), msg)
+		return false
+	}
+
+	transport := selectAudioTransport(clientHello.Capabilities.AudioTransports)
+	audioTransports.Store(conn, transport)
+	log.Info("Client %s uses audio transport %s", clientID, transport)
+
+	hello := protocol.HelloPayload{
+		ProtocolVersion: protocol.ProtocolVersion,
+		Capabilities:    serverCapabilities(),
+	}
+	hello.Capabilities.AudioTransports = []string{transport}
+	wsPayload(conn, "hello", hello)
 
 	res := db.ProjectName()
 	wsPayload(conn, "project_name", res)
+	wsPayload(conn, "project_config", db.Config())
+	wsPayload(conn, "segment_types", db.SegmentTypes())
+	return true
+}
+
+func listenToClient(conn *websocket.Conn, clientID ClientID) {
+	//wsInfo(conn, "Websocket created on server")
+
+	activity := make(chan bool, 1)
+	done := make(chan bool)
+	defer removeClient(conn, clientID)
+	defer close(done)
+	go keepAlive(conn, clientID, activity, done)
+
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	// the client must start with a hello message, see handshake
+	handshakeCompleted := false
 
 	for {
-		var msg Message
-		err := conn.ReadJSON(&msg)
+		_, bts, err := conn.ReadMessage()
 		if err != nil {
 			msg := fmt.Sprintf("Websocket error : %v", err)
 			log.Error(msg)
-			clientMutex.Lock()
-			delete(clients, clientID)
-			clientMutex.Unlock()
-			log.Info("Removed websocket for client id %s", clientID)
-
 			return
 		}
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		select {
+		case activity <- true:
+		default:
+		}
+		var msg Message
+		err = protocol.UnmarshalStrict(bts, &msg)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid message : %v", err)
+			wsError(conn, protocol.ErrorInvalidPayload, msg, msg)
+			continue
+		}
 
 		//log.Info("Payload received over websocket: %#v\n", msg)
 
+		if !handshakeCompleted && msg.MessageType != "hello" {
+			// clients using protocol version 1 do not send hello
+			msg := fmt.Sprintf("The client is outdated (protocol version 1, the server requires version %d or later). Please reload the page.", protocol.MinProtocolVersion)
+			wsFatal(conn, protocol.ErrorVersionMismatch, fmt.Sprintf("Client %s : %s", clientID, msg), msg)
+			return
+		}
+
 		switch msg.MessageType {
+		case "hello":
+			var payload protocol.HelloPayload
+			err := protocol.UnmarshalStrict([]byte(msg.Payload), &payload)
+			if err != nil {
+				msg := fmt.Sprintf("Failed to unmarshal payload : %v", err)
+				wsError(conn, protocol.ErrorInvalidPayload, msg, msg)
+				continue
+			}
+			if !handshake(conn, clientID, payload) {
+				return
+			}
+			handshakeCompleted = true
+
+		case "keep_alive":
+			// nothing to do, the message is only sent to signal activity
+
 		case "stats":
 			res, err := db.Stats()
 			if err != nil {
 				msg := fmt.Sprintf("Failed to create stats : %v", err)
-				wsError(conn, msg, msg)
-				return
+				wsError(conn, protocol.ErrorInternal, msg, msg)
+				continue
 			}
 			wsPayload(conn, "stats", res)
 
 		case "saveunlockandnext":
 			var payload AnnotationUnlockAndQueryPayload
-			err := json.Unmarshal([]byte(msg.Payload), &payload)
+			err := protocol.UnmarshalStrict([]byte(msg.Payload), &payload)
 			if err != nil {
 				msg := fmt.Sprintf("Failed to unmarshal payload : %v", err)
-				wsError(conn, msg, msg)
-				return
+				wsError(conn, protocol.ErrorInvalidPayload, msg, msg)
+				continue
 			}
 			saveUnlockAndNext(conn, payload)
 			pushStats()
 
 		case "unlock":
 			var payload protocol.UnlockPayload
-			err := json.Unmarshal([]byte(msg.Payload), &payload)
+			err := protocol.UnmarshalStrict([]byte(msg.Payload), &payload)
 			if err != nil {
 				msg := fmt.Sprintf("Failed to unmarshal payload : %v", err)
-				wsError(conn, msg, msg)
-				return
+				wsError(conn, protocol.ErrorInvalidPayload, msg, msg)
+				continue
 			}
 
 			err = db.Unlock(payload.SegmentID, payload.UserName)
 			if err != nil {
-				msg := fmt.Sprintf("Couldn't unlock segment: %v", err)
-				wsError(conn, msg, msg)
-				return
+				wsDBError(conn, err, "Couldn't unlock segment")
+				continue
 			}
 			msg := fmt.Sprintf("Unlocked segment %s for user %s", payload.SegmentID, payload.UserName)
 			wsPayload(conn, "explicit_unlock_completed", msg)
@@ -272,23 +515,44 @@ func listenToClient(conn *websocket.Conn, clientID ClientID) {
 
 		case "unlock_all":
 			var payload protocol.UnlockPayload
-			err := json.Unmarshal([]byte(msg.Payload), &payload)
+			err := protocol.UnmarshalStrict([]byte(msg.Payload), &payload)
 			if err != nil {
 				msg := fmt.Sprintf("Failed to unmarshal payload : %v", err)
-				wsError(conn, msg, msg)
-				return
+				wsError(conn, protocol.ErrorInvalidPayload, msg, msg)
+				continue
 			}
 
 			n, err := db.UnlockAll(payload.UserName)
 			if err != nil {
-				msg := fmt.Sprintf("Failed to unlock : %v", err)
-				wsError(conn, msg, msg)
-				return
+				wsDBError(conn, err, "Failed to unlock")
+				continue
 			}
 			msg := fmt.Sprintf("Unlocked %d segment%s for user %s", n, pluralS(n), payload.UserName)
 			wsPayload(conn, "explicit_unlock_completed", msg)
 			pushStats()
 
+		case "edit":
+			var payload protocol.EditPayload
+			err := protocol.UnmarshalStrict([]byte(msg.Payload), &payload)
+			if err != nil {
+				msg := fmt.Sprintf("Failed to unmarshal payload : %v", err)
+				wsError(conn, protocol.ErrorInvalidPayload, msg, msg)
+				continue
+			}
+			wsEdit(conn, payload)
+			pushStats()
+
+		case "peaks":
+			var payload protocol.PeaksRequestPayload
+			err := protocol.UnmarshalStrict([]byte(msg.Payload), &payload)
+			if err != nil {
+				msg := fmt.Sprintf("Failed to unmarshal payload : %v", err)
+				wsError(conn, protocol.ErrorInvalidPayload, msg, msg)
+				continue
+			}
+			// computing the peaks for a long recording may take a while, so the client is not blocked meanwhile
+			go wsPeaks(conn, payload)
+
 		default:
 			log.Error("Unknown message type: %s", msg.MessageType)
 		}
@@ -309,6 +573,8 @@ func pushStats() {
 		log.Error(msg)
 		return
 	}
+	clientMutex.RLock()
+	defer clientMutex.RUnlock()
 	for _, conn := range clients {
 		wsPayload(conn, "stats", res)
 	}
@@ -321,13 +587,6 @@ func dbg(format string, args ...interface{}) {
 	}
 }
 
-var contextMap = map[string]int64{
-	"e":       200,
-	"silence": 1000,
-}
-
-const fallbackContext = int64(1000)
-
 func buildURL(segmentURL string) string {
 	if strings.HasPrefix(segmentURL, "http") {
 		return segmentURL
@@ -336,46 +595,94 @@ func buildURL(segmentURL string) string {
 	return fmt.Sprintf("%s://%s:%s/%s", *cfg.Protocol, *cfg.Host, *cfg.Port, segmentURL)
 }
 
-func load(conn *websocket.Conn, annotation protocol.AnnotationPayload, explicitContext int64) {
+// audioSource returns the audio location used for chunk extraction: a local file for audio in the project folder, or a URL
+func audioSource(segmentURL string) string {
+	if file, ok := db.AudioFile(segmentURL); ok {
+		return file
+	}
+	return buildURL(segmentURL)
+}
+
+// splitRequest creates the chunk extraction request for the annotation, using the explicit context if set (> 0), or else the default context for the segment type
+func splitRequest(annotation protocol.AnnotationPayload, explicitContext int64) protocol.SplitRequestPayload {
 	var context int64
 	if explicitContext > 0 {
 		context = explicitContext
-	} else if ctx, ok := contextMap[annotation.SegmentType]; ok {
-		context = ctx
 	} else {
-		context = fallbackContext
+		context = db.Context(annotation.SegmentType)
 	}
 
-	request := protocol.SplitRequestPayload{
-		URL:          buildURL(annotation.URL),
+	return protocol.SplitRequestPayload{
+		URL:          audioSource(annotation.URL),
 		Chunk:        annotation.Chunk,
 		SegmentType:  annotation.SegmentType,
+		Channel:      db.Channel(annotation.SegmentPayload),
 		LeftContext:  context,
 		RightContext: context,
 	}
-	res, err := chunkExtractor.ProcessURLWithContext(request, "")
+}
+
+// analysis returns the analyses enabled for the segment type of the annotation, computed along with its audio (see load and prefetch)
+func analysis(annotation protocol.AnnotationPayload) modules.Analysis {
+	res := modules.Analysis{Contours: db.Contours(annotation.SegmentType)}
+	if db.Suggestions(annotation.SegmentType) {
+		if source, ok := db.SourceSegment(annotation.ID); ok {
+			res.Suggestion = &source.Chunk
+		}
+	}
+	return res
+}
+
+func load(conn *websocket.Conn, annotation protocol.AnnotationPayload, explicitContext int64) {
+	request := splitRequest(annotation, explicitContext)
+	// the contours and boundary suggestion (if enabled) are computed with the audio, and cached with it
+	res, bts, err := chunkExtractor.ExtractURLWithAnalysis(request, "", analysis(annotation))
 	if err != nil {
 		serverMsg := fmt.Sprintf("Chunk extractor failed : %v", err)
-		wsError(conn, serverMsg, fmt.Sprintf("Chunk extractor failed for %s. See server log for details.", request.URL))
+		wsErrorDetails(conn, protocol.ErrorExtractionFailed, map[string]string{"segment_id": annotation.ID, "url": annotation.URL}, serverMsg, fmt.Sprintf("Chunk extractor failed for %s. See server log for details.", request.URL))
 		return
 	}
 	chunk := res.Chunk
 	res.AnnotationPayload = annotation
 	res.Chunk = chunk
 	res.URL = annotation.URL
+	window := chunkExtractor.Window(request.URL, request.Chunk, request.LeftContext, request.RightContext)
+	for _, n := range db.Neighbours(annotation.SegmentPayload, window) {
+		n.Chunk.Start -= res.Offset
+		n.Chunk.End -= res.Offset
+		res.Neighbours = append(res.Neighbours, n)
+	}
 
 	// debug print
 	// resJSONDbg, _ := res.PrettyMarshal()
 	// log.Debug("ProcessURLWithContext gave %#v", string(resJSONDbg))
 
-	wsPayload(conn, "audio_chunk", res)
+	err = sendAudioChunk(conn, res, bts)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to send audio chunk : %v", err)
+		wsError(conn, protocol.ErrorInternal, msg, msg)
+	}
+}
+
+// validateQuery checks that the query has the required fields, and clears an undefined current id
+func validateQuery(query *protocol.QueryPayload) error {
+	if query.UserName == "" {
+		return fmt.Errorf("User name not provided for query")
+	}
+	if query.StepSize == 0 && query.RequestIndex == "" {
+		return fmt.Errorf("Neither step size nor request index was provided for query")
+	}
+	if query.CurrID == "undefined" {
+		query.CurrID = ""
+	}
+	return nil
 }
 
 func saveUnlockAndNext(conn *websocket.Conn, payload AnnotationUnlockAndQueryPayload) {
 	var err error
 	if payload.Annotation.ID != "" && payload.Annotation.ID != payload.Unlock.SegmentID {
 		msg := fmt.Sprintf("Mismatching uuids for annotation/unlock data : %v/%v", payload.Annotation.ID, payload.Unlock.SegmentID)
-		wsError(conn, msg, msg)
+		wsError(conn, protocol.ErrorInvalidPayload, msg, msg)
 		return
 	}
 
@@ -387,8 +694,7 @@ func saveUnlockAndNext(conn *websocket.Conn, payload AnnotationUnlockAndQueryPay
 	if payload.Annotation.ID != "" {
 		err = db.Save(payload.Annotation)
 		if err != nil {
-			msg := fmt.Sprintf("Failed to save annotation : %v", err)
-			wsError(conn, msg, msg)
+			wsDBError(conn, err, "Failed to save annotation")
 			return
 		}
 		log.Info("Saved annotation %#v", payload.Annotation)
@@ -399,40 +705,27 @@ func saveUnlockAndNext(conn *websocket.Conn, payload AnnotationUnlockAndQueryPay
 
 	// get next
 	query := payload.Query
-	if query.UserName == "" {
-		msg := fmt.Sprintf("User name not provided for query")
-		wsError(conn, msg, msg)
-		return
-	}
-	if query.StepSize == 0 && query.RequestIndex == "" {
-		msg := fmt.Sprintf("Neither step size nor request index was provided for query")
-		wsError(conn, msg, msg)
-		return
-	}
-	if query.CurrID == "undefined" {
-		query.CurrID = ""
-	}
-	segment, msg, err := db.GetNextSegment(query, payload.Unlock.SegmentID, true)
-	if err != nil {
+	if err := validateQuery(&query); err != nil {
 		msg := fmt.Sprintf("%v", err)
-		wsError(conn, msg, msg)
+		wsError(conn, protocol.ErrorInvalidPayload, msg, msg)
 		return
 	}
-	if msg == "" || segment.ID != "" {
-		load(conn, segment, query.Context)
-	} else {
-		msgFmted := ""
-		if msg != "" {
-			msgFmted = fmt.Sprintf(": %s", msg)
+	segment, err := db.GetNextSegment(query, payload.Unlock.SegmentID, true)
+	if err != nil {
+		code := dbapi.ErrorCode(err)
+		if code != protocol.ErrorNoMatch && code != protocol.ErrorLocked && code != protocol.ErrorConflict {
+			msg := fmt.Sprintf("%v", err)
+			wsErrorDetails(conn, code, dbapi.ErrorDetails(err), msg, msg)
+			return
 		}
+		msgFmted := fmt.Sprintf(": %v", err)
+		var msg string
 		if query.RequestIndex != "" {
 			reqI, err := strconv.Atoi(query.RequestIndex)
 			if err == nil {
-				msg := fmt.Sprintf("Couldn't go to segment %d%s", (reqI + 1), msgFmted)
-				wsPayload(conn, "no_audio_chunk", msg)
+				msg = fmt.Sprintf("Couldn't go to segment %d%s", (reqI + 1), msgFmted)
 			} else {
-				msg := fmt.Sprintf("Couldn't go to %s segment%s", query.RequestIndex, msgFmted)
-				wsPayload(conn, "no_audio_chunk", msg)
+				msg = fmt.Sprintf("Couldn't go to %s segment%s", query.RequestIndex, msgFmted)
 			}
 		} else {
 			direction := "next"
@@ -440,26 +733,27 @@ func saveUnlockAndNext(conn *websocket.Conn, payload AnnotationUnlockAndQueryPay
 				direction = "previous"
 			}
 			//msg := fmt.Sprintf("Couldn't find any %s segments matching status %v%s", direction, query.RequestStatus, msgFmted)
-			msg := fmt.Sprintf("Couldn't find any %s segments%s", direction, msgFmted)
-			wsPayload(conn, "no_audio_chunk", msg)
+			msg = fmt.Sprintf("Couldn't find any %s segments%s", direction, msgFmted)
 		}
+		wsNoAudioChunk(conn, msg, err)
 		if savedAnnotation.ID != "" {
 			load(conn, savedAnnotation, query.Context)
 		}
 		return
 	}
+	load(conn, segment, query.Context)
+	prefetch(query, segment)
 
 	// unlock entry
 	if payload.Unlock.SegmentID != "" {
 		if payload.Unlock.UserName == "" {
 			msg := fmt.Sprintf("User name not provided for unlock")
-			wsError(conn, msg, msg)
+			wsError(conn, protocol.ErrorInvalidPayload, msg, msg)
 			return
 		}
 		err = db.Unlock(payload.Unlock.SegmentID, payload.Unlock.UserName)
 		if err != nil {
-			msg := fmt.Sprintf("Couldn't unlock segment: %v", err)
-			wsError(conn, msg, msg)
+			wsDBError(conn, err, "Couldn't unlock segment")
 			return
 		}
 		msg := fmt.Sprintf("Unlocked segment %s for user %s", payload.Unlock.SegmentID, payload.Unlock.UserName)
@@ -469,15 +763,6 @@ func saveUnlockAndNext(conn *websocket.Conn, payload AnnotationUnlockAndQueryPay
 
 var walkedURLs []string
 
-func generateDoc(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	fmt.Fprintf(w, "<html><head><title>%s</title></head><body>", "STTS PromptRec: Doc")
-	for _, url := range walkedURLs {
-		fmt.Fprintf(w, "%s<br/>\n", url)
-	}
-	fmt.Fprintf(w, "</body></html>")
-}
-
 func serveAudio(w http.ResponseWriter, r *http.Request) {
 	file := getParam("file", r)
 	http.ServeFile(w, r, path.Join(*cfg.ProjectDir, "audio", file))
@@ -496,6 +781,17 @@ type Config struct {
 	ProjectDir *string `json:"project_dir"`
 	Debug      *bool   `json:"debug"`
 	Ffmpeg     *string `json:"ffmpeg"`
+	Ffprobe    *string `json:"ffprobe"`
+	Accurate   *bool   `json:"accurate"`
+	WavOutput  *bool   `json:"wav_output"`
+
+	IdleTimeout *time.Duration `json:"idle_timeout"`
+	IdleWarning *time.Duration `json:"idle_warning"`
+
+	CacheSize     *int64  `json:"cache_size"`
+	CacheDir      *string `json:"cache_dir"`
+	CacheDiskSize *int64  `json:"cache_disk_size"`
+	Prefetch      *bool   `json:"prefetch"`
 }
 
 func main() {
@@ -510,10 +806,19 @@ func main() {
 	cfg.BlockAudio = flag.Bool("block_audio", false, "Block audio folder from being served")
 	cfg.ProjectDir = flag.String("project", "", "Project `folder`")
 	cfg.Ffmpeg = flag.String("ffmpeg", "ffmpeg", "Ffmpeg command/path")
+	cfg.Ffprobe = flag.String("ffprobe", "ffprobe", "Ffprobe command/path (used for reading metadata for audio files other than PCM wav)")
+	cfg.Accurate = flag.Bool("accurate", true, "Sample accurate audio extraction using ffmpeg (slower for compressed audio; with -accurate=false, chunk boundaries may be off by tens of milliseconds)")
+	cfg.WavOutput = flag.Bool("wav", false, "Send compressed audio to the client as WAV: sample accurate on playback (compressed formats add encoder padding of a few tens of milliseconds), but about ten times the size")
+	cfg.IdleTimeout = flag.Duration("idle_timeout", 30*time.Minute, "Disconnect clients after this `duration` of inactivity (0 to disable)")
+	cfg.IdleWarning = flag.Duration("idle_warning", time.Minute, "Warn idle clients this `duration` before disconnecting them")
+	cfg.CacheSize = flag.Int64("cache_size", 100, "Max size of the in-memory audio chunk cache, in `MB` (0 to disable)")
+	cfg.CacheDir = flag.String("cache_dir", "", "Save cached audio chunks in `folder` (default: in-memory cache only)")
+	cfg.Prefetch = flag.Bool("prefetch", true, "Extract the audio for the user's next segment in the background (requires the chunk cache)")
+	cfg.CacheDiskSize = flag.Int64("cache_disk_size", 1000, "Max size of the on-disk audio chunk cache, in `MB`")
 
 	cfg.Debug = flag.Bool("debug", false, "Debug mode")
-	protocol := "http"
-	cfg.Protocol = &protocol
+	serverProtocol := "http"
+	cfg.Protocol = &serverProtocol
 
 	help := flag.Bool("help", false, "Print usage and exit")
 	flag.Parse()
@@ -551,23 +856,47 @@ func main() {
 	}
 
 	db = dbapi.NewDBAPI(*cfg.ProjectDir)
+	err = db.LoadData()
+	if err != nil {
+		log.Fatal("Couldn't load data: %v", err)
+	}
 
 	modules.FfmpegCmd = *cfg.Ffmpeg
+	modules.FfprobeCmd = *cfg.Ffprobe
 	chunkExtractor, err = modules.NewChunkExtractor()
 	if err != nil {
 		log.Fatal("Couldn't initialize chunk extractor: %v", err)
 	}
+	chunkExtractor.SetAccurate(*cfg.Accurate)
+	chunkExtractor.SetWavOutput(*cfg.WavOutput)
+	chunkExtractor.SetPlayback(db.Config().Playback)
+	if *cfg.CacheSize > 0 || *cfg.CacheDir != "" {
+		cache, err := modules.NewChunkCache(*cfg.CacheSize*1024*1024, *cfg.CacheDir, *cfg.CacheDiskSize*1024*1024)
+		if err != nil {
+			log.Fatal("Couldn't initialize chunk cache: %v", err)
+		}
+		chunkExtractor.SetCache(cache)
+	}
 
 	r := mux.NewRouter()
 	r.StrictSlash(true)
 
 	r.HandleFunc("/doc/", generateDoc).Methods("GET")
 	r.HandleFunc("/ws/{client_id}/{user_name}", wsHandler)
+	r.HandleFunc("/doc/openapi.json", generateOpenAPI).Methods("GET")
+	r.HandleFunc("/doc/schemas.json", generateSchemas).Methods("GET")
+	for _, route := range apiRoutes {
+		r.HandleFunc(route.Path, route.Handler).Methods(route.Method)
+	}
 	if !*cfg.BlockAudio {
 		r.HandleFunc("/audio/{file}", serveAudio).Methods("GET")
 	}
+	r.HandleFunc("/audio_chunk/{id}", serveAudioChunk).Methods("GET")
 
 	docs := make(map[string]string)
+	for _, route := range apiRoutes {
+		docs[route.Path] = route.Summary
+	}
 	err = r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
 		t, err := route.GetPathTemplate()
 		if err != nil {
@@ -604,16 +933,19 @@ func main() {
 	log.Info("Serving folder %s", *cfg.ServeDir)
 
 	go func() {
-		// wait for the server to start, and then load data, including URL access tests
-		// (which won't work if it's run before the server is started)
+		// wait for the server to start, and then run URL access tests
+		// (which won't work if they're run before the server is started)
 		time.Sleep(1000)
-		err = db.LoadData()
+		err := db.TestURLAccess(buildURL)
 		if err != nil {
-			log.Fatal("Couldn't load data: %v", err)
+			log.Fatal("URL access test failed: %v", err)
 		}
-		err = db.TestURLAccess(buildURL)
+		db.SetAudioProbe(func(segmentURL string) (protocol.AudioInfo, error) {
+			return chunkExtractor.Prober().Probe(audioSource(segmentURL))
+		})
+		err = db.TestChunkBounds()
 		if err != nil {
-			log.Fatal("URL access test failed: %v", err)
+			log.Fatal("Chunk bounds test failed: %v", err)
 		}
 	}()
 
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	"github.com/stts-se/segment_checker/dbapi"
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// testSegment returns a source segment of type silence
+func testSegment(id, url string, start, end int64) protocol.SegmentPayload {
+	return protocol.SegmentPayload{ID: id, URL: url, SegmentType: "silence", Chunk: protocol.Chunk{Start: start, End: end}}
+}
+
+// newTestProject creates a project folder with the source segments, and the project config (if not empty), loads it into db, and sets the server config.
+// The caller should remove the project folder.
+func newTestProject(t *testing.T, config string, segments ...protocol.SegmentPayload) string {
+	dir, err := ioutil.TempDir("", "app-server-test")
+	if err != nil {
+		t.Fatalf("got error from TempDir: %v", err)
+	}
+	for _, sub := range []string{"source", "audio"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatalf("couldn't create %s dir: %v", sub, err)
+		}
+	}
+	for _, seg := range segments {
+		bts, err := json.Marshal(seg)
+		if err != nil {
+			t.Fatalf("couldn't marshal segment: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "source", seg.ID+".json"), bts, 0644); err != nil {
+			t.Fatalf("couldn't write source file: %v", err)
+		}
+	}
+	if config != "" {
+		if err := ioutil.WriteFile(filepath.Join(dir, dbapi.ProjectConfigFile), []byte(config), 0644); err != nil {
+			t.Fatalf("couldn't write project config: %v", err)
+		}
+	}
+	db = dbapi.NewDBAPI(dir)
+	if err := db.LoadData(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("got error from LoadData: %v", err)
+	}
+	debug := false
+	idleTimeout := 30 * time.Minute
+	idleWarning := time.Minute
+	prefetch := false
+	cfg = &Config{ProjectDir: &dir, Debug: &debug, IdleTimeout: &idleTimeout, IdleWarning: &idleWarning, Prefetch: &prefetch}
+	return dir
+}
+
+// dialTestClient connects a websocket client to the server, and sends the hello message
+func dialTestClient(t *testing.T, srv *httptest.Server, clientID, userName string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/" + clientID + "/" + userName
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("couldn't connect to server: %v", err)
+	}
+	hello, _ := json.Marshal(protocol.HelloPayload{ProtocolVersion: protocol.ProtocolVersion})
+	msg, _ := json.Marshal(Message{MessageType: "hello", Payload: string(hello)})
+	if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatalf("couldn't send hello: %v", err)
+	}
+	return conn
+}
+
+func newTestServer() *httptest.Server {
+	r := mux.NewRouter()
+	r.HandleFunc("/ws/{client_id}/{user_name}", wsHandler)
+	for _, route := range apiRoutes {
+		r.HandleFunc(route.Path, route.Handler).Methods(route.Method)
+	}
+	return httptest.NewServer(r)
+}
+
+func connected(userName string) bool {
+	clientMutex.RLock()
+	defer clientMutex.RUnlock()
+	for clID := range clients {
+		if clID.UserName == userName {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForRemoved waits until all clients have been removed (after their connections have been closed), and returns false on timeout
+func waitForRemoved(timeout time.Duration) bool {
+	done := make(chan bool)
+	go func() {
+		listeners.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// setKeepAlive sets the keep alive periods, and returns a function restoring the previous periods
+func setKeepAlive(pong, ping, idleCheck time.Duration) func() {
+	prevPong, prevPing, prevIdleCheck := pongWait, pingPeriod, idleCheckPeriod
+	pongWait, pingPeriod, idleCheckPeriod = pong, ping, idleCheck
+	return func() {
+		pongWait, pingPeriod, idleCheckPeriod = prevPong, prevPing, prevIdleCheck
+	}
+}
+
+func TestIdleClient(t *testing.T) {
+	dir := newTestProject(t, "", testSegment("s1", "/audio/a.wav", 0, 100))
+	defer os.RemoveAll(dir)
+	defer setKeepAlive(pongWait, pingPeriod, 20*time.Millisecond)()
+	*cfg.IdleTimeout = 500 * time.Millisecond
+	*cfg.IdleWarning = 300 * time.Millisecond
+	srv := newTestServer()
+	defer srv.Close()
+
+	conn := dialTestClient(t, srv, "c1", "user1")
+	defer conn.Close()
+	if err := db.Lock("s1", "user1"); err != nil {
+		t.Fatalf("got error from Lock: %v", err)
+	}
+
+	// the client reads (and answers pings), but doesn't send any messages
+	warned := false
+	var fatal Message
+	for fatal.Fatal == "" {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, bts, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("expected an idle_timeout error before the connection was closed, got %v", err)
+		}
+		var msg Message
+		if err := json.Unmarshal(bts, &msg); err != nil {
+			t.Fatalf("couldn't unmarshal message: %v", err)
+		}
+		if msg.MessageType == "idle_warning" {
+			warned = true
+		}
+		fatal = msg
+	}
+	if !warned {
+		t.Errorf("expected an idle_warning before the disconnect")
+	}
+	if fatal.Code != protocol.ErrorIdleTimeout {
+		t.Errorf("expected error code %s, got %s", protocol.ErrorIdleTimeout, fatal.Code)
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+	if !waitForRemoved(5 * time.Second) {
+		t.Fatalf("expected the idle client to be removed")
+	}
+	if db.Locked("s1") {
+		t.Errorf("expected the segment locked by the idle client to be unlocked")
+	}
+}
+
+func TestUnresponsiveClient(t *testing.T) {
+	dir := newTestProject(t, "", testSegment("s1", "/audio/a.wav", 0, 100), testSegment("s2", "/audio/a.wav", 200, 300))
+	defer os.RemoveAll(dir)
+	defer setKeepAlive(300*time.Millisecond, 100*time.Millisecond, idleCheckPeriod)()
+	*cfg.IdleTimeout = 0
+	srv := newTestServer()
+	defer srv.Close()
+
+	// a client that reads answers the pings, and stays connected
+	responsive := dialTestClient(t, srv, "c1", "user1")
+	defer responsive.Close()
+	go func() {
+		for {
+			if _, _, err := responsive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	// a client that doesn't read doesn't answer the pings
+	unresponsive := dialTestClient(t, srv, "c2", "user2")
+	defer unresponsive.Close()
+	if err := db.Lock("s1", "user1"); err != nil {
+		t.Fatalf("got error from Lock: %v", err)
+	}
+	if err := db.Lock("s2", "user2"); err != nil {
+		t.Fatalf("got error from Lock: %v", err)
+	}
+
+	time.Sleep(3 * pongWait)
+	if connected("user2") || db.Locked("s2") {
+		t.Errorf("expected the client not answering pings to be removed, and its segment to be unlocked")
+	}
+	if !connected("user1") || !db.Locked("s1") {
+		t.Errorf("expected the client answering pings to stay connected, with its lock")
+	}
+	responsive.Close()
+	if !waitForRemoved(5 * time.Second) {
+		t.Errorf("expected the closed client to be removed")
+	}
+}
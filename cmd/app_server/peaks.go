@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/stts-se/segment_checker/modules"
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// peakComputer computes and caches waveform peaks for the project's audio files
+var peakComputer = modules.NewPeakComputer(100)
+
+// peaks returns the waveform peaks for the request. Only audio URLs used by the project's segments are accepted.
+func peaks(request protocol.PeaksRequestPayload) (protocol.PeaksPayload, protocol.ErrorCode, error) {
+	if !db.HasURL(request.URL) {
+		return protocol.PeaksPayload{}, protocol.ErrorNotFound, fmt.Errorf("no segment with url %s", request.URL)
+	}
+	if request.Channel < 0 {
+		return protocol.PeaksPayload{}, protocol.ErrorInvalidPayload, fmt.Errorf("invalid channel %d", request.Channel)
+	}
+	channel := db.Channel(protocol.SegmentPayload{Channel: request.Channel})
+	res, err := peakComputer.Peaks(audioSource(request.URL), channel, request.Chunk, request.Width)
+	if err != nil {
+		return res, protocol.ErrorExtractionFailed, err
+	}
+	res.URL = request.URL
+	return res, "", nil
+}
+
+// wsPeaks sends the waveform peaks for the request to the client
+func wsPeaks(conn *websocket.Conn, request protocol.PeaksRequestPayload) {
+	res, code, err := peaks(request)
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't compute peaks : %v", err)
+		wsErrorDetails(conn, code, map[string]string{"url": request.URL}, msg, msg)
+		return
+	}
+	wsPayload(conn, "peaks", res)
+}
+
+// GET /api/v1/peaks?url=<url>&width=<width>&start=<start>&end=<end>&channel=<channel>
+func apiPeaks(w http.ResponseWriter, r *http.Request) {
+	request := protocol.PeaksRequestPayload{URL: getParam("url", r)}
+	var err error
+	if request.Width, err = strconv.Atoi(getParam("width", r)); err != nil {
+		msg := fmt.Sprintf("Invalid width : %v", err)
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+	if s := getParam("channel", r); s != "" {
+		if request.Channel, err = strconv.Atoi(s); err != nil {
+			msg := fmt.Sprintf("Invalid channel : %v", err)
+			apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+			return
+		}
+	}
+	if start, end := getParam("start", r), getParam("end", r); start != "" || end != "" {
+		request.Chunk = &protocol.Chunk{}
+		request.Chunk.Start, err = strconv.ParseInt(start, 10, 64)
+		if err == nil {
+			request.Chunk.End, err = strconv.ParseInt(end, 10, 64)
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Invalid start/end : %v", err)
+			apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+			return
+		}
+	}
+	res, code, err := peaks(request)
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't compute peaks : %v", err)
+		apiErrorDetails(w, code, map[string]string{"url": request.URL}, msg, msg)
+		return
+	}
+	apiPayload(w, res)
+}
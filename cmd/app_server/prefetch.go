@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/stts-se/segment_checker/log"
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// nextQuery returns the query the user is expected to send next, after being served the segment: the same request status and step size, starting from the served segment
+func nextQuery(query protocol.QueryPayload, served protocol.AnnotationPayload) protocol.QueryPayload {
+	res := query
+	res.RequestIndex = ""
+	res.CurrID = served.ID
+	if res.StepSize == 0 {
+		res.StepSize = 1
+	}
+	return res
+}
+
+// prefetch predicts the user's next segment, and extracts its audio (and analyses) into the chunk cache in the background.
+// Concurrent requests for the same chunk share the extraction (see modules.ChunkCache), so a user asking for the segment before the prefetch is completed will wait for it to finish rather than start a new extraction.
+func prefetch(query protocol.QueryPayload, served protocol.AnnotationPayload) {
+	if !*cfg.Prefetch || chunkExtractor.Cache() == nil {
+		return
+	}
+	go func() {
+		// peek only, the segment is not locked
+		next, err := db.GetNextSegment(nextQuery(query, served), "", false)
+		if err != nil {
+			dbg("Nothing to prefetch after segment %s : %v", served.ID, err)
+			return
+		}
+		request := splitRequest(next, query.Context)
+		// with the same analyses as when the segment is loaded (see load), so that they are cached too
+		_, _, err = chunkExtractor.ExtractURLWithAnalysis(request, "", analysis(next))
+		if err != nil {
+			log.Warning("Couldn't prefetch audio for segment %s : %v", next.ID, err)
+			return
+		}
+		log.Info("Prefetched audio for segment %s", next.ID)
+	}()
+}
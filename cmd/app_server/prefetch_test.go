@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stts-se/segment_checker/modules"
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// testSegments returns six segments of 100 ms each, 100 ms apart, in /audio/a.wav
+func testSegments() []protocol.SegmentPayload {
+	var res []protocol.SegmentPayload
+	for i, id := range []string{"s1", "s2", "s3", "s4", "s5", "s6"} {
+		start := int64(i * 200)
+		res = append(res, testSegment(id, "/audio/a.wav", start, start+100))
+	}
+	return res
+}
+
+func TestNextQuery(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		query      protocol.QueryPayload
+		clientStep int64 // the step size of the client's next query
+		expServed  string
+		expNext    string
+	}{
+		{name: "request index", query: protocol.QueryPayload{RequestStatus: "any", RequestIndex: "2"}, clientStep: 1, expServed: "s3", expNext: "s4"},
+		{name: "request index last", query: protocol.QueryPayload{RequestStatus: "any", RequestIndex: "last"}, clientStep: 1, expServed: "s6"},
+		{name: "next", query: protocol.QueryPayload{RequestStatus: "unchecked", StepSize: 1, CurrID: "s1"}, clientStep: 1, expServed: "s2", expNext: "s3"},
+		{name: "previous", query: protocol.QueryPayload{RequestStatus: "unchecked", StepSize: -1, CurrID: "s5"}, clientStep: -1, expServed: "s4", expNext: "s3"},
+		{name: "step 2", query: protocol.QueryPayload{RequestStatus: "any", StepSize: 2, CurrID: "s1"}, clientStep: 2, expServed: "s3", expNext: "s5"},
+		{name: "step -2", query: protocol.QueryPayload{RequestStatus: "any", StepSize: -2, CurrID: "s6"}, clientStep: -2, expServed: "s4", expNext: "s2"},
+	} {
+		dir := newTestProject(t, "", testSegments()...)
+		test.query.UserName = "user1"
+
+		served, err := db.GetNextSegment(test.query, "", true)
+		if err != nil || served.ID != test.expServed {
+			t.Errorf("%s: expected segment %s to be served, got %q (%v)", test.name, test.expServed, served.ID, err)
+			os.RemoveAll(dir)
+			continue
+		}
+		predicted, predErr := db.GetNextSegment(nextQuery(test.query, served), "", false)
+
+		// the client saves the served segment, and asks for the next one
+		if err := db.Save(testAnnotation(t, served.ID, "ok", "user1")); err != nil {
+			t.Fatalf("%s: got error from Save: %v", test.name, err)
+		}
+		clientQuery := protocol.QueryPayload{UserName: "user1", RequestStatus: test.query.RequestStatus, StepSize: test.clientStep, CurrID: served.ID}
+		next, err := db.GetNextSegment(clientQuery, served.ID, true)
+		if next.ID != test.expNext {
+			t.Errorf("%s: expected the client's next segment to be %q, got %q (%v)", test.name, test.expNext, next.ID, err)
+		}
+		if predicted.ID != next.ID {
+			t.Errorf("%s: expected the predicted segment to be %q, got %q (%v)", test.name, next.ID, predicted.ID, predErr)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// writeTestWav writes a mono WAV file of the duration (in milliseconds) to the project's audio folder
+func writeTestWav(t *testing.T, dir, fileName string, duration int) {
+	format := modules.WavFormat{FormatCode: 1, Channels: 1, SampleRate: 16000, BitsPerSample: 16}
+	samples := make([]float64, format.SampleRate*duration/1000)
+	for i := range samples {
+		samples[i] = float64(i%100)/100 - 0.5
+	}
+	var buf bytes.Buffer
+	if err := modules.WriteWav(&buf, format, format.EncodeSamples(samples)); err != nil {
+		t.Fatalf("got error from WriteWav: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "audio", fileName), buf.Bytes(), 0644); err != nil {
+		t.Fatalf("couldn't write audio file: %v", err)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	// the contours and boundary suggestion are prefetched with the audio
+	dir := newTestProject(t, `{"contours": ["silence"], "suggestions": ["silence"]}`, testSegments()...)
+	defer os.RemoveAll(dir)
+	writeTestWav(t, dir, "a.wav", 2000)
+	*cfg.Prefetch = true
+
+	prevExtractor := chunkExtractor
+	defer func() { chunkExtractor = prevExtractor }()
+	var err error
+	chunkExtractor, err = modules.NewChunkExtractor()
+	if err != nil {
+		t.Fatalf("got error from NewChunkExtractor: %v", err)
+	}
+	cache, err := modules.NewChunkCache(1<<20, "", 0)
+	if err != nil {
+		t.Fatalf("got error from NewChunkCache: %v", err)
+	}
+	chunkExtractor.SetCache(cache)
+
+	query := protocol.QueryPayload{UserName: "user1", RequestStatus: "unchecked", StepSize: 1, CurrID: "s1"}
+	served, err := db.GetNextSegment(query, "", true)
+	if err != nil {
+		t.Fatalf("got error from GetNextSegment: %v", err)
+	}
+	prefetch(query, served)
+	for timeout := time.Now().Add(5 * time.Second); cache.Stats().MemEntries == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(timeout) {
+			t.Fatalf("expected the next segment to be prefetched")
+		}
+	}
+
+	// the client's next query returns the prefetched segment, and its audio is read from the cache
+	db.Save(testAnnotation(t, served.ID, "ok", "user1"))
+	next, err := db.GetNextSegment(nextQuery(query, served), served.ID, true)
+	if err != nil || next.ID != "s3" {
+		t.Fatalf("expected the next segment to be s3, got %q (%v)", next.ID, err)
+	}
+	before := cache.Stats()
+	res, _, err := chunkExtractor.ExtractURLWithAnalysis(splitRequest(next, query.Context), "", analysis(next))
+	if err != nil {
+		t.Fatalf("got error from ExtractURLWithAnalysis: %v", err)
+	}
+	after := cache.Stats()
+	if after.Hits != before.Hits+1 || after.Misses != before.Misses {
+		t.Errorf("expected the audio of the prefetched segment to be a cache hit, got %#v (before: %#v)", after, before)
+	}
+	if res.Contours == nil || res.Suggestion == nil {
+		t.Errorf("expected the prefetched audio chunk to have contours and a boundary suggestion")
+	}
+}
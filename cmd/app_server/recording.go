@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// maxSpanLength is the max length (milliseconds) of audio served from /api/v1/audio.
+// The audio is extracted in memory, and has to be sent within the server's write timeout (15 s, see main): two minutes of 16 bit stereo WAV at 48 kHz is 23 MB.
+const maxSpanLength = int64(2 * 60 * 1000)
+
+// GET /api/v1/audio?url=<url>&start=<ms>&end=<ms>&channel=<channel>
+func apiAudioSpan(w http.ResponseWriter, r *http.Request) {
+	url := getParam("url", r)
+	if !db.HasURL(url) {
+		msg := fmt.Sprintf("No segment with url %s", url)
+		apiErrorDetails(w, protocol.ErrorNotFound, map[string]string{"url": url}, msg, msg)
+		return
+	}
+	request := protocol.SplitRequestPayload{URL: audioSource(url)}
+	var err error
+	for name, v := range map[string]*int64{
+		"start": &request.Chunk.Start,
+		"end":   &request.Chunk.End,
+	} {
+		s := getParam(name, r)
+		if s == "" {
+			continue
+		}
+		if *v, err = strconv.ParseInt(s, 10, 64); err != nil {
+			msg := fmt.Sprintf("Invalid %s : %v", name, err)
+			apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+			return
+		}
+	}
+	if request.Chunk.End == 0 {
+		// the rest of the recording, up to the max length (the window is limited to the audio duration)
+		request.Chunk.End = request.Chunk.Start + maxSpanLength
+	}
+	// the span is checked before the audio is extracted
+	if request.Chunk.Start < 0 || request.Chunk.End <= request.Chunk.Start || request.Chunk.End-request.Chunk.Start > maxSpanLength {
+		msg := fmt.Sprintf("Invalid span %d-%d (max length %d ms)", request.Chunk.Start, request.Chunk.End, maxSpanLength)
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+	if s := getParam("channel", r); s != "" {
+		if request.Channel, err = strconv.Atoi(s); err != nil {
+			msg := fmt.Sprintf("Invalid channel : %v", err)
+			apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+			return
+		}
+	}
+	request.Channel = db.Channel(protocol.SegmentPayload{Channel: request.Channel})
+
+	res, bts, err := chunkExtractor.ExtractURLWithContext(request, "")
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't extract audio : %v", err)
+		apiErrorDetails(w, protocol.ErrorExtractionFailed, map[string]string{"url": url}, msg, msg)
+		return
+	}
+	if contentType := mime.TypeByExtension("." + res.FileType); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	// the audio timing, see protocol.AudioChunk
+	w.Header().Set("X-Audio-Offset", fmt.Sprintf("%d", res.Offset))
+	w.Header().Set("X-Audio-Exact-Offset", fmt.Sprintf("%v", res.ExactOffset))
+	w.Header().Set("X-Audio-Sample-Accurate", fmt.Sprintf("%v", res.SampleAccurate))
+	// ServeContent handles Range requests
+	http.ServeContent(w, r, "audio."+res.FileType, time.Time{}, bytes.NewReader(bts))
+}
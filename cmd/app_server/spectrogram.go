@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/stts-se/segment_checker/modules"
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// spectrogramParams reads the spectrogram options from the request's query parameters
+func spectrogramParams(r *http.Request) (protocol.SpectrogramOptions, error) {
+	res := protocol.SpectrogramOptions{}
+	for name, v := range map[string]*float64{
+		"window_ms":     &res.WindowMs,
+		"step_ms":       &res.StepMs,
+		"min_freq":      &res.MinFreq,
+		"max_freq":      &res.MaxFreq,
+		"dynamic_range": &res.DynamicRange,
+	} {
+		s := getParam(name, r)
+		if s == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return res, fmt.Errorf("invalid %s : %v", name, err)
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return res, fmt.Errorf("invalid %s : %s", name, s)
+		}
+		*v = f
+	}
+	return res, nil
+}
+
+// contextParam reads the (optional) context from the request's query parameters. 0 means the default context.
+func contextParam(r *http.Request) (int64, error) {
+	s := getParam("context", r)
+	if s == "" {
+		return 0, nil
+	}
+	res, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid context : %v", err)
+	}
+	return res, nil
+}
+
+// GET /api/v1/segments/{id}/spectrogram?format=<png|json>&context=<ms>&window_ms=<ms>&step_ms=<ms>&min_freq=<hz>&max_freq=<hz>&dynamic_range=<db>
+func apiSpectrogram(w http.ResponseWriter, r *http.Request) {
+	id := getParam("id", r)
+	annotation, err := db.GetSegment(id)
+	if err != nil {
+		apiDBError(w, err, "Couldn't get segment")
+		return
+	}
+	opts, err := spectrogramParams(r)
+	if err != nil {
+		msg := fmt.Sprintf("%v", err)
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+	context, err := contextParam(r)
+	if err != nil {
+		msg := fmt.Sprintf("%v", err)
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+	format := getParam("format", r)
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "json" {
+		msg := fmt.Sprintf("Invalid format %s (expected png or json)", format)
+		apiError(w, protocol.ErrorInvalidPayload, msg, msg)
+		return
+	}
+
+	spec, err := chunkExtractor.SpectrogramWithContext(splitRequest(annotation, context), opts)
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't compute spectrogram : %v", err)
+		apiErrorDetails(w, protocol.ErrorExtractionFailed, map[string]string{"segment_id": id, "url": annotation.URL}, msg, msg)
+		return
+	}
+	if format == "json" {
+		apiPayload(w, spec)
+		return
+	}
+
+	img, err := modules.SpectrogramPNG(spec)
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't render spectrogram : %v", err)
+		apiError(w, protocol.ErrorInternal, msg, msg)
+		return
+	}
+	// the image alignment, see protocol.Spectrogram
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("X-Spectrogram-Offset", fmt.Sprintf("%d", spec.Offset))
+	w.Header().Set("X-Spectrogram-Chunk", fmt.Sprintf("%d-%d", spec.Chunk.Start, spec.Chunk.End))
+	w.Header().Set("X-Spectrogram-Start", fmt.Sprintf("%v", spec.Start))
+	w.Header().Set("X-Spectrogram-Step", fmt.Sprintf("%v", spec.StepMs))
+	w.Header().Set("X-Spectrogram-Freq-Range", fmt.Sprintf("%v-%v", spec.MinFreq, spec.MaxFreq))
+	w.Write(img)
+}
@@ -3,6 +3,13 @@
 const baseURL = window.location.protocol + '//' + window.location.host + window.location.pathname.replace(/\/$/g, "");
 const wsBase = baseURL.replace(/^http/, "ws");
 const clientID = LIB.uuidv4();
+
+// websocket protocol version, see protocol.ProtocolVersion
+const protocolVersion = 2;
+// length of the audio id prefix in binary audio frames, see protocol.AudioIDLength
+const audioIDLength = 36;
+// the server's hello message, with protocol version and capabilities
+let serverHello;
 let ws;
 
 let gloptions = {
@@ -17,6 +24,10 @@ let gloptions = {
 let enabled = false;
 let waveform;
 let cachedSegment;
+// the segment types of the project, by name, with default context and allowed labels
+let segmentTypes = {};
+// the project settings, with the statuses and labels that can be saved
+let projectConfig = null;
 
 let debugVar;
 
@@ -52,23 +63,31 @@ function enableStart(enable) {
     }
 }
 
+// labelAllowed returns true if the label is allowed for the segment type (any labels are allowed if not configured)
+function labelAllowed(segmentType, label) {
+    let t = segmentTypes[segmentType];
+    return !t || !t.labels || t.labels.includes(label);
+}
+
 function setEnabled(enable) {
     document.getElementById("unlock-all").disabled = false;
     document.getElementById("unlock-all").classList.remove("disabled");
 
     enabled = enable;
     let buttons = [
-        document.getElementById("save-badsample"),
-        document.getElementById("save-skip"),
-        document.getElementById("save-ok"),
-        document.getElementById("save-badsample-next"),
-        document.getElementById("save-skip-next"),
-        document.getElementById("save-ok-next"),
+        ...document.querySelectorAll(".status-btn"),
+        ...document.querySelectorAll(".label-checkbox"),
         document.getElementById("play-all"),
         document.getElementById("play-label"),
         document.getElementById("play-right"),
         document.getElementById("play-left"),
         document.getElementById("reset"),
+        document.getElementById("use-suggestion"),
+        document.getElementById("split"),
+        document.getElementById("merge-next"),
+        document.getElementById("insert"),
+        document.getElementById("save-rejected-next"),
+        document.getElementById("save-deleted-next"),
         document.getElementById("quit"),
         document.getElementById("next"),
         document.getElementById("prev"),
@@ -88,9 +107,20 @@ function setEnabled(enable) {
         }
 	// document.getElementById("start").disabled = true;
         // document.getElementById("start").classList.add("disabled");
+        // statuses and labels with labels not allowed for the segment type
+        if (cachedSegment) {
+            document.querySelectorAll(".status-btn, .label-checkbox").forEach(function (btn) {
+                if (btn.dataset.label && !labelAllowed(cachedSegment.segment_type, btn.dataset.label)) {
+                    btn.classList.add("disabled");
+                    btn.disabled = true;
+                }
+            });
+        }
         document.getElementById("comment").removeAttribute("readonly");
+        document.getElementById("text").removeAttribute("readonly");
     } else {
         document.getElementById("comment").setAttribute("readonly", "readonly");
+        document.getElementById("text").setAttribute("readonly", "readonly");
         for (let i = 0; i < buttons.length; i++) {
             let btn = buttons[i];
             if (btn) {
@@ -162,17 +192,44 @@ document.getElementById("play-right").addEventListener("click", function (evt) {
     }
 });
 
-document.getElementById("save-badsample-next").addEventListener("click", function (evt) {
+document.getElementById("save-rejected-next").addEventListener("click", function (evt) {
     if (!evt.target.disabled)
-        saveUnlockAndNext({ status: "skip", label: "bad sample", stepSize: 1 });
+        saveUnlockAndNext({ status: "rejected", stepSize: 1 });
 });
-document.getElementById("save-skip-next").addEventListener("click", function (evt) {
+document.getElementById("save-deleted-next").addEventListener("click", function (evt) {
     if (!evt.target.disabled)
-        saveUnlockAndNext({ status: "skip", stepSize: 1 });
+        saveUnlockAndNext({ status: "deleted", stepSize: 1 });
 });
-document.getElementById("save-ok-next").addEventListener("click", function (evt) {
-    if (!evt.target.disabled)
-        saveUnlockAndNext({ status: "ok", stepSize: 1 });
+
+document.getElementById("split").addEventListener("click", function (evt) {
+    if (evt.target.disabled)
+        return;
+    let at = cursorTime();
+    if (at <= cachedSegment.chunk.start || at >= cachedSegment.chunk.end) {
+        logWarning("Place the cursor inside the segment to split it");
+        return;
+    }
+    sendEdit({ operation: "split", segment_ids: [cachedSegment.id], at: at + cachedSegment.offset });
+});
+document.getElementById("merge-next").addEventListener("click", function (evt) {
+    if (evt.target.disabled)
+        return;
+    let next = nextRecordingSegment();
+    if (!next) {
+        logWarning("There is no next segment to merge with");
+        return;
+    }
+    sendEdit({ operation: "merge", segment_ids: [cachedSegment.id, next.id] });
+});
+document.getElementById("insert").addEventListener("click", function (evt) {
+    if (evt.target.disabled)
+        return;
+    let gap = gapAt(cursorTime());
+    if (!gap) {
+        logWarning("Place the cursor between segments to insert a new segment");
+        return;
+    }
+    sendEdit({ operation: "insert", segment_ids: [cachedSegment.id], chunk: { start: gap.start + cachedSegment.offset, end: gap.end + cachedSegment.offset } });
 });
 
 if (document.getElementById("first")) {
@@ -219,15 +276,76 @@ if (document.getElementById("next_any")) {
     });
 }
 
+// the cursor time (milliseconds, relative to the offset, like the chunk of the audio chunk)
+function cursorTime() {
+    return Math.round(waveform.wavesurfer.getCurrentTime() * 1000);
+}
+
+// removed segments are not part of the final segmentation
+function removedStatus(status) {
+    return status === "replaced" || status === "rejected" || status === "deleted";
+}
+
+// the next segment (after the current segment) of the recording and channel, not counting removed segments
+function nextRecordingSegment() {
+    let segments = recordingSegments.filter(seg => seg.channel === cachedSegment.channel && !removedStatus(seg.current_status.name));
+    let i = segments.findIndex(seg => seg.id === cachedSegment.id);
+    if (i < 0 || i + 1 >= segments.length)
+        return null;
+    return segments[i + 1];
+}
+
+// the gap between the current and neighbouring segments at time t (relative to the offset), or null if t is inside a segment
+function gapAt(t) {
+    let gap = { start: 0, end: Math.floor(waveform.wavesurfer.getDuration() * 1000) };
+    let segments = [{ chunk: cachedSegment.chunk, status: cachedSegment.current_status.name }];
+    if (cachedSegment.neighbours)
+        segments = segments.concat(cachedSegment.neighbours);
+    for (let i = 0; i < segments.length; i++) {
+        let seg = segments[i];
+        if (removedStatus(seg.status))
+            continue;
+        if (t > seg.chunk.start && t < seg.chunk.end)
+            return null;
+        if (seg.chunk.end <= t && seg.chunk.end > gap.start)
+            gap.start = seg.chunk.end;
+        if (seg.chunk.start >= t && seg.chunk.start < gap.end)
+            gap.end = seg.chunk.start;
+    }
+    if (gap.end <= gap.start)
+        return null;
+    return gap;
+}
+
+// send an edit request (split, merge or insert); the server replies with an edited message, followed by the first new segment
+function sendEdit(edit) {
+    edit.user_name = document.getElementById("username").innerText;
+    if (gloptions.context && gloptions.context >= 0)
+        edit.context = parseInt(gloptions.context);
+    let request = {
+        'client_id': clientID,
+        'message_type': 'edit',
+        'payload': JSON.stringify(edit),
+    };
+    ws.send(JSON.stringify(request));
+}
+
 function clear() {
     if (waveform)
         waveform.clear();
     document.getElementById("comment").value = "";
+    document.getElementById("text").value = "";
+    document.getElementById("text").title = "";
+    setLabels([]);
     //document.getElementById("labels").innerText = "";
     document.getElementById("current_status").innerText = "";
     document.getElementById("current_status_div").style.backgroundColor = "";
     document.getElementById("current_status_div").style.borderColor = "";
     document.getElementById("segment_info").innerHTML = "&nbsp;";
+    document.getElementById("segment_meta").innerText = "";
+    document.getElementById("contours").classList.add("hidden");
+    document.getElementById("neighbours").classList.add("hidden");
+    document.getElementById("use-suggestion").classList.add("hidden");
 }
 
 document.getElementById("reset").addEventListener("click", function (evt) {
@@ -237,6 +355,18 @@ document.getElementById("reset").addEventListener("click", function (evt) {
             document.getElementById("comment").value = cachedSegment.comment;
         else
             document.getElementById("comment").value = "";
+        if (cachedSegment.text)
+            document.getElementById("text").value = cachedSegment.text;
+        else
+            document.getElementById("text").value = "";
+        setLabels(cachedSegment.labels);
+    }
+});
+document.getElementById("use-suggestion").addEventListener("click", function (evt) {
+    if (!evt.target.disabled && cachedSegment.suggestion) {
+        let suggestion = cachedSegment.suggestion;
+        waveform.updateRegion(0, suggestion.chunk.start, suggestion.chunk.end);
+        logMessage("Moved boundaries to the automatic suggestion (check before saving)");
     }
 });
 document.getElementById("quit").addEventListener("click", function (evt) {
@@ -331,41 +461,269 @@ document.getElementById("move-right2right-long").addEventListener("click", funct
     }
 });
 
-function displayAudioChunk(chunk) {
+// audio chunk waiting for its binary audio frame (audio transport binary)
+let pendingAudioChunk = null;
+
+// receiveAudioChunk gets the audio for the chunk, depending on the audio transport used by the server
+function receiveAudioChunk(chunk) {
+    if (chunk.audio) {
+        // https://stackoverflow.com/questions/16245767/creating-a-blob-from-a-base64-string-in-javascript#16245768
+        let byteCharacters = atob(chunk.audio);
+        let byteNumbers = new Array(byteCharacters.length);
+        for (let i = 0; i < byteCharacters.length; i++) {
+            byteNumbers[i] = byteCharacters.charCodeAt(i);
+        }
+        let byteArray = new Uint8Array(byteNumbers);
+        displayAudioChunk(chunk, new Blob([byteArray], { 'type': chunk.file_type }));
+    }
+    else if (chunk.audio_id) {
+        pendingAudioChunk = chunk;
+    }
+    else if (chunk.audio_url) {
+        fetch(baseURL + chunk.audio_url)
+            .then(function (resp) {
+                if (!resp.ok)
+                    throw new Error(resp.status + " " + resp.statusText);
+                return resp.blob();
+            })
+            .then(function (blob) { displayAudioChunk(chunk, blob); })
+            .catch(function (err) {
+                logError("Couldn't download audio from " + chunk.audio_url + ": " + err);
+            });
+    }
+    else
+        logError("No audio in audio chunk for segment " + chunk.id);
+}
+
+// receiveAudioFrame handles a binary audio frame: the audio id followed by the audio bytes
+function receiveAudioFrame(data) {
+    let audioID = new TextDecoder().decode(data.slice(0, audioIDLength));
+    if (!pendingAudioChunk || pendingAudioChunk.audio_id !== audioID) {
+        logWarning("Unexpected audio frame from server: " + audioID);
+        return;
+    }
+    let chunk = pendingAudioChunk;
+    pendingAudioChunk = null;
+    displayAudioChunk(chunk, new Blob([data.slice(audioIDLength)], { 'type': chunk.file_type }));
+}
+
+// overview peaks for the current recording
+let overviewPeaks = null;
+
+// all segments of the current recording, ordered by start time
+let recordingSegments = [];
+
+// request the segments of the recording (with their current status)
+function requestRecordingSegments(chunk) {
+    fetch("/api/v1/segments?url=" + encodeURIComponent(chunk.url))
+        .then(response => response.json())
+        .then(function (segments) {
+            if (!cachedSegment || cachedSegment.url !== chunk.url)
+                return;
+            recordingSegments = segments;
+            drawOverview();
+        })
+        .catch(err => console.log("Couldn't get recording segments", err));
+}
+
+// request peaks for the whole recording, unless they are already loaded
+function requestOverview(chunk) {
+    if (!serverHello || !serverHello.capabilities.message_types || !serverHello.capabilities.message_types.includes("peaks"))
+        return;
+    requestRecordingSegments(chunk);
+    if (overviewPeaks && overviewPeaks.url === chunk.url && overviewPeaks.channel === chunk.channel) {
+        drawOverview();
+        return;
+    }
+    let canvas = document.getElementById("overview");
+    let request = { url: chunk.url, width: canvas.width };
+    if (chunk.channel)
+        request.channel = chunk.channel;
+    ws.send(JSON.stringify({ 'client_id': clientID, 'message_type': 'peaks', 'payload': JSON.stringify(request) }));
+}
+
+function receivePeaks(peaks) {
+    if (!cachedSegment || cachedSegment.url !== peaks.url)
+        return;
+    overviewPeaks = peaks;
+    overviewPeaks.channel = cachedSegment.channel;
+    drawOverview();
+}
+
+// draw the overview peaks, highlighting the current audio chunk and segment
+function drawOverview() {
+    let canvas = document.getElementById("overview");
+    let ctx = canvas.getContext("2d");
+    ctx.clearRect(0, 0, canvas.width, canvas.height);
+    if (!overviewPeaks || !cachedSegment)
+        return;
+    let peaks = overviewPeaks;
+    let x = function (ms) {
+        return (ms / peaks.duration) * canvas.width;
+    };
+
+    // the current audio chunk (with context), and the segment
+    let chunkStart = cachedSegment.exact_offset;
+    let chunkEnd = chunkStart + waveform.wavesurfer.getDuration() * 1000;
+    ctx.fillStyle = 'hsla(200, 50%, 70%, 0.4)';
+    ctx.fillRect(x(chunkStart), 0, Math.max(1, x(chunkEnd) - x(chunkStart)), canvas.height);
+    ctx.fillStyle = 'orange';
+    let segStart = cachedSegment.offset + cachedSegment.chunk.start;
+    let segEnd = cachedSegment.offset + cachedSegment.chunk.end;
+    ctx.fillRect(x(segStart), 0, Math.max(1, x(segEnd) - x(segStart)), canvas.height);
+
+    // the recording's segments, below the waveform
+    recordingSegments.forEach(function (seg) {
+        if (seg.url !== cachedSegment.url || seg.channel !== cachedSegment.channel || seg.current_status.name === "replaced")
+            return;
+        ctx.fillStyle = statusColor(seg.current_status.name, seg.labels);
+        ctx.fillRect(x(seg.chunk.start), canvas.height - 4, Math.max(1, x(seg.chunk.end) - x(seg.chunk.start)), 4);
+    });
+
+    let mid = canvas.height / 2;
+    ctx.strokeStyle = 'purple';
+    ctx.beginPath();
+    for (let i = 0; i < peaks.min.length; i++) {
+        let px = x(peaks.start + i * peaks.peak_duration);
+        ctx.moveTo(px, mid - peaks.max[i] * mid);
+        ctx.lineTo(px, mid - peaks.min[i] * mid + 1);
+    }
+    ctx.stroke();
+}
+
+// displayStatus returns the name a status is shown by: the label of a configured status, if the labels include it, or else the status name (as on the server)
+function displayStatus(status, labels) {
+    if (projectConfig && labels && !removedStatus(status)) {
+        let s = projectConfig.statuses.find(s => s.label && labels.includes(s.label));
+        if (s)
+            return s.label;
+    }
+    return status;
+}
+
+// status colors, as for the current status (from the project config)
+function statusColor(status, labels) {
+    let name = displayStatus(status, labels);
+    if (projectConfig) {
+        let s = projectConfig.statuses.find(s => (s.label || s.name) === name);
+        if (s && s.color)
+            return s.color;
+    }
+    if (removedStatus(status))
+        return "dimgrey";
+    return "lightgrey";
+}
+
+// draw the other segments from the same recording that overlap the audio chunk, if any
+function drawNeighbours() {
+    let canvas = document.getElementById("neighbours");
+    if (!cachedSegment || !cachedSegment.neighbours) {
+        canvas.classList.add("hidden");
+        return;
+    }
+    canvas.classList.remove("hidden");
+    let ctx = canvas.getContext("2d");
+    ctx.clearRect(0, 0, canvas.width, canvas.height);
+    let duration = waveform.wavesurfer.getDuration() * 1000;
+    // neighbour chunks are relative to the offset, but the audio starts at the exact offset
+    let x = function (ms) {
+        return Math.min(Math.max(((ms + cachedSegment.offset - cachedSegment.exact_offset) / duration) * canvas.width, 0), canvas.width);
+    };
+    ctx.font = "10px sans-serif";
+    ctx.textBaseline = "middle";
+    cachedSegment.neighbours.forEach(function (n) {
+        let x0 = x(n.chunk.start);
+        let x1 = x(n.chunk.end);
+        ctx.fillStyle = statusColor(n.status, n.labels);
+        ctx.fillRect(x0, 0, Math.max(1, x1 - x0), canvas.height);
+        ctx.strokeStyle = "grey";
+        ctx.strokeRect(x0, 0, Math.max(1, x1 - x0), canvas.height);
+        ctx.fillStyle = "black";
+        ctx.fillText(n.id + " (" + n.status + ")", x0 + 2, canvas.height / 2, Math.max(0, x1 - x0 - 4));
+        if (n.chunk.start < cachedSegment.chunk.end && n.chunk.end > cachedSegment.chunk.start)
+            logMessage("Segment overlaps with neighbouring segment " + n.id);
+    });
+}
+
+// draw the pitch and intensity contours of the current audio chunk, if any
+function drawContours() {
+    let canvas = document.getElementById("contours");
+    if (!cachedSegment || !cachedSegment.contours) {
+        canvas.classList.add("hidden");
+        return;
+    }
+    canvas.classList.remove("hidden");
+    let ctx = canvas.getContext("2d");
+    ctx.clearRect(0, 0, canvas.width, canvas.height);
+    let contours = cachedSegment.contours;
+    let duration = waveform.wavesurfer.getDuration() * 1000;
+    // frame i is measured at the center of its time range, see protocol.Contours
+    let x = function (i) {
+        return ((contours.start + (i + 0.5) * contours.step_ms - cachedSegment.exact_offset) / duration) * canvas.width;
+    };
+
+    let maxIntensity = Math.max(...contours.intensity, 1);
+    ctx.strokeStyle = 'grey';
+    ctx.beginPath();
+    for (let i = 0; i < contours.intensity.length; i++) {
+        let y = canvas.height - (contours.intensity[i] / maxIntensity) * canvas.height;
+        if (i === 0)
+            ctx.moveTo(x(i), y);
+        else
+            ctx.lineTo(x(i), y);
+    }
+    ctx.stroke();
+
+    // pitch on a log scale, from pitch floor to pitch ceiling
+    let logRange = Math.log(contours.pitch_ceiling / contours.pitch_floor);
+    ctx.fillStyle = 'blue';
+    for (let i = 0; i < contours.pitch.length; i++) {
+        let f0 = contours.pitch[i];
+        if (f0 <= 0)
+            continue;
+        let y = canvas.height - (Math.log(f0 / contours.pitch_floor) / logRange) * canvas.height;
+        ctx.fillRect(x(i) - 1, y - 1, 3, 3);
+    }
+}
+
+function displayAudioChunk(chunk, blob) {
     clear();
     lockGUI();
-    // https://stackoverflow.com/questions/16245767/creating-a-blob-from-a-base64-string-in-javascript#16245768
-    let byteCharacters = atob(chunk.audio);
-    let byteNumbers = new Array(byteCharacters.length);
-    for (let i = 0; i < byteCharacters.length; i++) {
-        byteNumbers[i] = byteCharacters.charCodeAt(i);
-    }
-    let byteArray = new Uint8Array(byteNumbers);
 
     cachedSegment = chunk;
     cachedSegment.audio = null; // no need to cache the audio blob
     console.log("res => cache", JSON.stringify(cachedSegment));
 
-    let blob = new Blob([byteArray], { 'type': chunk.file_type });
     //chunk.chunk.segment_type = chunk.segment_type;
     loadAudioBlob(blob, chunk.chunk);
-    document.getElementById("segment_info").innerText = chunk.index + " | " + chunk.id + " | segment_type: " + chunk.segment_type;
+    let segmentInfo = chunk.index + " | " + chunk.id + " | segment_type: " + chunk.segment_type;
+    if (chunk.channel)
+        segmentInfo = segmentInfo + " | channel: " + chunk.channel;
+    if (chunk.playback)
+        segmentInfo = segmentInfo + " | preprocessed";
+    // boundaries from the source data that were generated automatically, and not checked by a human
+    if (chunk.provenance && chunk.current_status.name === "unchecked")
+        segmentInfo = segmentInfo + " | automatic boundaries (" + chunk.provenance.source + ")";
+    if (chunk.derivation)
+        segmentInfo = segmentInfo + " | " + chunk.derivation.operation + " of " + chunk.derivation.parents.join(", ");
+    if (chunk.suggestion)
+        document.getElementById("use-suggestion").classList.remove("hidden");
+    document.getElementById("segment_info").innerText = segmentInfo;
+    if (chunk.meta) {
+        let meta = Object.keys(chunk.meta).sort().map(function (key) {
+            let value = chunk.meta[key];
+            if (typeof value !== "string")
+                value = JSON.stringify(value);
+            return key + ": " + value;
+        });
+        document.getElementById("segment_meta").innerText = meta.join(" | ");
+    }
+    requestOverview(chunk);
 
     // status info + color code
-    let status = chunk.current_status.name;
+    let status = displayStatus(chunk.current_status.name, chunk.labels);
     let statusDiv = document.getElementById("current_status_div");
-    if (chunk.labels && chunk.labels.includes("bad sample"))
-        status = "bad sample";
-    if (status === "ok")
-        statusDiv.style.borderColor = "lightgreen";
-    else if (status === "bad sample")
-        statusDiv.style.borderColor = "#ff5757";
-    else if (status === "skip")
-        statusDiv.style.borderColor = "orange";
-    else if (status === "unchecked")
-        statusDiv.style.borderColor = "lightgrey";
-    else
-        statusDiv.style.borderColor = "none";
+    statusDiv.style.borderColor = statusColor(chunk.current_status.name, chunk.labels);
 
     if (chunk.current_status.source)
         status += " (" + chunk.current_status.source + ")";
@@ -377,6 +735,17 @@ function displayAudioChunk(chunk) {
     if (chunk.comment)
         document.getElementById("comment").value = chunk.comment;
 
+    // additional labels
+    setLabels(chunk.labels);
+
+    // text, with the last change (if any)
+    if (chunk.text)
+        document.getElementById("text").value = chunk.text;
+    if (chunk.text_history && chunk.text_history.length > 0) {
+        let last = chunk.text_history[chunk.text_history.length - 1];
+        document.getElementById("text").title = `Text changed by ${last.source} | ${last.timestamp} (${chunk.text_history.length} changes)`;
+    }
+
     // labels => integrated as status
     // if (chunk.labels && chunk.labels.length > 0)
     //     document.getElementById("labels").innerText = chunk.labels;
@@ -386,6 +755,116 @@ function displayAudioChunk(chunk) {
     logMessage("Loaded segment " + chunk.id + " from server");
 }
 
+// setLabels checks the checkboxes for the additional labels in the list
+function setLabels(labels) {
+    document.querySelectorAll(".label-checkbox").forEach(function (cb) {
+        cb.checked = labels && labels.includes(cb.dataset.label);
+    });
+}
+
+// the keyboard shortcuts added for the save buttons
+let statusShortcutKeys = [];
+
+// create the save buttons, request status options and label checkboxes from the project's statuses and labels
+function displayProjectConfig(config) {
+    projectConfig = config;
+
+    // save buttons
+    let buttons = document.getElementById("status-buttons");
+    buttons.innerHTML = "";
+    statusShortcutKeys.forEach(key => delete shortcuts[key]);
+    statusShortcutKeys = [];
+    config.statuses.forEach(function (status, i) {
+        let btn = document.createElement("span");
+        btn.id = "save-status-" + i;
+        btn.classList.add("btn", "status-btn");
+        if (status.color)
+            btn.style.backgroundColor = status.color;
+        btn.innerText = status.button;
+        if (status.label)
+            btn.dataset.label = status.label;
+        let desc = status.description;
+        if (!desc)
+            desc = `Save as ${status.label || status.name} and get next`;
+        if (status.key) {
+            shortcuts[status.key] = { buttonID: btn.id, funcDesc: desc };
+            statusShortcutKeys.push(status.key);
+        } else
+            btn.title = desc;
+        btn.addEventListener("click", function (evt) {
+            if (!evt.target.disabled)
+                saveUnlockAndNext({ status: status.name, label: status.label, stepSize: 1 });
+        });
+        buttons.appendChild(btn);
+        buttons.appendChild(document.createTextNode(" "));
+    });
+    loadKeyboardShortcuts();
+
+    // request status options: the built-in statuses, and the project's statuses
+    let select = document.getElementById("requeststatus");
+    let selected = select.value;
+    select.innerHTML = "";
+    let names = ["unchecked", "checked"].concat(config.statuses.map(s => s.label || s.name), ["rejected", "deleted", "replaced", "any"]);
+    names.forEach(function (name) {
+        let option = document.createElement("option");
+        option.value = name;
+        option.text = name.charAt(0).toUpperCase() + name.slice(1);
+        select.add(option);
+    });
+    select.value = names.includes(selected) ? selected : "unchecked";
+    if (new URLSearchParams(window.location.search).get('request_status')) {
+        if (names.includes(gloptions.requestStatus))
+            select.value = gloptions.requestStatus;
+        else
+            logError(`Invalid search mode: ${gloptions.requestStatus}`);
+    }
+
+    // additional labels
+    let labels = document.getElementById("label-checkboxes");
+    labels.innerHTML = "";
+    (config.labels || []).forEach(function (label, i) {
+        let cb = document.createElement("input");
+        cb.type = "checkbox";
+        cb.id = "label-" + i;
+        cb.classList.add("label-checkbox");
+        cb.dataset.label = label;
+        let lbl = document.createElement("label");
+        lbl.htmlFor = cb.id;
+        lbl.innerText = label;
+        labels.appendChild(cb);
+        labels.appendChild(lbl);
+        labels.appendChild(document.createTextNode(" "));
+    });
+    if (config.labels && config.labels.length > 0)
+        document.getElementById("labels-view").classList.remove("hidden");
+    else
+        document.getElementById("labels-view").classList.add("hidden");
+
+    if (!enabled) {
+        document.querySelectorAll(".status-btn, .label-checkbox").forEach(function (btn) {
+            btn.classList.add("disabled");
+            btn.disabled = true;
+        });
+    }
+}
+
+// list the project's segment types in the segment type option (if there is more than one)
+function displaySegmentTypes(types) {
+    let select = document.getElementById("segment-type");
+    while (select.options.length > 1)
+        select.remove(1);
+    segmentTypes = {};
+    types.forEach(function (t) {
+        segmentTypes[t.name] = t;
+        let option = document.createElement("option");
+        option.value = t.name;
+        option.text = `${t.name} (${t.count})`;
+        select.add(option);
+    });
+    if (types.length > 1)
+        document.getElementById("segment-type-view").classList.remove("hidden");
+}
+
 function displayStats(stats) {
     logMessage("Received stats from server");
     let ele = document.getElementById("stats");
@@ -450,8 +929,34 @@ function createQuery(stepSize, requestIndex, requestStatus) {
         query.request_index = requestIndex;
     if (gloptions.context && gloptions.context >= 0)
         query.context = parseInt(gloptions.context);
-    if (cachedSegment && cachedSegment !== null)
+    if (cachedSegment && cachedSegment !== null) {
         query.curr_id = cachedSegment.id;
+        if (document.getElementById("same-recording").checked)
+            query.url = cachedSegment.url;
+    }
+
+    // metadata filter, as comma separated key:value pairs
+    let metaFilter = document.getElementById("meta-filter").value.trim();
+    if (metaFilter !== "") {
+        query.meta = {};
+        metaFilter.split(",").forEach(function (kv) {
+            let i = kv.indexOf(":");
+            if (i > 0)
+                query.meta[kv.substring(0, i).trim()] = kv.substring(i + 1).trim();
+            else
+                logWarning("Invalid metadata filter: " + kv);
+        });
+    }
+
+    // segment type filter
+    let segmentType = document.getElementById("segment-type").value;
+    if (segmentType !== "")
+        query.segment_type = segmentType;
+
+    // text search, as a regular expression
+    let textFilter = document.getElementById("text-filter").value.trim();
+    if (textFilter !== "")
+        query.text = textFilter;
 
     // search for status
     if (requestStatus)
@@ -506,6 +1011,10 @@ function saveUnlockAndNext(options) {
         if (options.label) {
             labels.push(options.label);
         }
+        document.querySelectorAll(".label-checkbox").forEach(function (cb) {
+            if (cb.checked && !labels.includes(cb.dataset.label))
+                labels.push(cb.dataset.label);
+        });
         let statusHistory = cachedSegment.status_history;
         if (!statusHistory)
             statusHistory = [];
@@ -516,6 +1025,7 @@ function saveUnlockAndNext(options) {
             id: cachedSegment.id,
             url: cachedSegment.url,
             segment_type: cachedSegment.segment_type,
+            channel: cachedSegment.channel,
             chunk: {
                 start: region.start + cachedSegment.offset,
                 end: region.end + cachedSegment.offset,
@@ -524,8 +1034,12 @@ function saveUnlockAndNext(options) {
             status_history: statusHistory,
             labels: labels,
             comment: document.getElementById("comment").value,
+            text: document.getElementById("text").value.trim(),
             index: cachedSegment.index,
         }
+        // an empty text keeps the current text, unless it is cleared explicitly
+        if (annotation.text === "" && cachedSegment.text)
+            annotation.clear_text = true;
     }
     let query = createQuery(options.stepSize, options.requestIndex, options.requestStatus);
 
@@ -559,22 +1073,9 @@ onload = function () {
         document.getElementById("context").innerText = `${gloptions.context} ms`;
         document.getElementById("context-view").classList.remove("hidden");
     }
-    if (params.get('request_status')) {
+    // the request status is selected when the project's statuses are received (see displayProjectConfig)
+    if (params.get('request_status'))
         gloptions.requestStatus = params.get('request_status').toLowerCase();
-	let options = document.getElementById("requeststatus").options;
-	let seenRequestedStatus = false;
-	for (let i=0; i<options.length; i++) {
-	    if (options[i].value === gloptions.requestStatus) {
-		document.getElementById("requeststatus").value = gloptions.requestStatus;
-		seenRequestedStatus = true;
-	    }
-	}
-	if (!seenRequestedStatus) {
-            logError(`Invalid search mode: ${gloptions.requestStatus}`);
-	    document.getElementById("requeststatus").value = 'unchecked';
-	    gloptions.requestStatus = document.getElementById("requeststatus").value;
-	}
-    }
     if (params.get('autoplay')) {
         gloptions.autoplay = params.get('autoplay').toLowerCase();
 	let options = document.getElementById("autoplay").options;
@@ -622,12 +1123,18 @@ onload = function () {
 
     let url = wsBase + "/ws/" + clientID + "/" + document.getElementById("username").innerText;
     ws = new WebSocket(url);
+    ws.binaryType = 'arraybuffer';
     ws.onopen = function () {
         logMessage("Websocket opened");
-	if (requestIndex)
-            saveUnlockAndNext({ requestIndex: requestIndex });
-	else
-            saveUnlockAndNext({ stepSize: 1 });
+        let hello = {
+            'protocol_version': protocolVersion,
+            'capabilities': {
+                'message_types': ['hello', 'project_name', 'project_config', 'segment_types', 'stats', 'audio_chunk', 'no_audio_chunk', 'explicit_unlock_completed', 'idle_warning', 'keep_alive', 'edited'],
+                'features': ['keep_alive', 'error_codes'],
+                'audio_transports': ['binary', 'url', 'base64'],
+            },
+        };
+        ws.send(JSON.stringify({ 'client_id': clientID, 'message_type': 'hello', 'payload': JSON.stringify(hello) }));
     }
     ws.onclose = function () {
 	let msg = "Connection was closed from server";
@@ -655,10 +1162,20 @@ onload = function () {
 	alert(msg);
     }
     ws.onmessage = function (evt) {
+        if (evt.data instanceof ArrayBuffer) {
+            receiveAudioFrame(evt.data);
+            return;
+        }
         let resp = JSON.parse(evt.data);
         //console.log("ws.onmessage", resp);
         if (resp.fatal) {
 	    ws.close();
+            if (resp.code === "version_mismatch") {
+                logError(resp.fatal);
+                alert(resp.fatal);
+                ws = undefined;
+                return;
+            }
             logError("Non-recoverable server error: " + resp.fatal);
 	    clear();
 	    setEnabled(false);
@@ -671,15 +1188,34 @@ onload = function () {
             return;
         }
         if (resp.error) {
-            logError("Server error: " + resp.error);
+            if (resp.code === "locked" && resp.details && resp.details.locked_by) {
+                let msg = "Segment " + resp.details.segment_id + " is locked by user " + resp.details.locked_by;
+                logWarning(msg);
+                alert(msg);
+                return;
+            }
+            logError("Server error [" + resp.code + "]: " + resp.error);
 	    alert("Server error: " + resp.error);
             return;
         }
         if (resp.info) {
             logMessage(resp.info);
         }
-        if (resp.message_type === "project_name")
+        if (resp.message_type === "hello") {
+            serverHello = JSON.parse(resp.payload);
+            console.log("server hello", serverHello);
+            logMessage("Connected to server using protocol version " + serverHello.protocol_version);
+	    if (requestIndex)
+		saveUnlockAndNext({ requestIndex: requestIndex });
+	    else
+		saveUnlockAndNext({ stepSize: 1 });
+        }
+        else if (resp.message_type === "project_name")
             document.getElementById("project_name").innerHTML = ": " + JSON.parse(resp.payload);
+        else if (resp.message_type === "project_config")
+            displayProjectConfig(JSON.parse(resp.payload));
+        else if (resp.message_type === "segment_types")
+            displaySegmentTypes(JSON.parse(resp.payload));
         else if (resp.message_type === "stats")
             displayStats(JSON.parse(resp.payload));
         else if (resp.message_type === "explicit_unlock_completed") {
@@ -688,7 +1224,10 @@ onload = function () {
         }
         else if (resp.message_type === "no_audio_chunk") {
             let msg = JSON.parse(resp.payload);
-            logMessage(msg);
+            if (resp.code === "no_match")
+                logMessage(msg);
+            else
+                logWarning(msg);
 	    if (cachedSegment && cachedSegment !== null)
 		setEnabled(true);
 	    else
@@ -697,7 +1236,21 @@ onload = function () {
             alert(msg);
         }
         else if (resp.message_type === "audio_chunk")
-            displayAudioChunk(JSON.parse(resp.payload));
+            receiveAudioChunk(JSON.parse(resp.payload));
+        else if (resp.message_type === "peaks")
+            receivePeaks(JSON.parse(resp.payload));
+        else if (resp.message_type === "edited") {
+            let res = JSON.parse(resp.payload);
+            logMessage("Created segment" + (res.segments.length === 1 ? " " : "s ") + res.segments.map(seg => seg.id).join(", ") + " by " + res.operation + " of " + res.parents.join(", "));
+        }
+        else if (resp.message_type === "idle_warning") {
+            let msg = JSON.parse(resp.payload);
+            logWarning(msg);
+            alert(msg);
+            // the user closed the alert, so let the server know that we're still here
+            if (ws)
+                ws.send(JSON.stringify({ 'client_id': clientID, 'message_type': 'keep_alive' }));
+        }
         else if (resp.info === "" && resp.message_type !== "keep_alive")
             logWarning("Unknown message from server: [" + resp.message_type + "] " + resp.payload);
     }
@@ -711,12 +1264,16 @@ onload = function () {
         timelineElementID: "waveform-timeline",
         spectrogramElementID: "waveform-spectrogram",
         // autoplayFunc: function () { return true; },
-        // zoomElementID: "waveform-zoom",
+        zoomElementID: "waveform-zoom",
         // navigationElementID: "waveform-navigation",
         debug: false,
     };
 
     waveform = new Waveform(options);
+    // the audio chunk duration is known when the audio is loaded
+    waveform.wavesurfer.on("ready", drawOverview);
+    waveform.wavesurfer.on("ready", drawContours);
+    waveform.wavesurfer.on("ready", drawNeighbours);
     // waveform.wavesurfer.on("region-created", function (region) {
     //     autoplay();
     // });
@@ -774,14 +1331,12 @@ const shortcuts = {
     'shift  ': { buttonID: 'play-label' }, // hidden from shortcut view
     // 'n': { tooltip: 'n', buttonID: 'next', funcDesc: "Get next segment" },
     // 'p': { tooltip: 'p', buttonID: 'prev', funcDesc: "Get previous segment" },
-    'o': { buttonID: 'save-ok-next', funcDesc: "Save as ok and get next" },
-    's': { buttonID: 'save-skip-next', funcDesc: "Save as skip and get next" },
-    'b': { buttonID: 'save-badsample-next', funcDesc: "Save as skip with label 'bad sample', and get next" },
+    // keys for the save buttons are added from the project config (see displayProjectConfig)
 };
 
 window.addEventListener("keydown", function (evt) {
     //console.log(evt.which);
-    if (document.activeElement.tagName.toLowerCase() === "textarea")
+    if (document.activeElement.tagName.toLowerCase() === "textarea" || document.activeElement.type === "text")
         return;
     let key = evt.key;
     if (evt.altKey)
@@ -19,16 +19,48 @@ var (
 	silenceStartRE = regexp.MustCompile(".*] silence_start: ([0-9.]+) *")
 	silenceEndRE   = regexp.MustCompile(".*] silence_end: ([0-9.]+) *")
 	durationRE     = regexp.MustCompile("Duration: ([0-9]+):([0-9]{2}):([0-9]{2}[.][0-9]+)")
+	channelsRE     = regexp.MustCompile(`Stream #[^ ]+: Audio: [^,]+, [0-9]+ Hz, ([^,]+)`)
+	nChannelsRE    = regexp.MustCompile("^([0-9]+) channels")
 )
 
+// Channels returns the number of audio channels in the audioFile
+func (ch Chunker) Channels(audioFile string) (int, error) {
+	//ffmpeg -i <LJUDFIL>
+	cmd := exec.Command("ffmpeg", "-i", audioFile)
+	// ffmpeg exits with an error when no output file is specified, so the error is ignored
+	out, _ := cmd.CombinedOutput()
+	for _, l := range strings.Split(string(out), "\n") {
+		m := channelsRE.FindStringSubmatch(l)
+		if len(m) == 0 {
+			continue
+		}
+		layout := strings.TrimSpace(m[1])
+		switch layout {
+		case "mono":
+			return 1, nil
+		case "stereo":
+			return 2, nil
+		}
+		if nM := nChannelsRE.FindStringSubmatch(layout); len(nM) > 0 {
+			return strconv.Atoi(nM[1])
+		}
+		return 0, fmt.Errorf("unknown channel layout %s in %s", layout, audioFile)
+	}
+	return 0, fmt.Errorf("couldn't find audio stream info for %s", audioFile)
+}
+
 const extendChunk = 0 // extend all chunks by N ms before and after (N*2 ms in total)
 
-// Process the audioFile into time chunks
-func (ch Chunker) Process(audioFile string) ([]protocol.Chunk, error) {
+// Process the audioFile into time chunks. If channel > 0, silences are detected in the specified channel (starting at 1) only.
+func (ch Chunker) Process(audioFile string, channel int) ([]protocol.Chunk, error) {
 	res := []protocol.Chunk{}
 
+	filter := "silencedetect=noise=-50dB:d=1"
+	if channel > 0 {
+		filter = fmt.Sprintf("pan=mono|c0=c%d,%s", channel-1, filter)
+	}
 	//ffmpeg -i <LJUDFIL> -af silencedetect=noise=-50dB:d=1 -f null -
-	cmd := exec.Command("ffmpeg", "-i", audioFile, "-af", "silencedetect=noise=-50dB:d=1", "-f", "null", "-")
+	cmd := exec.Command("ffmpeg", "-i", audioFile, "-af", filter, "-f", "null", "-")
 	//log.Printf("chunker cmd: %v", cmd)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
@@ -13,8 +13,11 @@ import (
 	"github.com/stts-se/segment_checker/protocol"
 )
 
-func createID(audioFile string, chunkIndex int) string {
+func createID(audioFile string, channel int, chunkIndex int) string {
 	f := strings.Replace(path.Base(audioFile), ".", "_", -1)
+	if channel > 0 {
+		return fmt.Sprintf("%s_ch%d_%04d", f, channel, (chunkIndex + 1))
+	}
 	return fmt.Sprintf("%s_%04d", f, (chunkIndex + 1))
 }
 
@@ -26,6 +29,8 @@ func main() {
 	target := flag.Int("target", 0, "Target size (can generate duplicated data for performance testing)")
 	urlPrefixFlag := flag.String("urlprefix", "http://localhost:7381/", "URL prefix")
 	outDirFlag := flag.String("outdir", "data/${project}/source", "Output `directory`")
+	channelFlag := flag.Int("channel", 0, "Detect silences in this audio `channel` only (starting at 1; default: all channels mixed)")
+	perChannel := flag.Bool("per_channel", false, "Detect silences in each audio channel separately, creating one set of segments per channel")
 
 	help := flag.Bool("help", false, "Print usage and exit")
 
@@ -47,6 +52,16 @@ func main() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if *channelFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid channel: %d\n", *channelFlag)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *channelFlag > 0 && *perChannel {
+		fmt.Fprintf(os.Stderr, "Flags channel and per_channel cannot be combined\n")
+		flag.Usage()
+		os.Exit(1)
+	}
 
 	urlPrefix := strings.Replace(*urlPrefixFlag, "${project}", *project, 1)
 	if !strings.HasSuffix(urlPrefix, "/") {
@@ -58,6 +73,11 @@ func main() {
 	fmt.Fprintf(os.Stderr, "Target: %v\n", *target)
 	fmt.Fprintf(os.Stderr, "URL prefix: %s\n", urlPrefix)
 	fmt.Fprintf(os.Stderr, "Output directory: %s\n", outDir)
+	if *perChannel {
+		fmt.Fprintf(os.Stderr, "Channel: per channel\n")
+	} else if *channelFlag > 0 {
+		fmt.Fprintf(os.Stderr, "Channel: %d\n", *channelFlag)
+	}
 	fmt.Fprintf(os.Stderr, "\n")
 
 	if len(flag.Args()) == 0 {
@@ -73,46 +93,61 @@ func main() {
 	fmt.Fprintf(os.Stderr, "Creating files ")
 	for counter < *target || *target == 0 {
 		for _, fName := range flag.Args() {
-			func() {
-				chunks, err := chunker.Process(fName)
+			channels := []int{*channelFlag}
+			if *perChannel {
+				n, err := chunker.Channels(fName)
 				if err != nil {
-					log.Fatalf("Got error from chunker.Process: %v after %d created files", err, counter)
+					log.Fatalf("Got error from chunker.Channels: %v after %d created files", err, counter)
 				}
-				source := protocol.SourcePayload{
-					URL:         fmt.Sprintf("%s%s", urlPrefix, path.Base(fName)),
-					SegmentType: "silence",
-					Chunks:      chunks,
+				channels = []int{}
+				for c := 1; c <= n; c++ {
+					channels = append(channels, c)
 				}
-				for i, chunk := range source.Chunks {
-					id := createID(fName, i)
-					segment := protocol.SegmentPayload{
-						ID:          fmt.Sprintf("%v", id),
-						URL:         source.URL,
-						SegmentType: source.SegmentType,
-						Chunk:       chunk,
-					}
-					outFile := path.Join(outDir, fmt.Sprintf("%s.json", id))
-
-					json, err := json.MarshalIndent(segment, " ", " ")
+			}
+			for _, channel := range channels {
+				func() {
+					chunks, err := chunker.Process(fName, channel)
 					if err != nil {
-						log.Fatalf("Marshal failed: %v", err)
+						log.Fatalf("Got error from chunker.Process: %v after %d created files", err, counter)
 					}
-
-					file, err := os.Create(outFile)
-					if err != nil {
-						log.Fatal(err)
+					source := protocol.SourcePayload{
+						URL:         fmt.Sprintf("%s%s", urlPrefix, path.Base(fName)),
+						SegmentType: "silence",
+						Chunks:      chunks,
+						Channel:     channel,
 					}
-					defer file.Close()
-					file.Write(json)
-					//fmt.Fprintf(os.Stderr, "%s\n", outFile)
-					counterLock.Lock()
-					counter++
-					counterLock.Unlock()
-					if counter%100 == 0 {
-						fmt.Fprintf(os.Stderr, ".")
+					for i, chunk := range source.Chunks {
+						id := createID(fName, channel, i)
+						segment := protocol.SegmentPayload{
+							ID:          fmt.Sprintf("%v", id),
+							URL:         source.URL,
+							SegmentType: source.SegmentType,
+							Chunk:       chunk,
+							Channel:     source.Channel,
+						}
+						outFile := path.Join(outDir, fmt.Sprintf("%s.json", id))
+
+						json, err := json.MarshalIndent(segment, " ", " ")
+						if err != nil {
+							log.Fatalf("Marshal failed: %v", err)
+						}
+
+						file, err := os.Create(outFile)
+						if err != nil {
+							log.Fatal(err)
+						}
+						defer file.Close()
+						file.Write(json)
+						//fmt.Fprintf(os.Stderr, "%s\n", outFile)
+						counterLock.Lock()
+						counter++
+						counterLock.Unlock()
+						if counter%100 == 0 {
+							fmt.Fprintf(os.Stderr, ".")
+						}
 					}
-				}
-			}()
+				}()
+			}
 		}
 		if *target == 0 {
 			break
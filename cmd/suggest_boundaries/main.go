@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stts-se/segment_checker/dbapi"
+	"github.com/stts-se/segment_checker/modules"
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// audioSource returns the audio location used by the server for chunk extraction (see app_server), or false if it cannot be resolved without a running server
+func audioSource(db *dbapi.DBAPI, segmentURL string) (string, bool) {
+	if file, ok := db.AudioFile(segmentURL); ok {
+		return file, true
+	}
+	if strings.HasPrefix(segmentURL, "http") {
+		return segmentURL, true
+	}
+	return "", false
+}
+
+func main() {
+
+	cmd := "suggest_boundaries"
+
+	projectDir := flag.String("project", "", "Project `folder`")
+	outDirFlag := flag.String("outdir", "", "Output `directory` for the new source revision (default: <project>/source.suggested)")
+	replace := flag.Bool("replace", false, "Replace the project source data with the new revision (the current source folder is kept as source.<timestamp>)")
+	window := flag.Int64("window", modules.DefaultSuggestionWindow, "Search window before and after each boundary, in `milliseconds`")
+	segmentType := flag.String("segment_type", "", "Only process segments of this `type` (default: all segments)")
+	ffmpeg := flag.String("ffmpeg", "ffmpeg", "Ffmpeg command/path")
+
+	help := flag.Bool("help", false, "Print usage and exit")
+
+	flag.Parse()
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s <options>\n", cmd)
+		fmt.Fprintf(os.Stderr, "Suggests new segment boundaries (energy onset/offset, snapped to zero crossings) for all unchecked segments in a project, and writes them as a new source revision\n")
+		fmt.Fprintf(os.Stderr, "Segments with annotations (checked by a human) are copied unchanged. Changed segments are marked with provenance, including the original chunk.\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+	}
+
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	if *projectDir == "" {
+		fmt.Fprintf(os.Stderr, "Required flag project must be set\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *window < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid search window: %d\n", *window)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	db := dbapi.NewDBAPI(*projectDir)
+	err := db.LoadData()
+	if err != nil {
+		log.Fatalf("Couldn't load project data: %v", err)
+	}
+
+	outDir := *outDirFlag
+	if outDir == "" {
+		outDir = path.Join(*projectDir, "source.suggested")
+	}
+	if _, err := os.Stat(outDir); !os.IsNotExist(err) {
+		log.Fatalf("Output directory already exists: %s", outDir)
+	}
+	err = os.MkdirAll(outDir, os.ModePerm)
+	if err != nil {
+		log.Fatalf("Couldn't create output directory: %v", err)
+	}
+
+	modules.FfmpegCmd = *ffmpeg
+	chunkExtractor, err := modules.NewChunkExtractor()
+	if err != nil {
+		log.Fatalf("Couldn't initialize chunk extractor: %v", err)
+	}
+
+	files, err := filepath.Glob(path.Join(db.SourceDataDir, "*.json"))
+	if err != nil {
+		log.Fatalf("Couldn't list source files: %v", err)
+	}
+	checked := map[string]bool{}
+	for _, anno := range db.ListSegments(dbapi.StatusChecked, dbapi.Filter{}) {
+		checked[anno.ID] = true
+	}
+
+	timestamp := time.Now().Format("2006-01-02 15:04:05")
+	fmt.Fprintf(os.Stderr, "Project: %s\n", *projectDir)
+	fmt.Fprintf(os.Stderr, "Output directory: %s\n", outDir)
+	fmt.Fprintf(os.Stderr, "Search window: %d ms\n", *window)
+	fmt.Fprintf(os.Stderr, "Segments: %d\n", len(files))
+	fmt.Fprintf(os.Stderr, "\n")
+
+	changed, unchanged, annotated, failed := 0, 0, 0, 0
+	fmt.Fprintf(os.Stderr, "Suggesting boundaries ")
+	for i, f := range files {
+		if i > 0 && i%100 == 0 {
+			fmt.Fprintf(os.Stderr, ".")
+		}
+		bts, err := ioutil.ReadFile(f)
+		if err != nil {
+			log.Fatalf("Couldn't read segment file %s : %v", f, err)
+		}
+		var segment protocol.SegmentPayload
+		err = protocol.UnmarshalStrict(bts, &segment)
+		if err != nil {
+			log.Fatalf("Couldn't unmarshal segment file %s : %v", f, err)
+		}
+
+		switch {
+		case checked[segment.ID]:
+			annotated++
+		case *segmentType != "" && segment.SegmentType != *segmentType:
+			unchanged++
+		default:
+			url, ok := audioSource(db, segment.URL)
+			if !ok {
+				log.Printf("Skipping segment %s: cannot resolve relative URL %s", segment.ID, segment.URL)
+				failed++
+				break
+			}
+			suggestion, err := chunkExtractor.SuggestBoundariesForChunk(url, segment.Chunk, db.Channel(segment), *window)
+			if err != nil {
+				log.Printf("Couldn't suggest boundaries for segment %s: %v", segment.ID, err)
+				failed++
+				break
+			}
+			if suggestion.Chunk == segment.Chunk {
+				unchanged++
+				break
+			}
+			original := segment.Chunk
+			if segment.Provenance != nil && segment.Provenance.Original != nil {
+				// keep the chunk from before any automatic changes
+				original = *segment.Provenance.Original
+			}
+			segment.Chunk = suggestion.Chunk
+			segment.Provenance = &protocol.Provenance{
+				Source:    cmd,
+				Method:    suggestion.Method,
+				Timestamp: timestamp,
+				Original:  &original,
+			}
+			changed++
+		}
+
+		json, err := json.MarshalIndent(segment, " ", " ")
+		if err != nil {
+			log.Fatalf("Marshal failed: %v", err)
+		}
+		outFile := path.Join(outDir, path.Base(f))
+		err = ioutil.WriteFile(outFile, json, 0644)
+		if err != nil {
+			log.Fatalf("Couldn't write segment file %s : %v", outFile, err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, " done\nChanged %d segments, %d unchanged, %d annotated (copied unchanged), %d failed (copied unchanged)\n", changed, unchanged, annotated, failed)
+
+	if *replace {
+		backupDir := fmt.Sprintf("%s.%s", db.SourceDataDir, time.Now().Format("20060102-150405"))
+		err = os.Rename(db.SourceDataDir, backupDir)
+		if err != nil {
+			log.Fatalf("Couldn't move source data to %s : %v", backupDir, err)
+		}
+		err = os.Rename(outDir, db.SourceDataDir)
+		if err != nil {
+			log.Fatalf("Couldn't move new source data to %s : %v", db.SourceDataDir, err)
+		}
+		fmt.Fprintf(os.Stderr, "Replaced source data in %s (previous revision in %s)\n", db.SourceDataDir, backupDir)
+	} else {
+		fmt.Fprintf(os.Stderr, "New source revision in %s\n", outDir)
+	}
+}
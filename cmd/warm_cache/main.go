@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/stts-se/segment_checker/dbapi"
+	"github.com/stts-se/segment_checker/modules"
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// audioSource returns the audio location used by the server for chunk extraction (see app_server), or false if it cannot be resolved without a running server
+func audioSource(db *dbapi.DBAPI, segmentURL string) (string, bool) {
+	if file, ok := db.AudioFile(segmentURL); ok {
+		return file, true
+	}
+	if strings.HasPrefix(segmentURL, "http") {
+		return segmentURL, true
+	}
+	return "", false
+}
+
+func main() {
+
+	cmd := "warm_cache"
+
+	projectDir := flag.String("project", "", "Project `folder`")
+	cacheDir := flag.String("cache_dir", "", "Cache `folder` (same as the app_server cache_dir flag)")
+	cacheDiskSize := flag.Int64("cache_disk_size", 1000, "Max size of the on-disk audio chunk cache, in `MB`")
+	requestStatus := flag.String("status", "", "Only extract segments matching this request `status` (default: all segments)")
+	workers := flag.Int("workers", 4, "Number of parallel extractions")
+	ffmpeg := flag.String("ffmpeg", "ffmpeg", "Ffmpeg command/path")
+	accurate := flag.Bool("accurate", true, "Sample accurate audio extraction using ffmpeg (same as the app_server accurate flag)")
+	wavOutput := flag.Bool("wav", false, "Extract compressed audio as WAV (same as the app_server wav flag)")
+
+	help := flag.Bool("help", false, "Print usage and exit")
+
+	flag.Parse()
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s <options>\n", cmd)
+		fmt.Fprintf(os.Stderr, "Extracts the audio for all segments in a project into the audio chunk cache\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+	}
+
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	if *projectDir == "" || *cacheDir == "" {
+		fmt.Fprintf(os.Stderr, "Required flags project and cache_dir must be set\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *workers < 1 {
+		*workers = 1
+	}
+
+	db := dbapi.NewDBAPI(*projectDir)
+	err := db.LoadData()
+	if err != nil {
+		log.Fatalf("Couldn't load project data: %v", err)
+	}
+
+	modules.FfmpegCmd = *ffmpeg
+	chunkExtractor, err := modules.NewChunkExtractor()
+	if err != nil {
+		log.Fatalf("Couldn't initialize chunk extractor: %v", err)
+	}
+	chunkExtractor.SetAccurate(*accurate)
+	chunkExtractor.SetWavOutput(*wavOutput)
+	chunkExtractor.SetPlayback(db.Config().Playback)
+	// the memory tier is not used, since the process ends when the cache is warm
+	cache, err := modules.NewChunkCache(0, *cacheDir, *cacheDiskSize*1024*1024)
+	if err != nil {
+		log.Fatalf("Couldn't initialize chunk cache: %v", err)
+	}
+	chunkExtractor.SetCache(cache)
+
+	segments := db.ListSegments(*requestStatus, dbapi.Filter{})
+	fmt.Fprintf(os.Stderr, "Project: %s\n", *projectDir)
+	fmt.Fprintf(os.Stderr, "Cache dir: %s\n", *cacheDir)
+	fmt.Fprintf(os.Stderr, "Segments: %d\n", len(segments))
+	fmt.Fprintf(os.Stderr, "\n")
+
+	todo := make(chan protocol.AnnotationPayload)
+	var wg sync.WaitGroup
+	var counterLock sync.Mutex
+	extracted, failed, skipped := 0, 0, 0
+
+	fmt.Fprintf(os.Stderr, "Extracting chunks ")
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seg := range todo {
+				url, ok := audioSource(db, seg.URL)
+				if !ok {
+					log.Printf("Skipping segment %s: cannot resolve relative URL %s", seg.ID, seg.URL)
+					counterLock.Lock()
+					skipped++
+					counterLock.Unlock()
+					continue
+				}
+				context := db.Context(seg.SegmentType)
+				request := protocol.SplitRequestPayload{
+					URL:          url,
+					SegmentType:  seg.SegmentType,
+					Channel:      db.Channel(seg.SegmentPayload),
+					Chunk:        seg.Chunk,
+					LeftContext:  context,
+					RightContext: context,
+				}
+				// with the same analyses as the app_server, since they are cached with the audio
+				analysis := modules.Analysis{Contours: db.Contours(seg.SegmentType)}
+				if source, ok := db.SourceSegment(seg.ID); ok && db.Suggestions(seg.SegmentType) {
+					analysis.Suggestion = &source.Chunk
+				}
+				_, _, err := chunkExtractor.ExtractURLWithAnalysis(request, "", analysis)
+				counterLock.Lock()
+				if err != nil {
+					log.Printf("Couldn't extract segment %s: %v", seg.ID, err)
+					failed++
+				} else {
+					extracted++
+				}
+				if (extracted+failed)%100 == 0 {
+					fmt.Fprintf(os.Stderr, ".")
+				}
+				counterLock.Unlock()
+			}
+		}()
+	}
+	for _, seg := range segments {
+		todo <- seg
+	}
+	close(todo)
+	wg.Wait()
+
+	stats := cache.Stats()
+	fmt.Fprintf(os.Stderr, " done\nExtracted %d chunks (%d already cached), %d failed, %d skipped\n", extracted, stats.Hits, failed, skipped)
+	fmt.Fprintf(os.Stderr, "Cache size: %d chunks, %d bytes\n", stats.DiskEntries, stats.DiskBytes)
+}
@@ -8,10 +8,12 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/stts-se/segment_checker/log"
 	"github.com/stts-se/segment_checker/protocol"
@@ -23,10 +25,18 @@ const (
 
 type DBAPI struct {
 	ProjectDir, SourceDataDir, AnnotationDataDir string
+	// DerivedDataDir holds segments created by edit operations (split, merge, insert)
+	DerivedDataDir string
 
-	dbMutex        *sync.RWMutex // for db read/write (files and in-memory saves)
+	dbMutex *sync.RWMutex // for db read/write (files and in-memory saves)
+	// sourceData holds the source segments, and the derived segments (each after its parents)
 	sourceData     []protocol.SegmentPayload
 	annotationData map[string]protocol.AnnotationPayload
+	config         protocol.ProjectConfig
+	// lastEdit is the time of the latest edit, see editTimestamp
+	lastEdit time.Time
+	// audioProbe reads the audio metadata for a segment URL (optional, see SetAudioProbe)
+	audioProbe func(segmentURL string) (protocol.AudioInfo, error)
 
 	lockMapMutex *sync.RWMutex     // for segment locking
 	lockMap      map[string]string // segment id -> user
@@ -37,6 +47,7 @@ func NewDBAPI(projectDir string) *DBAPI {
 		ProjectDir:        projectDir,
 		SourceDataDir:     path.Join(projectDir, "source"),
 		AnnotationDataDir: path.Join(projectDir, "annotation"),
+		DerivedDataDir:    path.Join(projectDir, "derived"),
 
 		dbMutex:        &sync.RWMutex{},
 		sourceData:     []protocol.SegmentPayload{},
@@ -48,10 +59,31 @@ func NewDBAPI(projectDir string) *DBAPI {
 	return &res
 }
 
+// ProjectName returns the display name of the project, from the project config, or else the name of the project folder
 func (api *DBAPI) ProjectName() string {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	if api.config.Name != "" {
+		return api.config.Name
+	}
 	return path.Base(api.ProjectDir)
 }
 
+// AudioFormats returns the audio file formats (file extensions) used in the project
+func (api *DBAPI) AudioFormats() []string {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	res := []string{}
+	for _, seg := range api.sourceData {
+		ext := strings.TrimPrefix(path.Ext(strings.Split(seg.URL, "?")[0]), ".")
+		if ext != "" && !contains(res, ext) {
+			res = append(res, ext)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
 func (api *DBAPI) LoadData() error {
 	var err error
 
@@ -64,6 +96,9 @@ func (api *DBAPI) LoadData() error {
 	if api.AnnotationDataDir == "" {
 		return fmt.Errorf("annotation dir not set")
 	}
+	if api.DerivedDataDir == "" {
+		return fmt.Errorf("derived dir not set")
+	}
 
 	info, err := os.Stat(api.ProjectDir)
 	if os.IsNotExist(err) {
@@ -92,20 +127,57 @@ func (api *DBAPI) LoadData() error {
 		return fmt.Errorf("annotation dir is not a directory: %s", api.AnnotationDataDir)
 	}
 
-	api.dbMutex.RLock()
-	defer api.dbMutex.RUnlock()
+	info, err = os.Stat(api.DerivedDataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(api.DerivedDataDir, 0700)
+		if err != nil {
+			return fmt.Errorf("failed to create derived folder %s : %v", api.DerivedDataDir, err)
+		}
+		log.Info("dbapi Created derived dir %s", api.DerivedDataDir)
+	} else if !info.IsDir() {
+		return fmt.Errorf("derived dir is not a directory: %s", api.DerivedDataDir)
+	}
+
+	api.dbMutex.Lock()
+	defer api.dbMutex.Unlock()
 	api.sourceData, err = api.LoadSourceData()
 	if err != nil {
 		return err
 	}
 	log.Info("dbapi Loaded %d source files", len(api.sourceData))
 
+	// the default statuses depend on the source data (see LoadProjectConfig)
+	api.config, err = api.LoadProjectConfig()
+	if err != nil {
+		return err
+	}
+
+	derived, err := api.LoadDerivedData()
+	if err != nil {
+		return err
+	}
+	for _, seg := range derived {
+		if t, err := parseEditTimestamp(seg.Derivation.Timestamp); err == nil && t.After(api.lastEdit) {
+			api.lastEdit = t
+		}
+	}
+	err = api.addDerived(derived)
+	if err != nil {
+		return fmt.Errorf("data validation failed : %v", err)
+	}
+	log.Info("dbapi Loaded %d derived files", len(derived))
+
 	api.annotationData, err = api.LoadAnnotationData()
 	if err != nil {
 		return err
 	}
 	log.Info("dbapi Loaded %d annotation files", len(api.annotationData))
 
+	err = api.recoverEdits()
+	if err != nil {
+		return fmt.Errorf("data validation failed : %v", err)
+	}
+
 	err = api.validateData()
 	if err != nil {
 		return fmt.Errorf("data validation failed : %v", err)
@@ -134,40 +206,92 @@ func (api *DBAPI) validateData() error {
 		return fmt.Errorf("found no segments in source data")
 	}
 	sourceMap := map[string]protocol.SegmentPayload{}
-	segTypes := []string{}
 	for _, seg := range api.sourceData {
 		sourceMap[seg.ID] = seg
-		if !contains(segTypes, seg.SegmentType) {
-			segTypes = append(segTypes, seg.SegmentType)
-		}
-	}
-	if len(segTypes) != 1 {
-		return fmt.Errorf("source data contains mixed segment types: %v", strings.Join(segTypes, ", "))
 	}
 	for id, anno := range api.annotationData {
 		seg, segExists := sourceMap[id]
 		if !segExists {
 			return fmt.Errorf("annotation data with id %s not found in source data", id)
 		}
-		if anno.URL != seg.URL {
-			return fmt.Errorf("annotation data has a different URL than source data: %s vs %s", anno.URL, seg.URL)
+		if err := validateAnnotationAgainstSource(anno, seg); err != nil {
+			return err
 		}
-		if anno.ID != seg.ID {
-			return fmt.Errorf("annotation data has a different ID than source data: %s vs %s", anno.ID, seg.ID)
+		// replaced annotations can't be saved again
+		if anno.CurrentStatus.Name != StatusReplaced {
+			if err := api.checkStatusAndLabels(anno); err != nil {
+				return fmt.Errorf("%v (the statuses and labels of the annotations must be configured in %s)", err, ProjectConfigFile)
+			}
 		}
-		if anno.SegmentType != seg.SegmentType {
-			return fmt.Errorf("annotation data has a different segment type than source data: %s vs %s", anno.SegmentType, seg.SegmentType)
+	}
+	for _, seg := range api.sourceData {
+		if seg.Derivation != nil {
+			if err := api.validateDerivation(seg, sourceMap); err != nil {
+				return err
+			}
+			if err := api.validateReplaced(seg, sourceMap); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
+func validateAnnotationAgainstSource(anno protocol.AnnotationPayload, seg protocol.SegmentPayload) error {
+	if anno.URL != seg.URL {
+		return fmt.Errorf("annotation data has a different URL than source data: %s vs %s", anno.URL, seg.URL)
+	}
+	if anno.ID != seg.ID {
+		return fmt.Errorf("annotation data has a different ID than source data: %s vs %s", anno.ID, seg.ID)
+	}
+	if anno.SegmentType != seg.SegmentType {
+		return fmt.Errorf("annotation data has a different segment type than source data: %s vs %s", anno.SegmentType, seg.SegmentType)
+	}
+	if anno.Channel != seg.Channel {
+		return fmt.Errorf("annotation data has a different channel than source data: %d vs %d", anno.Channel, seg.Channel)
+	}
+	return nil
+}
+
+// Context returns the default audio context (in milliseconds, before and after the segment) for the segment type, from the segment type settings of the project config, or else the project's default context
+func (api *DBAPI) Context(segmentType string) int64 {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	return api.context(segmentType)
+}
+
+// context returns the default audio context for the segment type, see Context (api.dbMutex should be locked)
+func (api *DBAPI) context(segmentType string) int64 {
+	if ctx := api.config.SegmentTypes[segmentType].Context; ctx > 0 {
+		return ctx
+	}
+	return api.config.Context
+}
+
+// AudioFile returns the local file path for a segment URL referring to the project's audio folder (/audio/<file>).
+// For other URLs, it returns false.
+func (api *DBAPI) AudioFile(segmentURL string) (string, bool) {
+	rel := strings.TrimPrefix(segmentURL, "/")
+	if !strings.HasPrefix(rel, "audio/") {
+		return "", false
+	}
+	fileName := strings.TrimPrefix(rel, "audio/")
+	if fileName == "" || strings.Contains(fileName, "/") || strings.Contains(fileName, "?") {
+		return "", false
+	}
+	res, err := filepath.Abs(filepath.Join(api.ProjectDir, "audio", fileName))
+	if err != nil {
+		return "", false
+	}
+	return res, true
+}
+
 func testURLAccess(buildURL func(string) string, segment protocol.SegmentPayload) error {
 	urlResp, err := http.Get(buildURL(segment.URL))
-	defer urlResp.Body.Close()
 	if err != nil {
 		return fmt.Errorf("audio URL %s not reachable : %v", segment.URL, err)
 	}
+	defer urlResp.Body.Close()
 	if urlResp.StatusCode != http.StatusOK {
 		return fmt.Errorf("audio URL %s not reachable (status %s)", segment.URL, urlResp.Status)
 	}
@@ -183,6 +307,79 @@ func (api *DBAPI) TestURLAccess(buildURL func(string) string) error {
 	return nil
 }
 
+// SetAudioProbe sets the function used to read the audio metadata for a segment URL, to check that chunks are inside their audio files (see TestChunkBounds).
+// If set, the chunks of saved and inserted segments are also checked.
+func (api *DBAPI) SetAudioProbe(probe func(segmentURL string) (protocol.AudioInfo, error)) {
+	api.dbMutex.Lock()
+	defer api.dbMutex.Unlock()
+	api.audioProbe = probe
+}
+
+// chunkInBounds checks that the chunk and channel of the segment are inside the audio file (api.dbMutex should be locked)
+func (api *DBAPI) chunkInBounds(segment protocol.SegmentPayload, info protocol.AudioInfo) error {
+	// allow for rounding to milliseconds
+	if float64(segment.Chunk.End) > info.Duration+1 {
+		return fmt.Errorf("chunk end %d for segment %s is beyond the end of the audio file %s (%.0f ms)", segment.Chunk.End, segment.ID, segment.URL, info.Duration)
+	}
+	if channel := api.channel(segment); channel > info.Channels {
+		return fmt.Errorf("channel %d for segment %s is not in the audio file %s (%d channels)", channel, segment.ID, segment.URL, info.Channels)
+	}
+	return nil
+}
+
+// checkChunkBounds checks the chunk of a segment to be saved against its audio file, if an audio probe is set. Audio files that cannot be probed are not checked. (api.dbMutex should be locked)
+func (api *DBAPI) checkChunkBounds(segment protocol.SegmentPayload) error {
+	if api.audioProbe == nil {
+		return nil
+	}
+	info, err := api.audioProbe(segment.URL)
+	if err != nil {
+		log.Warning("Couldn't check chunk bounds for audio URL %s : %v", segment.URL, err)
+		return nil
+	}
+	if err := api.chunkInBounds(segment, info); err != nil {
+		return newError(protocol.ErrorInvalidPayload, map[string]string{"segment_id": segment.ID}, "%v", err)
+	}
+	return nil
+}
+
+// TestChunkBounds checks that all source chunks, and the chunks of saved annotations, are inside their audio files, using the audio probe (see SetAudioProbe).
+// Audio files that cannot be probed are skipped, with a warning.
+func (api *DBAPI) TestChunkBounds() error {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	if api.audioProbe == nil {
+		return fmt.Errorf("no audio probe set")
+	}
+	infos := make(map[string]protocol.AudioInfo)
+	failed := make(map[string]bool)
+	for _, seg := range api.sourceData {
+		if failed[seg.URL] {
+			continue
+		}
+		info, ok := infos[seg.URL]
+		if !ok {
+			var err error
+			info, err = api.audioProbe(seg.URL)
+			if err != nil {
+				log.Warning("Couldn't check chunk bounds for audio URL %s : %v", seg.URL, err)
+				failed[seg.URL] = true
+				continue
+			}
+			infos[seg.URL] = info
+		}
+		if err := api.chunkInBounds(seg, info); err != nil {
+			return err
+		}
+		if anno, ok := api.annotationData[seg.ID]; ok {
+			if err := api.chunkInBounds(anno.SegmentPayload, info); err != nil {
+				return fmt.Errorf("annotation data : %v", err)
+			}
+		}
+	}
+	return nil
+}
+
 func validateSegment(segment protocol.SegmentPayload) error {
 	if segment.ID == "" {
 		return fmt.Errorf("no id")
@@ -197,6 +394,15 @@ func validateSegment(segment protocol.SegmentPayload) error {
 	if segment.URL == "" {
 		return fmt.Errorf("no URL")
 	}
+	if segment.Channel < 0 {
+		return fmt.Errorf("invalid channel %d", segment.Channel)
+	}
+	if p := segment.Provenance; p != nil && (p.Source == "" || p.Timestamp == "") {
+		return fmt.Errorf("provenance requires source and timestamp, found %#v", *p)
+	}
+	if _, ok := segment.Meta[""]; ok {
+		return fmt.Errorf("empty key in meta")
+	}
 	// urlResp, err := http.Get(segment.URL)
 	// if err != nil {
 	// 	return fmt.Errorf("audio URL %s not reachable : %v", segment.URL, err)
@@ -238,14 +444,17 @@ func (api *DBAPI) LoadSourceData() ([]protocol.SegmentPayload, error) {
 				return res, fmt.Errorf("couldn't read segment file %s : %v", f, err)
 			}
 			var segment protocol.SegmentPayload
-			err = json.Unmarshal(bts, &segment)
+			err = protocol.UnmarshalStrict(bts, &segment)
 			if err != nil {
-				return res, fmt.Errorf("couldn't unmarshal segment file %s: %v", f, err)
+				return res, fmt.Errorf("couldn't unmarshal segment file %s : %v", f, err)
 			}
 			err = validateSegment(segment)
 			if err != nil {
 				return res, fmt.Errorf("invalid segment file %s : %v", f, err)
 			}
+			if segment.Derivation != nil {
+				return res, fmt.Errorf("invalid segment file %s : source segments can not have a derivation", f)
+			}
 			if _, seen := seenIDs[segment.ID]; seen {
 				return res, fmt.Errorf("duplicate ids for source data: %s", segment.ID)
 			}
@@ -266,7 +475,7 @@ func (api *DBAPI) LoadAnnotationData() (map[string]protocol.AnnotationPayload, e
 				return res, fmt.Errorf("couldn't read annotation file %s : %v", f, err)
 			}
 			var annotation protocol.AnnotationPayload
-			err = json.Unmarshal(bts, &annotation)
+			err = protocol.UnmarshalStrict(bts, &annotation)
 			if err != nil {
 				return res, fmt.Errorf("couldn't unmarshal annotation file %s : %v", f, err)
 			}
@@ -283,6 +492,7 @@ func (api *DBAPI) LoadAnnotationData() (map[string]protocol.AnnotationPayload, e
 	return res, nil
 }
 
+// ListUncheckedSegments returns the segments without annotation (api.dbMutex should be locked)
 func (api *DBAPI) ListUncheckedSegments() []protocol.SegmentPayload {
 	res := []protocol.SegmentPayload{}
 	for _, seg := range api.sourceData {
@@ -293,29 +503,166 @@ func (api *DBAPI) ListUncheckedSegments() []protocol.SegmentPayload {
 	return res
 }
 
+// Filter holds optional segment criteria, in addition to the request status
+type Filter struct {
+	// SegmentType matches segments of the segment type
+	SegmentType string
+	// Meta matches segments with the metadata values, see protocol.Meta.Match
+	Meta map[string]string
+	// Text matches segments with a text matching the regular expression
+	Text *regexp.Regexp
+}
+
+// Match returns true if the annotation matches all criteria of the filter
+func (f Filter) Match(annotation protocol.AnnotationPayload) bool {
+	if f.SegmentType != "" && annotation.SegmentType != f.SegmentType {
+		return false
+	}
+	if !annotation.Meta.Match(f.Meta) {
+		return false
+	}
+	if f.Text != nil && !f.Text.MatchString(annotation.Text) {
+		return false
+	}
+	return true
+}
+
+// ListSegments returns all segments matching the request status and filter, as annotations (unchecked segments are returned with status unchecked)
+func (api *DBAPI) ListSegments(requestStatus string, filter Filter) []protocol.AnnotationPayload {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	res := []protocol.AnnotationPayload{}
+	for i, seg := range api.sourceData {
+		annotation := api.annotationFromSegment(seg)
+		if requestStatus != StatusEmpty && !api.statusMatch(requestStatus, annotation.CurrentStatus.Name, annotation.Labels) {
+			continue
+		}
+		if !filter.Match(annotation) {
+			continue
+		}
+		annotation.Index = int64(i + 1)
+		res = append(res, annotation)
+	}
+	return res
+}
+
+// GetSegment returns the segment with the specified id, as an annotation (an unchecked segment is returned with status unchecked)
+func (api *DBAPI) GetSegment(segmentID string) (protocol.AnnotationPayload, error) {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	for i, seg := range api.sourceData {
+		if seg.ID == segmentID {
+			annotation := api.annotationFromSegment(seg)
+			annotation.Index = int64(i + 1)
+			return annotation, nil
+		}
+	}
+	return protocol.AnnotationPayload{}, newError(protocol.ErrorNotFound, map[string]string{"segment_id": segmentID}, "no segment with id %s", segmentID)
+}
+
+// SourceSegment returns the source data for the segment with the specified id (i.e., the segment before any annotation)
+func (api *DBAPI) SourceSegment(segmentID string) (protocol.SegmentPayload, bool) {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	return api.sourceSegment(segmentID)
+}
+
+func (api *DBAPI) sourceSegment(segmentID string) (protocol.SegmentPayload, bool) {
+	for _, seg := range api.sourceData {
+		if seg.ID == segmentID {
+			return seg, true
+		}
+	}
+	return protocol.SegmentPayload{}, false
+}
+
+// Neighbours returns the other segments from the same audio URL and channel as the segment, overlapping the window (milliseconds), sorted by start time.
+// Annotated segments are returned with their annotated chunk and status, other segments with their source chunk and status unchecked.
+func (api *DBAPI) Neighbours(segment protocol.SegmentPayload, window protocol.Chunk) []protocol.Neighbour {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	res := []protocol.Neighbour{}
+	channel := api.channel(segment)
+	for _, seg := range api.sourceData {
+		if seg.ID == segment.ID || seg.URL != segment.URL || api.channel(seg) != channel {
+			continue
+		}
+		anno := api.annotationFromSegment(seg)
+		if anno.CurrentStatus.Name == StatusReplaced || anno.Chunk.End <= window.Start || anno.Chunk.Start >= window.End {
+			continue
+		}
+		res = append(res, protocol.Neighbour{
+			ID:     anno.ID,
+			Chunk:  anno.Chunk,
+			Status: anno.CurrentStatus.Name,
+			Labels: anno.Labels,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Chunk.Start < res[j].Chunk.Start })
+	return res
+}
+
+// SegmentTypes returns the segment types used in the project, sorted by name
+func (api *DBAPI) SegmentTypes() []protocol.SegmentTypePayload {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	counts := map[string]int{}
+	for _, seg := range api.sourceData {
+		if _, seen := counts[seg.SegmentType]; !seen {
+			counts[seg.SegmentType] = 0
+		}
+		if anno, ok := api.annotationData[seg.ID]; !ok || anno.CurrentStatus.Name != StatusReplaced {
+			counts[seg.SegmentType]++
+		}
+	}
+	res := []protocol.SegmentTypePayload{}
+	for name, n := range counts {
+		res = append(res, protocol.SegmentTypePayload{
+			Name:    name,
+			Context: api.context(name),
+			Labels:  api.config.SegmentTypes[name].Labels,
+			Count:   n,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// HasURL returns true if the audio URL is used by any segment in the project
+func (api *DBAPI) HasURL(url string) bool {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	for _, seg := range api.sourceData {
+		if seg.URL == url {
+			return true
+		}
+	}
+	return false
+}
+
 func (api *DBAPI) Unlock(segmentID, user string) error {
 	log.Info("dbapi Unlock %s %s", segmentID, user)
 	api.lockMapMutex.Lock()
 	defer api.lockMapMutex.Unlock()
 	lockedBy, locked := api.lockMap[segmentID]
 	if !locked {
-		return fmt.Errorf("%v is not locked", segmentID)
+		return newError(protocol.ErrorNotLocked, map[string]string{"segment_id": segmentID}, "%v is not locked", segmentID)
 	}
 	if lockedBy != user {
-		return fmt.Errorf("%v is not locked by user %s", segmentID, user)
+		return newError(protocol.ErrorLocked, map[string]string{"segment_id": segmentID, "locked_by": lockedBy}, "%v is not locked by user %s", segmentID, user)
 	}
 	delete(api.lockMap, segmentID)
 	return nil
 }
 
 func (api *DBAPI) UnlockAll(user string) (int, error) {
+	log.Info("dbapi UnlockAll %s", user)
+	api.lockMapMutex.Lock()
+	defer api.lockMapMutex.Unlock()
 	n := 0
 	for k, v := range api.lockMap {
 		if v == user {
-			err := api.Unlock(k, v)
-			if err != nil {
-				return n, err
-			}
+			delete(api.lockMap, k)
 			n++
 		}
 	}
@@ -329,32 +676,42 @@ func (api *DBAPI) Locked(segmentID string) bool {
 	return res
 }
 
+// LockedBy returns the name of the user holding the lock for the segment, if the segment is locked
+func (api *DBAPI) LockedBy(segmentID string) (string, bool) {
+	api.lockMapMutex.RLock()
+	defer api.lockMapMutex.RUnlock()
+	user, res := api.lockMap[segmentID]
+	return user, res
+}
+
 func (api *DBAPI) Lock(segmentID, user string) error {
 	log.Info("dbapi Lock %s %s", segmentID, user)
 	api.lockMapMutex.Lock()
 	defer api.lockMapMutex.Unlock()
 	lockedBy, locked := api.lockMap[segmentID]
 	if locked {
-		return fmt.Errorf("%v is already locked by user %s", segmentID, lockedBy)
+		return newError(protocol.ErrorLocked, map[string]string{"segment_id": segmentID, "locked_by": lockedBy}, "%v is already locked by user %s", segmentID, lockedBy)
 	}
 	api.lockMap[segmentID] = user
 	return nil
 }
 
+// CheckedSegmentStats returns the number of annotated segments (not counting replaced segments), and stats by status, additional label, user, comment and text edits (api.dbMutex should be locked)
 func (api *DBAPI) CheckedSegmentStats() (int, map[string]int) {
 	res := map[string]int{}
+	n := 0
 	for _, anno := range api.annotationData {
-		badSample := false
-		for _, l := range anno.Labels {
-			if l == StatusBadSample {
-				badSample = true
-			}
+		if anno.CurrentStatus.Name == StatusReplaced {
+			res["status:"+StatusReplaced]++
+			continue
 		}
+		n++
 		status := anno.CurrentStatus
-		if badSample {
-			res["status:bad sample"]++
-		} else {
-			res["status:"+status.Name]++
+		res["status:"+api.displayStatus(status.Name, anno.Labels)]++
+		for _, l := range anno.Labels {
+			if contains(api.config.Labels, l) {
+				res["label:"+l]++
+			}
 		}
 		if len(status.Source) > 0 {
 			res["checked by:"+status.Source]++
@@ -362,19 +719,22 @@ func (api *DBAPI) CheckedSegmentStats() (int, map[string]int) {
 		if strings.TrimSpace(anno.Comment) != "" {
 			res["comment"]++
 		}
+		if len(anno.TextHistory) > 0 {
+			res["text edited"]++
+		}
 	}
-	return len(api.annotationData), res
+	return n, res
 }
 
 func (api *DBAPI) Stats() (map[string]int, error) {
-	allSegs, err := api.LoadSourceData()
-	if err != nil {
-		return map[string]int{}, fmt.Errorf("couldn't list segments: %v", err)
-	}
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
 	checkableSegs := api.ListUncheckedSegments()
 	nChecked, checkedStats := api.CheckedSegmentStats()
+	api.lockMapMutex.RLock()
+	defer api.lockMapMutex.RUnlock()
 	res := map[string]int{
-		"total":     len(allSegs),
+		"total":     len(api.sourceData),
 		"checked":   nChecked,
 		"unchecked": len(checkableSegs),
 		"locked":    len(api.lockMap),
@@ -382,6 +742,29 @@ func (api *DBAPI) Stats() (map[string]int, error) {
 	for label, count := range checkedStats {
 		res[label] = count
 	}
+	for _, seg := range api.sourceData {
+		if seg.Derivation != nil {
+			res["derived:"+seg.Derivation.Operation]++
+		}
+		anno, annoExists := api.annotationData[seg.ID]
+		if annoExists && anno.CurrentStatus.Name == StatusReplaced {
+			continue
+		}
+		res["type:"+seg.SegmentType]++
+		if !annoExists {
+			res["type:"+seg.SegmentType+" (unchecked)"]++
+		}
+		for _, key := range api.config.MetaStats {
+			value, ok := seg.Meta.Value(key)
+			if !ok {
+				continue
+			}
+			res[fmt.Sprintf("meta:%s=%s", key, value)]++
+			if !annoExists {
+				res[fmt.Sprintf("meta:%s=%s (unchecked)", key, value)]++
+			}
+		}
+	}
 	for _, user := range api.lockMap {
 		res["locked by:"+user]++
 	}
@@ -393,32 +776,31 @@ const (
 	StatusSkip      = "skip"
 	StatusOK        = "ok"
 	StatusBadSample = "bad sample"
+	// StatusRejected is for segments that should not be segments, such as false positives from the silence detector
+	StatusRejected = "rejected"
+	// StatusDeleted is for segments that should be removed for other reasons, such as segments inserted by mistake
+	StatusDeleted = "deleted"
+	// StatusTextVerified is for segments with checked boundaries and a checked (or corrected) text
+	StatusTextVerified = "text verified"
+	// StatusReplaced is set for segments that have been split or merged (by Edit), and can not be annotated
+	StatusReplaced = "replaced"
 
 	StatusChecked = "checked"
 	StatusAny     = "any"
 	StatusEmpty   = ""
 )
 
-func statusMatch(requestStatus string, actualStatus string, labels []string) bool {
-	badSample := false
-	for _, l := range labels {
-		if l == StatusBadSample {
-			badSample = true
-		}
-	}
+// statusMatch returns true if the request status matches the status: the request status is checked, any, or the display name of the status (see displayStatus) (api.dbMutex should be locked)
+func (api *DBAPI) statusMatch(requestStatus string, actualStatus string, labels []string) bool {
 	switch requestStatus {
 	case StatusChecked:
-		return actualStatus != StatusUnchecked && actualStatus != StatusEmpty
+		return actualStatus != StatusUnchecked && actualStatus != StatusEmpty && actualStatus != StatusReplaced
 	case StatusAny:
-		return true
-	case StatusBadSample:
-		return badSample
-	case StatusSkip:
-		return !badSample && actualStatus == StatusSkip
+		// replaced segments are only listed on request
+		return actualStatus != StatusReplaced
 	default:
-		return actualStatus == requestStatus
+		return api.displayStatus(actualStatus, labels) == requestStatus
 	}
-	return false
 }
 
 func abs(i int64) int64 {
@@ -431,6 +813,12 @@ func abs(i int64) int64 {
 func (api *DBAPI) annotationFromSegment(segment protocol.SegmentPayload) protocol.AnnotationPayload {
 	annotation, exists := api.annotationData[segment.ID]
 	if exists {
+		// the metadata is read from the source data (annotations saved before metadata was added to the source data don't have it)
+		annotation.Meta = segment.Meta
+		// the text is the source text, unless changed by an annotator
+		if len(annotation.TextHistory) == 0 {
+			annotation.Text = segment.Text
+		}
 		return annotation
 	}
 	return protocol.AnnotationPayload{
@@ -439,8 +827,42 @@ func (api *DBAPI) annotationFromSegment(segment protocol.SegmentPayload) protoco
 	}
 }
 
-// GetNextSegment returns an annotation based on the query request. If an error is found, it returns an empty annotation, and an error. If an error is not found, but there is no segment to be found, a message will be returned.
-func (api *DBAPI) GetNextSegment(query protocol.QueryPayload, currentlyLockedID string, lockOnLoad bool) (protocol.AnnotationPayload, string, error) {
+// urlOrder returns the indices (in the source data) of the segments with the audio URL, ordered by start time (api.dbMutex should be locked)
+func (api *DBAPI) urlOrder(url string) []int {
+	res := []int{}
+	for i, seg := range api.sourceData {
+		if seg.URL == url {
+			res = append(res, i)
+		}
+	}
+	sort.SliceStable(res, func(a, b int) bool {
+		return api.annotationFromSegment(api.sourceData[res[a]]).Chunk.Start < api.annotationFromSegment(api.sourceData[res[b]]).Chunk.Start
+	})
+	return res
+}
+
+// SegmentsForURL returns the segments (as annotations) for the audio URL matching the request status and filter, ordered by start time. All segments are returned if the request status and filter are empty.
+func (api *DBAPI) SegmentsForURL(url string, requestStatus string, filter Filter) []protocol.AnnotationPayload {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	res := []protocol.AnnotationPayload{}
+	for _, i := range api.urlOrder(url) {
+		annotation := api.annotationFromSegment(api.sourceData[i])
+		if requestStatus != StatusEmpty && !api.statusMatch(requestStatus, annotation.CurrentStatus.Name, annotation.Labels) {
+			continue
+		}
+		if !filter.Match(annotation) {
+			continue
+		}
+		annotation.Index = int64(i + 1)
+		res = append(res, annotation)
+	}
+	return res
+}
+
+// GetNextSegment returns an annotation based on the query request. If no segment can be returned, it returns an empty annotation and an error.
+// The error is an *Error, with code protocol.ErrorNoMatch if no segment matches the query.
+func (api *DBAPI) GetNextSegment(query protocol.QueryPayload, currentlyLockedID string, lockOnLoad bool) (protocol.AnnotationPayload, error) {
 	log.Info("dbapi GetNextSegment")
 	api.dbMutex.RLock()
 	defer api.dbMutex.RUnlock()
@@ -449,47 +871,121 @@ func (api *DBAPI) GetNextSegment(query protocol.QueryPayload, currentlyLockedID
 		log.Debug("dbapi GetNextSegment query: %#v", query)
 	}
 
-	var currIndex int
+	// the segments to step through, as indices in the source data
+	order := make([]int, len(api.sourceData))
+	for i := range order {
+		order[i] = i
+	}
+	if query.URL != "" {
+		order = api.urlOrder(query.URL)
+		if len(order) == 0 {
+			return protocol.AnnotationPayload{}, newError(protocol.ErrorNotFound, map[string]string{"url": query.URL}, "no segments for url %s", query.URL)
+		}
+	}
+	if len(query.Meta) > 0 {
+		filtered := []int{}
+		for _, i := range order {
+			if api.sourceData[i].Meta.Match(query.Meta) {
+				filtered = append(filtered, i)
+			}
+		}
+		if len(filtered) == 0 {
+			return protocol.AnnotationPayload{}, newError(protocol.ErrorNoMatch, map[string]string{"request_status": query.RequestStatus}, "no segments matching metadata %v", query.Meta)
+		}
+		order = filtered
+	}
+	if query.SegmentType != "" {
+		filtered := []int{}
+		for _, i := range order {
+			if api.sourceData[i].SegmentType == query.SegmentType {
+				filtered = append(filtered, i)
+			}
+		}
+		if len(filtered) == 0 {
+			return protocol.AnnotationPayload{}, newError(protocol.ErrorNoMatch, map[string]string{"request_status": query.RequestStatus, "segment_type": query.SegmentType}, "no segments of type %s", query.SegmentType)
+		}
+		order = filtered
+	}
+	var text *regexp.Regexp
+	if query.Text != "" {
+		var err error
+		text, err = regexp.Compile(query.Text)
+		if err != nil {
+			return protocol.AnnotationPayload{}, newError(protocol.ErrorInvalidPayload, map[string]string{"text": query.Text}, "invalid text search : %v", err)
+		}
+	}
+	// the current segment may be outside of the order, when starting to use a filter
+	filtered := query.URL != "" || len(query.Meta) > 0 || query.SegmentType != ""
+
+	var currPos int
 	var seenCurrID int64
 	if query.RequestIndex != "" {
+		// the segments matching the filters of the query
+		matching := order
+		if text != nil {
+			matching = []int{}
+			for _, i := range order {
+				if text.MatchString(api.annotationFromSegment(api.sourceData[i]).Text) {
+					matching = append(matching, i)
+				}
+			}
+			if len(matching) == 0 {
+				return protocol.AnnotationPayload{}, newError(protocol.ErrorNoMatch, map[string]string{"request_index": query.RequestIndex, "text": query.Text}, "no segments with a text matching %s", query.Text)
+			}
+		}
 		var i int
 		if query.RequestIndex == "first" {
-			i = 0
+			i = matching[0]
 		} else if query.RequestIndex == "last" {
-			i = len(api.sourceData) - 1
+			i = matching[len(matching)-1]
 		} else {
 			reqI, err := strconv.Atoi(query.RequestIndex)
 			if err == nil && reqI >= 0 && reqI < len(api.sourceData) {
 				i = reqI
 			} else {
-				return protocol.AnnotationPayload{}, "", fmt.Errorf("invalid request index: %s", query.RequestIndex)
+				return protocol.AnnotationPayload{}, newError(protocol.ErrorInvalidIndex, map[string]string{"request_index": query.RequestIndex}, "invalid request index: %s", query.RequestIndex)
+			}
+			// the index is in the source data, but the segment must match the filters of the query
+			if !containsInt(matching, i) {
+				return protocol.AnnotationPayload{}, newError(protocol.ErrorNoMatch, map[string]string{"request_index": query.RequestIndex}, "segment at request index %s doesn't match the query", query.RequestIndex)
 			}
 		}
 		segment := api.sourceData[i]
 		if segment.ID == currentlyLockedID {
-			return protocol.AnnotationPayload{}, "user is already at the requested segment", nil
+			return protocol.AnnotationPayload{}, newError(protocol.ErrorConflict, map[string]string{"segment_id": segment.ID}, "user is already at the requested segment")
 		}
 		annotation := api.annotationFromSegment(segment)
 		if lockOnLoad {
 			err := api.Lock(annotation.ID, query.UserName)
 			if err != nil {
-				return protocol.AnnotationPayload{}, "segment is already locked", nil
+				return protocol.AnnotationPayload{}, newError(protocol.ErrorLocked, ErrorDetails(err), "segment is already locked")
 			}
 		}
 		annotation.Index = int64(i + 1)
-		return annotation, "", nil
+		return annotation, nil
 	} else if query.CurrID != "" {
 		seenCurrID = int64(-1)
-		for i, segment := range api.sourceData {
-			if segment.ID == query.CurrID {
-				currIndex = i
+		found := false
+		for pos, i := range order {
+			if api.sourceData[i].ID == query.CurrID {
+				currPos = pos
+				found = true
+			}
+		}
+		if !found && filtered {
+			// entering a recording from another one (or a segment not matching the metadata or segment type filter): start at the first (or last) segment
+			seenCurrID = int64(0)
+			query.CurrID = ""
+			if query.StepSize < 0 {
+				currPos = len(order) - 1
 			}
 		}
 	} else {
 		seenCurrID = int64(0)
-		currIndex = 0
+		currPos = 0
 	}
-	for i := currIndex; i >= 0 && i < len(api.sourceData); {
+	for pos := currPos; pos >= 0 && pos < len(order); {
+		i := order[pos]
 		segment := api.sourceData[i]
 		if seenCurrID < 0 && segment.ID == query.CurrID {
 			seenCurrID = 0
@@ -501,39 +997,101 @@ func (api *DBAPI) GetNextSegment(query protocol.QueryPayload, currentlyLockedID
 			if debug {
 				log.Debug("dbapi GetNextSegment index=%v seenCurrID=%v segment.ID=%v stepSize=%v status=%v", i+1, seenCurrID, segment.ID, query.StepSize, annotation.CurrentStatus.Name)
 			}
-			if seenCurrID >= 0 && statusMatch(query.RequestStatus, annotation.CurrentStatus.Name, annotation.Labels) && !api.Locked(segment.ID) {
+			if seenCurrID >= 0 && api.statusMatch(query.RequestStatus, annotation.CurrentStatus.Name, annotation.Labels) && (text == nil || text.MatchString(annotation.Text)) && !api.Locked(segment.ID) {
 				seenCurrID++
 				if query.CurrID == "" || seenCurrID == abs(query.StepSize) {
 					if lockOnLoad {
-						if api.Locked(annotation.ID) {
-							return protocol.AnnotationPayload{}, fmt.Sprintf("%v is already locked", segment.ID), nil
-						}
 						err := api.Lock(annotation.ID, query.UserName)
 						if err != nil {
-							return protocol.AnnotationPayload{}, "", err
+							return protocol.AnnotationPayload{}, err
 						}
-
 					}
 					annotation.Index = int64(i + 1)
-					return annotation, "", nil
+					return annotation, nil
 				}
 			}
 		}
 		if query.StepSize < 0 {
-			i--
+			pos--
 		} else {
-			i++
+			pos++
 		}
 	}
-	return protocol.AnnotationPayload{}, fmt.Sprintf("no segment matching requested status %s", query.RequestStatus), nil
+	return protocol.AnnotationPayload{}, newError(protocol.ErrorNoMatch, map[string]string{"request_status": query.RequestStatus}, "no segment matching requested status %s", query.RequestStatus)
 }
 
 func (api *DBAPI) Save(annotation protocol.AnnotationPayload) error {
 	log.Info("dbapi Save %#v", annotation)
 
-	api.dbMutex.RLock()
-	defer api.dbMutex.RUnlock()
+	api.dbMutex.Lock()
+	defer api.dbMutex.Unlock()
+	return api.save(annotation)
+}
+
+// SaveIfLockedBy saves the annotation, if the segment is locked by the user, and the user is the source of the annotation's current status.
+// The lock is checked while saving, so that another user can't lock the segment in between.
+func (api *DBAPI) SaveIfLockedBy(annotation protocol.AnnotationPayload, user string) error {
+	log.Info("dbapi SaveIfLockedBy %s %#v", user, annotation)
+
+	api.dbMutex.Lock()
+	defer api.dbMutex.Unlock()
+
+	if user == "" {
+		return newError(protocol.ErrorInvalidPayload, map[string]string{"segment_id": annotation.ID}, "user name not provided")
+	}
+	if annotation.CurrentStatus.Source != user {
+		return newError(protocol.ErrorInvalidPayload, map[string]string{"segment_id": annotation.ID, "user_name": user, "source": annotation.CurrentStatus.Source}, "the source of the current status (%s) doesn't match user %s", annotation.CurrentStatus.Source, user)
+	}
+	api.lockMapMutex.RLock()
+	defer api.lockMapMutex.RUnlock()
+	lockedBy, locked := api.lockMap[annotation.ID]
+	if !locked {
+		return newError(protocol.ErrorNotLocked, map[string]string{"segment_id": annotation.ID}, "%v is not locked by user %s", annotation.ID, user)
+	}
+	if lockedBy != user {
+		return newError(protocol.ErrorLocked, map[string]string{"segment_id": annotation.ID, "locked_by": lockedBy}, "%v is locked by user %s", annotation.ID, lockedBy)
+	}
+	return api.save(annotation)
+}
+
+// save validates and saves the annotation, see Save (api.dbMutex should be locked)
+func (api *DBAPI) save(annotation protocol.AnnotationPayload) error {
+	if err := validateAnnotation(annotation); err != nil {
+		return newError(protocol.ErrorInvalidPayload, map[string]string{"segment_id": annotation.ID}, "invalid annotation : %v", err)
+	}
+	seg, segExists := api.sourceSegment(annotation.ID)
+	if !segExists {
+		return newError(protocol.ErrorNotFound, map[string]string{"segment_id": annotation.ID}, "annotation data with id %s not found in source data", annotation.ID)
+	}
+	if err := validateAnnotationAgainstSource(annotation, seg); err != nil {
+		return newError(protocol.ErrorInvalidPayload, map[string]string{"segment_id": annotation.ID}, "%v", err)
+	}
+	if annotation.CurrentStatus.Name == StatusReplaced {
+		return newError(protocol.ErrorInvalidPayload, map[string]string{"segment_id": annotation.ID}, "status %s can only be set by split or merge", StatusReplaced)
+	}
+	prev := api.annotationFromSegment(seg)
+	if prev.CurrentStatus.Name == StatusReplaced {
+		return newError(protocol.ErrorConflict, map[string]string{"segment_id": annotation.ID}, "segment %s has been replaced, and can not be annotated", annotation.ID)
+	}
+	if err := api.checkStatusAndLabels(annotation); err != nil {
+		return err
+	}
+	// saved boundaries are checked by a human, so the provenance of automatic source boundaries doesn't apply
+	annotation.Provenance = nil
+	annotation.Derivation = seg.Derivation
+	annotation.Meta = seg.Meta
+	if err := api.updateText(&annotation, prev); err != nil {
+		return err
+	}
+	if err := api.checkChunkBounds(annotation.SegmentPayload); err != nil {
+		return err
+	}
 
+	return api.saveAnnotation(annotation)
+}
+
+// saveAnnotation saves the annotation to the cache and the annotation folder (api.dbMutex should be locked)
+func (api *DBAPI) saveAnnotation(annotation protocol.AnnotationPayload) error {
 	/* SAVE TO CACHE */
 	api.annotationData[annotation.ID] = annotation
 
@@ -544,7 +1102,11 @@ func (api *DBAPI) Save(annotation protocol.AnnotationPayload) error {
 	saveAnno.Index = 0
 
 	f := path.Join(api.AnnotationDataDir, fmt.Sprintf("%s.json", annotation.ID))
-	writeJSON, err := json.MarshalIndent(saveAnno, " ", " ")
+	return writeJSONFile(f, saveAnno)
+}
+
+func writeJSONFile(f string, v interface{}) error {
+	writeJSON, err := json.MarshalIndent(v, " ", " ")
 	if err != nil {
 		return fmt.Errorf("marhsal failed : %v", err)
 	}
@@ -554,11 +1116,22 @@ func (api *DBAPI) Save(annotation protocol.AnnotationPayload) error {
 		return fmt.Errorf("failed create file %s : %v", f, err)
 	}
 	defer file.Close()
-	file.Write(writeJSON)
-
+	_, err = file.Write(writeJSON)
+	if err != nil {
+		return fmt.Errorf("failed to write file %s : %v", f, err)
+	}
 	return nil
 }
 
+func containsInt(slice []int, i int) bool {
+	for _, i0 := range slice {
+		if i0 == i {
+			return true
+		}
+	}
+	return false
+}
+
 func contains(slice []string, s string) bool {
 	for _, s0 := range slice {
 		if s0 == s {
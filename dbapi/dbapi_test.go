@@ -0,0 +1,517 @@
+package dbapi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// testSegment returns a source segment of type silence
+func testSegment(id, url string, start, end int64) protocol.SegmentPayload {
+	return protocol.SegmentPayload{ID: id, URL: url, SegmentType: "silence", Chunk: protocol.Chunk{Start: start, End: end}}
+}
+
+// newTestDB creates a project folder with the source segments, and the project config (if not empty), and loads the project.
+// The caller should remove the project folder (db.ProjectDir).
+func newTestDB(t *testing.T, config string, segments ...protocol.SegmentPayload) *DBAPI {
+	dir, err := ioutil.TempDir("", "dbapi-test")
+	if err != nil {
+		t.Fatalf("got error from TempDir: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "source"), 0700); err != nil {
+		t.Fatalf("couldn't create source dir: %v", err)
+	}
+	for _, seg := range segments {
+		if err := writeJSONFile(filepath.Join(dir, "source", seg.ID+".json"), seg); err != nil {
+			t.Fatalf("couldn't write source file: %v", err)
+		}
+	}
+	if config != "" {
+		if err := ioutil.WriteFile(filepath.Join(dir, ProjectConfigFile), []byte(config), 0644); err != nil {
+			t.Fatalf("couldn't write project config: %v", err)
+		}
+	}
+	db := NewDBAPI(dir)
+	if err := db.LoadData(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("got error from LoadData: %v", err)
+	}
+	return db
+}
+
+// reload loads the project folder of db into a new DBAPI
+func reload(t *testing.T, db *DBAPI) *DBAPI {
+	res := NewDBAPI(db.ProjectDir)
+	if err := res.LoadData(); err != nil {
+		t.Fatalf("got error from LoadData: %v", err)
+	}
+	return res
+}
+
+// save saves the segment with the status, labels and text
+func save(db *DBAPI, id, status, user, text string, labels ...string) error {
+	seg, ok := db.SourceSegment(id)
+	if !ok {
+		return newError(protocol.ErrorNotFound, nil, "no segment %s", id)
+	}
+	anno := protocol.AnnotationPayload{SegmentPayload: seg, Labels: labels}
+	anno.Text = text
+	anno.SetCurrentStatus(protocol.Status{Name: status, Source: user, Timestamp: "2020-01-01 00:00:00"})
+	return db.Save(anno)
+}
+
+// ids returns the ids of the annotations
+func ids(annotations []protocol.AnnotationPayload) []string {
+	res := []string{}
+	for _, anno := range annotations {
+		res = append(res, anno.ID)
+	}
+	return res
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestChunkBounds(t *testing.T) {
+	db := newTestDB(t, "", testSegment("s1", "/audio/a.wav", 0, 100), testSegment("s2", "/audio/a.wav", 800, 900))
+	defer os.RemoveAll(db.ProjectDir)
+	probe := func(duration float64) func(string) (protocol.AudioInfo, error) {
+		return func(string) (protocol.AudioInfo, error) {
+			return protocol.AudioInfo{Duration: duration, SampleRate: 16000, Channels: 1}, nil
+		}
+	}
+
+	// without an audio probe, chunks are not checked
+	anno, _ := db.GetSegment("s1")
+	anno.Chunk.End = 1200
+	anno.SetCurrentStatus(protocol.Status{Name: StatusOK, Source: "user1"})
+	if err := db.Save(anno); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+
+	db.SetAudioProbe(probe(1000))
+	if err := db.TestChunkBounds(); err == nil {
+		t.Errorf("expected error for a saved chunk beyond the end of the audio")
+	}
+	anno.Chunk.End = 1001
+	if err := db.Save(anno); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	if err := db.TestChunkBounds(); err != nil {
+		t.Errorf("got error from TestChunkBounds: %v", err)
+	}
+	anno.Chunk.End = 1100
+	if err := db.Save(anno); ErrorCode(err) != protocol.ErrorInvalidPayload {
+		t.Errorf("expected error code %s for a chunk beyond the end of the audio, got %v", protocol.ErrorInvalidPayload, err)
+	}
+
+	edit := protocol.EditPayload{Operation: protocol.EditInsert, SegmentIDs: []string{"s2"}, Chunk: &protocol.Chunk{Start: 950, End: 1100}, UserName: "user1"}
+	if _, err := db.Edit(edit, protocol.Chunk{Start: 600, End: 1100}); ErrorCode(err) != protocol.ErrorInvalidPayload {
+		t.Errorf("expected error code %s for an inserted chunk beyond the end of the audio, got %v", protocol.ErrorInvalidPayload, err)
+	}
+	edit.Chunk.End = 1000
+	if _, err := db.Edit(edit, protocol.Chunk{Start: 600, End: 1100}); err != nil {
+		t.Errorf("got error from Edit: %v", err)
+	}
+
+	// audio files that can't be probed are not checked
+	db.SetAudioProbe(func(string) (protocol.AudioInfo, error) { return protocol.AudioInfo{}, fmt.Errorf("no audio") })
+	anno.Chunk.End = 1100
+	if err := db.Save(anno); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+}
+
+// neighbourIDs returns the ids of the neighbours
+func neighbourIDs(neighbours []protocol.Neighbour) []string {
+	res := []string{}
+	for _, n := range neighbours {
+		res = append(res, n.ID)
+	}
+	return res
+}
+
+func TestNeighbours(t *testing.T) {
+	other := testSegment("c1", "/audio/a.wav", 250, 350)
+	other.Channel = 2
+	db := newTestDB(t, "",
+		testSegment("s1", "/audio/a.wav", 0, 100),
+		testSegment("s2", "/audio/a.wav", 200, 300),
+		testSegment("s3", "/audio/a.wav", 400, 500),
+		testSegment("s4", "/audio/a.wav", 900, 1000),
+		testSegment("t1", "/audio/b.wav", 200, 300),
+		other,
+	)
+	defer os.RemoveAll(db.ProjectDir)
+	seg := func(id string) protocol.SegmentPayload {
+		res, _ := db.SourceSegment(id)
+		return res
+	}
+
+	for _, test := range []struct {
+		id     string
+		window protocol.Chunk
+		exp    []string
+	}{
+		// at the start of the recording
+		{id: "s1", window: protocol.Chunk{Start: 0, End: 250}, exp: []string{"s2"}},
+		{id: "s1", window: protocol.Chunk{Start: 0, End: 200}, exp: []string{}},
+		// at the end of the recording
+		{id: "s4", window: protocol.Chunk{Start: 800, End: 1000}, exp: []string{}},
+		{id: "s4", window: protocol.Chunk{Start: 450, End: 1000}, exp: []string{"s3"}},
+		// segments of other URLs and channels are not included
+		{id: "s2", window: protocol.Chunk{Start: 0, End: 600}, exp: []string{"s1", "s3"}},
+		{id: "t1", window: protocol.Chunk{Start: 0, End: 1000}, exp: []string{}},
+		{id: "c1", window: protocol.Chunk{Start: 0, End: 1000}, exp: []string{}},
+	} {
+		if got := neighbourIDs(db.Neighbours(seg(test.id), test.window)); !equalStrings(got, test.exp) {
+			t.Errorf("expected neighbours %v for %s in window %v, got %v", test.exp, test.id, test.window, got)
+		}
+	}
+
+	// annotated segments are returned with their annotated chunk and status
+	anno, _ := db.GetSegment("s2")
+	anno.Chunk.Start = 120
+	anno.SetCurrentStatus(protocol.Status{Name: StatusOK, Source: "user1"})
+	if err := db.Save(anno); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	got := db.Neighbours(seg("s1"), protocol.Chunk{Start: 0, End: 150})
+	if len(got) != 1 || got[0].ID != "s2" || got[0].Chunk.Start != 120 || got[0].Status != StatusOK {
+		t.Errorf("expected annotated neighbour s2 at 120 ms with status ok, got %#v", got)
+	}
+
+	// replaced segments are not included, but the segments replacing them are
+	if _, err := db.Edit(protocol.EditPayload{Operation: protocol.EditSplit, SegmentIDs: []string{"s3"}, At: 450, UserName: "user1"}, protocol.Chunk{}); err != nil {
+		t.Errorf("got error from Edit: %v", err)
+	}
+	if got, exp := neighbourIDs(db.Neighbours(seg("s4"), protocol.Chunk{Start: 0, End: 1000})), []string{"s1", "s2", "s3_split1", "s3_split2"}; !equalStrings(got, exp) {
+		t.Errorf("expected neighbours %v, got %v", exp, got)
+	}
+}
+
+func TestSegmentsForURL(t *testing.T) {
+	// the source data is ordered by file name, a2 is the first segment of a.wav
+	db := newTestDB(t, "",
+		testSegment("a1", "/audio/a.wav", 500, 600),
+		testSegment("a2", "/audio/a.wav", 0, 100),
+		testSegment("a3", "/audio/a.wav", 1000, 1100),
+		testSegment("b1", "/audio/b.wav", 0, 100),
+	)
+	defer os.RemoveAll(db.ProjectDir)
+
+	if got, exp := db.urlOrder("/audio/a.wav"), []int{1, 0, 2}; len(got) != 3 || got[0] != exp[0] || got[1] != exp[1] || got[2] != exp[2] {
+		t.Errorf("expected url order %v, got %v", exp, got)
+	}
+	if got := db.urlOrder("/audio/c.wav"); len(got) != 0 {
+		t.Errorf("expected empty url order for unknown url, got %v", got)
+	}
+	got := db.SegmentsForURL("/audio/a.wav", "", Filter{})
+	if exp := []string{"a2", "a1", "a3"}; !equalStrings(ids(got), exp) {
+		t.Errorf("expected segments %v, got %v", exp, ids(got))
+	} else if got[0].Index != 2 || got[1].Index != 1 || got[2].Index != 3 {
+		t.Errorf("expected indices 2, 1, 3, got %d, %d, %d", got[0].Index, got[1].Index, got[2].Index)
+	}
+
+	// the annotated chunk is used for the order
+	anno, _ := db.GetSegment("a2")
+	anno.Chunk = protocol.Chunk{Start: 800, End: 900}
+	anno.SetCurrentStatus(protocol.Status{Name: StatusOK, Source: "user1"})
+	if err := db.Save(anno); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	if got, exp := ids(db.SegmentsForURL("/audio/a.wav", "", Filter{})), []string{"a1", "a2", "a3"}; !equalStrings(got, exp) {
+		t.Errorf("expected segments %v, got %v", exp, got)
+	}
+	if got, exp := ids(db.SegmentsForURL("/audio/a.wav", StatusOK, Filter{})), []string{"a2"}; !equalStrings(got, exp) {
+		t.Errorf("expected segments %v with status ok, got %v", exp, got)
+	}
+	if got, exp := ids(db.SegmentsForURL("/audio/a.wav", StatusUnchecked, Filter{})), []string{"a1", "a3"}; !equalStrings(got, exp) {
+		t.Errorf("expected unchecked segments %v, got %v", exp, got)
+	}
+}
+
+func TestGetNextSegmentForURL(t *testing.T) {
+	b1 := testSegment("b1", "/audio/b.wav", 0, 100)
+	b1.Meta = protocol.Meta{"speaker": "B"}
+	a1 := testSegment("a1", "/audio/a.wav", 500, 600)
+	a1.Meta = protocol.Meta{"speaker": "A"}
+	db := newTestDB(t, "",
+		a1,
+		testSegment("a2", "/audio/a.wav", 0, 100),
+		testSegment("a3", "/audio/a.wav", 1000, 1100),
+		b1,
+	)
+	defer os.RemoveAll(db.ProjectDir)
+	next := func(query protocol.QueryPayload) string {
+		anno, err := db.GetNextSegment(query, "", false)
+		if err != nil {
+			return string(ErrorCode(err))
+		}
+		return anno.ID
+	}
+
+	query := protocol.QueryPayload{UserName: "user1", RequestStatus: StatusAny, URL: "/audio/a.wav"}
+	for _, test := range []struct {
+		currID   string
+		stepSize int64
+		exp      string
+	}{
+		// entering the recording from another one
+		{currID: "b1", stepSize: 1, exp: "a2"},
+		{currID: "b1", stepSize: -1, exp: "a3"},
+		// stepping in order of start time
+		{currID: "a2", stepSize: 1, exp: "a1"},
+		{currID: "a1", stepSize: 1, exp: "a3"},
+		{currID: "a3", stepSize: -1, exp: "a1"},
+		{currID: "a2", stepSize: 2, exp: "a3"},
+		{currID: "a3", stepSize: 1, exp: string(protocol.ErrorNoMatch)},
+	} {
+		query.CurrID = test.currID
+		query.StepSize = test.stepSize
+		if got := next(query); got != test.exp {
+			t.Errorf("expected %s from %s with step %d, got %s", test.exp, test.currID, test.stepSize, got)
+		}
+	}
+
+	query = protocol.QueryPayload{UserName: "user1", RequestStatus: StatusAny, URL: "/audio/c.wav", StepSize: 1}
+	if got := next(query); got != string(protocol.ErrorNotFound) {
+		t.Errorf("expected %s for unknown url, got %s", protocol.ErrorNotFound, got)
+	}
+
+	// request index: first and last are in the recording, and numeric indices must be in the recording
+	query = protocol.QueryPayload{UserName: "user1", RequestStatus: StatusAny, URL: "/audio/a.wav"}
+	for _, test := range []struct {
+		index string
+		exp   string
+	}{
+		{index: "first", exp: "a2"},
+		{index: "last", exp: "a3"},
+		{index: "0", exp: "a1"},
+		{index: "3", exp: string(protocol.ErrorNoMatch)},
+		{index: "4", exp: string(protocol.ErrorInvalidIndex)},
+	} {
+		query.RequestIndex = test.index
+		if got := next(query); got != test.exp {
+			t.Errorf("expected %s for request index %s, got %s", test.exp, test.index, got)
+		}
+	}
+	query.URL = ""
+	query.RequestIndex = "3"
+	if got := next(query); got != "b1" {
+		t.Errorf("expected b1 for request index 3 without url, got %s", got)
+	}
+	query.Meta = map[string]string{"speaker": "A"}
+	if got := next(query); got != string(protocol.ErrorNoMatch) {
+		t.Errorf("expected %s for request index with a metadata filter, got %s", protocol.ErrorNoMatch, got)
+	}
+	query.RequestIndex = "0"
+	if got := next(query); got != "a1" {
+		t.Errorf("expected a1 for request index 0 with a metadata filter, got %s", got)
+	}
+}
+
+// typedSegment returns a source segment of the segment type
+func typedSegment(id, segmentType string, start, end int64) protocol.SegmentPayload {
+	seg := testSegment(id, "/audio/a.wav", start, end)
+	seg.SegmentType = segmentType
+	return seg
+}
+
+const segmentTypeConfig = `{"labels": ["noise", "overlap"], "segment_types": {"e": {"context": 300, "labels": ["bad sample", "noise"]}}}`
+
+func TestSegmentTypes(t *testing.T) {
+	db := newTestDB(t, segmentTypeConfig,
+		typedSegment("seg1", "e", 0, 100),
+		typedSegment("seg2", "silence", 200, 300),
+		typedSegment("seg3", "e", 400, 500),
+		typedSegment("seg4", "silence", 600, 700),
+		typedSegment("seg5", "x", 800, 900),
+	)
+	defer os.RemoveAll(db.ProjectDir)
+
+	types := db.SegmentTypes()
+	if len(types) != 3 {
+		t.Fatalf("expected 3 segment types, got %#v", types)
+	}
+	for i, exp := range []protocol.SegmentTypePayload{
+		{Name: "e", Context: 300, Labels: []string{"bad sample", "noise"}, Count: 2},
+		{Name: "silence", Context: 1000, Count: 2},
+		{Name: "x", Context: 1000, Count: 1},
+	} {
+		got := types[i]
+		if got.Name != exp.Name || got.Context != exp.Context || !equalStrings(got.Labels, exp.Labels) || got.Count != exp.Count {
+			t.Errorf("expected segment type %#v, got %#v", exp, got)
+		}
+	}
+	if got := db.Context("e"); got != 300 {
+		t.Errorf("expected context 300 for segment type e, got %d", got)
+	}
+
+	// the type filter
+	if got, exp := ids(db.ListSegments(StatusAny, Filter{SegmentType: "e"})), []string{"seg1", "seg3"}; !equalStrings(got, exp) {
+		t.Errorf("expected segments %v of type e, got %v", exp, got)
+	}
+	next := func(query protocol.QueryPayload) string {
+		anno, err := db.GetNextSegment(query, "", false)
+		if err != nil {
+			return string(ErrorCode(err))
+		}
+		return anno.ID
+	}
+	query := protocol.QueryPayload{UserName: "user1", RequestStatus: StatusAny, SegmentType: "e"}
+	for _, test := range []struct {
+		currID   string
+		stepSize int64
+		exp      string
+	}{
+		{currID: "", stepSize: 1, exp: "seg1"},
+		{currID: "seg1", stepSize: 1, exp: "seg3"},
+		{currID: "seg3", stepSize: -1, exp: "seg1"},
+		{currID: "seg3", stepSize: 1, exp: string(protocol.ErrorNoMatch)},
+		// starting from a segment of another type
+		{currID: "seg2", stepSize: 1, exp: "seg1"},
+		{currID: "seg2", stepSize: -1, exp: "seg3"},
+	} {
+		query.CurrID = test.currID
+		query.StepSize = test.stepSize
+		if got := next(query); got != test.exp {
+			t.Errorf("expected %s from %q with step %d, got %s", test.exp, test.currID, test.stepSize, got)
+		}
+	}
+	query = protocol.QueryPayload{UserName: "user1", RequestStatus: StatusAny, SegmentType: "y", StepSize: 1}
+	if got := next(query); got != string(protocol.ErrorNoMatch) {
+		t.Errorf("expected %s for unknown segment type, got %s", protocol.ErrorNoMatch, got)
+	}
+
+	// stats by segment type
+	if err := save(db, "seg1", StatusOK, "user1", ""); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	stats, _ := db.Stats()
+	for key, exp := range map[string]int{"type:e": 2, "type:e (unchecked)": 1, "type:silence": 2, "type:silence (unchecked)": 2, "type:x": 1} {
+		if stats[key] != exp {
+			t.Errorf("expected stats %s = %d, got %d", key, exp, stats[key])
+		}
+	}
+}
+
+func TestSegmentTypeLabels(t *testing.T) {
+	db := newTestDB(t, segmentTypeConfig,
+		typedSegment("seg1", "e", 0, 100),
+		typedSegment("seg2", "silence", 200, 300),
+	)
+	defer os.RemoveAll(db.ProjectDir)
+
+	if err := save(db, "seg1", StatusOK, "user1", "", "noise"); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	if err := save(db, "seg1", StatusSkip, "user1", "", StatusBadSample); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	if err := save(db, "seg1", StatusOK, "user1", "", "overlap"); ErrorCode(err) != protocol.ErrorInvalidPayload {
+		t.Errorf("expected error code %s for a label not allowed for the segment type, got %v", protocol.ErrorInvalidPayload, err)
+	}
+	// segment types without labels in the config allow any labels of the project
+	if err := save(db, "seg2", StatusOK, "user1", "", "overlap", "noise"); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	db := newTestDB(t, "",
+		testSegment("s1", "/audio/a.wav", 0, 100),
+		testSegment("s2", "/audio/a.wav", 200, 300),
+		testSegment("s3", "/audio/a.wav", 400, 500),
+	)
+	defer os.RemoveAll(db.ProjectDir)
+	if err := db.Lock("s1", "user1"); err != nil {
+		t.Fatalf("got error from Lock: %v", err)
+	}
+	if _, err := db.Edit(protocol.EditPayload{Operation: "split", SegmentIDs: []string{"s3"}, At: 450, UserName: "user1"}, protocol.Chunk{}); err != nil {
+		t.Fatalf("got error from Edit: %v", err)
+	}
+	unknown := protocol.AnnotationPayload{SegmentPayload: testSegment("s9", "/audio/a.wav", 0, 100)}
+	unknown.SetCurrentStatus(protocol.Status{Name: StatusOK, Source: "user1"})
+	next := func(query protocol.QueryPayload, currentlyLockedID string, lock bool) func() error {
+		return func() error {
+			_, err := db.GetNextSegment(query, currentlyLockedID, lock)
+			return err
+		}
+	}
+
+	// the error codes are a stable contract with the clients
+	for _, test := range []struct {
+		name       string
+		fn         func() error
+		expCode    protocol.ErrorCode
+		expDetails map[string]string
+	}{
+		{name: "lock a locked segment", fn: func() error { return db.Lock("s1", "user2") }, expCode: protocol.ErrorLocked, expDetails: map[string]string{"segment_id": "s1", "locked_by": "user1"}},
+		{name: "unlock another user's segment", fn: func() error { return db.Unlock("s1", "user2") }, expCode: protocol.ErrorLocked, expDetails: map[string]string{"segment_id": "s1", "locked_by": "user1"}},
+		{name: "unlock an unlocked segment", fn: func() error { return db.Unlock("s2", "user1") }, expCode: protocol.ErrorNotLocked, expDetails: map[string]string{"segment_id": "s2"}},
+		{name: "get an unknown segment", fn: func() error { _, err := db.GetSegment("s9"); return err }, expCode: protocol.ErrorNotFound, expDetails: map[string]string{"segment_id": "s9"}},
+		{name: "save an unknown segment", fn: func() error { return db.Save(unknown) }, expCode: protocol.ErrorNotFound, expDetails: map[string]string{"segment_id": "s9"}},
+		{name: "save an unknown status", fn: func() error { return save(db, "s2", "great", "user1", "") }, expCode: protocol.ErrorInvalidPayload, expDetails: map[string]string{"segment_id": "s2", "status": "great"}},
+		{name: "save a replaced segment", fn: func() error { return save(db, "s3", StatusOK, "user1", "") }, expCode: protocol.ErrorConflict, expDetails: map[string]string{"segment_id": "s3"}},
+		{name: "save without holding the lock", fn: func() error {
+			anno, _ := db.GetSegment("s2")
+			anno.SetCurrentStatus(protocol.Status{Name: StatusOK, Source: "user1"})
+			return db.SaveIfLockedBy(anno, "user1")
+		}, expCode: protocol.ErrorNotLocked, expDetails: map[string]string{"segment_id": "s2"}},
+		{name: "save another user's segment", fn: func() error {
+			anno, _ := db.GetSegment("s1")
+			anno.SetCurrentStatus(protocol.Status{Name: StatusOK, Source: "user2"})
+			return db.SaveIfLockedBy(anno, "user2")
+		}, expCode: protocol.ErrorLocked, expDetails: map[string]string{"segment_id": "s1", "locked_by": "user1"}},
+		{name: "request index out of range", fn: next(protocol.QueryPayload{UserName: "user1", RequestIndex: "9"}, "", false), expCode: protocol.ErrorInvalidIndex, expDetails: map[string]string{"request_index": "9"}},
+		{name: "request index not a number", fn: next(protocol.QueryPayload{UserName: "user1", RequestIndex: "second"}, "", false), expCode: protocol.ErrorInvalidIndex, expDetails: map[string]string{"request_index": "second"}},
+		{name: "request the current segment", fn: next(protocol.QueryPayload{UserName: "user1", RequestIndex: "0"}, "s1", false), expCode: protocol.ErrorConflict, expDetails: map[string]string{"segment_id": "s1"}},
+		{name: "request a segment locked by another user", fn: next(protocol.QueryPayload{UserName: "user2", RequestIndex: "0"}, "", true), expCode: protocol.ErrorLocked, expDetails: map[string]string{"segment_id": "s1", "locked_by": "user1"}},
+		{name: "no matching segment", fn: next(protocol.QueryPayload{UserName: "user1", RequestStatus: StatusOK, StepSize: 1}, "", false), expCode: protocol.ErrorNoMatch, expDetails: map[string]string{"request_status": StatusOK}},
+		{name: "edit a segment locked by another user", fn: func() error {
+			_, err := db.Edit(protocol.EditPayload{Operation: "split", SegmentIDs: []string{"s1"}, At: 50, UserName: "user2"}, protocol.Chunk{})
+			return err
+		}, expCode: protocol.ErrorLocked, expDetails: map[string]string{"segment_id": "s1", "locked_by": "user1"}},
+		{name: "edit a replaced segment", fn: func() error {
+			_, err := db.Edit(protocol.EditPayload{Operation: "split", SegmentIDs: []string{"s3"}, At: 420, UserName: "user1"}, protocol.Chunk{})
+			return err
+		}, expCode: protocol.ErrorConflict, expDetails: map[string]string{"segment_id": "s3"}},
+		{name: "edit an unknown segment", fn: func() error {
+			_, err := db.Edit(protocol.EditPayload{Operation: "split", SegmentIDs: []string{"s9"}, At: 50, UserName: "user1"}, protocol.Chunk{})
+			return err
+		}, expCode: protocol.ErrorNotFound, expDetails: map[string]string{"segment_id": "s9"}},
+	} {
+		err := test.fn()
+		if got := ErrorCode(err); got != test.expCode {
+			t.Errorf("%s: expected error code %s, got %s (%v)", test.name, test.expCode, got, err)
+		}
+		details := ErrorDetails(err)
+		for key, exp := range test.expDetails {
+			if details[key] != exp {
+				t.Errorf("%s: expected error detail %s = %s, got %#v", test.name, key, exp, details)
+			}
+		}
+	}
+
+	// wrapped errors keep their code, and other errors are internal errors
+	if got := ErrorCode(fmt.Errorf("failed : %w", newError(protocol.ErrorLocked, nil, "locked"))); got != protocol.ErrorLocked {
+		t.Errorf("expected error code %s for a wrapped error, got %s", protocol.ErrorLocked, got)
+	}
+	if got := ErrorCode(fmt.Errorf("failed")); got != protocol.ErrorInternal {
+		t.Errorf("expected error code %s for a plain error, got %s", protocol.ErrorInternal, got)
+	}
+}
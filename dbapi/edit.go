@@ -0,0 +1,538 @@
+package dbapi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stts-se/segment_checker/log"
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// timestampLayout is the layout for timestamps in the data files
+const timestampLayout = "2006-01-02 15:04:05"
+
+// derivationTimestampLayout is the layout for the timestamps of edits, with milliseconds, since derived segments are loaded in the order of the edits
+const derivationTimestampLayout = "2006-01-02 15:04:05.000"
+
+// LoadDerivedData reads the segments created by edit operations (split, merge, insert) from the derived data folder, sorted by the time of the edit
+func (api *DBAPI) LoadDerivedData() ([]protocol.SegmentPayload, error) {
+	res := []protocol.SegmentPayload{}
+	files := api.listJSONFiles(api.DerivedDataDir)
+	seenIDs := make(map[string]bool)
+	for _, f := range files {
+		bts, err := ioutil.ReadFile(f)
+		if err != nil {
+			return res, fmt.Errorf("couldn't read derived segment file %s : %v", f, err)
+		}
+		var segment protocol.SegmentPayload
+		err = protocol.UnmarshalStrict(bts, &segment)
+		if err != nil {
+			return res, fmt.Errorf("couldn't unmarshal derived segment file %s : %v", f, err)
+		}
+		err = validateSegment(segment)
+		if err != nil {
+			return res, fmt.Errorf("invalid derived segment file %s : %v", f, err)
+		}
+		if segment.Derivation == nil {
+			return res, fmt.Errorf("invalid derived segment file %s : no derivation", f)
+		}
+		if _, seen := seenIDs[segment.ID]; seen {
+			return res, fmt.Errorf("duplicate ids for derived data: %s", segment.ID)
+		}
+		seenIDs[segment.ID] = true
+		res = append(res, segment)
+	}
+	// the segments of one edit share the timestamp, and are ordered by start time
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Derivation.Timestamp == res[j].Derivation.Timestamp {
+			return res[i].Chunk.Start < res[j].Chunk.Start
+		}
+		return res[i].Derivation.Timestamp < res[j].Derivation.Timestamp
+	})
+	return res, nil
+}
+
+// addDerived adds the derived segments to the source data, see insertDerived. Segments are added when their parents have been added, so that segments derived from derived segments can be loaded in any order.
+func (api *DBAPI) addDerived(derived []protocol.SegmentPayload) error {
+	for len(derived) > 0 {
+		rest := []protocol.SegmentPayload{}
+		var firstErr error
+		for _, seg := range derived {
+			if err := api.insertDerived(seg); err != nil {
+				rest = append(rest, seg)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		if len(rest) == len(derived) {
+			return firstErr
+		}
+		derived = rest
+	}
+	return nil
+}
+
+// insertDerived inserts a derived segment in the source data after its (last) parent, and after other segments derived from the same source segments (api.dbMutex should be locked)
+func (api *DBAPI) insertDerived(seg protocol.SegmentPayload) error {
+	pos := -1
+	for i, s := range api.sourceData {
+		if s.ID == seg.ID {
+			return fmt.Errorf("duplicate ids for source and derived data: %s", seg.ID)
+		}
+		if contains(seg.Derivation.Parents, s.ID) {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		return fmt.Errorf("parent segments not found for derived segment %s: %v", seg.ID, strings.Join(seg.Derivation.Parents, ", "))
+	}
+	pos++
+	for pos < len(api.sourceData) && api.sourceData[pos].Derivation != nil && overlaps(api.sourceData[pos].Derivation.Sources, seg.Derivation.Sources) {
+		pos++
+	}
+	api.sourceData = append(api.sourceData[:pos], append([]protocol.SegmentPayload{seg}, api.sourceData[pos:]...)...)
+	return nil
+}
+
+func overlaps(slice1, slice2 []string) bool {
+	for _, s := range slice1 {
+		if contains(slice2, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateDerivation checks the derivation of a derived segment against its parents (api.dbMutex should be locked)
+func (api *DBAPI) validateDerivation(seg protocol.SegmentPayload, segMap map[string]protocol.SegmentPayload) error {
+	d := seg.Derivation
+	if !contains(protocol.EditOperations, d.Operation) {
+		return fmt.Errorf("derived segment %s has an unknown operation: %s", seg.ID, d.Operation)
+	}
+	if d.User == "" || d.Timestamp == "" {
+		return fmt.Errorf("derived segment %s requires user and timestamp", seg.ID)
+	}
+	if d.Operation == protocol.EditMerge && len(d.Parents) < 2 {
+		return fmt.Errorf("merged segment %s requires at least two parents, found %d", seg.ID, len(d.Parents))
+	}
+	if d.Operation != protocol.EditMerge && len(d.Parents) != 1 {
+		return fmt.Errorf("derived segment %s (%s) requires one parent, found %d", seg.ID, d.Operation, len(d.Parents))
+	}
+	for _, id := range d.Parents {
+		parent, ok := segMap[id]
+		if !ok {
+			return fmt.Errorf("parent segment %s not found for derived segment %s", id, seg.ID)
+		}
+		if parent.URL != seg.URL || parent.SegmentType != seg.SegmentType || api.channel(parent) != api.channel(seg) {
+			return fmt.Errorf("derived segment %s has a different URL, segment type or channel than its parent %s", seg.ID, id)
+		}
+	}
+	if len(d.Sources) == 0 {
+		return fmt.Errorf("derived segment %s has no source segments", seg.ID)
+	}
+	for _, id := range d.Sources {
+		source, ok := segMap[id]
+		if !ok || source.Derivation != nil {
+			return fmt.Errorf("source segment %s not found for derived segment %s", id, seg.ID)
+		}
+	}
+	return nil
+}
+
+// validateReplaced checks that the parents of a split or merged segment have status replaced (api.dbMutex should be locked)
+func (api *DBAPI) validateReplaced(seg protocol.SegmentPayload, segMap map[string]protocol.SegmentPayload) error {
+	if seg.Derivation.Operation == protocol.EditInsert {
+		return nil
+	}
+	for _, id := range seg.Derivation.Parents {
+		if api.annotationFromSegment(segMap[id]).CurrentStatus.Name != StatusReplaced {
+			return fmt.Errorf("parent segment %s of derived segment %s does not have status %s", id, seg.ID, StatusReplaced)
+		}
+	}
+	return nil
+}
+
+// sources returns the segments in the source data that the segments trace back to (api.dbMutex should be locked)
+func (api *DBAPI) sources(segments []protocol.AnnotationPayload) []string {
+	res := []string{}
+	for _, seg := range segments {
+		ids := []string{seg.ID}
+		if src, ok := api.sourceSegment(seg.ID); ok && src.Derivation != nil {
+			ids = src.Derivation.Sources
+		}
+		for _, id := range ids {
+			if !contains(res, id) {
+				res = append(res, id)
+			}
+		}
+	}
+	return res
+}
+
+// newID returns an unused id for a segment created by an edit operation, such as <parent id>_split1 (api.dbMutex should be locked)
+func (api *DBAPI) newID(parentID, operation string, taken []string) string {
+	for n := 1; ; n++ {
+		id := fmt.Sprintf("%s_%s%d", parentID, operation, n)
+		if _, exists := api.sourceSegment(id); !exists && !contains(taken, id) {
+			return id
+		}
+	}
+}
+
+// derivedMeta returns the metadata for a segment created by an edit operation: split segments keep the metadata of the parent, merged segments keep the metadata values shared by all parents, and inserted segments have no metadata
+func derivedMeta(operation string, parents []protocol.AnnotationPayload) protocol.Meta {
+	if operation == protocol.EditInsert || len(parents[0].Meta) == 0 {
+		return nil
+	}
+	res := protocol.Meta{}
+	for key, v := range parents[0].Meta {
+		value, _ := parents[0].Meta.Value(key)
+		shared := true
+		for _, p := range parents[1:] {
+			if pv, ok := p.Meta.Value(key); !ok || pv != value {
+				shared = false
+			}
+		}
+		if shared {
+			res[key] = v
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+// derivedText returns the text for a segment created by an edit operation: merged segments get the texts of the parents joined by spaces, while split and inserted segments have no text (the annotator has to enter it)
+func derivedText(operation string, parents []protocol.AnnotationPayload) string {
+	if operation != protocol.EditMerge {
+		return ""
+	}
+	texts := []string{}
+	for _, p := range parents {
+		if t := strings.TrimSpace(p.Text); t != "" {
+			texts = append(texts, t)
+		}
+	}
+	return strings.Join(texts, " ")
+}
+
+// removed returns true for segments that are not part of the final segmentation: segments replaced by split or merge, and rejected or deleted segments
+func removed(status string) bool {
+	return status == StatusReplaced || status == StatusRejected || status == StatusDeleted
+}
+
+// checkAdjacent checks that the segments are from the same audio URL, channel and segment type, and adjacent (in order of start time), not counting removed segments (api.dbMutex should be locked)
+func (api *DBAPI) checkAdjacent(segments []protocol.AnnotationPayload) error {
+	first := segments[0]
+	for _, seg := range segments {
+		if seg.URL != first.URL || seg.SegmentType != first.SegmentType || api.channel(seg.SegmentPayload) != api.channel(first.SegmentPayload) {
+			return newError(protocol.ErrorInvalidPayload, map[string]string{"segment_id": seg.ID}, "segment %s has a different URL, segment type or channel than segment %s", seg.ID, first.ID)
+		}
+		if removed(seg.CurrentStatus.Name) {
+			return newError(protocol.ErrorInvalidPayload, map[string]string{"segment_id": seg.ID}, "segment %s has status %s", seg.ID, seg.CurrentStatus.Name)
+		}
+	}
+	positions := map[string]int{}
+	pos := 0
+	for _, i := range api.urlOrder(first.URL) {
+		anno := api.annotationFromSegment(api.sourceData[i])
+		if api.channel(anno.SegmentPayload) != api.channel(first.SegmentPayload) || removed(anno.CurrentStatus.Name) {
+			continue
+		}
+		positions[anno.ID] = pos
+		pos++
+	}
+	for i := 1; i < len(segments); i++ {
+		if positions[segments[i].ID] != positions[segments[i-1].ID]+1 {
+			return newError(protocol.ErrorInvalidPayload, map[string]string{"segment_id": segments[i].ID}, "segment %s is not adjacent to segment %s", segments[i].ID, segments[i-1].ID)
+		}
+	}
+	return nil
+}
+
+// Edit splits, merges or inserts segments. The new segments are saved in the derived data folder, with ids and a derivation that trace back to the edited segments.
+// Split and merged segments get status replaced. For insert, window is the audio window of the segment, and the new chunk is clipped to the window.
+// Segments locked by other users can not be edited.
+func (api *DBAPI) Edit(edit protocol.EditPayload, window protocol.Chunk) (protocol.EditResultPayload, error) {
+	log.Info("dbapi Edit %#v", edit)
+
+	api.dbMutex.Lock()
+	defer api.dbMutex.Unlock()
+
+	res := protocol.EditResultPayload{Operation: edit.Operation, Parents: edit.SegmentIDs}
+	details := map[string]string{"operation": edit.Operation}
+	if edit.UserName == "" {
+		return res, newError(protocol.ErrorInvalidPayload, details, "user name not provided for edit")
+	}
+	if len(edit.SegmentIDs) == 0 {
+		return res, newError(protocol.ErrorInvalidPayload, details, "no segments provided for edit")
+	}
+	parents := []protocol.AnnotationPayload{}
+	for _, id := range edit.SegmentIDs {
+		seg, ok := api.sourceSegment(id)
+		if !ok {
+			return res, newError(protocol.ErrorNotFound, map[string]string{"segment_id": id}, "no segment with id %s", id)
+		}
+		if lockedBy, locked := api.LockedBy(id); locked && lockedBy != edit.UserName {
+			return res, newError(protocol.ErrorLocked, map[string]string{"segment_id": id, "locked_by": lockedBy}, "%v is locked by user %s", id, lockedBy)
+		}
+		anno := api.annotationFromSegment(seg)
+		if anno.CurrentStatus.Name == StatusReplaced {
+			return res, newError(protocol.ErrorConflict, map[string]string{"segment_id": id}, "segment %s has already been replaced", id)
+		}
+		parents = append(parents, anno)
+	}
+
+	var chunks []protocol.Chunk
+	switch edit.Operation {
+	case protocol.EditSplit:
+		if len(parents) != 1 {
+			return res, newError(protocol.ErrorInvalidPayload, details, "split requires one segment, found %d", len(parents))
+		}
+		c := parents[0].Chunk
+		if edit.At <= c.Start || edit.At >= c.End {
+			return res, newError(protocol.ErrorInvalidPayload, details, "split time %d is outside of segment %s (%d-%d)", edit.At, parents[0].ID, c.Start, c.End)
+		}
+		chunks = []protocol.Chunk{{Start: c.Start, End: edit.At}, {Start: edit.At, End: c.End}}
+	case protocol.EditMerge:
+		if len(parents) < 2 {
+			return res, newError(protocol.ErrorInvalidPayload, details, "merge requires at least two segments, found %d", len(parents))
+		}
+		if err := api.checkAdjacent(parents); err != nil {
+			return res, err
+		}
+		chunk := parents[0].Chunk
+		for _, p := range parents[1:] {
+			if p.Chunk.Start < chunk.Start {
+				chunk.Start = p.Chunk.Start
+			}
+			if p.Chunk.End > chunk.End {
+				chunk.End = p.Chunk.End
+			}
+		}
+		chunks = []protocol.Chunk{chunk}
+	case protocol.EditInsert:
+		if len(parents) != 1 {
+			return res, newError(protocol.ErrorInvalidPayload, details, "insert requires one segment, found %d", len(parents))
+		}
+		if edit.Chunk == nil || edit.Chunk.Start < 0 || edit.Chunk.Start >= edit.Chunk.End {
+			return res, newError(protocol.ErrorInvalidPayload, details, "insert requires a valid chunk, found %v", edit.Chunk)
+		}
+		// the client's idea of the audio window may differ slightly from the server's (for compressed audio), so the chunk is clipped to the window
+		chunk := *edit.Chunk
+		if chunk.Start < window.Start {
+			chunk.Start = window.Start
+		}
+		if chunk.End > window.End {
+			chunk.End = window.End
+		}
+		if chunk.Start >= chunk.End {
+			return res, newError(protocol.ErrorInvalidPayload, details, "chunk %d-%d is outside of the audio window %d-%d", edit.Chunk.Start, edit.Chunk.End, window.Start, window.End)
+		}
+		seg := parents[0].SegmentPayload
+		seg.Chunk = chunk
+		if err := api.checkChunkBounds(seg); err != nil {
+			return res, err
+		}
+		chunks = []protocol.Chunk{chunk}
+	default:
+		return res, newError(protocol.ErrorInvalidPayload, details, "unknown edit operation: %s", edit.Operation)
+	}
+
+	timestamp := api.editTimestamp()
+	derivation := protocol.Derivation{
+		Operation: edit.Operation,
+		Parents:   edit.SegmentIDs,
+		Sources:   api.sources(parents),
+		User:      edit.UserName,
+		Timestamp: timestamp,
+	}
+	ids := []string{}
+	for _, chunk := range chunks {
+		seg := parents[0].SegmentPayload
+		seg.ID = api.newID(parents[0].ID, edit.Operation, ids)
+		seg.Chunk = chunk
+		seg.Provenance = nil
+		seg.Meta = derivedMeta(edit.Operation, parents)
+		seg.Text = derivedText(edit.Operation, parents)
+		d := derivation
+		seg.Derivation = &d
+		ids = append(ids, seg.ID)
+		res.Segments = append(res.Segments, seg)
+	}
+
+	/* PRINT TO FILE */
+	for i, seg := range res.Segments {
+		f := path.Join(api.DerivedDataDir, fmt.Sprintf("%s.json", seg.ID))
+		if err := writeJSONFile(f, seg); err != nil {
+			for _, saved := range res.Segments[:i] {
+				os.Remove(path.Join(api.DerivedDataDir, fmt.Sprintf("%s.json", saved.ID)))
+			}
+			return res, err
+		}
+	}
+	// the new segments are saved before the edited segments are replaced, so that an interrupted edit can be completed or ignored on load (see recoverEdits)
+	if edit.Operation != protocol.EditInsert {
+		for i, anno := range parents {
+			if err := api.saveAnnotation(replacedAnnotation(anno, edit.UserName, timestamp)); err != nil {
+				// the failed annotation may have been saved to the cache
+				for _, prev := range parents[:i+1] {
+					api.restoreAnnotation(prev)
+				}
+				for _, seg := range res.Segments {
+					os.Remove(path.Join(api.DerivedDataDir, fmt.Sprintf("%s.json", seg.ID)))
+				}
+				return res, err
+			}
+		}
+	}
+
+	/* SAVE TO CACHE */
+	for _, seg := range res.Segments {
+		if err := api.insertDerived(seg); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// editTimestamp returns the timestamp for a new edit, later than the timestamps of all previous edits, so that the derived segments are loaded in the order of the edits (api.dbMutex should be locked)
+func (api *DBAPI) editTimestamp() string {
+	now := time.Now().Truncate(time.Millisecond)
+	if !now.After(api.lastEdit) {
+		now = api.lastEdit.Add(time.Millisecond)
+	}
+	api.lastEdit = now
+	return now.Format(derivationTimestampLayout)
+}
+
+// parseEditTimestamp parses the timestamp of an edit, with or without milliseconds
+func parseEditTimestamp(timestamp string) (time.Time, error) {
+	res, err := time.ParseInLocation(derivationTimestampLayout, timestamp, time.Local)
+	if err != nil {
+		return time.ParseInLocation(timestampLayout, timestamp, time.Local)
+	}
+	return res, nil
+}
+
+// replacedAnnotation returns the annotation with status replaced, set by the user
+func replacedAnnotation(anno protocol.AnnotationPayload, user, timestamp string) protocol.AnnotationPayload {
+	if anno.CurrentStatus.Name == StatusUnchecked {
+		anno.CurrentStatus = protocol.Status{}
+	}
+	anno.SetCurrentStatus(protocol.Status{Name: StatusReplaced, Source: user, Timestamp: timestamp})
+	return anno
+}
+
+// restoreAnnotation restores the annotation to its state before an edit, removing it if the segment was unchecked (api.dbMutex should be locked)
+func (api *DBAPI) restoreAnnotation(prev protocol.AnnotationPayload) {
+	if prev.CurrentStatus.Name != StatusUnchecked {
+		if err := api.saveAnnotation(prev); err != nil {
+			log.Error("Couldn't restore annotation for segment %s : %v", prev.ID, err)
+		}
+		return
+	}
+	delete(api.annotationData, prev.ID)
+	f := path.Join(api.AnnotationDataDir, fmt.Sprintf("%s.json", prev.ID))
+	if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+		log.Error("Couldn't remove annotation file %s : %v", f, err)
+	}
+}
+
+// editKey identifies the split or merge that created a derived segment
+type editKey struct {
+	operation, parents, timestamp string
+}
+
+// recoverEdits handles split and merge edits interrupted after saving the new segments, but before setting status replaced for the edited segments (see Edit).
+// If all new segments of the edit were saved, the edit is completed. Otherwise, the new segments (and segments derived from them) are ignored, and the edited segments are kept.
+// (api.dbMutex should be locked)
+func (api *DBAPI) recoverEdits() error {
+	segMap := map[string]protocol.SegmentPayload{}
+	for _, seg := range api.sourceData {
+		segMap[seg.ID] = seg
+	}
+	edits := map[editKey][]protocol.SegmentPayload{}
+	keys := []editKey{}
+	for _, seg := range api.sourceData {
+		d := seg.Derivation
+		if d == nil || d.Operation == protocol.EditInsert {
+			continue
+		}
+		if err := api.validateDerivation(seg, segMap); err != nil {
+			return err
+		}
+		key := editKey{operation: d.Operation, parents: strings.Join(d.Parents, " "), timestamp: d.Timestamp}
+		if _, seen := edits[key]; !seen {
+			keys = append(keys, key)
+		}
+		edits[key] = append(edits[key], seg)
+	}
+	ignored := []string{}
+	for _, key := range keys {
+		segs := edits[key]
+		d := segs[0].Derivation
+		unreplaced := []protocol.AnnotationPayload{}
+		for _, id := range d.Parents {
+			if anno := api.annotationFromSegment(segMap[id]); anno.CurrentStatus.Name != StatusReplaced {
+				unreplaced = append(unreplaced, anno)
+			}
+		}
+		if len(unreplaced) == 0 {
+			continue
+		}
+		complete := (d.Operation == protocol.EditSplit && len(segs) == 2) || (d.Operation == protocol.EditMerge && len(segs) == 1)
+		if !complete {
+			ids := []string{}
+			for _, seg := range segs {
+				ids = append(ids, seg.ID)
+			}
+			log.Warning("dbapi Ignoring segments of interrupted %s of %s: %s", d.Operation, key.parents, strings.Join(ids, ", "))
+			ignored = append(ignored, ids...)
+			continue
+		}
+		for _, anno := range unreplaced {
+			if err := api.saveAnnotation(replacedAnnotation(anno, d.User, d.Timestamp)); err != nil {
+				return fmt.Errorf("couldn't complete interrupted %s of %s : %v", d.Operation, key.parents, err)
+			}
+		}
+		log.Warning("dbapi Completed interrupted %s of %s", d.Operation, key.parents)
+	}
+	if len(ignored) == 0 {
+		return nil
+	}
+	res := []protocol.SegmentPayload{}
+	for _, seg := range api.sourceData {
+		if contains(ignored, seg.ID) || (seg.Derivation != nil && overlaps(seg.Derivation.Parents, ignored)) {
+			ignored = append(ignored, seg.ID)
+			continue
+		}
+		res = append(res, seg)
+	}
+	api.sourceData = res
+	return nil
+}
+
+// Export returns the final segments, as annotations in the order of the source data (unchecked segments are returned with status unchecked).
+// Segments replaced by split or merge, and rejected or deleted segments, are excluded unless all is true.
+func (api *DBAPI) Export(all bool) []protocol.AnnotationPayload {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	res := []protocol.AnnotationPayload{}
+	for i, seg := range api.sourceData {
+		annotation := api.annotationFromSegment(seg)
+		if !all && removed(annotation.CurrentStatus.Name) {
+			continue
+		}
+		annotation.Index = int64(i + 1)
+		res = append(res, annotation)
+	}
+	return res
+}
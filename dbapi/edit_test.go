@@ -0,0 +1,328 @@
+package dbapi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// newEditTestDB creates a project with three adjacent segments of one recording, and one segment of another recording
+func newEditTestDB(t *testing.T) *DBAPI {
+	s1 := testSegment("s1", "/audio/a.wav", 0, 100)
+	s1.Meta = protocol.Meta{"speaker": "A", "confidence": 0.5}
+	s1.Text = "one"
+	s2 := testSegment("s2", "/audio/a.wav", 200, 300)
+	s2.Meta = protocol.Meta{"speaker": "A", "confidence": 0.7}
+	s2.Text = "two"
+	return newTestDB(t, "", s1, s2, testSegment("s3", "/audio/a.wav", 400, 500), testSegment("t1", "/audio/b.wav", 0, 100))
+}
+
+func split(id string, at int64) protocol.EditPayload {
+	return protocol.EditPayload{Operation: protocol.EditSplit, SegmentIDs: []string{id}, At: at, UserName: "user1"}
+}
+
+func merge(ids ...string) protocol.EditPayload {
+	return protocol.EditPayload{Operation: protocol.EditMerge, SegmentIDs: ids, UserName: "user1"}
+}
+
+func insert(id string, start, end int64) protocol.EditPayload {
+	return protocol.EditPayload{Operation: protocol.EditInsert, SegmentIDs: []string{id}, Chunk: &protocol.Chunk{Start: start, End: end}, UserName: "user1"}
+}
+
+// exportIDs returns the ids of the exported segments
+func exportIDs(db *DBAPI, all bool) []string {
+	return ids(db.Export(all))
+}
+
+func TestSplit(t *testing.T) {
+	db := newEditTestDB(t)
+	defer os.RemoveAll(db.ProjectDir)
+
+	for _, at := range []int64{0, 100, 150, -1} {
+		if _, err := db.Edit(split("s1", at), protocol.Chunk{}); ErrorCode(err) != protocol.ErrorInvalidPayload {
+			t.Errorf("expected error code %s for split at %d, got %v", protocol.ErrorInvalidPayload, at, err)
+		}
+	}
+	if _, err := db.Edit(split("s0", 50), protocol.Chunk{}); ErrorCode(err) != protocol.ErrorNotFound {
+		t.Errorf("expected error code %s for unknown segment, got %v", protocol.ErrorNotFound, err)
+	}
+	db.Lock("s1", "user2")
+	if _, err := db.Edit(split("s1", 50), protocol.Chunk{}); ErrorCode(err) != protocol.ErrorLocked {
+		t.Errorf("expected error code %s for segment locked by another user, got %v", protocol.ErrorLocked, err)
+	}
+	db.Unlock("s1", "user2")
+
+	res, err := db.Edit(split("s1", 40), protocol.Chunk{})
+	if err != nil {
+		t.Errorf("got error from Edit: %v", err)
+		return
+	}
+	if len(res.Segments) != 2 || res.Segments[0].ID != "s1_split1" || res.Segments[0].Chunk != (protocol.Chunk{Start: 0, End: 40}) || res.Segments[1].ID != "s1_split2" || res.Segments[1].Chunk != (protocol.Chunk{Start: 40, End: 100}) {
+		t.Errorf("expected s1_split1 (0-40) and s1_split2 (40-100), got %#v", res.Segments)
+	}
+	for _, seg := range res.Segments {
+		d := seg.Derivation
+		if d == nil || d.Operation != protocol.EditSplit || !equalStrings(d.Parents, []string{"s1"}) || !equalStrings(d.Sources, []string{"s1"}) || d.User != "user1" {
+			t.Errorf("unexpected derivation for %s: %#v", seg.ID, d)
+		}
+		// split segments keep the metadata, but not the text
+		if v, _ := seg.Meta.Value("speaker"); v != "A" || seg.Text != "" {
+			t.Errorf("expected speaker A and no text for %s, got %#v and %q", seg.ID, seg.Meta, seg.Text)
+		}
+	}
+	if anno, _ := db.GetSegment("s1"); anno.CurrentStatus.Name != StatusReplaced || anno.CurrentStatus.Source != "user1" {
+		t.Errorf("expected s1 to be replaced by user1, got %#v", anno.CurrentStatus)
+	}
+	if _, err := db.Edit(split("s1", 50), protocol.Chunk{}); ErrorCode(err) != protocol.ErrorConflict {
+		t.Errorf("expected error code %s for split of a replaced segment, got %v", protocol.ErrorConflict, err)
+	}
+	if err := save(db, "s1", StatusOK, "user1", ""); ErrorCode(err) != protocol.ErrorConflict {
+		t.Errorf("expected error code %s for saving a replaced segment, got %v", protocol.ErrorConflict, err)
+	}
+
+	// a derived segment can be split again, and the new segments are placed after the other segments derived from the same source segment
+	if _, err := db.Edit(split("s1_split1", 20), protocol.Chunk{}); err != nil {
+		t.Errorf("got error from Edit: %v", err)
+	}
+	exp := []string{"s1", "s1_split1", "s1_split2", "s1_split1_split1", "s1_split1_split2", "s2", "s3", "t1"}
+	if got := exportIDs(db, true); !equalStrings(got, exp) {
+		t.Errorf("expected all segments %v, got %v", exp, got)
+	}
+	exp = []string{"s1_split2", "s1_split1_split1", "s1_split1_split2", "s2", "s3", "t1"}
+	export := db.Export(false)
+	if got := ids(export); !equalStrings(got, exp) {
+		t.Errorf("expected exported segments %v, got %v", exp, got)
+	}
+	// the index is the position in the source data, including derived and replaced segments
+	for i, exp := range []int64{3, 4, 5, 6, 7, 8} {
+		if export[i].Index != exp {
+			t.Errorf("expected index %d for %s, got %d", exp, export[i].ID, export[i].Index)
+		}
+	}
+	if d := export[1].Derivation; d == nil || !equalStrings(d.Parents, []string{"s1_split1"}) || !equalStrings(d.Sources, []string{"s1"}) {
+		t.Errorf("expected s1_split1_split1 to be derived from s1_split1, with source s1, got %#v", d)
+	}
+
+	// the derived segments are loaded in the same order
+	db = reload(t, db)
+	if got := exportIDs(db, false); !equalStrings(got, exp) {
+		t.Errorf("expected exported segments %v after reload, got %v", exp, got)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	db := newEditTestDB(t)
+	defer os.RemoveAll(db.ProjectDir)
+
+	for _, edit := range []protocol.EditPayload{merge("s1"), merge("s1", "s3"), merge("s3", "t1"), merge("s2", "s1")} {
+		if _, err := db.Edit(edit, protocol.Chunk{}); ErrorCode(err) != protocol.ErrorInvalidPayload {
+			t.Errorf("expected error code %s for merge of %v, got %v", protocol.ErrorInvalidPayload, edit.SegmentIDs, err)
+		}
+	}
+	// the validation errors didn't change the data
+	if got, exp := exportIDs(db, true), []string{"s1", "s2", "s3", "t1"}; !equalStrings(got, exp) {
+		t.Errorf("expected segments %v, got %v", exp, got)
+	}
+
+	res, err := db.Edit(merge("s1", "s2"), protocol.Chunk{})
+	if err != nil {
+		t.Errorf("got error from Edit: %v", err)
+		return
+	}
+	if len(res.Segments) != 1 || res.Segments[0].ID != "s1_merge1" || res.Segments[0].Chunk != (protocol.Chunk{Start: 0, End: 300}) {
+		t.Errorf("expected s1_merge1 (0-300), got %#v", res.Segments)
+		return
+	}
+	seg := res.Segments[0]
+	// the shared metadata is kept, and the texts are joined
+	if len(seg.Meta) != 1 || seg.Meta["speaker"] != "A" || seg.Text != "one two" {
+		t.Errorf("expected speaker A and text %q, got %#v and %q", "one two", seg.Meta, seg.Text)
+	}
+	if !equalStrings(seg.Derivation.Sources, []string{"s1", "s2"}) {
+		t.Errorf("expected sources [s1 s2], got %v", seg.Derivation.Sources)
+	}
+
+	// removed segments are skipped when checking for adjacent segments
+	if err := save(db, "s3", StatusRejected, "user1", ""); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	if _, err := db.Edit(merge("s1_merge1", "s3"), protocol.Chunk{}); ErrorCode(err) != protocol.ErrorInvalidPayload {
+		t.Errorf("expected error code %s for merge with a rejected segment, got %v", protocol.ErrorInvalidPayload, err)
+	}
+	if got, exp := exportIDs(db, false), []string{"s1_merge1", "t1"}; !equalStrings(got, exp) {
+		t.Errorf("expected exported segments %v, got %v", exp, got)
+	}
+	db = reload(t, db)
+	if got, exp := exportIDs(db, false), []string{"s1_merge1", "t1"}; !equalStrings(got, exp) {
+		t.Errorf("expected exported segments %v after reload, got %v", exp, got)
+	}
+}
+
+func TestInsert(t *testing.T) {
+	db := newEditTestDB(t)
+	defer os.RemoveAll(db.ProjectDir)
+	window := protocol.Chunk{Start: 100, End: 400}
+
+	for _, edit := range []protocol.EditPayload{insert("s2", 150, 150), insert("s2", 160, 150), insert("s2", -10, 50), insert("s2", 0, 100), insert("s2", 400, 450)} {
+		if _, err := db.Edit(edit, window); ErrorCode(err) != protocol.ErrorInvalidPayload {
+			t.Errorf("expected error code %s for insert of %v in window %v, got %v", protocol.ErrorInvalidPayload, *edit.Chunk, window, err)
+		}
+	}
+	edit := insert("s2", 320, 500)
+	edit.SegmentIDs = []string{"s2", "s3"}
+	if _, err := db.Edit(edit, window); ErrorCode(err) != protocol.ErrorInvalidPayload {
+		t.Errorf("expected error code %s for insert with two segments, got %v", protocol.ErrorInvalidPayload, err)
+	}
+
+	// the chunk is clipped to the window
+	res, err := db.Edit(insert("s2", 320, 500), window)
+	if err != nil {
+		t.Errorf("got error from Edit: %v", err)
+		return
+	}
+	if len(res.Segments) != 1 || res.Segments[0].ID != "s2_insert1" || res.Segments[0].Chunk != (protocol.Chunk{Start: 320, End: 400}) {
+		t.Errorf("expected s2_insert1 (320-400), got %#v", res.Segments)
+		return
+	}
+	// inserted segments have no metadata or text, and the parent is kept
+	if seg := res.Segments[0]; seg.Meta != nil || seg.Text != "" {
+		t.Errorf("expected no metadata or text, got %#v and %q", seg.Meta, seg.Text)
+	}
+	if anno, _ := db.GetSegment("s2"); anno.CurrentStatus.Name != StatusUnchecked {
+		t.Errorf("expected s2 to be unchecked, got %s", anno.CurrentStatus.Name)
+	}
+	if _, err := db.Edit(insert("s2", 110, 150), window); err != nil {
+		t.Errorf("got error from Edit: %v", err)
+	}
+
+	// inserted segments can be deleted
+	if err := save(db, "s2_insert2", StatusDeleted, "user1", ""); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	exp := []string{"s1", "s2", "s2_insert1", "s3", "t1"}
+	if got := exportIDs(db, false); !equalStrings(got, exp) {
+		t.Errorf("expected exported segments %v, got %v", exp, got)
+	}
+	db = reload(t, db)
+	if got := exportIDs(db, false); !equalStrings(got, exp) {
+		t.Errorf("expected exported segments %v after reload, got %v", exp, got)
+	}
+	if got, exp := ids(db.SegmentsForURL("/audio/a.wav", "", Filter{})), []string{"s1", "s2_insert2", "s2", "s2_insert1", "s3"}; !equalStrings(got, exp) {
+		t.Errorf("expected segments %v in order of start time, got %v", exp, got)
+	}
+}
+
+func TestEditRollback(t *testing.T) {
+	db := newEditTestDB(t)
+	defer os.RemoveAll(db.ProjectDir)
+	if err := save(db, "s1", StatusOK, "user1", ""); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+
+	// saving s2 fails, since the annotation file is a directory
+	blocker := filepath.Join(db.AnnotationDataDir, "s2.json")
+	if err := os.Mkdir(blocker, 0700); err != nil {
+		t.Errorf("got error from Mkdir: %v", err)
+		return
+	}
+	if _, err := db.Edit(merge("s1", "s2"), protocol.Chunk{}); err == nil {
+		t.Errorf("expected error from Edit")
+	}
+	os.Remove(blocker)
+
+	if anno, _ := db.GetSegment("s1"); anno.CurrentStatus.Name != StatusOK {
+		t.Errorf("expected s1 to be restored to status ok, got %s", anno.CurrentStatus.Name)
+	}
+	if anno, _ := db.GetSegment("s2"); anno.CurrentStatus.Name != StatusUnchecked {
+		t.Errorf("expected s2 to be unchecked, got %s", anno.CurrentStatus.Name)
+	}
+	if files, _ := ioutil.ReadDir(db.DerivedDataDir); len(files) != 0 {
+		t.Errorf("expected no derived files, found %d", len(files))
+	}
+	db = reload(t, db)
+	if got, exp := exportIDs(db, true), []string{"s1", "s2", "s3", "t1"}; !equalStrings(got, exp) {
+		t.Errorf("expected segments %v after reload, got %v", exp, got)
+	}
+}
+
+func TestRecoverEdits(t *testing.T) {
+	db := newEditTestDB(t)
+	defer os.RemoveAll(db.ProjectDir)
+	res, err := db.Edit(split("s1", 50), protocol.Chunk{})
+	if err != nil {
+		t.Errorf("got error from Edit: %v", err)
+		return
+	}
+	if _, err := db.Edit(merge("s2", "s3"), protocol.Chunk{}); err != nil {
+		t.Errorf("got error from Edit: %v", err)
+		return
+	}
+
+	// the merge was interrupted before s3 was replaced: it is completed on load
+	if err := os.Remove(filepath.Join(db.AnnotationDataDir, "s3.json")); err != nil {
+		t.Errorf("got error from Remove: %v", err)
+	}
+	// the split was interrupted after one of the new segments was saved: it is ignored on load, with the segments derived from it
+	if err := os.Remove(filepath.Join(db.AnnotationDataDir, "s1.json")); err != nil {
+		t.Errorf("got error from Remove: %v", err)
+	}
+	if err := os.Remove(filepath.Join(db.DerivedDataDir, res.Segments[1].ID+".json")); err != nil {
+		t.Errorf("got error from Remove: %v", err)
+	}
+	derived := res.Segments[0]
+	derived.ID = "s1_split1_insert1"
+	derived.Derivation = &protocol.Derivation{Operation: protocol.EditInsert, Parents: []string{"s1_split1"}, Sources: []string{"s1"}, User: "user1", Timestamp: "2099-01-01 00:00:00"}
+	if err := writeJSONFile(filepath.Join(db.DerivedDataDir, derived.ID+".json"), derived); err != nil {
+		t.Errorf("got error from writeJSONFile: %v", err)
+	}
+
+	db = reload(t, db)
+	if got, exp := exportIDs(db, false), []string{"s1", "s2_merge1", "t1"}; !equalStrings(got, exp) {
+		t.Errorf("expected exported segments %v after recovery, got %v", exp, got)
+	}
+	if anno, _ := db.GetSegment("s3"); anno.CurrentStatus.Name != StatusReplaced || anno.CurrentStatus.Source != "user1" {
+		t.Errorf("expected s3 to be replaced by user1, got %#v", anno.CurrentStatus)
+	}
+	// the completed edit is saved
+	db = reload(t, db)
+	if _, ok := db.annotationData["s3"]; !ok {
+		t.Errorf("expected an annotation for s3 after recovery")
+	}
+}
+
+func TestValidateDerivation(t *testing.T) {
+	parent := testSegment("s1", "/audio/a.wav", 0, 100)
+	derivation := func(operation string, parents ...string) *protocol.Derivation {
+		return &protocol.Derivation{Operation: operation, Parents: parents, Sources: []string{"s1"}, User: "user1", Timestamp: "2020-01-01 00:00:00"}
+	}
+	for _, test := range []struct {
+		name string
+		seg  protocol.SegmentPayload
+	}{
+		{name: "unknown operation", seg: protocol.SegmentPayload{Derivation: derivation("join", "s1")}},
+		{name: "no user", seg: protocol.SegmentPayload{Derivation: &protocol.Derivation{Operation: protocol.EditInsert, Parents: []string{"s1"}, Sources: []string{"s1"}, Timestamp: "2020-01-01 00:00:00"}}},
+		{name: "merge with one parent", seg: protocol.SegmentPayload{Derivation: derivation(protocol.EditMerge, "s1")}},
+		{name: "unknown parent", seg: protocol.SegmentPayload{Derivation: derivation(protocol.EditInsert, "s0")}},
+		{name: "different url", seg: protocol.SegmentPayload{URL: "/audio/b.wav", Derivation: derivation(protocol.EditInsert, "s1")}},
+		{name: "no sources", seg: protocol.SegmentPayload{Derivation: &protocol.Derivation{Operation: protocol.EditInsert, Parents: []string{"s1"}, User: "user1", Timestamp: "2020-01-01 00:00:00"}}},
+	} {
+		db := newTestDB(t, "", parent)
+		seg := test.seg
+		seg.ID = "d1"
+		if seg.URL == "" {
+			seg.URL = parent.URL
+		}
+		seg.SegmentType = parent.SegmentType
+		seg.Chunk = protocol.Chunk{Start: 10, End: 20}
+		if err := writeJSONFile(filepath.Join(db.DerivedDataDir, "d1.json"), seg); err != nil {
+			t.Errorf("got error from writeJSONFile: %v", err)
+		}
+		if err := NewDBAPI(db.ProjectDir).LoadData(); err == nil {
+			t.Errorf("expected error from LoadData for derived segment with %s", test.name)
+		}
+		os.RemoveAll(db.ProjectDir)
+	}
+}
@@ -0,0 +1,41 @@
+package dbapi
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// Error is an error with an error code and structured details, for clients to react on
+type Error struct {
+	Code    protocol.ErrorCode
+	Msg     string
+	Details map[string]string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func newError(code protocol.ErrorCode, details map[string]string, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, args...), Details: details}
+}
+
+// ErrorCode returns the error code for err, or protocol.ErrorInternal if err is not (or does not wrap) an *Error
+func ErrorCode(err error) protocol.ErrorCode {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return protocol.ErrorInternal
+}
+
+// ErrorDetails returns the error details for err, or nil if err is not (or does not wrap) an *Error
+func ErrorDetails(err error) map[string]string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Details
+	}
+	return nil
+}
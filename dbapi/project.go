@@ -0,0 +1,279 @@
+package dbapi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/stts-se/segment_checker/log"
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// ProjectConfigFile is the name of the (optional) project config file in the project folder
+const ProjectConfigFile = "project.json"
+
+// DefaultStatuses are the statuses used for projects without statuses in the project config
+var DefaultStatuses = []protocol.StatusConfig{
+	{Name: StatusSkip, Label: StatusBadSample, Button: "bs+next", Color: "#ff5757", Key: "b", Description: "Save as skip with label 'bad sample', and get next"},
+	{Name: StatusSkip, Button: "skip+next", Color: "orange", Key: "s", Description: "Save as skip and get next"},
+	{Name: StatusOK, Button: "save+next", Color: "lightgreen", Key: "o", Description: "Save as ok and get next"},
+}
+
+// DefaultTextStatus is added to the default statuses for projects with text: with text rules in the project config, or with source segments with a text
+var DefaultTextStatus = protocol.StatusConfig{Name: StatusTextVerified, Button: "text ok+next", Color: "mediumseagreen", Key: "t", Description: "Save the boundaries and the text as checked, and get next"}
+
+// DefaultContext is the default audio context (in milliseconds, before and after the segment) for projects without a context in the project config
+const DefaultContext = int64(1000)
+
+// DefaultSegmentTypeContexts are the default audio contexts of segment types, for projects without a context in the project config
+var DefaultSegmentTypeContexts = map[string]int64{
+	"e":       200,
+	"silence": 1000,
+}
+
+// reservedStatuses can not be used for configured statuses: they are set by the server or by edit operations, or used in queries
+var reservedStatuses = []string{StatusUnchecked, StatusReplaced, StatusRejected, StatusDeleted, StatusChecked, StatusAny}
+
+// LoadProjectConfig reads the project config from the project folder. If there is no config file, the default config is returned.
+// Default statuses and button texts are filled in. The default text status is included if the source data (which should be loaded first) has segments with a text.
+func (api *DBAPI) LoadProjectConfig() (protocol.ProjectConfig, error) {
+	res := protocol.ProjectConfig{}
+	hasText := false
+	for _, seg := range api.sourceData {
+		if seg.Text != "" {
+			hasText = true
+			break
+		}
+	}
+	fn := path.Join(api.ProjectDir, ProjectConfigFile)
+	bts, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		log.Info("dbapi No project config file %s, using default settings", fn)
+		return withDefaults(res, hasText), nil
+	}
+	if err != nil {
+		return res, fmt.Errorf("couldn't read project config file %s : %v", fn, err)
+	}
+	err = protocol.UnmarshalStrict(bts, &res)
+	if err != nil {
+		return res, fmt.Errorf("couldn't unmarshal project config file %s : %v", fn, err)
+	}
+	err = validateProjectConfig(res)
+	if err != nil {
+		return res, fmt.Errorf("invalid project config file %s : %v", fn, err)
+	}
+	return withDefaults(res, hasText), nil
+}
+
+// withDefaults fills in the default statuses, the button texts of the statuses, and the default contexts.
+// The default statuses include the default text status if the project has text rules, or if hasText is set (for projects with segments with a text).
+// If the project config has no context, the default contexts of the segment types are used for segment types without a configured context.
+func withDefaults(config protocol.ProjectConfig, hasText bool) protocol.ProjectConfig {
+	segmentTypes := map[string]protocol.SegmentTypeConfig{}
+	for name, typeConfig := range config.SegmentTypes {
+		segmentTypes[name] = typeConfig
+	}
+	if config.Context == 0 {
+		config.Context = DefaultContext
+		for name, context := range DefaultSegmentTypeContexts {
+			typeConfig := segmentTypes[name]
+			if typeConfig.Context == 0 {
+				typeConfig.Context = context
+				segmentTypes[name] = typeConfig
+			}
+		}
+	}
+	config.SegmentTypes = segmentTypes
+	statuses := config.Statuses
+	if len(statuses) == 0 {
+		statuses = DefaultStatuses
+		if hasText || config.Text.Chars != "" || config.Text.Pattern != "" {
+			statuses = append(append([]protocol.StatusConfig{}, DefaultStatuses...), DefaultTextStatus)
+		}
+	}
+	config.Statuses = []protocol.StatusConfig{}
+	for _, status := range statuses {
+		if status.Button == "" {
+			status.Button = status.DisplayName()
+		}
+		config.Statuses = append(config.Statuses, status)
+	}
+	return config
+}
+
+// allLabels returns the labels of the statuses, followed by the additional labels
+func allLabels(config protocol.ProjectConfig) []string {
+	res := []string{}
+	for _, status := range config.Statuses {
+		if status.Label != "" && !contains(res, status.Label) {
+			res = append(res, status.Label)
+		}
+	}
+	for _, label := range config.Labels {
+		if !contains(res, label) {
+			res = append(res, label)
+		}
+	}
+	return res
+}
+
+func validateProjectConfig(config protocol.ProjectConfig) error {
+	if config.Channel < 0 {
+		return fmt.Errorf("invalid channel %d", config.Channel)
+	}
+	if config.Context < 0 {
+		return fmt.Errorf("invalid context %d", config.Context)
+	}
+	displayNames := []string{}
+	keys := []string{}
+	for _, status := range config.Statuses {
+		if status.Name == "" {
+			return fmt.Errorf("empty status name")
+		}
+		if contains(reservedStatuses, status.Name) || contains(reservedStatuses, status.Label) {
+			return fmt.Errorf("status %s is reserved (reserved statuses: %s)", status.DisplayName(), strings.Join(reservedStatuses, ", "))
+		}
+		if contains(displayNames, status.DisplayName()) {
+			return fmt.Errorf("duplicate status %s", status.DisplayName())
+		}
+		displayNames = append(displayNames, status.DisplayName())
+		if status.Key != "" {
+			if contains(keys, status.Key) {
+				return fmt.Errorf("duplicate key %s for status %s", status.Key, status.DisplayName())
+			}
+			keys = append(keys, status.Key)
+		}
+	}
+	for _, label := range config.Labels {
+		if label == "" {
+			return fmt.Errorf("empty label in labels")
+		}
+	}
+	playback := config.Playback
+	if math.IsNaN(playback.Gain) || math.Abs(playback.Gain) > 60 {
+		return fmt.Errorf("invalid playback gain %v (expected -60 to 60 dB)", playback.Gain)
+	}
+	if playback.HighPass < 0 || math.IsNaN(playback.HighPass) {
+		return fmt.Errorf("invalid playback highpass frequency %v", playback.HighPass)
+	}
+	if playback.SampleRate != 0 && (playback.SampleRate < 1000 || playback.SampleRate > 192000) {
+		return fmt.Errorf("invalid playback sample rate %d (expected 1000 to 192000 Hz)", playback.SampleRate)
+	}
+	if playback.FadeMs < 0 {
+		return fmt.Errorf("invalid playback fade length %d", playback.FadeMs)
+	}
+	for _, segmentType := range config.Contours {
+		if segmentType == "" {
+			return fmt.Errorf("empty segment type in contours")
+		}
+	}
+	for _, segmentType := range config.Suggestions {
+		if segmentType == "" {
+			return fmt.Errorf("empty segment type in suggestions")
+		}
+	}
+	for _, key := range config.MetaStats {
+		if key == "" {
+			return fmt.Errorf("empty key in meta_stats")
+		}
+	}
+	for segmentType, typeConfig := range config.SegmentTypes {
+		if segmentType == "" {
+			return fmt.Errorf("empty segment type in segment_types")
+		}
+		if typeConfig.Context < 0 {
+			return fmt.Errorf("invalid context %d for segment type %s", typeConfig.Context, segmentType)
+		}
+		for _, label := range typeConfig.Labels {
+			if !contains(allLabels(withDefaults(config, false)), label) {
+				return fmt.Errorf("unknown label %s for segment type %s (not a label of the project)", label, segmentType)
+			}
+		}
+	}
+	if _, err := textPattern(config.Text); err != nil {
+		return fmt.Errorf("invalid text pattern %s : %v", config.Text.Pattern, err)
+	}
+	return nil
+}
+
+// Config returns the project config
+func (api *DBAPI) Config() protocol.ProjectConfig {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	return api.config
+}
+
+// Channel returns the audio channel for the segment (starting at 1), using the project default for segments without a channel. 0 means all channels.
+func (api *DBAPI) Channel(segment protocol.SegmentPayload) int {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	return api.channel(segment)
+}
+
+// channel returns the audio channel for the segment, see Channel (api.dbMutex should be locked)
+func (api *DBAPI) channel(segment protocol.SegmentPayload) int {
+	if segment.Channel > 0 {
+		return segment.Channel
+	}
+	return api.config.Channel
+}
+
+// statusAllowed returns true if annotators can save the status: a configured status, or rejected or deleted (api.dbMutex should be locked)
+func (api *DBAPI) statusAllowed(name string) bool {
+	if name == StatusRejected || name == StatusDeleted {
+		return true
+	}
+	for _, status := range api.config.Statuses {
+		if status.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkStatusAndLabels checks that annotators can save the status of the annotation (see statusAllowed), and that the labels are labels of the project, allowed for the segment type (api.dbMutex should be locked)
+func (api *DBAPI) checkStatusAndLabels(annotation protocol.AnnotationPayload) error {
+	if !api.statusAllowed(annotation.CurrentStatus.Name) {
+		return newError(protocol.ErrorInvalidPayload, map[string]string{"segment_id": annotation.ID, "status": annotation.CurrentStatus.Name}, "unknown status %s for segment %s", annotation.CurrentStatus.Name, annotation.ID)
+	}
+	for _, label := range annotation.Labels {
+		if !contains(allLabels(api.config), label) {
+			return newError(protocol.ErrorInvalidPayload, map[string]string{"segment_id": annotation.ID, "label": label}, "unknown label %s for segment %s", label, annotation.ID)
+		}
+		if allowed := api.config.SegmentTypes[annotation.SegmentType].Labels; len(allowed) > 0 && !contains(allowed, label) {
+			return newError(protocol.ErrorInvalidPayload, map[string]string{"segment_id": annotation.ID, "label": label}, "label %s is not allowed for segment type %s", label, annotation.SegmentType)
+		}
+	}
+	return nil
+}
+
+// displayStatus returns the name that a status is shown, searched and counted by: the label of a configured status, if the labels include it, or else the status name.
+// The label applies whatever the status name (an annotation with label "bad sample" is a bad sample), except for the built-in statuses, such as rejected and replaced (api.dbMutex should be locked).
+func (api *DBAPI) displayStatus(name string, labels []string) string {
+	if contains(reservedStatuses, name) {
+		return name
+	}
+	for _, status := range api.config.Statuses {
+		if status.Label != "" && contains(labels, status.Label) {
+			return status.Label
+		}
+	}
+	return name
+}
+
+// Contours returns true if pitch and intensity contours are enabled for the segment type
+func (api *DBAPI) Contours(segmentType string) bool {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	return contains(api.config.Contours, segmentType)
+}
+
+// Suggestions returns true if boundary suggestions are enabled for the segment type
+func (api *DBAPI) Suggestions(segmentType string) bool {
+	api.dbMutex.RLock()
+	defer api.dbMutex.RUnlock()
+	return contains(api.config.Suggestions, segmentType)
+}
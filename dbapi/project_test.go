@@ -0,0 +1,214 @@
+package dbapi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+func TestDefaultConfig(t *testing.T) {
+	db := newTestDB(t, "",
+		testSegment("s1", "/audio/a.wav", 0, 100),
+		testSegment("s2", "/audio/a.wav", 200, 300),
+		testSegment("s3", "/audio/a.wav", 400, 500),
+		testSegment("s4", "/audio/a.wav", 600, 700),
+		testSegment("s5", "/audio/a.wav", 800, 900),
+	)
+	defer os.RemoveAll(db.ProjectDir)
+
+	config := db.Config()
+	if len(config.Statuses) != len(DefaultStatuses) {
+		t.Errorf("expected the default statuses, got %#v", config.Statuses)
+	}
+	for _, test := range []struct {
+		id     string
+		status string
+		labels []string
+	}{
+		{id: "s1", status: StatusSkip, labels: []string{StatusBadSample}},
+		{id: "s2", status: StatusSkip},
+		{id: "s3", status: StatusOK},
+		{id: "s4", status: StatusRejected, labels: []string{StatusBadSample}},
+	} {
+		if err := save(db, test.id, test.status, "user1", "", test.labels...); err != nil {
+			t.Errorf("got error from Save: %v", err)
+		}
+	}
+
+	// as before the project config: segments with label bad sample are bad samples, and skip is skip without bad sample
+	for _, test := range []struct {
+		requestStatus string
+		exp           []string
+	}{
+		{requestStatus: StatusBadSample, exp: []string{"s1"}},
+		{requestStatus: StatusSkip, exp: []string{"s2"}},
+		{requestStatus: StatusOK, exp: []string{"s3"}},
+		{requestStatus: StatusRejected, exp: []string{"s4"}},
+		{requestStatus: StatusChecked, exp: []string{"s1", "s2", "s3", "s4"}},
+		{requestStatus: StatusUnchecked, exp: []string{"s5"}},
+	} {
+		if got := ids(db.ListSegments(test.requestStatus, Filter{})); !equalStrings(got, test.exp) {
+			t.Errorf("expected segments %v for request status %s, got %v", test.exp, test.requestStatus, got)
+		}
+	}
+	n, stats := db.CheckedSegmentStats()
+	if n != 4 {
+		t.Errorf("expected 4 checked segments, got %d", n)
+	}
+	for key, exp := range map[string]int{"status:bad sample": 1, "status:skip": 1, "status:ok": 1, "status:rejected": 1, "checked by:user1": 4} {
+		if stats[key] != exp {
+			t.Errorf("expected stats %s = %d, got %d", key, exp, stats[key])
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	for _, test := range []struct {
+		config string
+		exp    map[string]int64
+	}{
+		{config: "", exp: map[string]int64{"e": 200, "silence": 1000, "x": 1000}},
+		{config: `{"context": 500}`, exp: map[string]int64{"e": 500, "silence": 500, "x": 500}},
+		{config: `{"context": 500, "segment_types": {"e": {"context": 300}}}`, exp: map[string]int64{"e": 300, "silence": 500, "x": 500}},
+		{config: `{"segment_types": {"x": {"context": 300}}}`, exp: map[string]int64{"e": 200, "silence": 1000, "x": 300}},
+	} {
+		db := newTestDB(t, test.config, testSegment("s1", "/audio/a.wav", 0, 100))
+		for segmentType, exp := range test.exp {
+			if got := db.Context(segmentType); got != exp {
+				t.Errorf("expected context %d for segment type %s with config %q, got %d", exp, segmentType, test.config, got)
+			}
+		}
+		os.RemoveAll(db.ProjectDir)
+	}
+}
+
+func TestDefaultTextStatus(t *testing.T) {
+	withText := testSegment("s2", "/audio/a.wav", 200, 300)
+	withText.Text = "some text"
+	for _, test := range []struct {
+		name     string
+		config   string
+		segments []protocol.SegmentPayload
+		exp      bool
+	}{
+		{name: "no text", segments: []protocol.SegmentPayload{testSegment("s1", "/audio/a.wav", 0, 100)}},
+		{name: "source text", segments: []protocol.SegmentPayload{testSegment("s1", "/audio/a.wav", 0, 100), withText}, exp: true},
+		{name: "text rules", config: `{"text": {"chars": "abc "}}`, segments: []protocol.SegmentPayload{testSegment("s1", "/audio/a.wav", 0, 100)}, exp: true},
+		{name: "configured statuses", config: `{"statuses": [{"name": "ok"}]}`, segments: []protocol.SegmentPayload{withText}},
+	} {
+		db := newTestDB(t, test.config, test.segments...)
+		got := false
+		for _, status := range db.Config().Statuses {
+			if status.Name == StatusTextVerified {
+				got = true
+			}
+		}
+		if got != test.exp {
+			t.Errorf("%s: expected status %s to be included %v, got %v", test.name, StatusTextVerified, test.exp, got)
+		}
+		err := save(db, test.segments[0].ID, StatusTextVerified, "user1", "abc")
+		if test.exp && err != nil {
+			t.Errorf("%s: got error from Save: %v", test.name, err)
+		}
+		if !test.exp && ErrorCode(err) != protocol.ErrorInvalidPayload {
+			t.Errorf("%s: expected error code %s for status %s, got %v", test.name, protocol.ErrorInvalidPayload, StatusTextVerified, err)
+		}
+		os.RemoveAll(db.ProjectDir)
+	}
+}
+
+func TestValidateProjectConfig(t *testing.T) {
+	for _, test := range []struct {
+		config string
+		expErr string
+	}{
+		{config: `{"statuses": [{"name": "checked"}]}`, expErr: "status checked is reserved"},
+		{config: `{"statuses": [{"name": "skip", "label": "replaced"}]}`, expErr: "status replaced is reserved"},
+		{config: `{"statuses": [{"name": ""}]}`, expErr: "empty status name"},
+		{config: `{"statuses": [{"name": "ok"}, {"name": "ok"}]}`, expErr: "duplicate status ok"},
+		{config: `{"statuses": [{"name": "skip", "label": "noise"}, {"name": "ok", "label": "noise"}]}`, expErr: "duplicate status noise"},
+		{config: `{"statuses": [{"name": "ok", "key": "o"}, {"name": "skip", "key": "o"}]}`, expErr: "duplicate key o for status skip"},
+		{config: `{"labels": [""]}`, expErr: "empty label"},
+		{config: `{"segment_types": {"e": {"labels": ["noise"]}}}`, expErr: "unknown label noise for segment type e"},
+		{config: `{"context": -1}`, expErr: "invalid context"},
+		// valid configs
+		{config: `{"statuses": [{"name": "skip", "label": "bad sample", "key": "b"}, {"name": "skip", "key": "s"}, {"name": "ok", "key": "o"}]}`},
+		{config: `{"labels": ["noise"], "segment_types": {"e": {"labels": ["noise", "bad sample"]}}}`},
+	} {
+		config := protocol.ProjectConfig{}
+		if err := protocol.UnmarshalStrict([]byte(test.config), &config); err != nil {
+			t.Errorf("couldn't unmarshal config %s : %v", test.config, err)
+			continue
+		}
+		err := validateProjectConfig(config)
+		if test.expErr == "" && err != nil {
+			t.Errorf("expected config %s to be valid, got %v", test.config, err)
+		}
+		if test.expErr != "" && (err == nil || !strings.Contains(err.Error(), test.expErr)) {
+			t.Errorf("expected error %q for config %s, got %v", test.expErr, test.config, err)
+		}
+	}
+}
+
+const statusConfig = `{"statuses": [{"name": "ok"}, {"name": "creaky", "label": "creak"}], "labels": ["noise"]}`
+
+func TestSaveStatusAndLabels(t *testing.T) {
+	db := newTestDB(t, statusConfig, testSegment("s1", "/audio/a.wav", 0, 100))
+	defer os.RemoveAll(db.ProjectDir)
+
+	for _, test := range []struct {
+		status string
+		labels []string
+		ok     bool
+	}{
+		{status: StatusOK, ok: true},
+		{status: "creaky", labels: []string{"creak", "noise"}, ok: true},
+		{status: StatusRejected, ok: true},
+		{status: StatusDeleted, ok: true},
+		// statuses and labels not in the project config
+		{status: StatusSkip},
+		{status: StatusTextVerified},
+		{status: StatusReplaced},
+		{status: StatusOK, labels: []string{StatusBadSample}},
+		{status: StatusOK, labels: []string{"overlap"}},
+	} {
+		err := save(db, "s1", test.status, "user1", "", test.labels...)
+		if test.ok && err != nil {
+			t.Errorf("expected status %s with labels %v to be saved, got %v", test.status, test.labels, err)
+		}
+		if !test.ok && ErrorCode(err) != protocol.ErrorInvalidPayload {
+			t.Errorf("expected error code %s for status %s with labels %v, got %v", protocol.ErrorInvalidPayload, test.status, test.labels, err)
+		}
+	}
+}
+
+func TestLoadUnknownStatusAndLabels(t *testing.T) {
+	db := newTestDB(t, statusConfig, testSegment("s1", "/audio/a.wav", 0, 100), testSegment("s2", "/audio/a.wav", 200, 300))
+	defer os.RemoveAll(db.ProjectDir)
+	if err := save(db, "s1", "creaky", "user1", "", "creak", "noise"); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	writeConfig := func(config string) {
+		if err := ioutil.WriteFile(filepath.Join(db.ProjectDir, ProjectConfigFile), []byte(config), 0644); err != nil {
+			t.Fatalf("couldn't write project config: %v", err)
+		}
+	}
+
+	// the annotations are checked against the project config when the data is loaded
+	for _, config := range []string{
+		`{"statuses": [{"name": "ok"}, {"name": "creaky", "label": "creak"}]}`,
+		`{"statuses": [{"name": "ok"}], "labels": ["noise", "creak"]}`,
+	} {
+		writeConfig(config)
+		err := NewDBAPI(db.ProjectDir).LoadData()
+		if err == nil || !strings.Contains(err.Error(), "s1") {
+			t.Errorf("expected error for segment s1 with config %s, got %v", config, err)
+		}
+	}
+	writeConfig(statusConfig)
+	reload(t, db)
+}
@@ -0,0 +1,77 @@
+package dbapi
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// textPattern compiles the pattern of the text rules, matching the whole text (nil if there is no pattern)
+func textPattern(rules protocol.TextRules) (*regexp.Regexp, error) {
+	if rules.Pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + rules.Pattern + ")$")
+}
+
+// checkText checks a (non-empty) text against the project's text rules (api.dbMutex should be locked)
+func (api *DBAPI) checkText(text string) error {
+	if text == "" {
+		return nil
+	}
+	rules := api.config.Text
+	if rules.Chars != "" {
+		for _, r := range text {
+			if !strings.ContainsRune(rules.Chars, r) {
+				return fmt.Errorf("character %q is not allowed in the text", r)
+			}
+		}
+	}
+	re, err := textPattern(rules)
+	if err != nil {
+		return fmt.Errorf("invalid text pattern : %v", err)
+	}
+	if re != nil && !re.MatchString(text) {
+		return fmt.Errorf("text %q doesn't match the pattern %s", text, rules.Pattern)
+	}
+	return nil
+}
+
+// updateText checks the text of an annotation to save against the text rules, and sets the text history from the previous annotation, adding a text edit if the text is changed (api.dbMutex should be locked).
+// An empty text keeps the previous text, since clients unaware of the text (such as scripts using the HTTP API) don't send it. To remove the text, ClearText is set instead.
+func (api *DBAPI) updateText(annotation *protocol.AnnotationPayload, prev protocol.AnnotationPayload) error {
+	details := map[string]string{"segment_id": annotation.ID, "text": annotation.Text}
+	if annotation.ClearText && annotation.Text != "" {
+		return newError(protocol.ErrorInvalidPayload, details, "a text can't be set and cleared at the same time")
+	}
+	if annotation.Text == "" && !annotation.ClearText {
+		annotation.Text = prev.Text
+	}
+	annotation.ClearText = false
+	details["text"] = annotation.Text
+	if annotation.CurrentStatus.Name == StatusTextVerified && strings.TrimSpace(annotation.Text) == "" {
+		return newError(protocol.ErrorInvalidPayload, details, "status %s requires a text", StatusTextVerified)
+	}
+	changed := annotation.Text != prev.Text
+	if changed || annotation.CurrentStatus.Name == StatusTextVerified {
+		if err := api.checkText(annotation.Text); err != nil {
+			return newError(protocol.ErrorInvalidPayload, details, "%v", err)
+		}
+	}
+	// the text history is kept by the server
+	annotation.TextHistory = append([]protocol.TextEdit{}, prev.TextHistory...)
+	if changed {
+		annotation.TextHistory = append(annotation.TextHistory, protocol.TextEdit{
+			Text:      annotation.Text,
+			Source:    annotation.CurrentStatus.Source,
+			Timestamp: time.Now().Format(timestampLayout),
+		})
+	}
+	if len(annotation.TextHistory) == 0 {
+		annotation.TextHistory = nil
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package dbapi
+
+import (
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+const textConfig = `{"text": {"chars": "abcdefghijklmnopqrstuvwxyz ", "pattern": "[a-z]+( [a-z]+)*"}}`
+
+func TestCheckText(t *testing.T) {
+	db := newTestDB(t, textConfig, testSegment("s1", "/audio/a.wav", 0, 100))
+	defer os.RemoveAll(db.ProjectDir)
+
+	for _, text := range []string{"", "hello", "hello world"} {
+		if err := db.checkText(text); err != nil {
+			t.Errorf("expected text %q to be ok, got %v", text, err)
+		}
+	}
+	for _, text := range []string{"Hello", "hello, world", "hello  world", " hello", "hello "} {
+		if err := db.checkText(text); err == nil {
+			t.Errorf("expected error for text %q", text)
+		}
+	}
+}
+
+func TestSaveText(t *testing.T) {
+	seg2 := testSegment("s2", "/audio/a.wav", 200, 300)
+	seg2.Text = "source text"
+	db := newTestDB(t, textConfig, testSegment("s1", "/audio/a.wav", 0, 100), seg2)
+	defer os.RemoveAll(db.ProjectDir)
+
+	// a changed text is added to the text history
+	if err := save(db, "s1", StatusOK, "user1", "first text"); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	// an empty text keeps the current text
+	if err := save(db, "s1", StatusOK, "user2", ""); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	if err := save(db, "s1", StatusTextVerified, "user2", "second text"); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	anno, err := db.GetSegment("s1")
+	if err != nil {
+		t.Errorf("got error from GetSegment: %v", err)
+		return
+	}
+	if anno.Text != "second text" {
+		t.Errorf("expected text %q, got %q", "second text", anno.Text)
+	}
+	if len(anno.TextHistory) != 2 || anno.TextHistory[0].Text != "first text" || anno.TextHistory[0].Source != "user1" || anno.TextHistory[1].Text != "second text" || anno.TextHistory[1].Source != "user2" {
+		t.Errorf("unexpected text history %#v", anno.TextHistory)
+	}
+
+	// the text history is kept on reload
+	db = reload(t, db)
+	anno, _ = db.GetSegment("s1")
+	if anno.Text != "second text" || len(anno.TextHistory) != 2 {
+		t.Errorf("expected text %q with 2 edits after reload, got %q with %d", "second text", anno.Text, len(anno.TextHistory))
+	}
+
+	// the text rules are checked
+	err = save(db, "s1", StatusOK, "user1", "Bad text!")
+	if ErrorCode(err) != protocol.ErrorInvalidPayload {
+		t.Errorf("expected error code %s for text not matching the rules, got %v", protocol.ErrorInvalidPayload, err)
+	}
+
+	// the text can be cleared explicitly, but not set and cleared at the same time
+	clear := func(text string) error {
+		anno, _ := db.GetSegment("s1")
+		anno.Text = text
+		anno.ClearText = true
+		anno.SetCurrentStatus(protocol.Status{Name: StatusOK, Source: "user1", Timestamp: "2020-01-01 00:00:00"})
+		return db.Save(anno)
+	}
+	if err := clear("third text"); ErrorCode(err) != protocol.ErrorInvalidPayload {
+		t.Errorf("expected error code %s for a text set and cleared, got %v", protocol.ErrorInvalidPayload, err)
+	}
+	if err := clear(""); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	db = reload(t, db)
+	anno, _ = db.GetSegment("s1")
+	if anno.Text != "" || anno.ClearText || len(anno.TextHistory) != 3 || anno.TextHistory[2].Text != "" || anno.TextHistory[2].Source != "user1" {
+		t.Errorf("expected a cleared text, with the removal in the text history, got %q with %#v", anno.Text, anno.TextHistory)
+	}
+
+	// the source text is kept, without history, if the text is not changed
+	if err := save(db, "s2", StatusTextVerified, "user1", ""); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	anno, _ = db.GetSegment("s2")
+	if anno.Text != "source text" || len(anno.TextHistory) != 0 {
+		t.Errorf("expected source text without history, got %q with %d edits", anno.Text, len(anno.TextHistory))
+	}
+}
+
+func TestTextVerified(t *testing.T) {
+	seg2 := testSegment("s2", "/audio/a.wav", 200, 300)
+	seg2.Text = "Not Verifiable"
+	db := newTestDB(t, textConfig, testSegment("s1", "/audio/a.wav", 0, 100), seg2)
+	defer os.RemoveAll(db.ProjectDir)
+
+	// text verified requires a text
+	err := save(db, "s1", StatusTextVerified, "user1", "")
+	if ErrorCode(err) != protocol.ErrorInvalidPayload {
+		t.Errorf("expected error code %s for text verified without a text, got %v", protocol.ErrorInvalidPayload, err)
+	}
+	// an unchanged source text is checked against the rules for text verified only
+	if err := save(db, "s2", StatusOK, "user1", ""); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	err = save(db, "s2", StatusTextVerified, "user1", "")
+	if ErrorCode(err) != protocol.ErrorInvalidPayload {
+		t.Errorf("expected error code %s for text verified with a text not matching the rules, got %v", protocol.ErrorInvalidPayload, err)
+	}
+	if err := save(db, "s2", StatusTextVerified, "user1", "verifiable"); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+	if got := db.ListSegments(StatusTextVerified, Filter{}); !equalStrings(ids(got), []string{"s2"}) {
+		t.Errorf("expected text verified segments [s2], got %v", ids(got))
+	}
+}
+
+func TestTextSearch(t *testing.T) {
+	seg1 := testSegment("s1", "/audio/a.wav", 0, 100)
+	seg1.Text = "one two"
+	seg2 := testSegment("s2", "/audio/a.wav", 200, 300)
+	seg2.Text = "three"
+	seg3 := testSegment("s3", "/audio/a.wav", 400, 500)
+	seg3.Text = "two three"
+	db := newTestDB(t, "", seg1, seg2, seg3)
+	defer os.RemoveAll(db.ProjectDir)
+
+	// the annotated text is searched, not the source text
+	if err := save(db, "s2", StatusOK, "user1", "four"); err != nil {
+		t.Errorf("got error from Save: %v", err)
+	}
+
+	filter := Filter{Text: regexp.MustCompile("^t")}
+	if got := db.ListSegments(StatusAny, filter); !equalStrings(ids(got), []string{"s3"}) {
+		t.Errorf("expected segments [s3] for text ^t, got %v", ids(got))
+	}
+	filter = Filter{Text: regexp.MustCompile("two")}
+	if got := db.ListSegments(StatusAny, filter); !equalStrings(ids(got), []string{"s1", "s3"}) {
+		t.Errorf("expected segments [s1 s3] for text two, got %v", ids(got))
+	}
+
+	query := protocol.QueryPayload{UserName: "user1", RequestStatus: StatusAny, StepSize: 1, Text: "two"}
+	anno, err := db.GetNextSegment(query, "", false)
+	if err != nil || anno.ID != "s1" {
+		t.Errorf("expected s1 for text two, got %s (%v)", anno.ID, err)
+	}
+	query.CurrID = "s1"
+	anno, err = db.GetNextSegment(query, "", false)
+	if err != nil || anno.ID != "s3" {
+		t.Errorf("expected s3 after s1 for text two, got %s (%v)", anno.ID, err)
+	}
+	query.Text = "("
+	_, err = db.GetNextSegment(query, "", false)
+	if ErrorCode(err) != protocol.ErrorInvalidPayload {
+		t.Errorf("expected error code %s for invalid text search, got %v", protocol.ErrorInvalidPayload, err)
+	}
+
+	// the export has the annotated text
+	texts := []string{}
+	for _, anno := range db.Export(false) {
+		texts = append(texts, anno.Text)
+	}
+	if exp := []string{"one two", "four", "two three"}; !equalStrings(texts, exp) {
+		t.Errorf("expected exported texts %v, got %v", exp, texts)
+	}
+}
@@ -0,0 +1,65 @@
+package modules
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stts-se/segment_checker/log"
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// Analysis selects the analyses computed along with an extracted audio chunk (see ExtractURLWithAnalysis). The audio window is decoded once for all analyses.
+type Analysis struct {
+	// Contours: pitch and intensity tracks for the audio window, using the default options (see ComputeContours)
+	Contours bool
+	// Suggestion: suggested boundaries for this chunk (typically the source chunk of the segment), if not nil. The search for boundaries is limited to the audio window (see SuggestBoundaries).
+	Suggestion *protocol.Chunk
+}
+
+// String identifies the analyses in cache keys, and is empty if no analysis is selected
+func (a Analysis) String() string {
+	var res []string
+	if a.Contours {
+		res = append(res, "contours")
+	}
+	if a.Suggestion != nil {
+		res = append(res, fmt.Sprintf("suggestion:%d-%d:%d", a.Suggestion.Start, a.Suggestion.End, DefaultSuggestionWindow))
+	}
+	return strings.Join(res, ",")
+}
+
+// analyse decodes the audio window (from the source audio file, without playback preprocessing), and adds the selected analyses to the audio chunk.
+// Failed analyses are logged and left out, so that the audio can still be used.
+func analyse(res *protocol.AudioChunk, audioFile string, chunk, window protocol.Chunk, channel int, analysis Analysis) {
+	if analysis.String() == "" {
+		return
+	}
+	pcm, err := DecodePCM(audioFile, window, channel)
+	if err != nil {
+		log.Warning("Couldn't decode %s for analysis : %v", audioFile, err)
+		return
+	}
+	if analysis.Contours {
+		contours, err := ComputeContours(pcm, protocol.ContourOptions{})
+		if err != nil {
+			log.Warning("Couldn't compute contours for %s : %v", audioFile, err)
+		} else {
+			contours.Offset = window.Start
+			contours.Chunk = protocol.Chunk{
+				Start: chunk.Start - window.Start,
+				End:   chunk.End - window.Start,
+			}
+			res.Contours = &contours
+		}
+	}
+	if analysis.Suggestion != nil {
+		suggestion, err := SuggestBoundaries(pcm, *analysis.Suggestion, DefaultSuggestionWindow)
+		if err != nil {
+			log.Warning("Couldn't compute boundary suggestion for %s : %v", audioFile, err)
+		} else {
+			suggestion.Chunk.Start -= window.Start
+			suggestion.Chunk.End -= window.Start
+			res.Suggestion = &suggestion
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package modules
+
+import (
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+func TestExtractURLWithAnalysis(t *testing.T) {
+	ch, err := NewChunkExtractor()
+	if err != nil {
+		t.Errorf("got error from NewChunkExtractor: %v", err)
+		return
+	}
+	cache, err := NewChunkCache(10*1024*1024, "", 0)
+	if err != nil {
+		t.Errorf("got error from NewChunkCache: %v", err)
+		return
+	}
+	ch.SetCache(cache)
+	payload := protocol.SplitRequestPayload{
+		URL:          path.Join("test_data", "three_sentences.wav"),
+		Chunk:        protocol.Chunk{Start: 1000, End: 1500},
+		LeftContext:  200,
+		RightContext: 200,
+	}
+	source := protocol.Chunk{Start: 1020, End: 1480}
+	analysis := Analysis{Contours: true, Suggestion: &source}
+
+	res, _, err := ch.ExtractURLWithAnalysis(payload, "", analysis)
+	if err != nil {
+		t.Errorf("got error from ExtractURLWithAnalysis: %v", err)
+		return
+	}
+	// the same results as for separate decoding
+	expContours, err := ch.ContoursWithContext(payload, protocol.ContourOptions{})
+	if err != nil {
+		t.Errorf("got error from ContoursWithContext: %v", err)
+		return
+	}
+	if res.Contours == nil || !reflect.DeepEqual(*res.Contours, expContours) {
+		t.Errorf("expected contours %#v, got %#v", expContours, res.Contours)
+	}
+	pcm, err := DecodePCM(payload.URL, protocol.Chunk{Start: 800, End: 1700}, 0)
+	if err != nil {
+		t.Errorf("got error from DecodePCM: %v", err)
+		return
+	}
+	expSuggestion, err := SuggestBoundaries(pcm, source, DefaultSuggestionWindow)
+	if err != nil {
+		t.Errorf("got error from SuggestBoundaries: %v", err)
+		return
+	}
+	// relative to the offset, like the chunk
+	expSuggestion.Chunk = protocol.Chunk{Start: expSuggestion.Chunk.Start - 800, End: expSuggestion.Chunk.End - 800}
+	if res.Suggestion == nil || !reflect.DeepEqual(*res.Suggestion, expSuggestion) {
+		t.Errorf("expected suggestion %#v, got %#v", expSuggestion, res.Suggestion)
+	}
+
+	// the analyses are cached with the audio
+	res, _, err = ch.ExtractURLWithAnalysis(payload, "", analysis)
+	if err != nil {
+		t.Errorf("got error from ExtractURLWithAnalysis: %v", err)
+		return
+	}
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("expected one cache hit and one miss, got %#v", stats)
+	}
+	if res.Contours == nil || res.Suggestion == nil {
+		t.Errorf("expected the cached chunk to have contours and a suggestion")
+	}
+	// other analyses are cached separately
+	res, _, err = ch.ExtractURLWithContext(payload, "")
+	if err != nil {
+		t.Errorf("got error from ExtractURLWithContext: %v", err)
+		return
+	}
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("expected a cache miss for audio without analysis, got %#v", stats)
+	}
+	if res.Contours != nil || res.Suggestion != nil {
+		t.Errorf("expected no analysis, got %#v and %#v", res.Contours, res.Suggestion)
+	}
+}
@@ -0,0 +1,152 @@
+package modules
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// DefaultSuggestionWindow is the default search window (milliseconds) before and after each boundary, see SuggestBoundaries
+const DefaultSuggestionWindow = int64(100)
+
+const (
+	// suggestionFrameMs is the length (milliseconds) of the energy frames
+	suggestionFrameMs = 5.0
+	// suggestionStepMs is the time step (milliseconds) between energy frames
+	suggestionStepMs = 1.0
+	// suggestionThreshold is the energy threshold for an onset/offset, relative to the low (0) and high (1) energy levels in the search range
+	suggestionThreshold = 0.3
+	// suggestionMinContrast is the min difference (dB) between the low and high energy levels for a suggestion
+	suggestionMinContrast = 10.0
+	// suggestionSnapMs is the max distance (milliseconds) from an onset/offset to the zero crossing it is snapped to
+	suggestionSnapMs = 5.0
+)
+
+// SuggestionMethod describes the method used by SuggestBoundaries
+var SuggestionMethod = fmt.Sprintf("energy onset/offset (%v ms frames, threshold %v%%), snapped to zero crossings", suggestionFrameMs, suggestionThreshold*100)
+
+// SuggestBoundaries suggests new boundaries for the chunk, at the energy onset/offset nearest to each boundary within window milliseconds, snapped to the nearest zero crossing.
+// The decoded audio should cover the chunk and the search window. Boundaries without a clear energy onset/offset nearby are kept as they are.
+func SuggestBoundaries(pcm PCM, chunk protocol.Chunk, window int64) (protocol.BoundarySuggestion, error) {
+	res := protocol.BoundarySuggestion{
+		Chunk:  chunk,
+		Start:  float64(chunk.Start),
+		End:    float64(chunk.End),
+		Method: SuggestionMethod,
+	}
+	if pcm.SampleRate < 1 {
+		return res, fmt.Errorf("invalid sample rate %d", pcm.SampleRate)
+	}
+	if window < 1 {
+		return res, fmt.Errorf("invalid search window %d ms", window)
+	}
+	if chunk.End <= chunk.Start {
+		return res, fmt.Errorf("invalid chunk %v", chunk)
+	}
+	rate := float64(pcm.SampleRate)
+	frameSize := int(math.Round(suggestionFrameMs * rate / 1000))
+	step := suggestionStepMs * rate / 1000
+	frames := int(float64(len(pcm.Samples)) / step)
+	if frameSize < 1 || frames < 2 {
+		return res, nil
+	}
+
+	// energy (dB) per frame, centered at (i+0.5)*step
+	energy := make([]float64, frames)
+	for i := range energy {
+		from := int(math.Round((float64(i)+0.5)*step - float64(frameSize)/2))
+		var sum float64
+		var n int
+		for k := from; k < from+frameSize; k++ {
+			if k >= 0 && k < len(pcm.Samples) {
+				sum += pcm.Samples[k] * pcm.Samples[k]
+				n++
+			}
+		}
+		if n > 0 {
+			sum /= float64(n)
+		}
+		energy[i] = 10 * math.Log10(sum+1e-12)
+	}
+	frameTime := func(i float64) float64 {
+		return pcm.Start + (i+0.5)*suggestionStepMs
+	}
+
+	// the low and high energy levels (10th and 90th percentiles)
+	sorted := append([]float64{}, energy...)
+	sort.Float64s(sorted)
+	low, high := sorted[len(sorted)/10], sorted[len(sorted)*9/10]
+	if high-low < suggestionMinContrast {
+		return res, nil
+	}
+	threshold := low + suggestionThreshold*(high-low)
+
+	// nearest threshold crossing (interpolated between frames) within the search window
+	nearest := func(boundary float64) (float64, bool) {
+		best, found := 0.0, false
+		for i := 0; i+1 < frames; i++ {
+			a, b := energy[i], energy[i+1]
+			if (a < threshold) == (b < threshold) {
+				continue
+			}
+			t := frameTime(float64(i) + (threshold-a)/(b-a))
+			if math.Abs(t-boundary) > float64(window) {
+				continue
+			}
+			if !found || math.Abs(t-boundary) < math.Abs(best-boundary) {
+				best, found = t, true
+			}
+		}
+		return best, found
+	}
+
+	if t, ok := nearest(float64(chunk.Start)); ok {
+		res.Start, res.StartFound = snapToZeroCrossing(pcm, t), true
+	}
+	if t, ok := nearest(float64(chunk.End)); ok {
+		res.End, res.EndFound = snapToZeroCrossing(pcm, t), true
+	}
+	if res.End <= res.Start {
+		// no usable suggestion
+		res.Start, res.StartFound = float64(chunk.Start), false
+		res.End, res.EndFound = float64(chunk.End), false
+	}
+	res.Chunk = protocol.Chunk{Start: int64(math.Round(res.Start)), End: int64(math.Round(res.End))}
+	return res, nil
+}
+
+// snapToZeroCrossing returns the time (milliseconds) of the zero crossing nearest to t, within suggestionSnapMs. If there is no zero crossing, t is returned.
+func snapToZeroCrossing(pcm PCM, t float64) float64 {
+	rate := float64(pcm.SampleRate)
+	center := int(math.Round((t - pcm.Start) * rate / 1000))
+	maxDist := int(suggestionSnapMs * rate / 1000)
+	for d := 0; d <= maxDist; d++ {
+		for _, i := range []int{center - d, center + d} {
+			if i < 1 || i >= len(pcm.Samples) {
+				continue
+			}
+			a, b := pcm.Samples[i-1], pcm.Samples[i]
+			if a == 0 || (a < 0) != (b < 0) {
+				// the sample closest to zero
+				if math.Abs(a) <= math.Abs(b) {
+					return pcm.Time(i - 1)
+				}
+				return pcm.Time(i)
+			}
+		}
+	}
+	return t
+}
+
+// SuggestBoundariesForChunk decodes the chunk of the audioFile with the search window, and suggests new boundaries, see SuggestBoundaries
+func (ch ChunkExtractor) SuggestBoundariesForChunk(audioFile string, chunk protocol.Chunk, channel int, window int64) (protocol.BoundarySuggestion, error) {
+	// one frame extra, so that the energy is available for the whole search window
+	margin := window + int64(suggestionFrameMs)
+	pcm, err := DecodePCM(audioFile, ch.Window(audioFile, chunk, margin, margin), channel)
+	if err != nil {
+		return protocol.BoundarySuggestion{}, err
+	}
+	return SuggestBoundaries(pcm, chunk, window)
+}
@@ -0,0 +1,83 @@
+package modules
+
+import (
+	"math"
+	"path"
+	"testing"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+func TestSuggestBoundaries(t *testing.T) {
+	// 16 kHz: silence 0-500 ms, 150 Hz tone 500-1200 ms, silence 1200-1700 ms
+	pcm := PCM{PCMInfo: PCMInfo{SampleRate: 16000}}
+	for i := 0; i < 27200; i++ {
+		var s float64
+		if i >= 8000 && i < 19200 {
+			s = 0.5 * math.Sin(2*math.Pi*150*float64(i-8000)/16000)
+		}
+		pcm.Samples = append(pcm.Samples, s)
+	}
+	sugg, err := SuggestBoundaries(pcm, protocol.Chunk{Start: 460, End: 1250}, 100)
+	if err != nil {
+		t.Errorf("got error from SuggestBoundaries: %v", err)
+		return
+	}
+	if !sugg.StartFound || !sugg.EndFound {
+		t.Errorf("expected both boundaries to be found, got %#v", sugg)
+	}
+	if math.Abs(sugg.Start-500) > 5 || math.Abs(sugg.End-1200) > 5 {
+		t.Errorf("expected suggestion near 500-1200 ms, got %v-%v", sugg.Start, sugg.End)
+	}
+	if sugg.Chunk.Start != int64(math.Round(sugg.Start)) || sugg.Chunk.End != int64(math.Round(sugg.End)) {
+		t.Errorf("expected chunk %v-%v, got %v", sugg.Start, sugg.End, sugg.Chunk)
+	}
+	// snapped to zero crossings
+	for _, ms := range []float64{sugg.Start, sugg.End} {
+		i := int(math.Round(ms * 16000 / 1000))
+		if math.Abs(pcm.Samples[i]) > 0.05 {
+			t.Errorf("expected zero crossing at %v ms, got sample value %v", ms, pcm.Samples[i])
+		}
+	}
+
+	// no onset/offset within the search window
+	sugg, err = SuggestBoundaries(pcm, protocol.Chunk{Start: 200, End: 1250}, 100)
+	if err != nil {
+		t.Errorf("got error from SuggestBoundaries: %v", err)
+		return
+	}
+	if sugg.StartFound || sugg.Chunk.Start != 200 || !sugg.EndFound {
+		t.Errorf("expected only the end boundary to be moved, got %#v", sugg)
+	}
+
+	// no energy contrast
+	silence := PCM{PCMInfo: PCMInfo{SampleRate: 16000}, Samples: make([]float64, 16000)}
+	sugg, err = SuggestBoundaries(silence, protocol.Chunk{Start: 300, End: 600}, 100)
+	if err != nil {
+		t.Errorf("got error from SuggestBoundaries: %v", err)
+		return
+	}
+	if sugg.StartFound || sugg.EndFound || sugg.Chunk != (protocol.Chunk{Start: 300, End: 600}) {
+		t.Errorf("expected no suggestion for silence, got %#v", sugg)
+	}
+}
+
+func TestSuggestBoundariesForChunk(t *testing.T) {
+	ch, err := NewChunkExtractor()
+	if err != nil {
+		t.Errorf("got error from NewChunkExtractor: %v", err)
+		return
+	}
+	chunk := protocol.Chunk{Start: 1000, End: 1500}
+	sugg, err := ch.SuggestBoundariesForChunk(path.Join("test_data", "three_sentences.wav"), chunk, 0, 100)
+	if err != nil {
+		t.Errorf("got error from SuggestBoundariesForChunk: %v", err)
+		return
+	}
+	if sugg.Start < 900 || sugg.Start > 1100 || sugg.End < 1400 || sugg.End > 1600 || sugg.Start >= sugg.End {
+		t.Errorf("expected suggestion within the search window, got %v-%v", sugg.Start, sugg.End)
+	}
+	if sugg.Method == "" {
+		t.Errorf("expected method to be set")
+	}
+}
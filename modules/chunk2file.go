@@ -14,23 +14,90 @@ import (
 // Chunk2File extracts time chunks from an audio file, creating a subset of files containing "phrases" from the file.
 // For initialization, use NewChunk2File().
 type Chunk2File struct {
+	// Accurate: seek to a point before the chunk (see inputSeek), decode from there and trim at the exact sample, instead of seeking to the nearest frame (which may be off by tens of milliseconds for compressed input)
+	Accurate bool
 }
 
-// NewChunk2File creates a new Chunk2File after first checking that the ffmpeg command exists
+// seekMargin is the minimum time (in milliseconds) decoded before the chunk start in accurate mode, so that the decoder output has settled at the chunk start
+const seekMargin = 500
+
+// inputSeek returns the time (in milliseconds) where decoding starts for a chunk starting at start, in accurate mode: at least seekMargin before start, and rounded down to a whole second.
+// Since the seek point is a whole second, it falls on a sample boundary for any (integer) sample rate, and the first sample of the trimmed output is the same as without seeking (see FirstSample).
+func inputSeek(start int64) int64 {
+	seek := start - seekMargin
+	if seek <= 0 {
+		return 0
+	}
+	return seek - seek%1000
+}
+
+// accurateStart returns the time (in milliseconds) of the first sample of a chunk starting at start, extracted in accurate mode at the sample rate: the first sample at or after start, counted from the seek point (see inputSeek)
+func accurateStart(start int64, sampleRate int) float64 {
+	seek := inputSeek(start)
+	sample := seek*int64(sampleRate)/1000 + FirstSample(start-seek, sampleRate)
+	return float64(sample) * 1000.0 / float64(sampleRate)
+}
+
+// NewChunk2File creates a new Chunk2File (using accurate mode) after first checking that the ffmpeg command exists
 func NewChunk2File() (Chunk2File, error) {
 	if err := ffmpegEnabled(); err != nil {
 		return Chunk2File{}, err
 	}
-	return Chunk2File{}, nil
+	return Chunk2File{Accurate: true}, nil
 }
 
-// ProcessChunk extracts the specified chunk from the audioFile into the outFile
+// formatSeconds formats milliseconds as seconds, without rounding errors
+func formatSeconds(ms int64) string {
+	sign := ""
+	if ms < 0 {
+		sign = "-"
+		ms = -ms
+	}
+	return fmt.Sprintf("%s%d.%03d", sign, ms/1000, ms%1000)
+}
+
+// FirstSample returns the index of the first sample at or after the time (in milliseconds), for the sample rate
+func FirstSample(ms int64, sampleRate int) int64 {
+	return (ms*int64(sampleRate) + 999) / 1000
+}
+
+// ProcessChunk extracts the specified chunk from the audioFile into the outFile.
+// In accurate mode, the first sample is the first sample at or after the chunk start (see FirstSample and inputSeek).
 func (ch Chunk2File) ProcessChunk(audioFile string, chunk protocol.Chunk, outFile, encoding string) error {
-	startFloat := float64(chunk.Start) / 1000.0
-	endFloat := float64(chunk.End) / 1000.0
-	duration := endFloat - startFloat
-	//ffmpeg -y -ss 0 -t 30 -i <in> <out>
-	args := []string{"-y", "-ss", fmt.Sprintf("%v", startFloat), "-t", fmt.Sprintf("%v", duration), "-i", audioFile}
+	return ch.ProcessChunkWithChannel(audioFile, chunk, 0, outFile, encoding)
+}
+
+// panFilter returns an ffmpeg filter selecting one channel (starting at 1) as mono output
+func panFilter(channel int) string {
+	return fmt.Sprintf("pan=mono|c0=c%d", channel-1)
+}
+
+// ProcessChunkWithChannel extracts the specified chunk from the audioFile into the outFile, see ProcessChunk.
+// If channel > 0, only the specified channel (starting at 1) is extracted, as mono audio.
+func (ch Chunk2File) ProcessChunkWithChannel(audioFile string, chunk protocol.Chunk, channel int, outFile, encoding string) error {
+	var args []string
+	filters := []string{}
+	if ch.Accurate {
+		//ffmpeg -y -ss 10.000 -i <in> -af atrim=start=0.600:end=30.000,asetpts=PTS-STARTPTS <out>
+		// the input timestamps start at 0 at the seek point, so the chunk is trimmed relative to it
+		seek := inputSeek(chunk.Start)
+		trim := fmt.Sprintf("atrim=start=%s:end=%s,asetpts=PTS-STARTPTS", formatSeconds(chunk.Start-seek), formatSeconds(chunk.End-seek))
+		args = []string{"-y"}
+		if seek > 0 {
+			args = append(args, "-ss", formatSeconds(seek))
+		}
+		args = append(args, "-i", audioFile)
+		filters = append(filters, trim)
+	} else {
+		//ffmpeg -y -ss 0.000 -t 30.000 -i <in> <out>
+		args = []string{"-y", "-ss", formatSeconds(chunk.Start), "-t", formatSeconds(chunk.End - chunk.Start), "-i", audioFile}
+	}
+	if channel > 0 {
+		filters = append(filters, panFilter(channel))
+	}
+	if len(filters) > 0 {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
 	if encoding != "" {
 		args = append(args, "-f")
 		args = append(args, encoding)
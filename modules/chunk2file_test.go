@@ -91,3 +91,28 @@ func TestChunk2File1Wav(t *testing.T) {
 
 	}
 }
+
+func TestFormatSeconds(t *testing.T) {
+	for ms, exp := range map[int64]string{0: "0.000", 7: "0.007", 1587: "1.587", 60010: "60.010", -25: "-0.025"} {
+		if got := formatSeconds(ms); got != exp {
+			t.Errorf("expected %v, got %v", exp, got)
+		}
+	}
+}
+
+func TestInputSeek(t *testing.T) {
+	for start, exp := range map[int64]int64{0: 0, 400: 0, 500: 0, 1499: 0, 1500: 1000, 1587: 1000, 10600: 10000, 11499: 10000} {
+		if got := inputSeek(start); got != exp {
+			t.Errorf("expected seek point %d for start %d, got %d", exp, start, got)
+		}
+	}
+	// counted from the seek point, the first sample is the first sample at or after the start in the source
+	for _, sampleRate := range []int{8000, 16000, 22050, 44100, 48000} {
+		for _, start := range []int64{0, 65, 1587, 3885, 7647, 123457} {
+			exp := float64(FirstSample(start, sampleRate)) * 1000.0 / float64(sampleRate)
+			if got := accurateStart(start, sampleRate); got != exp {
+				t.Errorf("expected start %v for %d ms at %d Hz, got %v", exp, start, sampleRate, got)
+			}
+		}
+	}
+}
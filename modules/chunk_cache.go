@@ -0,0 +1,426 @@
+package modules
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stts-se/segment_checker/log"
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// ChunkCacheKey identifies an extracted audio chunk
+type ChunkCacheKey struct {
+	URL          string         `json:"url"`
+	Chunk        protocol.Chunk `json:"chunk"`
+	LeftContext  int64          `json:"left_context"`
+	RightContext int64          `json:"right_context"`
+	Encoding     string         `json:"encoding"`
+	// Accurate is the extraction mode, see Chunk2File.Accurate
+	Accurate bool `json:"accurate"`
+	// Channel is the extracted channel, starting at 1 (0 for all channels)
+	Channel int `json:"channel,omitempty"`
+	// Playback is the playback preprocessing, see protocol.PlaybackConfig
+	Playback protocol.PlaybackConfig `json:"playback,omitempty"`
+	// Analysis identifies the analyses cached with the audio, see Analysis.String
+	Analysis string `json:"analysis,omitempty"`
+}
+
+func (k ChunkCacheKey) String() string {
+	res := fmt.Sprintf("%s|%d-%d|%d|%d|%s|%v|%d", k.URL, k.Chunk.Start, k.Chunk.End, k.LeftContext, k.RightContext, k.Encoding, k.Accurate, k.Channel)
+	if k.Playback.Enabled() {
+		p := k.Playback
+		res = fmt.Sprintf("%s|%v|%v|%v|%d|%d", res, p.Gain, p.Normalize, p.HighPass, p.SampleRate, p.FadeMs)
+	}
+	if k.Analysis != "" {
+		res = fmt.Sprintf("%s|%s", res, k.Analysis)
+	}
+	return res
+}
+
+func (k ChunkCacheKey) hash() string {
+	h := sha1.Sum([]byte(k.String()))
+	return hex.EncodeToString(h[:])
+}
+
+// ChunkCacheStats holds cache metrics
+type ChunkCacheStats struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+	MemEntries    int   `json:"mem_entries"`
+	MemBytes      int64 `json:"mem_bytes"`
+	DiskEntries   int   `json:"disk_entries"`
+	DiskBytes     int64 `json:"disk_bytes"`
+}
+
+type cacheEntry struct {
+	Key ChunkCacheKey `json:"key"`
+	// Version of the source audio at the time of extraction, see ChunkCache.sourceVersion
+	Version string              `json:"version"`
+	Header  protocol.AudioChunk `json:"header"`
+	Size    int64               `json:"size"`
+
+	audio []byte // memory tier only
+}
+
+// lruTier is a size limited LRU list of cache entries. The front of the list is the most recently used entry.
+type lruTier struct {
+	maxBytes int64
+	bytes    int64
+	list     *list.List
+	index    map[string]*list.Element
+}
+
+func newLRUTier(maxBytes int64) lruTier {
+	return lruTier{maxBytes: maxBytes, list: list.New(), index: make(map[string]*list.Element)}
+}
+
+func (t *lruTier) get(hash string) (*cacheEntry, bool) {
+	if elem, ok := t.index[hash]; ok {
+		t.list.MoveToFront(elem)
+		return elem.Value.(*cacheEntry), true
+	}
+	return nil, false
+}
+
+func (t *lruTier) remove(hash string) {
+	if elem, ok := t.index[hash]; ok {
+		t.bytes -= elem.Value.(*cacheEntry).Size
+		t.list.Remove(elem)
+		delete(t.index, hash)
+	}
+}
+
+// add adds the entry, and returns the entries evicted to make room for it
+func (t *lruTier) add(hash string, entry *cacheEntry) []*cacheEntry {
+	t.remove(hash)
+	t.index[hash] = t.list.PushFront(entry)
+	t.bytes += entry.Size
+	evicted := []*cacheEntry{}
+	for t.bytes > t.maxBytes && t.list.Len() > 0 {
+		oldest := t.list.Back().Value.(*cacheEntry)
+		t.remove(oldest.Key.hash())
+		evicted = append(evicted, oldest)
+	}
+	return evicted
+}
+
+type sourceVersion struct {
+	version string
+	checked time.Time
+}
+
+// ChunkCache is a two-tier (memory and disk) LRU cache for extracted audio chunks.
+// Cached chunks are invalidated when the source audio changes (modification time and size for local files; ETag, Last-Modified and Content-Length for remote files).
+// For initialization, use NewChunkCache().
+type ChunkCache struct {
+	// VersionTTL is the time a remote source version is trusted before it is checked again
+	VersionTTL time.Duration
+
+	mutex sync.Mutex
+	dir   string
+	mem   lruTier
+	disk  lruTier
+	stats ChunkCacheStats
+
+	versionMutex sync.Mutex
+	versions     map[string]sourceVersion // url -> version
+
+	inflightMutex sync.Mutex
+	inflight      map[string]*inflightExtraction // key hash -> extraction in progress
+}
+
+// inflightExtraction is an extraction in progress, shared by all callers requesting the same chunk
+type inflightExtraction struct {
+	done   chan bool
+	header protocol.AudioChunk
+	audio  []byte
+	err    error
+}
+
+// NewChunkCache creates a new cache, holding up to maxMemBytes of audio in memory. If dir is not empty, cached chunks are also saved to disk, up to maxDiskBytes. Chunks already in dir are loaded into the cache index.
+func NewChunkCache(maxMemBytes int64, dir string, maxDiskBytes int64) (*ChunkCache, error) {
+	res := &ChunkCache{
+		VersionTTL: time.Minute,
+		dir:        dir,
+		mem:        newLRUTier(maxMemBytes),
+		disk:       newLRUTier(maxDiskBytes),
+		versions:   make(map[string]sourceVersion),
+		inflight:   make(map[string]*inflightExtraction),
+	}
+	if dir != "" {
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create cache dir : %v", err)
+		}
+		err = res.loadDiskIndex()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// loadDiskIndex loads the entries saved in the cache dir, the most recently modified first
+func (c *ChunkCache) loadDiskIndex() error {
+	files, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("couldn't list cache dir : %v", err)
+	}
+	type indexed struct {
+		entry   *cacheEntry
+		modTime time.Time
+	}
+	entries := []indexed{}
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return fmt.Errorf("couldn't stat cache file : %v", err)
+		}
+		bts, err := ioutil.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("couldn't read cache file : %v", err)
+		}
+		var entry cacheEntry
+		err = json.Unmarshal(bts, &entry)
+		if err != nil || filepath.Base(f) != entry.Key.hash()+".json" {
+			log.Warning("Removing invalid cache file %s", f)
+			c.removeFiles(strings.TrimSuffix(filepath.Base(f), ".json"))
+			continue
+		}
+		entries = append(entries, indexed{entry: &entry, modTime: info.ModTime()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	for _, e := range entries {
+		for _, evicted := range c.disk.add(e.entry.Key.hash(), e.entry) {
+			c.removeFiles(evicted.Key.hash())
+		}
+	}
+	log.Info("Loaded %d cached chunks from %s", c.disk.list.Len(), c.dir)
+	return nil
+}
+
+func (c *ChunkCache) metaFile(hash string) string {
+	return filepath.Join(c.dir, hash+".json")
+}
+
+func (c *ChunkCache) audioFile(hash string) string {
+	return filepath.Join(c.dir, hash+".audio")
+}
+
+func (c *ChunkCache) removeFiles(hash string) {
+	os.Remove(c.metaFile(hash))
+	os.Remove(c.audioFile(hash))
+}
+
+// sourceVersion returns a version string for the source audio, changing whenever the audio changes. Remote versions are cached for VersionTTL.
+func (c *ChunkCache) sourceVersion(url string) (string, error) {
+	if !isRemote(url) {
+		return checkSourceVersion(url)
+	}
+
+	c.versionMutex.Lock()
+	v, ok := c.versions[url]
+	c.versionMutex.Unlock()
+	if ok && time.Since(v.checked) < c.VersionTTL {
+		return v.version, nil
+	}
+	version, err := checkSourceVersion(url)
+	if err != nil {
+		return "", err
+	}
+	c.versionMutex.Lock()
+	c.versions[url] = sourceVersion{version: version, checked: time.Now()}
+	c.versionMutex.Unlock()
+	return version, nil
+}
+
+func isRemote(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// checkSourceVersion returns a version string for the source audio: modification time and size for local files; ETag, Last-Modified and Content-Length for remote files
+func checkSourceVersion(url string) (string, error) {
+	if !isRemote(url) {
+		info, err := os.Stat(strings.TrimPrefix(url, "file://"))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d|%d", info.Size(), info.ModTime().UnixNano()), nil
+	}
+	resp, err := http.Head(url)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HEAD %s returned %s", url, resp.Status)
+	}
+	return fmt.Sprintf("%s|%s|%d", resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), resp.ContentLength), nil
+}
+
+// Get returns the cached chunk (header and audio) for the key, if it exists, and if the source audio has not changed since it was cached
+func (c *ChunkCache) Get(key ChunkCacheKey) (protocol.AudioChunk, []byte, bool) {
+	version, err := c.sourceVersion(key.URL)
+	if err != nil {
+		log.Warning("Chunk cache couldn't check source version for %s : %v", key.URL, err)
+		c.mutex.Lock()
+		c.stats.Misses++
+		c.mutex.Unlock()
+		return protocol.AudioChunk{}, nil, false
+	}
+
+	hash := key.hash()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if entry, ok := c.mem.get(hash); ok {
+		if entry.Version == version {
+			c.stats.Hits++
+			return entry.Header, entry.audio, true
+		}
+		c.invalidate(hash)
+		c.stats.Misses++
+		return protocol.AudioChunk{}, nil, false
+	}
+
+	if entry, ok := c.disk.get(hash); ok {
+		if entry.Version != version {
+			c.invalidate(hash)
+			c.stats.Misses++
+			return protocol.AudioChunk{}, nil, false
+		}
+		bts, err := ioutil.ReadFile(c.audioFile(hash))
+		if err != nil || int64(len(bts)) != entry.Size {
+			log.Warning("Chunk cache couldn't read cached audio for %s : %v", key, err)
+			c.invalidate(hash)
+			c.stats.Misses++
+			return protocol.AudioChunk{}, nil, false
+		}
+		now := time.Now()
+		os.Chtimes(c.metaFile(hash), now, now) // for LRU order on reload
+		c.addToMemory(hash, &cacheEntry{Key: entry.Key, Version: entry.Version, Header: entry.Header, Size: entry.Size, audio: bts})
+		c.stats.Hits++
+		return entry.Header, bts, true
+	}
+
+	c.stats.Misses++
+	return protocol.AudioChunk{}, nil, false
+}
+
+// Put adds an extracted chunk (header and audio) to the cache
+func (c *ChunkCache) Put(key ChunkCacheKey, header protocol.AudioChunk, audio []byte) error {
+	version, err := c.sourceVersion(key.URL)
+	if err != nil {
+		return fmt.Errorf("couldn't check source version for %s : %v", key.URL, err)
+	}
+	header.Audio = ""
+	entry := &cacheEntry{Key: key, Version: version, Header: header, Size: int64(len(audio)), audio: audio}
+	hash := key.hash()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.addToMemory(hash, entry)
+
+	if c.dir == "" || entry.Size > c.disk.maxBytes {
+		return nil
+	}
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal cache entry : %v", err)
+	}
+	err = ioutil.WriteFile(c.audioFile(hash), audio, 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't write cache file : %v", err)
+	}
+	// the meta file is written last, so that it's only loaded on restart if the audio file is complete
+	err = ioutil.WriteFile(c.metaFile(hash), meta, 0644)
+	if err != nil {
+		os.Remove(c.audioFile(hash))
+		return fmt.Errorf("couldn't write cache file : %v", err)
+	}
+	for _, evicted := range c.disk.add(hash, &cacheEntry{Key: key, Version: version, Header: header, Size: entry.Size}) {
+		c.removeFiles(evicted.Key.hash())
+		c.stats.Evictions++
+	}
+	return nil
+}
+
+// getOrExtract returns the cached chunk for the key, or calls extract and adds the result to the cache.
+// Concurrent requests for the same chunk share a single extraction.
+func (c *ChunkCache) getOrExtract(key ChunkCacheKey, extract func() (protocol.AudioChunk, []byte, error)) (protocol.AudioChunk, []byte, error) {
+	if header, audio, ok := c.Get(key); ok {
+		return header, audio, nil
+	}
+
+	hash := key.hash()
+	c.inflightMutex.Lock()
+	if call, ok := c.inflight[hash]; ok {
+		c.inflightMutex.Unlock()
+		<-call.done
+		return call.header, call.audio, call.err
+	}
+	call := &inflightExtraction{done: make(chan bool)}
+	c.inflight[hash] = call
+	c.inflightMutex.Unlock()
+
+	call.header, call.audio, call.err = extract()
+	if call.err == nil {
+		if err := c.Put(key, call.header, call.audio); err != nil {
+			log.Warning("Couldn't add chunk to cache : %v", err)
+		}
+	}
+
+	c.inflightMutex.Lock()
+	delete(c.inflight, hash)
+	c.inflightMutex.Unlock()
+	close(call.done)
+	return call.header, call.audio, call.err
+}
+
+// addToMemory adds the entry to the memory tier; the caller must hold the mutex
+func (c *ChunkCache) addToMemory(hash string, entry *cacheEntry) {
+	if entry.Size > c.mem.maxBytes {
+		return
+	}
+	for _, evicted := range c.mem.add(hash, entry) {
+		if _, onDisk := c.disk.index[evicted.Key.hash()]; !onDisk {
+			c.stats.Evictions++
+		}
+	}
+}
+
+// invalidate removes the entry from all tiers; the caller must hold the mutex
+func (c *ChunkCache) invalidate(hash string) {
+	c.mem.remove(hash)
+	if _, ok := c.disk.index[hash]; ok {
+		c.disk.remove(hash)
+		c.removeFiles(hash)
+	}
+	c.stats.Invalidations++
+}
+
+// Stats returns the current cache metrics
+func (c *ChunkCache) Stats() ChunkCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	res := c.stats
+	res.MemEntries = c.mem.list.Len()
+	res.MemBytes = c.mem.bytes
+	res.DiskEntries = c.disk.list.Len()
+	res.DiskBytes = c.disk.bytes
+	return res
+}
@@ -0,0 +1,112 @@
+package modules
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+func TestChunkCacheMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunk-cache-test")
+	if err != nil {
+		t.Errorf("got error from TempDir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	audioFile := filepath.Join(dir, "audio.wav")
+	ioutil.WriteFile(audioFile, []byte("source audio"), 0644)
+
+	cache, err := NewChunkCache(10, "", 0)
+	if err != nil {
+		t.Errorf("got error from NewChunkCache: %v", err)
+		return
+	}
+	key1 := ChunkCacheKey{URL: audioFile, Chunk: protocol.Chunk{Start: 0, End: 100}, Encoding: "wav"}
+	key2 := ChunkCacheKey{URL: audioFile, Chunk: protocol.Chunk{Start: 100, End: 200}, Encoding: "wav"}
+
+	if _, _, ok := cache.Get(key1); ok {
+		t.Errorf("expected cache miss for %v", key1)
+	}
+	cache.Put(key1, protocol.AudioChunk{FileType: "wav", Offset: 17}, []byte("123456"))
+	header, bts, ok := cache.Get(key1)
+	if !ok {
+		t.Errorf("expected cache hit for %v", key1)
+		return
+	}
+	if header.Offset != 17 || string(bts) != "123456" {
+		t.Errorf("expected offset 17 and audio 123456, got %d and %s", header.Offset, bts)
+	}
+
+	// key1 is evicted to make room for key2
+	cache.Put(key2, protocol.AudioChunk{FileType: "wav"}, []byte("abcdef"))
+	if _, _, ok := cache.Get(key1); ok {
+		t.Errorf("expected %v to be evicted", key1)
+	}
+	if _, _, ok := cache.Get(key2); !ok {
+		t.Errorf("expected cache hit for %v", key2)
+	}
+
+	exp := ChunkCacheStats{Hits: 2, Misses: 2, Evictions: 1, MemEntries: 1, MemBytes: 6}
+	if got := cache.Stats(); got != exp {
+		t.Errorf("expected %#v, got %#v", exp, got)
+	}
+}
+
+func TestChunkCacheDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunk-cache-test")
+	if err != nil {
+		t.Errorf("got error from TempDir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	audioFile := filepath.Join(dir, "audio.wav")
+	ioutil.WriteFile(audioFile, []byte("source audio"), 0644)
+	cacheDir := filepath.Join(dir, "cache")
+
+	cache, err := NewChunkCache(0, cacheDir, 1000)
+	if err != nil {
+		t.Errorf("got error from NewChunkCache: %v", err)
+		return
+	}
+	key := ChunkCacheKey{URL: audioFile, Chunk: protocol.Chunk{Start: 0, End: 100}, LeftContext: 10, RightContext: 10, Encoding: "wav"}
+	err = cache.Put(key, protocol.AudioChunk{FileType: "wav", Offset: 5}, []byte("123456"))
+	if err != nil {
+		t.Errorf("got error from Put: %v", err)
+		return
+	}
+
+	// a new cache instance should load the cached chunk from disk
+	cache, err = NewChunkCache(100, cacheDir, 1000)
+	if err != nil {
+		t.Errorf("got error from NewChunkCache: %v", err)
+		return
+	}
+	header, bts, ok := cache.Get(key)
+	if !ok {
+		t.Errorf("expected cache hit for %v", key)
+		return
+	}
+	if header.Offset != 5 || string(bts) != "123456" {
+		t.Errorf("expected offset 5 and audio 123456, got %d and %s", header.Offset, bts)
+	}
+
+	// the cached chunk is invalidated when the source audio changes
+	later := time.Now().Add(time.Minute)
+	ioutil.WriteFile(audioFile, []byte("new source audio"), 0644)
+	os.Chtimes(audioFile, later, later)
+	if _, _, ok := cache.Get(key); ok {
+		t.Errorf("expected cache miss for %v after source update", key)
+	}
+	stats := cache.Stats()
+	if stats.Invalidations != 1 || stats.DiskEntries != 0 || stats.MemEntries != 0 {
+		t.Errorf("expected 1 invalidation and an empty cache, got %#v", stats)
+	}
+	files, _ := filepath.Glob(filepath.Join(cacheDir, "*"))
+	if len(files) != 0 {
+		t.Errorf("expected empty cache dir, found %v", files)
+	}
+}
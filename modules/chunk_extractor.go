@@ -1,9 +1,11 @@
 package modules
 
 import (
+	"bytes"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
@@ -19,43 +21,156 @@ import (
 
 // ChunkExtractor extracts time chunks from an audio file, creating a subset of "phrases" from the file.
 // For initialization, use NewChunkExtractor().
+// Uncompressed WAV files are read natively; other formats require ffmpeg.
 type ChunkExtractor struct {
 	chunk2file Chunk2File
+	ffmpegErr  error // set if ffmpeg is not available
+	cache      *ChunkCache
+	prober     *Prober
+	playback   protocol.PlaybackConfig
+	wavOutput  bool
 }
 
-// NewChunkExtractor creates a new ChunkExtractor after first checking that the ffmpeg command exists
+// NewChunkExtractor creates a new ChunkExtractor. If the ffmpeg command doesn't exist, only uncompressed WAV files can be processed.
 func NewChunkExtractor() (ChunkExtractor, error) {
 	c2f, err := NewChunk2File()
 	if err != nil {
-		return ChunkExtractor{}, err
+		log.Warning("Chunk extractor : %v (only PCM wav files can be processed)", err)
 	}
-	return ChunkExtractor{chunk2file: c2f}, nil
+	return ChunkExtractor{chunk2file: c2f, ffmpegErr: err, prober: NewProber()}, nil
 }
 
-// ProcessFileWithContext an audioFile, extracting the specified chunks to slices of byte
+// SetCache sets the cache used by ExtractWithContext (and ProcessFileWithContext). Use nil to disable caching.
+func (ch *ChunkExtractor) SetCache(cache *ChunkCache) {
+	ch.cache = cache
+}
+
+// SetAccurate sets accurate mode for extraction using ffmpeg (default: true), see Chunk2File.Accurate.
+// Compressed output formats add encoder padding, so the audio is only sample accurate on playback if it's returned as wav (see SetWavOutput).
+func (ch *ChunkExtractor) SetAccurate(accurate bool) {
+	ch.chunk2file.Accurate = accurate
+}
+
+// SetWavOutput sets the default output encoding to wav (default: false, the same encoding as the input).
+// Wav output keeps accurate extraction exact on playback, but compressed input is returned at about ten times the size.
+func (ch *ChunkExtractor) SetWavOutput(wavOutput bool) {
+	ch.wavOutput = wavOutput
+}
+
+// SetPlayback sets the playback preprocessing applied to extracted chunks (see protocol.PlaybackConfig).
+// Preprocessing requires wav output, so audio is returned as wav by default if preprocessing is enabled.
+func (ch *ChunkExtractor) SetPlayback(playback protocol.PlaybackConfig) {
+	ch.playback = playback
+}
+
+// defaultEncoding returns the output encoding used if no encoding is specified: wav if wav output is set (see SetWavOutput) or playback preprocessing is enabled, or else the same as the input
+func (ch ChunkExtractor) defaultEncoding(audioFile string) string {
+	if ch.wavOutput || ch.playback.Enabled() {
+		return "wav"
+	}
+	ext := filepath.Ext(audioFile)
+	ext = strings.TrimPrefix(ext, ".")
+	return trimURLParamsRE.ReplaceAllString(ext, "")
+}
+
+// Prober returns the prober used to read source audio metadata
+func (ch ChunkExtractor) Prober() *Prober {
+	return ch.prober
+}
+
+// Cache returns the cache used by the chunk extractor, or nil if caching is disabled
+func (ch ChunkExtractor) Cache() *ChunkCache {
+	return ch.cache
+}
+
+// ProcessFileWithContext an audioFile, extracting the specified chunk (with context) into an AudioChunk with base64 encoded audio
 func (ch ChunkExtractor) ProcessFileWithContext(audioFile string, chunk protocol.Chunk, leftContext, rightContext int64, encoding string) (protocol.AudioChunk, error) {
+	res, bts, err := ch.ExtractWithContext(audioFile, chunk, leftContext, rightContext, encoding)
+	if err != nil {
+		return res, err
+	}
+	res.Audio = base64.StdEncoding.EncodeToString(bts)
+	return res, nil
+}
+
+// ExtractWithContext an audioFile, extracting the specified chunk (with context). The audio is returned as raw bytes, and is not included in the returned AudioChunk.
+func (ch ChunkExtractor) ExtractWithContext(audioFile string, chunk protocol.Chunk, leftContext, rightContext int64, encoding string) (protocol.AudioChunk, []byte, error) {
+	return ch.extractWithContext(audioFile, chunk, leftContext, rightContext, 0, encoding, Analysis{})
+}
+
+// extractWithContext see ExtractWithContext. If channel > 0, only the specified channel (starting at 1) is extracted. The selected analyses are added to the returned AudioChunk, and cached with the audio.
+func (ch ChunkExtractor) extractWithContext(audioFile string, chunk protocol.Chunk, leftContext, rightContext int64, channel int, encoding string, analysis Analysis) (protocol.AudioChunk, []byte, error) {
+	processChunk := contextWindow(chunk, leftContext, rightContext)
+
+	if encoding == "" {
+		encoding = ch.defaultEncoding(audioFile)
+	}
+	if ch.playback.Enabled() && strings.ToLower(encoding) != "wav" {
+		return protocol.AudioChunk{}, nil, fmt.Errorf("playback preprocessing requires wav output, found %s", encoding)
+	}
+
+	if ch.cache != nil {
+		key := ChunkCacheKey{URL: audioFile, Chunk: chunk, LeftContext: leftContext, RightContext: rightContext, Encoding: encoding, Accurate: ch.chunk2file.Accurate, Channel: channel, Playback: ch.playback, Analysis: analysis.String()}
+		return ch.cache.getOrExtract(key, func() (protocol.AudioChunk, []byte, error) {
+			return ch.extract(audioFile, chunk, processChunk, channel, encoding, analysis)
+		})
+	}
+	return ch.extract(audioFile, chunk, processChunk, channel, encoding, analysis)
+}
+
+// contextWindow returns the chunk with context (the audio window that is extracted)
+func contextWindow(chunk protocol.Chunk, leftContext, rightContext int64) protocol.Chunk {
 	offset := chunk.Start - leftContext
 	if offset < 0 {
 		offset = 0
 	}
-	processChunk := protocol.Chunk{
+	return protocol.Chunk{
 		Start: offset,
 		End:   chunk.End + rightContext,
 	}
+}
 
-	ext := filepath.Ext(audioFile)
-	ext = strings.TrimPrefix(ext, ".")
-	ext = trimURLParamsRE.ReplaceAllString(ext, "")
-	if encoding == "" {
-		encoding = ext
+// limitWindow limits the right context of the window to the file duration, returning the source audio metadata (nil if the file couldn't be probed)
+func (ch ChunkExtractor) limitWindow(audioFile string, window *protocol.Chunk) (*protocol.AudioInfo, error) {
+	if ch.prober == nil {
+		return nil, nil
 	}
-	btss, err := ch.ProcessFile(audioFile, []protocol.Chunk{processChunk}, encoding)
+	info, err := ch.prober.Probe(audioFile)
 	if err != nil {
-		return protocol.AudioChunk{}, err
+		return nil, err
+	}
+	if duration := int64(math.Ceil(info.Duration)); window.End > duration {
+		window.End = duration
+	}
+	return &info, nil
+}
+
+// Window returns the audio window extracted for the chunk with context (see ExtractWithContext), in milliseconds
+func (ch ChunkExtractor) Window(audioFile string, chunk protocol.Chunk, leftContext, rightContext int64) protocol.Chunk {
+	res := contextWindow(chunk, leftContext, rightContext)
+	ch.limitWindow(audioFile, &res)
+	return res
+}
+
+// extract the processChunk (the chunk with context) from the audioFile, and compute the selected analyses
+func (ch ChunkExtractor) extract(audioFile string, chunk, processChunk protocol.Chunk, channel int, encoding string, analysis Analysis) (protocol.AudioChunk, []byte, error) {
+	offset := processChunk.Start
+
+	sourceInfo, err := ch.limitWindow(audioFile, &processChunk)
+	if sourceInfo != nil && channel > sourceInfo.Channels {
+		return protocol.AudioChunk{}, nil, fmt.Errorf("channel %d not found in %s (%d channels)", channel, audioFile, sourceInfo.Channels)
+	}
+	if err != nil {
+		log.Warning("Couldn't probe %s : %v", audioFile, err)
+	}
+
+	btss, accurate, err := ch.processFile(audioFile, []protocol.Chunk{processChunk}, channel, encoding)
+	if err != nil {
+		return protocol.AudioChunk{}, nil, err
 	}
 
 	if len(btss) != 1 {
-		return protocol.AudioChunk{}, fmt.Errorf("expected one byte array, found %d", len(btss))
+		return protocol.AudioChunk{}, nil, fmt.Errorf("expected one byte array, found %d", len(btss))
 	}
 
 	bts := btss[0]
@@ -63,15 +178,36 @@ func (ch ChunkExtractor) ProcessFileWithContext(audioFile string, chunk protocol
 	//ioutil.WriteFile("chunk_extractor_debug.wav", bts, 0644)
 
 	res := protocol.AudioChunk{
-		Audio:    base64.StdEncoding.EncodeToString(bts),
-		FileType: encoding,
-		Offset:   offset,
+		FileType:    encoding,
+		Offset:      offset,
+		ExactOffset: float64(offset),
+		SourceInfo:  sourceInfo,
+	}
+	if wav, err := NewWavReader(bytes.NewReader(bts)); err == nil {
+		// the exact offset is computed using the sample rate of the extraction, since resampling preserves the start time
+		res.SampleRate = wav.Format.SampleRate
+		if accurate {
+			res.ExactOffset = accurateStart(offset, res.SampleRate)
+			res.SampleAccurate = true
+		}
+	}
+	analyse(&res, audioFile, chunk, processChunk, channel, analysis)
+	if ch.playback.Enabled() {
+		bts, err = ProcessPlayback(bts, ch.playback)
+		if err != nil {
+			return protocol.AudioChunk{}, nil, fmt.Errorf("playback preprocessing failed : %v", err)
+		}
+		playback := ch.playback
+		res.Playback = &playback
+		if playback.SampleRate > 0 {
+			res.SampleRate = playback.SampleRate
+		}
 	}
 	res.Chunk = protocol.Chunk{
 		Start: chunk.Start - offset,
 		End:   chunk.End - offset,
 	}
-	return res, nil
+	return res, bts, nil
 }
 
 // ProcessURLWithContext an audioURL, extracting the specified chunks to slices of byte
@@ -79,6 +215,23 @@ func (ch ChunkExtractor) ProcessURLWithContext(payload protocol.SplitRequestPayl
 	return ch.ProcessFileWithContext(payload.URL, payload.Chunk, payload.LeftContext, payload.RightContext, encoding)
 }
 
+// ExtractURLWithContext an audioURL, extracting the specified chunk (with context), see ExtractWithContext. If payload.Channel is set, only that channel is extracted.
+func (ch ChunkExtractor) ExtractURLWithContext(payload protocol.SplitRequestPayload, encoding string) (protocol.AudioChunk, []byte, error) {
+	if payload.Channel < 0 {
+		return protocol.AudioChunk{}, nil, fmt.Errorf("invalid channel %d", payload.Channel)
+	}
+	return ch.ExtractURLWithAnalysis(payload, encoding, Analysis{})
+}
+
+// ExtractURLWithAnalysis extracts the chunk (with context) like ExtractURLWithContext, and adds the selected analyses of the audio window (contours and boundary suggestion) to the returned AudioChunk.
+// The analyses are cached with the audio, so a chunk extracted in advance (e.g., prefetched) should be extracted with the same analyses as when it's used.
+func (ch ChunkExtractor) ExtractURLWithAnalysis(payload protocol.SplitRequestPayload, encoding string, analysis Analysis) (protocol.AudioChunk, []byte, error) {
+	if payload.Channel < 0 {
+		return protocol.AudioChunk{}, nil, fmt.Errorf("invalid channel %d", payload.Channel)
+	}
+	return ch.extractWithContext(payload.URL, payload.Chunk, payload.LeftContext, payload.RightContext, payload.Channel, encoding, analysis)
+}
+
 // ProcessURL an audioURL, extracting the specified chunks to slices of byte
 func (ch ChunkExtractor) ProcessURL(audioURL string, chunks []protocol.Chunk, encoding string) ([][]byte, error) {
 	return ch.ProcessFile(audioURL, chunks, encoding)
@@ -88,36 +241,91 @@ var trimURLParamsRE = regexp.MustCompile(`\?[^?.]*$`)
 
 // ProcessFile an audioFile, extracting the specified chunks to slices of byte
 func (ch ChunkExtractor) ProcessFile(audioFile string, chunks []protocol.Chunk, encoding string) ([][]byte, error) {
+	res, _, err := ch.processFile(audioFile, chunks, 0, encoding)
+	return res, err
+}
+
+// processFile an audioFile, extracting the specified chunks (and channel, if > 0) to slices of byte. The returned bool is true if the extraction was sample accurate.
+func (ch ChunkExtractor) processFile(audioFile string, chunks []protocol.Chunk, channel int, encoding string) ([][]byte, bool, error) {
 	res := [][]byte{}
-	for _, chunk := range chunks {
+	ext := filepath.Ext(audioFile)
+	ext = strings.TrimPrefix(ext, ".")
+	ext = trimURLParamsRE.ReplaceAllString(ext, "")
+	if encoding == "" {
+		encoding = ch.defaultEncoding(audioFile)
+	}
 
-		ext := filepath.Ext(audioFile)
-		ext = strings.TrimPrefix(ext, ".")
-		ext = trimURLParamsRE.ReplaceAllString(ext, "")
-		if encoding != "" {
-			ext = encoding
-		} else {
-			encoding = ext
+	// uncompressed wav: slice the file natively, without ffmpeg
+	if strings.ToLower(ext) == "wav" && strings.ToLower(encoding) == "wav" {
+		wavStart := time.Now()
+		btss, err := processWav(audioFile, chunks, channel)
+		if err == nil {
+			log.Info("native wav dur %v", time.Since(wavStart))
+			return btss, true, nil
 		}
+		if ch.ffmpegErr != nil {
+			return res, false, fmt.Errorf("couldn't process wav file natively : %v (ffmpeg fallback not available : %v)", err, ch.ffmpegErr)
+		}
+		log.Info("Couldn't process wav file %s natively, using ffmpeg : %v", audioFile, err)
+	}
+	if ch.ffmpegErr != nil {
+		return res, false, ch.ffmpegErr
+	}
+
+	for _, chunk := range chunks {
 		id, err := uuid.NewUUID()
 		if err != nil {
-			return res, fmt.Errorf("couldn't create uuid : %v", err)
+			return res, false, fmt.Errorf("couldn't create uuid : %v", err)
 		}
-		tmpFile := path.Join(os.TempDir(), fmt.Sprintf("chunk-extractor-%s.%s", id, ext))
+		tmpFile := path.Join(os.TempDir(), fmt.Sprintf("chunk-extractor-%s.%s", id, encoding))
 		//log.Info("chunk_extractor tmpFile", tmpFile)
 		defer os.Remove(tmpFile)
 		c2fStart := time.Now()
-		err = ch.chunk2file.ProcessChunk(audioFile, chunk, tmpFile, encoding)
+		err = ch.chunk2file.ProcessChunkWithChannel(audioFile, chunk, channel, tmpFile, encoding)
 		if err != nil {
-			return res, fmt.Errorf("chunk2file.ProcessChunk failed : %v", err)
+			return res, false, fmt.Errorf("chunk2file.ProcessChunkWithChannel failed : %v", err)
 		}
 		c2fDur := time.Since(c2fStart)
 		log.Info("chunk2file dur %v", c2fDur)
 		bytes, err := ioutil.ReadFile(tmpFile)
 		if err != nil {
-			return res, fmt.Errorf("failed to read file : %v", err)
+			return res, false, fmt.Errorf("failed to read file : %v", err)
 		}
 		res = append(res, bytes)
 	}
+	return res, ch.chunk2file.Accurate, nil
+}
+
+// processWav extracts the chunks from an uncompressed wav file, returning each chunk as a wav file.
+// If channel > 0, only the specified channel (starting at 1) is extracted.
+func processWav(audioFile string, chunks []protocol.Chunk, channel int) ([][]byte, error) {
+	res := [][]byte{}
+	wav, close, err := OpenWav(audioFile)
+	if err != nil {
+		return res, err
+	}
+	defer close()
+	if channel > wav.Format.Channels {
+		return res, fmt.Errorf("channel %d not found in %s (%d channels)", channel, audioFile, wav.Format.Channels)
+	}
+	format := wav.Format
+	if channel > 0 {
+		format.Channels = 1
+	}
+	for _, chunk := range chunks {
+		data, err := wav.ReadChunk(chunk)
+		if err != nil {
+			return res, err
+		}
+		if channel > 0 {
+			data = wav.Format.ExtractChannel(data, channel)
+		}
+		buf := &bytes.Buffer{}
+		err = WriteWav(buf, format, data)
+		if err != nil {
+			return res, fmt.Errorf("couldn't write wav : %v", err)
+		}
+		res = append(res, buf.Bytes())
+	}
 	return res, nil
 }
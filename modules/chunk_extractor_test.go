@@ -1,14 +1,43 @@
 package modules
 
 import (
+	"bytes"
 	"fmt"
+	"math"
 	"os"
+	"os/exec"
 	"path"
+	"strings"
 	"testing"
 
 	"github.com/stts-se/segment_checker/protocol"
 )
 
+// skipWithoutFfmpeg skips the test if ffmpeg is not installed
+func skipWithoutFfmpeg(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg not found")
+	}
+}
+
+// checkSamples checks that the wav audio has the sample rate, and the number of samples for the chunk (see FirstSample), with a tolerance in samples
+func checkSamples(t *testing.T, audio []byte, chunk protocol.Chunk, sampleRate int, tolerance int64) {
+	t.Helper()
+	wav, err := NewWavReader(bytes.NewReader(audio))
+	if err != nil {
+		t.Errorf("got error from NewWavReader: %v", err)
+		return
+	}
+	if wav.Format.SampleRate != sampleRate {
+		t.Errorf("expected sample rate %v, got %v", sampleRate, wav.Format.SampleRate)
+	}
+	exp := FirstSample(chunk.End, sampleRate) - FirstSample(chunk.Start, sampleRate)
+	if got := wav.Frames(); got < exp-tolerance || got > exp+tolerance {
+		t.Errorf("expected %v samples (+/- %v) for chunk %v, got %v (%.3f ms off)", exp, tolerance, chunk, got, float64(got-exp)*1000.0/float64(sampleRate))
+	}
+}
+
 func TestChunkExtractorFileMP3(t *testing.T) {
 	chunker, err := NewChunkExtractor()
 	if err != nil {
@@ -22,24 +51,18 @@ func TestChunkExtractorFileMP3(t *testing.T) {
 		{Start: 3885, End: 7647},
 	}
 
-	got, err := chunker.ProcessFile(fName, chunks, "")
+	got, err := chunker.ProcessFile(fName, chunks, "wav")
 	if err != nil {
 		t.Errorf("got error from ChunkExtractor.Process: %v", err)
 		return
 	}
-	expLens := []int{13183, 18826, 30738} // approximate byte len
-	if len(got) != len(expLens) {
-		t.Errorf("expected %v, got %v", expLens, got)
+	if len(got) != len(chunks) {
+		t.Errorf("expected %v chunks, got %v", len(chunks), len(got))
 		return
 	}
-	for i, exp0 := range expLens {
-		got0 := got[i]
-		max := exp0 + 200
-		min := exp0 - 200
-		if len(got0) < min || len(got0) > max {
-			t.Errorf("expected a value between %v and %v, got %v", min, max, len(got0))
-		}
-
+	for i, chunk := range chunks {
+		// allow one sample off for mp3 decoding
+		checkSamples(t, got[i], chunk, 44100, 1)
 	}
 }
 
@@ -61,19 +84,12 @@ func TestChunkExtractorFileWAV(t *testing.T) {
 		t.Errorf("got error from ChunkExtractor.Process: %v", err)
 		return
 	}
-	expLens := []int{140052, 202762, 331886} // approximate byte len
-	if len(got) != len(expLens) {
-		t.Errorf("expected %v, got %v", expLens, got)
+	if len(got) != len(chunks) {
+		t.Errorf("expected %v chunks, got %v", len(chunks), len(got))
 		return
 	}
-	for i, exp0 := range expLens {
-		got0 := got[i]
-		max := exp0 + 200
-		min := exp0 - 200
-		if len(got0) < min || len(got0) > max {
-			t.Errorf("expected a value between %v and %v, got %v", min, max, len(got0))
-		}
-
+	for i, chunk := range chunks {
+		checkSamples(t, got[i], chunk, 44100, 0)
 	}
 }
 
@@ -99,19 +115,12 @@ func TestChunkExtractorURLWAV(t *testing.T) {
 		t.Errorf("got error from ChunkExtractor.Process: %v", err)
 		return
 	}
-	expLens := []int{140052, 202762, 331886} // approximate byte len
-	if len(got) != len(expLens) {
-		t.Errorf("expected %v, got %v", expLens, got)
+	if len(got) != len(chunks) {
+		t.Errorf("expected %v chunks, got %v", len(chunks), len(got))
 		return
 	}
-	for i, exp0 := range expLens {
-		got0 := got[i]
-		max := exp0 + 200
-		min := exp0 - 200
-		if len(got0) < min || len(got0) > max {
-			t.Errorf("expected a value between %v and %v, got %v", min, max, len(got0))
-		}
-
+	for i, chunk := range chunks {
+		checkSamples(t, got[i], chunk, 44100, 0)
 	}
 }
 
@@ -187,3 +196,65 @@ func TestChunkExtractorFileWithContext(t *testing.T) {
 		t.Errorf("expected %v, got %v", 159, got.Chunk.End)
 	}
 }
+
+func TestChunkExtractorExactOffset(t *testing.T) {
+	chunker, err := NewChunkExtractor()
+	if err != nil {
+		t.Errorf("got error from NewChunkExtractor: %v", err)
+		return
+	}
+	for _, file := range []string{"test_data/three_sentences.wav", "test_data/three_sentences.mp3"} {
+		t.Run(file, func(t *testing.T) {
+			if strings.HasSuffix(file, ".mp3") {
+				skipWithoutFfmpeg(t)
+			}
+			chunk := protocol.Chunk{Start: 165, End: 261}
+			got, bts, err := chunker.ExtractWithContext(file, chunk, 100, 100, "wav")
+			if err != nil {
+				t.Errorf("got error from ChunkExtractor.ExtractWithContext: %v", err)
+				return
+			}
+			if got.Offset != 65 {
+				t.Errorf("expected offset %v, got %v", 65, got.Offset)
+			}
+			// 65 ms at 44.1 kHz = sample 2866.5, the first sample after is 2867
+			expExact := 2867 * 1000.0 / 44100.0
+			if math.Abs(got.ExactOffset-expExact) > 1e-9 {
+				t.Errorf("expected exact offset %v, got %v", expExact, got.ExactOffset)
+			}
+			if !got.SampleAccurate {
+				t.Errorf("expected sample accurate extraction for %s", file)
+			}
+			if got.SampleRate != 44100 {
+				t.Errorf("expected sample rate %v, got %v", 44100, got.SampleRate)
+			}
+			if got.FileType != "wav" {
+				t.Errorf("expected file type %v, got %v", "wav", got.FileType)
+			}
+			checkSamples(t, bts, protocol.Chunk{Start: 65, End: 361}, 44100, 1)
+		})
+	}
+}
+
+func TestChunkExtractorDefaultEncoding(t *testing.T) {
+	chunker, err := NewChunkExtractor()
+	if err != nil {
+		t.Errorf("got error from NewChunkExtractor: %v", err)
+		return
+	}
+	// the input encoding is kept by default, also in accurate mode
+	for file, exp := range map[string]string{"a.mp3": "mp3", "a.wav": "wav", "http://host/a.opus?x=1": "opus"} {
+		if got := chunker.defaultEncoding(file); got != exp {
+			t.Errorf("expected encoding %s for %s, got %s", exp, file, got)
+		}
+	}
+	chunker.SetWavOutput(true)
+	if got := chunker.defaultEncoding("a.mp3"); got != "wav" {
+		t.Errorf("expected encoding wav with wav output, got %s", got)
+	}
+	chunker.SetWavOutput(false)
+	chunker.SetPlayback(protocol.PlaybackConfig{Normalize: true})
+	if got := chunker.defaultEncoding("a.mp3"); got != "wav" {
+		t.Errorf("expected encoding wav with playback preprocessing, got %s", got)
+	}
+}
@@ -0,0 +1,237 @@
+package modules
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// Default contour settings, see protocol.ContourOptions
+const (
+	DefaultContourStepMs       = 10.0
+	DefaultContourPitchFloor   = 75.0
+	DefaultContourPitchCeiling = 600.0
+)
+
+const (
+	// voicingThreshold is the min (normalized) autocorrelation peak for a voiced frame
+	voicingThreshold = 0.45
+	// octaveCost favours higher pitch candidates, so that a peak at twice the period does not win over an equally strong peak at the period
+	octaveCost = 0.01
+	// silenceThreshold is the min peak amplitude for a voiced frame, relative to the max amplitude of the audio
+	silenceThreshold = 0.03
+	// intensityReference is the reference mean square value (2e-5 squared) for intensity in dB
+	intensityReference = 4e-10
+	// contoursMaxFrames is the max number of frames in a contour
+	contoursMaxFrames = 20000
+)
+
+// contourOptions returns the options with zero values replaced by defaults
+func contourOptions(opts protocol.ContourOptions, sampleRate int) (protocol.ContourOptions, error) {
+	if opts.StepMs == 0 {
+		opts.StepMs = DefaultContourStepMs
+	}
+	if opts.PitchFloor == 0 {
+		opts.PitchFloor = DefaultContourPitchFloor
+	}
+	if opts.PitchCeiling == 0 {
+		opts.PitchCeiling = DefaultContourPitchCeiling
+	}
+	for _, v := range []float64{opts.StepMs, opts.PitchFloor, opts.PitchCeiling} {
+		if !isFinite(v) {
+			return opts, fmt.Errorf("invalid contour option value %v", v)
+		}
+	}
+	// the step is at least one sample
+	if opts.StepMs < 1000/float64(sampleRate) {
+		return opts, fmt.Errorf("invalid time step %v ms", opts.StepMs)
+	}
+	if opts.PitchFloor < 10 || opts.PitchFloor >= opts.PitchCeiling || opts.PitchCeiling > float64(sampleRate)/2 {
+		return opts, fmt.Errorf("invalid pitch range %v-%v Hz", opts.PitchFloor, opts.PitchCeiling)
+	}
+	return opts, nil
+}
+
+// hannWindow returns a Hann window of length n
+func hannWindow(n int) []float64 {
+	res := make([]float64, n)
+	for i := range res {
+		res[i] = 0.5 - 0.5*math.Cos(2*math.Pi*(float64(i)+0.5)/float64(n))
+	}
+	return res
+}
+
+// autocorrelation returns the autocorrelation of x for lags 0 to maxLag, computed using an FFT of size fftSize (at least 2*len(x))
+func autocorrelation(x []float64, maxLag, fftSize int) []float64 {
+	buf := make([]complex128, fftSize)
+	for i, v := range x {
+		buf[i] = complex(v, 0)
+	}
+	fft(buf)
+	for i, v := range buf {
+		// the power spectrum is real, so the inverse transform can be computed with a forward transform
+		buf[i] = complex(math.Pow(cmplx.Abs(v), 2), 0)
+	}
+	fft(buf)
+	res := make([]float64, maxLag+1)
+	for i := range res {
+		res[i] = real(buf[i]) / float64(fftSize)
+	}
+	return res
+}
+
+// frameSamples returns the n samples centered at center, with the mean removed (zero outside of the audio)
+func frameSamples(samples []float64, center float64, n int) []float64 {
+	from := int(math.Round(center - float64(n)/2))
+	res := make([]float64, n)
+	var sum float64
+	var count int
+	for j := range res {
+		if k := from + j; k >= 0 && k < len(samples) {
+			res[j] = samples[k]
+			sum += samples[k]
+			count++
+		}
+	}
+	if count == 0 {
+		return res
+	}
+	mean := sum / float64(count)
+	for j := range res {
+		if k := from + j; k >= 0 && k < len(samples) {
+			res[j] -= mean
+		}
+	}
+	return res
+}
+
+// ComputeContours computes pitch (autocorrelation method) and intensity (RMS) tracks for the decoded audio.
+// The Offset and Chunk of the result are not set.
+func ComputeContours(pcm PCM, opts protocol.ContourOptions) (protocol.Contours, error) {
+	res := protocol.Contours{Start: pcm.Start, Pitch: []float64{}, Intensity: []float64{}}
+	if pcm.SampleRate < 1 {
+		return res, fmt.Errorf("invalid sample rate %d", pcm.SampleRate)
+	}
+	opts, err := contourOptions(opts, pcm.SampleRate)
+	if err != nil {
+		return res, err
+	}
+	res.ContourOptions = opts
+	rate := float64(pcm.SampleRate)
+	step := opts.StepMs * rate / 1000
+	// the number of frames is checked before conversion to int, to avoid overflow
+	nFrames := math.Ceil(float64(len(pcm.Samples)) / step)
+	if nFrames < 1 {
+		return res, fmt.Errorf("no audio")
+	}
+	if nFrames > contoursMaxFrames {
+		return res, fmt.Errorf("too many frames (%.0f), use a longer time step", nFrames)
+	}
+	frames := int(nFrames)
+
+	var globalPeak float64
+	for _, s := range pcm.Samples {
+		globalPeak = math.Max(globalPeak, math.Abs(s))
+	}
+
+	// pitch analysis: 3 periods of the pitch floor
+	pitchWindow := hannWindow(int(math.Ceil(3 * rate / opts.PitchFloor)))
+	minLag := int(math.Floor(rate / opts.PitchCeiling))
+	maxLag := int(math.Ceil(rate / opts.PitchFloor))
+	if minLag < 1 {
+		minLag = 1
+	}
+	fftSize := 1
+	for fftSize < 2*len(pitchWindow) {
+		fftSize *= 2
+	}
+	// the autocorrelation of the window, used to compensate for the window taper
+	windowAC := autocorrelation(pitchWindow, maxLag+1, fftSize)
+
+	// intensity analysis: 3.2 periods of the pitch floor, as in Praat
+	intensityWindow := hannWindow(int(math.Ceil(3.2 * rate / opts.PitchFloor)))
+	var intensityWindowSum float64
+	for _, w := range intensityWindow {
+		intensityWindowSum += w
+	}
+
+	for i := 0; i < frames; i++ {
+		center := (float64(i) + 0.5) * step
+
+		// intensity: window weighted mean square
+		x := frameSamples(pcm.Samples, center, len(intensityWindow))
+		var power float64
+		for j, v := range x {
+			power += v * v * intensityWindow[j]
+		}
+		db := 10 * math.Log10(power/intensityWindowSum/intensityReference)
+		if math.IsInf(db, 0) || math.IsNaN(db) || db < 0 {
+			db = 0
+		}
+		res.Intensity = append(res.Intensity, db)
+
+		// pitch
+		x = frameSamples(pcm.Samples, center, len(pitchWindow))
+		var localPeak float64
+		for j, v := range x {
+			localPeak = math.Max(localPeak, math.Abs(v))
+			x[j] = v * pitchWindow[j]
+		}
+		if globalPeak == 0 || localPeak < silenceThreshold*globalPeak {
+			res.Pitch = append(res.Pitch, 0)
+			continue
+		}
+		ac := autocorrelation(x, maxLag+1, fftSize)
+		if ac[0] <= 0 {
+			res.Pitch = append(res.Pitch, 0)
+			continue
+		}
+		r := func(lag int) float64 {
+			return ac[lag] / ac[0] / (windowAC[lag] / windowAC[0])
+		}
+		bestLag, best, bestStrength := 0, 0.0, math.Inf(-1)
+		for lag := minLag; lag <= maxLag; lag++ {
+			v := r(lag)
+			if v < voicingThreshold || v < r(lag-1) || v < r(lag+1) {
+				continue
+			}
+			if strength := v - octaveCost*math.Log2(opts.PitchFloor*float64(lag)/rate); strength > bestStrength {
+				bestLag, best, bestStrength = lag, v, strength
+			}
+		}
+		if bestLag == 0 {
+			res.Pitch = append(res.Pitch, 0)
+			continue
+		}
+		// parabolic interpolation of the peak
+		prev, next := r(bestLag-1), r(bestLag+1)
+		lag := float64(bestLag)
+		if d := prev - 2*best + next; d < 0 {
+			lag += 0.5 * (prev - next) / d
+		}
+		res.Pitch = append(res.Pitch, rate/lag)
+	}
+	return res, nil
+}
+
+// ContoursWithContext computes pitch and intensity tracks for the same audio window that is extracted for the chunk with context (see ExtractURLWithContext).
+// The source audio is analysed, without playback preprocessing.
+func (ch ChunkExtractor) ContoursWithContext(payload protocol.SplitRequestPayload, opts protocol.ContourOptions) (protocol.Contours, error) {
+	window := ch.Window(payload.URL, payload.Chunk, payload.LeftContext, payload.RightContext)
+	pcm, err := DecodePCM(payload.URL, window, payload.Channel)
+	if err != nil {
+		return protocol.Contours{}, err
+	}
+	res, err := ComputeContours(pcm, opts)
+	if err != nil {
+		return res, err
+	}
+	res.Offset = window.Start
+	res.Chunk = protocol.Chunk{
+		Start: payload.Chunk.Start - window.Start,
+		End:   payload.Chunk.End - window.Start,
+	}
+	return res, nil
+}
@@ -0,0 +1,140 @@
+package modules
+
+import (
+	"math"
+	"path"
+	"testing"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+func TestComputeContours(t *testing.T) {
+	// 200 ms of a 200 Hz tone (with a harmonic) followed by 200 ms of silence, 16 kHz
+	pcm := PCM{PCMInfo: PCMInfo{SampleRate: 16000, Start: 100}}
+	for i := 0; i < 6400; i++ {
+		var s float64
+		if i < 3200 {
+			t := float64(i) / 16000
+			s = 0.4*math.Sin(2*math.Pi*200*t) + 0.2*math.Sin(2*math.Pi*400*t)
+		}
+		pcm.Samples = append(pcm.Samples, s)
+	}
+	cont, err := ComputeContours(pcm, protocol.ContourOptions{})
+	if err != nil {
+		t.Errorf("got error from ComputeContours: %v", err)
+		return
+	}
+	if cont.StepMs != DefaultContourStepMs || cont.PitchFloor != DefaultContourPitchFloor || cont.Start != 100 {
+		t.Errorf("expected default options starting at 100 ms, got %#v", cont.ContourOptions)
+	}
+	if len(cont.Pitch) != 40 || len(cont.Intensity) != 40 {
+		t.Errorf("expected 40 frames, got %d pitch and %d intensity values", len(cont.Pitch), len(cont.Intensity))
+		return
+	}
+	// frames well inside the tone (the analysis window is 40 ms)
+	for i := 3; i < 17; i++ {
+		if math.Abs(cont.Pitch[i]-200) > 2 {
+			t.Errorf("frame %d: expected pitch 200 Hz, got %v", i, cont.Pitch[i])
+		}
+		if cont.Intensity[i] < 80 {
+			t.Errorf("frame %d: expected intensity above 80 dB, got %v", i, cont.Intensity[i])
+		}
+	}
+	// frames well inside the silence
+	for i := 24; i < 40; i++ {
+		if cont.Pitch[i] != 0 || cont.Intensity[i] != 0 {
+			t.Errorf("frame %d: expected unvoiced silence, got pitch %v and intensity %v", i, cont.Pitch[i], cont.Intensity[i])
+		}
+	}
+
+	if _, err := ComputeContours(pcm, protocol.ContourOptions{PitchFloor: 500, PitchCeiling: 400}); err == nil {
+		t.Errorf("expected error for pitch floor above pitch ceiling")
+	}
+}
+
+func TestComputeContoursInvalidOptions(t *testing.T) {
+	// 3 seconds of silence at 16 kHz
+	pcm := PCM{PCMInfo: PCMInfo{SampleRate: 16000}, Samples: make([]float64, 48000)}
+	for _, opts := range []protocol.ContourOptions{
+		{StepMs: math.NaN()},
+		{StepMs: math.Inf(1)},
+		{StepMs: 1e-300},
+		{StepMs: -1},
+		// less than one sample
+		{StepMs: 0.05},
+		// too many frames
+		{StepMs: 0.125},
+		{PitchFloor: math.NaN()},
+		{PitchCeiling: math.NaN()},
+		{PitchFloor: math.Inf(-1)},
+	} {
+		if _, err := ComputeContours(pcm, opts); err == nil {
+			t.Errorf("expected error for options %#v", opts)
+		}
+	}
+
+	if _, err := ComputeContours(PCM{PCMInfo: PCMInfo{SampleRate: 16000}}, protocol.ContourOptions{}); err == nil {
+		t.Errorf("expected error for empty audio")
+	}
+}
+
+func TestComputeContoursNoise(t *testing.T) {
+	// white noise (deterministic) is unvoiced
+	pcm := PCM{PCMInfo: PCMInfo{SampleRate: 16000}}
+	seed := uint32(1)
+	for i := 0; i < 8000; i++ {
+		seed = seed*1664525 + 1013904223
+		pcm.Samples = append(pcm.Samples, float64(int32(seed))/math.MaxInt32*0.5)
+	}
+	cont, err := ComputeContours(pcm, protocol.ContourOptions{})
+	if err != nil {
+		t.Errorf("got error from ComputeContours: %v", err)
+		return
+	}
+	voiced := 0
+	for _, p := range cont.Pitch {
+		if p > 0 {
+			voiced++
+		}
+	}
+	if voiced > len(cont.Pitch)/10 {
+		t.Errorf("expected noise to be unvoiced, got %d voiced frames of %d", voiced, len(cont.Pitch))
+	}
+}
+
+func TestContoursWithContext(t *testing.T) {
+	ch, err := NewChunkExtractor()
+	if err != nil {
+		t.Errorf("got error from NewChunkExtractor: %v", err)
+		return
+	}
+	payload := protocol.SplitRequestPayload{
+		URL:          path.Join("test_data", "three_sentences.wav"),
+		Chunk:        protocol.Chunk{Start: 1000, End: 1500},
+		LeftContext:  200,
+		RightContext: 200,
+	}
+	cont, err := ch.ContoursWithContext(payload, protocol.ContourOptions{})
+	if err != nil {
+		t.Errorf("got error from ContoursWithContext: %v", err)
+		return
+	}
+	if cont.Offset != 800 || cont.Chunk.Start != 200 || cont.Chunk.End != 700 || cont.Start != 800 {
+		t.Errorf("unexpected timing: offset %v, chunk %v, start %v", cont.Offset, cont.Chunk, cont.Start)
+	}
+	if len(cont.Pitch) != 90 || len(cont.Intensity) != 90 {
+		t.Errorf("expected 90 frames, got %d pitch and %d intensity values", len(cont.Pitch), len(cont.Intensity))
+	}
+	voiced := 0
+	for _, p := range cont.Pitch {
+		if p > 0 {
+			voiced++
+			if p < cont.PitchFloor || p > cont.PitchCeiling {
+				t.Errorf("pitch %v outside of range %v-%v", p, cont.PitchFloor, cont.PitchCeiling)
+			}
+		}
+	}
+	if voiced == 0 {
+		t.Errorf("expected voiced frames in speech")
+	}
+}
@@ -14,3 +14,5 @@ func ffmpegEnabled() error {
 	}
 	return nil
 }
+
+var FfprobeCmd = "ffprobe"
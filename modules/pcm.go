@@ -0,0 +1,184 @@
+package modules
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strconv"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// pcmBlockSize is the number of samples passed to the ReadPCM callback at a time
+const pcmBlockSize = 16384
+
+// PCMInfo describes decoded audio
+type PCMInfo struct {
+	SampleRate int
+	// Start is the exact time (milliseconds) of the first sample
+	Start float64
+}
+
+// PCM holds decoded mono audio
+type PCM struct {
+	PCMInfo
+	// Samples are in the range [-1, 1]
+	Samples []float64
+}
+
+// Time returns the time (milliseconds) of sample i
+func (p PCM) Time(i int) float64 {
+	return p.Start + float64(i)*1000.0/float64(p.SampleRate)
+}
+
+// ReadPCM decodes the chunk of the audioFile to mono samples, passing them to fn in blocks. If chunk.End is 0, the whole file is decoded.
+// If channel > 0, only the specified channel (starting at 1) is decoded, else all channels are mixed.
+// Uncompressed WAV files are read natively; other formats require ffmpeg.
+func ReadPCM(audioFile string, chunk protocol.Chunk, channel int, fn func(samples []float64) error) (PCMInfo, error) {
+	res, err := readPCMWav(audioFile, chunk, channel, fn)
+	if !errors.Is(err, ErrNotPCMWav) {
+		return res, err
+	}
+	if err := ffmpegEnabled(); err != nil {
+		return res, err
+	}
+	return readPCMFfmpeg(audioFile, chunk, channel, fn)
+}
+
+// DecodePCM decodes the chunk of the audioFile to mono samples, see ReadPCM
+func DecodePCM(audioFile string, chunk protocol.Chunk, channel int) (PCM, error) {
+	res := PCM{}
+	info, err := ReadPCM(audioFile, chunk, channel, func(samples []float64) error {
+		res.Samples = append(res.Samples, samples...)
+		return nil
+	})
+	res.PCMInfo = info
+	return res, err
+}
+
+func readPCMWav(audioFile string, chunk protocol.Chunk, channel int, fn func(samples []float64) error) (PCMInfo, error) {
+	res := PCMInfo{}
+	wav, close, err := OpenWav(audioFile)
+	if err != nil {
+		return res, err
+	}
+	defer close()
+	format := wav.Format
+	if channel > format.Channels {
+		return res, fmt.Errorf("channel %d not found in %s (%d channels)", channel, audioFile, format.Channels)
+	}
+	from, to := wav.FrameAt(chunk.Start), wav.Frames()
+	if chunk.End > 0 {
+		to = wav.FrameAt(chunk.End)
+	}
+	res.SampleRate = format.SampleRate
+	res.Start = float64(from) * 1000.0 / float64(format.SampleRate)
+
+	for pos := from; pos < to; pos += pcmBlockSize {
+		end := pos + pcmBlockSize
+		if end > to {
+			end = to
+		}
+		data, err := wav.ReadFrames(pos, end)
+		if err != nil {
+			return res, err
+		}
+		if channel > 0 {
+			data = format.ExtractChannel(data, channel)
+			if err := fn(format.DecodeSamples(data)); err != nil {
+				return res, err
+			}
+			continue
+		}
+		interleaved := format.DecodeSamples(data)
+		mono := make([]float64, len(interleaved)/format.Channels)
+		for i := range mono {
+			var sum float64
+			for c := 0; c < format.Channels; c++ {
+				sum += interleaved[i*format.Channels+c]
+			}
+			mono[i] = sum / float64(format.Channels)
+		}
+		if err := fn(mono); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+func readPCMFfmpeg(audioFile string, chunk protocol.Chunk, channel int, fn func(samples []float64) error) (PCMInfo, error) {
+	res := PCMInfo{}
+	info, err := probeFfprobe(audioFile)
+	if err != nil {
+		return res, err
+	}
+	if channel > info.Channels {
+		return res, fmt.Errorf("channel %d not found in %s (%d channels)", channel, audioFile, info.Channels)
+	}
+	res.SampleRate = info.SampleRate
+	res.Start = accurateStart(chunk.Start, info.SampleRate)
+
+	//ffmpeg -v error -ss 10.000 -i <in> -af atrim=start=0.600:end=1.600 -ac 1 -ar <rate> -f f32le -
+	// as in accurate chunk extraction, decoding starts before the chunk (see inputSeek), and the chunk is trimmed relative to the seek point
+	seek := inputSeek(chunk.Start)
+	args := []string{"-v", "error"}
+	if seek > 0 {
+		args = append(args, "-ss", formatSeconds(seek))
+	}
+	args = append(args, "-i", audioFile)
+	filters := ""
+	if chunk.Start > 0 || chunk.End > 0 {
+		filters = fmt.Sprintf("atrim=start=%s", formatSeconds(chunk.Start-seek))
+		if chunk.End > 0 {
+			filters = fmt.Sprintf("%s:end=%s", filters, formatSeconds(chunk.End-seek))
+		}
+	}
+	if channel > 0 {
+		if filters != "" {
+			filters = filters + ","
+		}
+		filters = filters + panFilter(channel)
+	}
+	if filters != "" {
+		args = append(args, "-af", filters)
+	}
+	args = append(args, "-ac", "1", "-ar", strconv.Itoa(info.SampleRate), "-f", "f32le", "-")
+	cmd := exec.Command(FfmpegCmd, args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return res, err
+	}
+	if err := cmd.Start(); err != nil {
+		return res, fmt.Errorf("command %s failed : %v", cmd, err)
+	}
+	buf := make([]byte, pcmBlockSize*4)
+	for {
+		n, readErr := io.ReadFull(out, buf)
+		if n >= 4 {
+			samples := make([]float64, n/4)
+			for i := range samples {
+				samples[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(buf[i*4:])))
+			}
+			if err := fn(samples); err != nil {
+				cmd.Process.Kill()
+				cmd.Wait()
+				return res, err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return res, readErr
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return res, fmt.Errorf("command %s failed : %v", cmd, err)
+	}
+	return res, nil
+}
@@ -0,0 +1,55 @@
+package modules
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+func TestDecodePCM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcm-test")
+	if err != nil {
+		t.Errorf("got error from TempDir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// 1 kHz stereo: channel 1 is 0.5, channel 2 is -0.25
+	format := WavFormat{FormatCode: 1, Channels: 2, SampleRate: 1000, BitsPerSample: 16}
+	samples := []float64{}
+	for i := 0; i < 100; i++ {
+		samples = append(samples, 0.5, -0.25)
+	}
+	audioFile := filepath.Join(dir, "stereo.wav")
+	ioutil.WriteFile(audioFile, testWavFormat(t, format, samples), 0644)
+
+	for channel, exp := range map[int]float64{0: 0.125, 1: 0.5, 2: -0.25} {
+		pcm, err := DecodePCM(audioFile, protocol.Chunk{Start: 10, End: 20}, channel)
+		if err != nil {
+			t.Errorf("got error from DecodePCM: %v", err)
+			return
+		}
+		if pcm.SampleRate != 1000 || pcm.Start != 10 || len(pcm.Samples) != 10 {
+			t.Errorf("expected 10 samples at 1000 Hz starting at 10 ms, got %d samples at %d Hz starting at %v", len(pcm.Samples), pcm.SampleRate, pcm.Start)
+		}
+		if math.Abs(pcm.Samples[0]-exp) > 0.001 {
+			t.Errorf("channel %d: expected %v, got %v", channel, exp, pcm.Samples[0])
+		}
+	}
+}
+
+func TestDecodePCMWholeFile(t *testing.T) {
+	pcm, err := DecodePCM(path.Join("test_data", "three_sentences.wav"), protocol.Chunk{}, 0)
+	if err != nil {
+		t.Errorf("got error from DecodePCM: %v", err)
+		return
+	}
+	if len(pcm.Samples) != 364505 {
+		t.Errorf("expected %d samples, got %d", 364505, len(pcm.Samples))
+	}
+}
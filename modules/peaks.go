@@ -0,0 +1,248 @@
+package modules
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// PeaksBaseResolution is the number of samples per peak at the finest resolution
+const PeaksBaseResolution = 256
+
+// PeaksMaxWidth is the max number of peaks returned for one request
+const PeaksMaxWidth = 10000
+
+// peaksMinLevelSize is the min number of peaks in the coarsest resolution level
+const peaksMinLevelSize = 100
+
+// peakLevel holds the peaks at one resolution
+type peakLevel struct {
+	samplesPerPeak int
+	min, max       []float32
+}
+
+// peakEntry holds the peaks at all resolutions for one audio file (and channel)
+type peakEntry struct {
+	version    string
+	checked    time.Time
+	lastUsed   time.Time
+	sampleRate int
+	samples    int64
+	levels     []peakLevel // from finest to coarsest
+
+	done chan bool // closed when the peaks are computed
+	err  error
+}
+
+// PeakComputer computes min/max waveform peaks at several resolutions (each level halving the resolution of the previous one), so that a client can draw an overview of a whole recording, or zoom into part of it, without downloading the audio.
+// Peaks are computed for the whole audio file on the first request, and cached per file (and channel). Cached peaks are recomputed when the source audio changes.
+// For initialization, use NewPeakComputer().
+type PeakComputer struct {
+	// VersionTTL is the time a remote source version is trusted before it is checked again
+	VersionTTL time.Duration
+
+	mutex    sync.Mutex
+	maxFiles int
+	files    map[string]*peakEntry // file|channel -> peaks
+}
+
+// NewPeakComputer creates a new PeakComputer, caching peaks for up to maxFiles audio files (and channels)
+func NewPeakComputer(maxFiles int) *PeakComputer {
+	return &PeakComputer{
+		VersionTTL: time.Minute,
+		maxFiles:   maxFiles,
+		files:      make(map[string]*peakEntry),
+	}
+}
+
+// Peaks returns the peaks for the chunk of the audioFile (if chunk is nil, the whole file), at the coarsest resolution giving at least width peaks.
+// If channel > 0, peaks are computed for the specified channel (starting at 1), else for all channels mixed.
+func (p *PeakComputer) Peaks(audioFile string, channel int, chunk *protocol.Chunk, width int) (protocol.PeaksPayload, error) {
+	res := protocol.PeaksPayload{Channel: channel}
+	if width < 1 || width > PeaksMaxWidth {
+		return res, fmt.Errorf("invalid width %d (expected 1 to %d)", width, PeaksMaxWidth)
+	}
+	if chunk != nil && (chunk.Start < 0 || chunk.End <= chunk.Start) {
+		return res, fmt.Errorf("invalid chunk %v", *chunk)
+	}
+	entry, err := p.get(audioFile, channel)
+	if err != nil {
+		return res, err
+	}
+
+	res.SampleRate = entry.sampleRate
+	res.Duration = float64(entry.samples) * 1000.0 / float64(entry.sampleRate)
+	from, to := int64(0), entry.samples
+	if chunk != nil {
+		from = FirstSample(chunk.Start, entry.sampleRate)
+		to = FirstSample(chunk.End, entry.sampleRate)
+		if to > entry.samples {
+			to = entry.samples
+		}
+		if from > to {
+			from = to
+		}
+	}
+
+	// the coarsest level with at least width peaks in the range (or the finest level, for short ranges)
+	level := entry.levels[0]
+	for _, l := range entry.levels {
+		if (to-from)/int64(l.samplesPerPeak) < int64(width) {
+			break
+		}
+		level = l
+	}
+	spp := int64(level.samplesPerPeak)
+	i0 := from / spp
+	i1 := (to + spp - 1) / spp
+	if i1 > int64(len(level.min)) {
+		i1 = int64(len(level.min))
+	}
+	if i0 > i1 {
+		i0 = i1
+	}
+	res.SamplesPerPeak = level.samplesPerPeak
+	res.PeakDuration = float64(spp) * 1000.0 / float64(entry.sampleRate)
+	res.Start = float64(i0*spp) * 1000.0 / float64(entry.sampleRate)
+	res.Min = level.min[i0:i1]
+	res.Max = level.max[i0:i1]
+	return res, nil
+}
+
+// get returns the cached peaks for the file, computing them if needed
+func (p *PeakComputer) get(audioFile string, channel int) (*peakEntry, error) {
+	key := fmt.Sprintf("%s|%d", audioFile, channel)
+
+	p.mutex.Lock()
+	entry, ok := p.files[key]
+	p.mutex.Unlock()
+	if ok {
+		<-entry.done
+		if entry.err == nil && p.upToDate(audioFile, entry) {
+			p.mutex.Lock()
+			entry.lastUsed = time.Now()
+			p.mutex.Unlock()
+			return entry, nil
+		}
+		p.mutex.Lock()
+		if p.files[key] == entry {
+			delete(p.files, key)
+		}
+		p.mutex.Unlock()
+	}
+
+	p.mutex.Lock()
+	if other, ok := p.files[key]; ok {
+		// computation started by another caller
+		p.mutex.Unlock()
+		<-other.done
+		return other, other.err
+	}
+	entry = &peakEntry{done: make(chan bool), lastUsed: time.Now()}
+	p.files[key] = entry
+	p.evict()
+	p.mutex.Unlock()
+
+	entry.version, entry.err = checkSourceVersion(audioFile)
+	if entry.err == nil {
+		entry.checked = time.Now()
+		entry.err = computePeaks(audioFile, channel, entry)
+	}
+	close(entry.done)
+	if entry.err != nil {
+		p.mutex.Lock()
+		if p.files[key] == entry {
+			delete(p.files, key)
+		}
+		p.mutex.Unlock()
+	}
+	return entry, entry.err
+}
+
+// upToDate checks that the source audio has not changed since the peaks were computed
+func (p *PeakComputer) upToDate(audioFile string, entry *peakEntry) bool {
+	p.mutex.Lock()
+	checked := entry.checked
+	p.mutex.Unlock()
+	if isRemote(audioFile) && time.Since(checked) < p.VersionTTL {
+		return true
+	}
+	version, err := checkSourceVersion(audioFile)
+	if err != nil || version != entry.version {
+		return false
+	}
+	p.mutex.Lock()
+	entry.checked = time.Now()
+	p.mutex.Unlock()
+	return true
+}
+
+// evict removes the least recently used entries, if there are more than maxFiles (p.mutex should be locked)
+func (p *PeakComputer) evict() {
+	for len(p.files) > p.maxFiles && p.maxFiles > 0 {
+		var oldestKey string
+		var oldest *peakEntry
+		for key, e := range p.files {
+			if oldest == nil || e.lastUsed.Before(oldest.lastUsed) {
+				oldestKey, oldest = key, e
+			}
+		}
+		delete(p.files, oldestKey)
+	}
+}
+
+// computePeaks decodes the audio file, and computes the peaks at all resolutions
+func computePeaks(audioFile string, channel int, entry *peakEntry) error {
+	base := peakLevel{samplesPerPeak: PeaksBaseResolution}
+	var n int
+	min, max := math.Inf(1), math.Inf(-1)
+	info, err := ReadPCM(audioFile, protocol.Chunk{}, channel, func(samples []float64) error {
+		for _, s := range samples {
+			min = math.Min(min, s)
+			max = math.Max(max, s)
+			n++
+			if n == PeaksBaseResolution {
+				base.min = append(base.min, float32(min))
+				base.max = append(base.max, float32(max))
+				n = 0
+				min, max = math.Inf(1), math.Inf(-1)
+			}
+		}
+		entry.samples += int64(len(samples))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't decode %s : %v", audioFile, err)
+	}
+	if n > 0 {
+		base.min = append(base.min, float32(min))
+		base.max = append(base.max, float32(max))
+	}
+	if info.SampleRate < 1 {
+		return fmt.Errorf("couldn't read sample rate for %s", audioFile)
+	}
+	entry.sampleRate = info.SampleRate
+	entry.levels = []peakLevel{base}
+	for l := base; len(l.min) > peaksMinLevelSize; {
+		next := peakLevel{samplesPerPeak: l.samplesPerPeak * 2}
+		for i := 0; i < len(l.min); i += 2 {
+			min, max := l.min[i], l.max[i]
+			if i+1 < len(l.min) {
+				if l.min[i+1] < min {
+					min = l.min[i+1]
+				}
+				if l.max[i+1] > max {
+					max = l.max[i+1]
+				}
+			}
+			next.min = append(next.min, min)
+			next.max = append(next.max, max)
+		}
+		entry.levels = append(entry.levels, next)
+		l = next
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package modules
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+func TestPeaks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peaks-test")
+	if err != nil {
+		t.Errorf("got error from TempDir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// 8 kHz mono, 1 second, silence except for samples 1000-1099 (0.5) and 4000 (-0.75)
+	samples := make([]float64, 8000)
+	for i := 1000; i < 1100; i++ {
+		samples[i] = 0.5
+	}
+	samples[4000] = -0.75
+	audioFile := filepath.Join(dir, "audio.wav")
+	ioutil.WriteFile(audioFile, testWav(t, 8000, samples), 0644)
+
+	pc := NewPeakComputer(10)
+	peaks, err := pc.Peaks(audioFile, 0, nil, 10)
+	if err != nil {
+		t.Errorf("got error from Peaks: %v", err)
+		return
+	}
+	// 8000 samples: 32 peaks at 256 samples per peak (too few peaks for coarser levels)
+	if peaks.SamplesPerPeak != PeaksBaseResolution || len(peaks.Min) != 32 || peaks.Duration != 1000 || peaks.Start != 0 {
+		t.Errorf("expected 32 peaks at %d samples per peak, got %d peaks at %d samples per peak (duration %v, start %v)", PeaksBaseResolution, len(peaks.Min), peaks.SamplesPerPeak, peaks.Duration, peaks.Start)
+	}
+	if peaks.Max[3] < 0.49 || peaks.Max[4] < 0.49 || peaks.Max[5] != 0 {
+		t.Errorf("unexpected max values %v", peaks.Max)
+	}
+	if peaks.Min[15] > -0.74 {
+		t.Errorf("unexpected min values %v", peaks.Min)
+	}
+
+	// part of the file, at the finest resolution
+	peaks, err = pc.Peaks(audioFile, 0, &protocol.Chunk{Start: 100, End: 200}, 100)
+	if err != nil {
+		t.Errorf("got error from Peaks: %v", err)
+		return
+	}
+	// samples 800-1600: peaks 3-6 (768-1791)
+	if peaks.SamplesPerPeak != PeaksBaseResolution || len(peaks.Min) != 4 || peaks.Start != 96 || peaks.PeakDuration != 32 {
+		t.Errorf("expected 4 peaks starting at 96 ms, got %d peaks starting at %v (%d samples per peak)", len(peaks.Min), peaks.Start, peaks.SamplesPerPeak)
+	}
+
+	// the peaks are recomputed when the file changes
+	for i := range samples {
+		samples[i] = 0.25
+	}
+	ioutil.WriteFile(audioFile, testWav(t, 8000, samples), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(audioFile, later, later)
+	peaks, err = pc.Peaks(audioFile, 0, nil, 10)
+	if err != nil {
+		t.Errorf("got error from Peaks: %v", err)
+		return
+	}
+	if peaks.Max[3] > 0.26 || peaks.Min[15] < 0.24 {
+		t.Errorf("expected peaks for the updated file, got %v and %v", peaks.Max, peaks.Min)
+	}
+
+	if _, err := pc.Peaks(audioFile, 0, nil, 0); err == nil {
+		t.Errorf("expected error for width 0")
+	}
+}
+
+func TestPeaksTestData(t *testing.T) {
+	pc := NewPeakComputer(10)
+
+	// 364505 samples: 1424 peaks at 256 samples per peak, 712 at 512, 356 at 1024, 178 at 2048, 89 at 4096
+	peaks, err := pc.Peaks(path.Join("test_data", "three_sentences.wav"), 0, nil, 300)
+	if err != nil {
+		t.Errorf("got error from Peaks: %v", err)
+		return
+	}
+	if peaks.SamplesPerPeak != 1024 || len(peaks.Min) != 356 {
+		t.Errorf("expected 356 peaks at 1024 samples per peak, got %d peaks at %d samples per peak", len(peaks.Min), peaks.SamplesPerPeak)
+	}
+
+	peaks, err = pc.Peaks(path.Join("test_data", "three_sentences.wav"), 0, nil, 1000)
+	if err != nil {
+		t.Errorf("got error from Peaks: %v", err)
+		return
+	}
+	if len(peaks.Min) < 1000 || len(peaks.Min) != len(peaks.Max) {
+		t.Errorf("expected at least 1000 peaks, got %d/%d", len(peaks.Min), len(peaks.Max))
+	}
+	for i := range peaks.Min {
+		if peaks.Min[i] > peaks.Max[i] {
+			t.Errorf("min %v > max %v for peak %d", peaks.Min[i], peaks.Max[i], i)
+			break
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package modules
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// normalizePeak is the peak level (dBFS) used for normalization
+const normalizePeak = -1.0
+
+// resampleZeroCrossings is the number of zero crossings on each side of the (windowed sinc) resampling filter
+const resampleZeroCrossings = 16
+
+// ProcessPlayback applies playback preprocessing to a wav file, returning a new wav file.
+// Processing is applied in the following order: high-pass filter, gain or normalization, resampling, fades.
+func ProcessPlayback(wavBytes []byte, config protocol.PlaybackConfig) ([]byte, error) {
+	wav, err := NewWavReader(bytes.NewReader(wavBytes))
+	if err != nil {
+		return nil, err
+	}
+	data, err := wav.ReadFrames(0, wav.Frames())
+	if err != nil {
+		return nil, err
+	}
+	format := wav.Format
+	channels := splitChannels(format.DecodeSamples(data), format.Channels)
+
+	if config.HighPass > 0 && config.HighPass < float64(format.SampleRate)/2 {
+		for _, ch := range channels {
+			highPass(ch, config.HighPass, format.SampleRate)
+		}
+	}
+
+	gain := math.Pow(10, config.Gain/20)
+	if config.Normalize {
+		var peak float64
+		for _, ch := range channels {
+			for _, s := range ch {
+				peak = math.Max(peak, math.Abs(s))
+			}
+		}
+		gain = 1
+		if peak > 0 {
+			gain = math.Pow(10, normalizePeak/20) / peak
+		}
+	}
+	if gain != 1 {
+		for _, ch := range channels {
+			for i := range ch {
+				ch[i] *= gain
+			}
+		}
+	}
+
+	if config.SampleRate > 0 && config.SampleRate != format.SampleRate {
+		for i, ch := range channels {
+			channels[i] = resample(ch, format.SampleRate, config.SampleRate)
+		}
+		format.SampleRate = config.SampleRate
+	}
+
+	if config.FadeMs > 0 {
+		for _, ch := range channels {
+			fade(ch, int(config.FadeMs*int64(format.SampleRate)/1000))
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	err = WriteWav(buf, format, format.EncodeSamples(joinChannels(channels)))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't write wav : %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// splitChannels de-interleaves samples into one slice per channel
+func splitChannels(samples []float64, nChannels int) [][]float64 {
+	res := make([][]float64, nChannels)
+	n := len(samples) / nChannels
+	for c := range res {
+		res[c] = make([]float64, n)
+		for i := 0; i < n; i++ {
+			res[c][i] = samples[i*nChannels+c]
+		}
+	}
+	return res
+}
+
+// joinChannels interleaves the channels (of equal length)
+func joinChannels(channels [][]float64) []float64 {
+	if len(channels) == 0 {
+		return []float64{}
+	}
+	n := len(channels[0])
+	res := make([]float64, n*len(channels))
+	for c, ch := range channels {
+		for i, s := range ch {
+			res[i*len(channels)+c] = s
+		}
+	}
+	return res
+}
+
+// highPass applies a second order Butterworth high-pass filter (in place)
+func highPass(samples []float64, cutoff float64, sampleRate int) {
+	w0 := 2 * math.Pi * cutoff / float64(sampleRate)
+	// Q = 1/sqrt(2), alpha = sin(w0)/(2*Q)
+	alpha := math.Sin(w0) / math.Sqrt2
+	cosW0 := math.Cos(w0)
+	a0 := 1 + alpha
+	b0 := (1 + cosW0) / 2 / a0
+	b1 := -(1 + cosW0) / a0
+	b2 := b0
+	a1 := -2 * cosW0 / a0
+	a2 := (1 - alpha) / a0
+
+	var x1, x2, y1, y2 float64
+	for i, x := range samples {
+		y := b0*x + b1*x1 + b2*x2 - a1*y1 - a2*y2
+		x2, x1 = x1, x
+		y2, y1 = y1, y
+		samples[i] = y
+	}
+}
+
+// resample converts the samples to a new sample rate, using a windowed sinc filter.
+// Output sample i is at time i/toRate, so the first sample keeps its time position.
+func resample(samples []float64, fromRate, toRate int) []float64 {
+	n := int((int64(len(samples))*int64(toRate) + int64(fromRate) - 1) / int64(fromRate))
+	res := make([]float64, n)
+	ratio := float64(toRate) / float64(fromRate)
+	// when downsampling, the cutoff is lowered to avoid aliasing
+	cutoff := math.Min(1, ratio)
+	width := float64(resampleZeroCrossings) / cutoff
+	for i := range res {
+		pos := float64(i) / ratio
+		from := int(math.Ceil(pos - width))
+		to := int(math.Floor(pos + width))
+		var sum float64
+		for j := from; j <= to; j++ {
+			if j < 0 || j >= len(samples) {
+				continue
+			}
+			d := float64(j) - pos
+			// Hann window
+			w := 0.5 + 0.5*math.Cos(math.Pi*d/width)
+			sum += samples[j] * cutoff * sinc(cutoff*d) * w
+		}
+		res[i] = sum
+	}
+	return res
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// fade applies a linear fade in and fade out of n samples (in place)
+func fade(samples []float64, n int) {
+	if n > len(samples)/2 {
+		n = len(samples) / 2
+	}
+	for i := 0; i < n; i++ {
+		g := float64(i) / float64(n)
+		samples[i] *= g
+		samples[len(samples)-1-i] *= g
+	}
+}
@@ -0,0 +1,151 @@
+package modules
+
+import (
+	"bytes"
+	"math"
+	"path"
+	"testing"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// testWav creates a mono 16 bit wav file with the samples
+func testWav(t *testing.T, sampleRate int, samples []float64) []byte {
+	return testWavFormat(t, WavFormat{FormatCode: 1, Channels: 1, SampleRate: sampleRate, BitsPerSample: 16}, samples)
+}
+
+// testWavFormat creates a wav file with the format and (interleaved) samples
+func testWavFormat(t *testing.T, format WavFormat, samples []float64) []byte {
+	buf := &bytes.Buffer{}
+	err := WriteWav(buf, format, format.EncodeSamples(samples))
+	if err != nil {
+		t.Fatalf("got error from WriteWav: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func readTestWav(t *testing.T, bts []byte) (WavFormat, []float64) {
+	wav, err := NewWavReader(bytes.NewReader(bts))
+	if err != nil {
+		t.Fatalf("got error from NewWavReader: %v", err)
+	}
+	data, err := wav.ReadFrames(0, wav.Frames())
+	if err != nil {
+		t.Fatalf("got error from ReadFrames: %v", err)
+	}
+	return wav.Format, wav.Format.DecodeSamples(data)
+}
+
+func TestSampleCodec(t *testing.T) {
+	samples := []float64{0, 0.5, -0.5, 1, -1}
+	for _, format := range []WavFormat{
+		{FormatCode: 1, Channels: 1, SampleRate: 8000, BitsPerSample: 8},
+		{FormatCode: 1, Channels: 1, SampleRate: 8000, BitsPerSample: 16},
+		{FormatCode: 1, Channels: 1, SampleRate: 8000, BitsPerSample: 24},
+		{FormatCode: 1, Channels: 1, SampleRate: 8000, BitsPerSample: 32},
+		{FormatCode: 3, Channels: 1, SampleRate: 8000, BitsPerSample: 32},
+	} {
+		got := format.DecodeSamples(format.EncodeSamples(samples))
+		for i := range samples {
+			if math.Abs(got[i]-samples[i]) > 0.01 {
+				t.Errorf("%d bits, format %d: expected %v, got %v", format.BitsPerSample, format.FormatCode, samples, got)
+				break
+			}
+		}
+	}
+}
+
+func TestProcessPlaybackNormalize(t *testing.T) {
+	bts := testWav(t, 8000, []float64{0.1, -0.2, 0.1, 0})
+	processed, err := ProcessPlayback(bts, protocol.PlaybackConfig{Normalize: true})
+	if err != nil {
+		t.Errorf("got error from ProcessPlayback: %v", err)
+		return
+	}
+	_, got := readTestWav(t, processed)
+	exp := math.Pow(10, -1.0/20)
+	if math.Abs(got[1]+exp) > 0.001 || math.Abs(got[0]-exp/2) > 0.001 {
+		t.Errorf("expected peak %v, got %v", -exp, got)
+	}
+}
+
+func TestProcessPlaybackHighPassAndFade(t *testing.T) {
+	// DC offset is removed by the high-pass filter
+	samples := make([]float64, 8000)
+	for i := range samples {
+		samples[i] = 0.5
+	}
+	processed, err := ProcessPlayback(testWav(t, 8000, samples), protocol.PlaybackConfig{HighPass: 80, FadeMs: 10})
+	if err != nil {
+		t.Errorf("got error from ProcessPlayback: %v", err)
+		return
+	}
+	_, got := readTestWav(t, processed)
+	if len(got) != len(samples) {
+		t.Errorf("expected %d samples, got %d", len(samples), len(got))
+	}
+	if math.Abs(got[4000]) > 0.001 {
+		t.Errorf("expected DC to be removed, got %v", got[4000])
+	}
+	if got[0] != 0 || got[len(got)-1] != 0 {
+		t.Errorf("expected faded edges, got %v and %v", got[0], got[len(got)-1])
+	}
+}
+
+func TestProcessPlaybackResample(t *testing.T) {
+	// 100 Hz sine, 1 second
+	samples := make([]float64, 16000)
+	for i := range samples {
+		samples[i] = 0.5 * math.Sin(2*math.Pi*100*float64(i)/16000)
+	}
+	processed, err := ProcessPlayback(testWav(t, 16000, samples), protocol.PlaybackConfig{SampleRate: 8000})
+	if err != nil {
+		t.Errorf("got error from ProcessPlayback: %v", err)
+		return
+	}
+	format, got := readTestWav(t, processed)
+	if format.SampleRate != 8000 {
+		t.Errorf("expected sample rate %v, got %v", 8000, format.SampleRate)
+	}
+	if len(got) != 8000 {
+		t.Errorf("expected %d samples, got %d", 8000, len(got))
+	}
+	// the signal keeps its timing (away from the edges)
+	for _, i := range []int{1000, 2020, 4000} {
+		exp := 0.5 * math.Sin(2*math.Pi*100*float64(i)/8000)
+		if math.Abs(got[i]-exp) > 0.01 {
+			t.Errorf("sample %d: expected %v, got %v", i, exp, got[i])
+		}
+	}
+}
+
+func TestChunkExtractorPlayback(t *testing.T) {
+	ch, err := NewChunkExtractor()
+	if err != nil {
+		t.Errorf("got error from NewChunkExtractor: %v", err)
+		return
+	}
+	ch.SetPlayback(protocol.PlaybackConfig{SampleRate: 16000, FadeMs: 5})
+	chunk := protocol.Chunk{Start: 1000, End: 1500}
+	res, bts, err := ch.ExtractWithContext(path.Join("test_data", "three_sentences.wav"), chunk, 100, 100, "")
+	if err != nil {
+		t.Errorf("got error from ExtractWithContext: %v", err)
+		return
+	}
+	if res.SampleRate != 16000 || res.Playback == nil {
+		t.Errorf("expected sample rate 16000 and playback settings, got %v and %v", res.SampleRate, res.Playback)
+	}
+	// the timing is unchanged
+	if res.Offset != 900 || res.ExactOffset != 900 || res.Chunk.Start != 100 || res.Chunk.End != 600 {
+		t.Errorf("unexpected timing: offset %v, exact offset %v, chunk %v", res.Offset, res.ExactOffset, res.Chunk)
+	}
+	format, samples := readTestWav(t, bts)
+	if format.SampleRate != 16000 || len(samples) != 11200 {
+		t.Errorf("expected 700 ms at 16 kHz, got %d samples at %d Hz", len(samples), format.SampleRate)
+	}
+
+	_, _, err = ch.ExtractWithContext(path.Join("test_data", "three_sentences.wav"), chunk, 100, 100, "mp3")
+	if err == nil {
+		t.Errorf("expected error for playback preprocessing with mp3 output")
+	}
+}
@@ -0,0 +1,131 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// Prober reads audio metadata (duration, sample rate, channels and codec). Uncompressed WAV files are read natively; other formats require ffprobe.
+// Results are cached per audio file. Local files are probed again if their size or modification time has changed.
+// For initialization, use NewProber().
+type Prober struct {
+	mutex sync.RWMutex
+	cache map[string]probeEntry
+}
+
+type probeEntry struct {
+	info protocol.AudioInfo
+	// version is the size and modification time of a local file (empty for remote files), see checkSourceVersion
+	version string
+}
+
+// NewProber creates a new Prober
+func NewProber() *Prober {
+	return &Prober{cache: make(map[string]probeEntry)}
+}
+
+// Probe returns the metadata for the audioFile (a local file, a file:// URL, or an http(s) URL)
+func (p *Prober) Probe(audioFile string) (protocol.AudioInfo, error) {
+	var version string
+	if !isRemote(audioFile) {
+		var err error
+		version, err = checkSourceVersion(audioFile)
+		if err != nil {
+			return protocol.AudioInfo{}, err
+		}
+	}
+	p.mutex.RLock()
+	entry, ok := p.cache[audioFile]
+	p.mutex.RUnlock()
+	if ok && entry.version == version {
+		return entry.info, nil
+	}
+
+	res, err := probeWav(audioFile)
+	if err != nil {
+		res, err = probeFfprobe(audioFile)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	p.mutex.Lock()
+	p.cache[audioFile] = probeEntry{info: res, version: version}
+	p.mutex.Unlock()
+	return res, nil
+}
+
+func probeWav(audioFile string) (protocol.AudioInfo, error) {
+	wav, close, err := OpenWav(audioFile)
+	if err != nil {
+		return protocol.AudioInfo{}, err
+	}
+	defer close()
+	var codec string
+	switch {
+	case wav.Format.FormatCode == wavFormatFloat:
+		codec = fmt.Sprintf("pcm_f%dle", wav.Format.BitsPerSample)
+	case wav.Format.BitsPerSample == 8:
+		codec = "pcm_u8"
+	default:
+		codec = fmt.Sprintf("pcm_s%dle", wav.Format.BitsPerSample)
+	}
+	return protocol.AudioInfo{
+		Duration:   wav.Duration(),
+		SampleRate: wav.Format.SampleRate,
+		Channels:   wav.Format.Channels,
+		Codec:      codec,
+	}, nil
+}
+
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecName  string `json:"codec_name"`
+		SampleRate string `json:"sample_rate"`
+		Channels   int    `json:"channels"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+func probeFfprobe(audioFile string) (protocol.AudioInfo, error) {
+	if _, err := exec.LookPath(FfprobeCmd); err != nil {
+		return protocol.AudioInfo{}, fmt.Errorf("external command does not exist: %s", FfprobeCmd)
+	}
+	//ffprobe -v error -select_streams a:0 -show_entries stream=codec_name,sample_rate,channels:format=duration -of json <in>
+	cmd := exec.Command(FfprobeCmd, "-v", "error", "-select_streams", "a:0", "-show_entries", "stream=codec_name,sample_rate,channels:format=duration", "-of", "json", strings.TrimPrefix(audioFile, "file://"))
+	out, err := cmd.Output()
+	if err != nil {
+		return protocol.AudioInfo{}, fmt.Errorf("command %s failed : %#v", cmd, err)
+	}
+	var probe ffprobeOutput
+	err = json.Unmarshal(out, &probe)
+	if err != nil {
+		return protocol.AudioInfo{}, fmt.Errorf("couldn't parse ffprobe output : %v", err)
+	}
+	if len(probe.Streams) == 0 {
+		return protocol.AudioInfo{}, fmt.Errorf("no audio stream in %s", audioFile)
+	}
+	stream := probe.Streams[0]
+	sampleRate, err := strconv.Atoi(stream.SampleRate)
+	if err != nil {
+		return protocol.AudioInfo{}, fmt.Errorf("couldn't parse ffprobe sample rate %s : %v", stream.SampleRate, err)
+	}
+	duration, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil {
+		return protocol.AudioInfo{}, fmt.Errorf("couldn't parse ffprobe duration %s : %v", probe.Format.Duration, err)
+	}
+	return protocol.AudioInfo{
+		Duration:   duration * 1000.0,
+		SampleRate: sampleRate,
+		Channels:   stream.Channels,
+		Codec:      stream.CodecName,
+	}, nil
+}
@@ -0,0 +1,127 @@
+package modules
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+func TestProbeWav(t *testing.T) {
+	prober := NewProber()
+	got, err := prober.Probe(path.Join("test_data", "three_sentences.wav"))
+	if err != nil {
+		t.Errorf("got error from Probe: %v", err)
+		return
+	}
+	// 364505 samples at 44.1 kHz
+	exp := protocol.AudioInfo{Duration: 364505 * 1000.0 / 44100.0, SampleRate: 44100, Channels: 1, Codec: "pcm_s16le"}
+	if got != exp {
+		t.Errorf("expected %#v, got %#v", exp, got)
+	}
+}
+
+func TestProbeMP3(t *testing.T) {
+	skipWithoutFfmpeg(t)
+	prober := NewProber()
+	got, err := prober.Probe(path.Join("test_data", "three_sentences.mp3"))
+	if err != nil {
+		t.Errorf("got error from Probe: %v", err)
+		return
+	}
+	if got.SampleRate != 44100 || got.Channels != 1 || got.Codec != "mp3" {
+		t.Errorf("expected 44100 Hz mono mp3, got %#v", got)
+	}
+	if math.Abs(got.Duration-8265) > 100 {
+		t.Errorf("expected a duration of about %v ms, got %v", 8265, got.Duration)
+	}
+}
+
+func TestProbeChangedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "probe-test")
+	if err != nil {
+		t.Errorf("got error from TempDir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	audioFile := filepath.Join(dir, "audio.wav")
+	format := WavFormat{FormatCode: 1, Channels: 1, SampleRate: 1000, BitsPerSample: 16}
+	writeFile := func(frames int, modTime time.Time) {
+		buf := &bytes.Buffer{}
+		if err := WriteWav(buf, format, make([]byte, frames*2)); err != nil {
+			t.Fatalf("got error from WriteWav: %v", err)
+		}
+		if err := ioutil.WriteFile(audioFile, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("got error from WriteFile: %v", err)
+		}
+		os.Chtimes(audioFile, modTime, modTime)
+	}
+
+	prober := NewProber()
+	writeFile(100, time.Now().Add(-time.Hour))
+	got, err := prober.Probe(audioFile)
+	if err != nil || got.Duration != 100 {
+		t.Errorf("expected a duration of 100 ms, got %v (%v)", got.Duration, err)
+	}
+	// the cached metadata is not used for a changed file
+	writeFile(200, time.Now())
+	got, err = prober.Probe(audioFile)
+	if err != nil || got.Duration != 200 {
+		t.Errorf("expected a duration of 200 ms after the file changed, got %v (%v)", got.Duration, err)
+	}
+}
+
+func TestChunkExtractorClampContext(t *testing.T) {
+	chunker, err := NewChunkExtractor()
+	if err != nil {
+		t.Errorf("got error from NewChunkExtractor: %v", err)
+		return
+	}
+	got, bts, err := chunker.ExtractWithContext(path.Join("test_data", "three_sentences.wav"), protocol.Chunk{Start: 8000, End: 8200}, 100, 1000, "")
+	if err != nil {
+		t.Errorf("got error from ChunkExtractor.ExtractWithContext: %v", err)
+		return
+	}
+	if got.SourceInfo == nil || got.SourceInfo.SampleRate != 44100 {
+		t.Errorf("expected source info for 44.1 kHz audio, got %#v", got.SourceInfo)
+		return
+	}
+	wav, err := NewWavReader(bytes.NewReader(bts))
+	if err != nil {
+		t.Errorf("got error from NewWavReader: %v", err)
+		return
+	}
+	// the right context ends at the end of the file (sample 364505)
+	if exp := int64(364505) - FirstSample(7900, 44100); wav.Frames() != exp {
+		t.Errorf("expected %v samples, got %v", exp, wav.Frames())
+	}
+}
+
+func TestChunkExtractorWindow(t *testing.T) {
+	chunker, err := NewChunkExtractor()
+	if err != nil {
+		t.Errorf("got error from NewChunkExtractor: %v", err)
+		return
+	}
+	file := path.Join("test_data", "three_sentences.wav")
+	for _, test := range []struct {
+		chunk protocol.Chunk
+		exp   protocol.Chunk
+	}{
+		// the left context is limited by the start of the file
+		{chunk: protocol.Chunk{Start: 50, End: 150}, exp: protocol.Chunk{Start: 0, End: 250}},
+		{chunk: protocol.Chunk{Start: 1000, End: 1100}, exp: protocol.Chunk{Start: 900, End: 1200}},
+		// the right context is limited by the end of the file (8265.4 ms)
+		{chunk: protocol.Chunk{Start: 8200, End: 8250}, exp: protocol.Chunk{Start: 8100, End: 8266}},
+	} {
+		if got := chunker.Window(file, test.chunk, 100, 100); got != test.exp {
+			t.Errorf("expected window %v for chunk %v, got %v", test.exp, test.chunk, got)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package modules
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/cmplx"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// Default spectrogram settings, see protocol.SpectrogramOptions
+const (
+	DefaultSpectrogramWindowMs     = 5.0
+	DefaultSpectrogramStepMs       = 2.0
+	DefaultSpectrogramMaxFreq      = 8000.0
+	DefaultSpectrogramDynamicRange = 50.0
+)
+
+// spectrogramMaxFrames is the max number of frames in a spectrogram
+const spectrogramMaxFrames = 20000
+
+// spectrogramMaxValues is the max number of values (frames * bins) in a spectrogram
+const spectrogramMaxValues = 10000000
+
+// isFinite returns true if v is neither NaN nor infinite
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// spectrogramOptions returns the options with zero values replaced by defaults, and the max frequency limited to the Nyquist frequency
+func spectrogramOptions(opts protocol.SpectrogramOptions, sampleRate int) (protocol.SpectrogramOptions, error) {
+	if opts.WindowMs == 0 {
+		opts.WindowMs = DefaultSpectrogramWindowMs
+	}
+	if opts.StepMs == 0 {
+		opts.StepMs = DefaultSpectrogramStepMs
+	}
+	if opts.MaxFreq == 0 {
+		opts.MaxFreq = DefaultSpectrogramMaxFreq
+	}
+	if opts.DynamicRange == 0 {
+		opts.DynamicRange = DefaultSpectrogramDynamicRange
+	}
+	for _, v := range []float64{opts.WindowMs, opts.StepMs, opts.MinFreq, opts.MaxFreq, opts.DynamicRange} {
+		if !isFinite(v) {
+			return opts, fmt.Errorf("invalid spectrogram option value %v", v)
+		}
+	}
+	if nyquist := float64(sampleRate) / 2; opts.MaxFreq > nyquist {
+		opts.MaxFreq = nyquist
+	}
+	// window and step are at least one sample
+	sampleMs := 1000 / float64(sampleRate)
+	if opts.WindowMs < sampleMs || opts.WindowMs > 1000 {
+		return opts, fmt.Errorf("invalid window length %v ms", opts.WindowMs)
+	}
+	if opts.StepMs < sampleMs {
+		return opts, fmt.Errorf("invalid time step %v ms", opts.StepMs)
+	}
+	if opts.MinFreq < 0 || opts.MinFreq >= opts.MaxFreq {
+		return opts, fmt.Errorf("invalid frequency range %v-%v Hz", opts.MinFreq, opts.MaxFreq)
+	}
+	if opts.DynamicRange < 0 || opts.DynamicRange > 200 {
+		return opts, fmt.Errorf("invalid dynamic range %v dB", opts.DynamicRange)
+	}
+	return opts, nil
+}
+
+// ComputeSpectrogram computes a spectrogram for the decoded audio, using a short-time Fourier transform with a Hann window.
+// The Offset and Chunk of the result are not set.
+func ComputeSpectrogram(pcm PCM, opts protocol.SpectrogramOptions) (protocol.Spectrogram, error) {
+	res := protocol.Spectrogram{Start: pcm.Start}
+	if pcm.SampleRate < 1 {
+		return res, fmt.Errorf("invalid sample rate %d", pcm.SampleRate)
+	}
+	opts, err := spectrogramOptions(opts, pcm.SampleRate)
+	if err != nil {
+		return res, err
+	}
+	rate := float64(pcm.SampleRate)
+
+	windowSize := int(math.Round(opts.WindowMs * rate / 1000))
+	if windowSize < 2 {
+		windowSize = 2
+	}
+	fftSize := 1
+	for fftSize < windowSize {
+		fftSize *= 2
+	}
+	window := make([]float64, windowSize)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(windowSize-1))
+	}
+	step := opts.StepMs * rate / 1000
+	// the number of frames is checked before conversion to int, to avoid overflow
+	nFrames := math.Ceil(float64(len(pcm.Samples)) / step)
+	if nFrames < 1 {
+		return res, fmt.Errorf("no audio")
+	}
+	if nFrames > spectrogramMaxFrames {
+		return res, fmt.Errorf("too many frames (%.0f), use a longer time step", nFrames)
+	}
+	frames := int(nFrames)
+
+	res.FreqStep = rate / float64(fftSize)
+	firstBin := int(math.Ceil(opts.MinFreq / res.FreqStep))
+	lastBin := int(math.Floor(opts.MaxFreq / res.FreqStep))
+	opts.MinFreq = float64(firstBin) * res.FreqStep
+	opts.MaxFreq = float64(lastBin) * res.FreqStep
+	res.SpectrogramOptions = opts
+	res.Frames = frames
+	res.Bins = lastBin - firstBin + 1
+	if frames*res.Bins > spectrogramMaxValues {
+		return res, fmt.Errorf("too many values (%d frames, %d frequency bins), use a longer time step or a shorter window", frames, res.Bins)
+	}
+
+	// power (dB) per frame and bin
+	db := make([]float64, frames*res.Bins)
+	maxDB := math.Inf(-1)
+	buf := make([]complex128, fftSize)
+	for i := 0; i < frames; i++ {
+		center := (float64(i) + 0.5) * step
+		from := int(math.Round(center - float64(windowSize)/2))
+		for j := range buf {
+			buf[j] = 0
+		}
+		for j := 0; j < windowSize; j++ {
+			if k := from + j; k >= 0 && k < len(pcm.Samples) {
+				buf[j] = complex(pcm.Samples[k]*window[j], 0)
+			}
+		}
+		fft(buf)
+		for b := 0; b < res.Bins; b++ {
+			power := math.Pow(cmplx.Abs(buf[firstBin+b]), 2)
+			v := 10 * math.Log10(power+1e-20)
+			db[i*res.Bins+b] = v
+			if v > maxDB {
+				maxDB = v
+			}
+		}
+	}
+
+	res.Data = make([]byte, len(db))
+	floor := maxDB - opts.DynamicRange
+	for i, v := range db {
+		if v <= floor {
+			continue
+		}
+		res.Data[i] = byte(math.Round(255 * (v - floor) / opts.DynamicRange))
+	}
+	return res, nil
+}
+
+// fft computes the discrete Fourier transform in place (iterative radix-2). The length of x must be a power of 2.
+func fft(x []complex128) {
+	n := len(x)
+	// bit reversal permutation
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a := x[start+k]
+				b := x[start+k+size/2] * wk
+				x[start+k] = a + b
+				x[start+k+size/2] = a - b
+				wk *= w
+			}
+		}
+	}
+}
+
+// SpectrogramPNG renders the spectrogram as a grayscale PNG image, one pixel per frame and bin, with the lowest frequency at the bottom, and darker pixels for higher intensity
+func SpectrogramPNG(spec protocol.Spectrogram) ([]byte, error) {
+	img := image.NewGray(image.Rect(0, 0, spec.Frames, spec.Bins))
+	for i := 0; i < spec.Frames; i++ {
+		for j := 0; j < spec.Bins; j++ {
+			img.SetGray(i, spec.Bins-1-j, color.Gray{Y: 255 - spec.Data[i*spec.Bins+j]})
+		}
+	}
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, img)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode png : %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// SpectrogramWithContext computes a spectrogram for the same audio window that is extracted for the chunk with context (see ExtractURLWithContext)
+func (ch ChunkExtractor) SpectrogramWithContext(payload protocol.SplitRequestPayload, opts protocol.SpectrogramOptions) (protocol.Spectrogram, error) {
+	window := ch.Window(payload.URL, payload.Chunk, payload.LeftContext, payload.RightContext)
+	pcm, err := DecodePCM(payload.URL, window, payload.Channel)
+	if err != nil {
+		return protocol.Spectrogram{}, err
+	}
+	res, err := ComputeSpectrogram(pcm, opts)
+	if err != nil {
+		return res, err
+	}
+	res.Offset = window.Start
+	res.Chunk = protocol.Chunk{
+		Start: payload.Chunk.Start - window.Start,
+		End:   payload.Chunk.End - window.Start,
+	}
+	return res, nil
+}
@@ -0,0 +1,121 @@
+package modules
+
+import (
+	"bytes"
+	"image/png"
+	"math"
+	"path"
+	"testing"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+func TestComputeSpectrogram(t *testing.T) {
+	// 1 kHz sine at 8 kHz, 100 ms
+	pcm := PCM{PCMInfo: PCMInfo{SampleRate: 8000, Start: 250}}
+	for i := 0; i < 800; i++ {
+		pcm.Samples = append(pcm.Samples, 0.5*math.Sin(2*math.Pi*1000*float64(i)/8000))
+	}
+	spec, err := ComputeSpectrogram(pcm, protocol.SpectrogramOptions{WindowMs: 8, StepMs: 10})
+	if err != nil {
+		t.Errorf("got error from ComputeSpectrogram: %v", err)
+		return
+	}
+	// window 64 samples, fft size 64: 125 Hz per bin, 0-4000 Hz
+	if spec.Frames != 10 || spec.FreqStep != 125 || spec.Bins != 33 || spec.MaxFreq != 4000 || spec.Start != 250 {
+		t.Errorf("expected 10 frames and 33 bins (125 Hz) starting at 250 ms, got %d frames and %d bins (%v Hz) starting at %v ms, max freq %v", spec.Frames, spec.Bins, spec.FreqStep, spec.Start, spec.MaxFreq)
+	}
+	if len(spec.Data) != spec.Frames*spec.Bins {
+		t.Errorf("expected %d values, got %d", spec.Frames*spec.Bins, len(spec.Data))
+	}
+	// the max intensity is in the 1 kHz bin
+	for i := 0; i < spec.Frames; i++ {
+		frame := spec.Data[i*spec.Bins : (i+1)*spec.Bins]
+		maxBin := 0
+		for j, v := range frame {
+			if v > frame[maxBin] {
+				maxBin = j
+			}
+		}
+		if maxBin != 8 {
+			t.Errorf("frame %d: expected max intensity at bin %d (1000 Hz), got bin %d", i, 8, maxBin)
+		}
+	}
+
+	img, err := SpectrogramPNG(spec)
+	if err != nil {
+		t.Errorf("got error from SpectrogramPNG: %v", err)
+		return
+	}
+	decoded, err := png.Decode(bytes.NewReader(img))
+	if err != nil {
+		t.Errorf("got error from png.Decode: %v", err)
+		return
+	}
+	if b := decoded.Bounds(); b.Dx() != spec.Frames || b.Dy() != spec.Bins {
+		t.Errorf("expected %dx%d image, got %dx%d", spec.Frames, spec.Bins, b.Dx(), b.Dy())
+	}
+
+	if _, err := ComputeSpectrogram(pcm, protocol.SpectrogramOptions{MinFreq: 5000}); err == nil {
+		t.Errorf("expected error for min freq above the Nyquist frequency")
+	}
+}
+
+func TestComputeSpectrogramInvalidOptions(t *testing.T) {
+	// 3 seconds of silence at 8 kHz
+	pcm := PCM{PCMInfo: PCMInfo{SampleRate: 8000}, Samples: make([]float64, 24000)}
+	for _, opts := range []protocol.SpectrogramOptions{
+		{StepMs: math.NaN()},
+		{StepMs: math.Inf(1)},
+		{StepMs: 1e-300},
+		{StepMs: -1},
+		// less than one sample
+		{StepMs: 0.1},
+		{WindowMs: math.NaN()},
+		{WindowMs: math.Inf(1)},
+		{WindowMs: 1e-300},
+		{WindowMs: 0.1},
+		{DynamicRange: math.NaN()},
+		{MinFreq: math.NaN()},
+		{MaxFreq: math.Inf(1)},
+		// too many frames
+		{StepMs: 0.125, WindowMs: 1},
+		// too many values
+		{StepMs: 0.25, WindowMs: 1000},
+	} {
+		if _, err := ComputeSpectrogram(pcm, opts); err == nil {
+			t.Errorf("expected error for options %#v", opts)
+		}
+	}
+
+	if _, err := ComputeSpectrogram(PCM{PCMInfo: PCMInfo{SampleRate: 8000}}, protocol.SpectrogramOptions{}); err == nil {
+		t.Errorf("expected error for empty audio")
+	}
+}
+
+func TestSpectrogramWithContext(t *testing.T) {
+	ch, err := NewChunkExtractor()
+	if err != nil {
+		t.Errorf("got error from NewChunkExtractor: %v", err)
+		return
+	}
+	payload := protocol.SplitRequestPayload{
+		URL:          path.Join("test_data", "three_sentences.wav"),
+		Chunk:        protocol.Chunk{Start: 1000, End: 1500},
+		LeftContext:  200,
+		RightContext: 200,
+	}
+	spec, err := ch.SpectrogramWithContext(payload, protocol.SpectrogramOptions{})
+	if err != nil {
+		t.Errorf("got error from SpectrogramWithContext: %v", err)
+		return
+	}
+	// the same offset and chunk as the extracted audio chunk
+	if spec.Offset != 800 || spec.Start != 800 || spec.Chunk.Start != 200 || spec.Chunk.End != 700 {
+		t.Errorf("unexpected timing: offset %v, start %v, chunk %v", spec.Offset, spec.Start, spec.Chunk)
+	}
+	// 900 ms with 2 ms steps
+	if spec.Frames != 450 || spec.MaxFreq > 8000 {
+		t.Errorf("expected 450 frames up to 8000 Hz, got %d frames up to %v Hz", spec.Frames, spec.MaxFreq)
+	}
+}
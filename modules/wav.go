@@ -0,0 +1,365 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+// ErrNotPCMWav is returned by the WAV reader for audio that is not an uncompressed (PCM or IEEE float) WAV file
+var ErrNotPCMWav = errors.New("not a PCM wav file")
+
+// WAV format codes
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+// wavStreamedSize is the chunk size written by programs streaming a WAV file, when the size is not known in advance
+const wavStreamedSize = 0xFFFFFFFF
+
+// wavFmtSize is the size of the largest fmt chunk used by the reader (WAVE_FORMAT_EXTENSIBLE), any additional bytes are skipped
+const wavFmtSize = 40
+
+// sizer is implemented by readers knowing the size of their data, such as bytes.Reader and io.SectionReader
+type sizer interface {
+	Size() int64
+}
+
+// WavFormat describes the audio format of a WAV file
+type WavFormat struct {
+	FormatCode    uint16
+	Channels      int
+	SampleRate    int
+	BitsPerSample int
+}
+
+// BlockAlign is the size of one frame (one sample for each channel) in bytes
+func (f WavFormat) BlockAlign() int {
+	return f.Channels * f.BitsPerSample / 8
+}
+
+// ExtractChannel returns the audio data (raw bytes) for one channel (starting at 1) of the interleaved audio data
+func (f WavFormat) ExtractChannel(data []byte, channel int) []byte {
+	blockAlign := f.BlockAlign()
+	sampleSize := f.BitsPerSample / 8
+	from := (channel - 1) * sampleSize
+	res := make([]byte, 0, len(data)/f.Channels)
+	for i := 0; i+blockAlign <= len(data); i += blockAlign {
+		res = append(res, data[i+from:i+from+sampleSize]...)
+	}
+	return res
+}
+
+// DecodeSamples converts the audio data (raw bytes) to interleaved samples in the range [-1, 1]
+func (f WavFormat) DecodeSamples(data []byte) []float64 {
+	sampleSize := f.BitsPerSample / 8
+	res := make([]float64, len(data)/sampleSize)
+	for i := range res {
+		bts := data[i*sampleSize : (i+1)*sampleSize]
+		switch {
+		case f.FormatCode == wavFormatFloat && sampleSize == 4:
+			res[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(bts)))
+		case f.FormatCode == wavFormatFloat && sampleSize == 8:
+			res[i] = math.Float64frombits(binary.LittleEndian.Uint64(bts))
+		case sampleSize == 1:
+			// 8 bit samples are unsigned
+			res[i] = (float64(bts[0]) - 128) / 128
+		default:
+			var v int64
+			for j := sampleSize - 1; j >= 0; j-- {
+				v = v<<8 | int64(bts[j])
+			}
+			// sign extend
+			shift := uint(64 - 8*sampleSize)
+			v = v << shift >> shift
+			res[i] = float64(v) / float64(int64(1)<<uint(8*sampleSize-1))
+		}
+	}
+	return res
+}
+
+// EncodeSamples converts interleaved samples in the range [-1, 1] to audio data (raw bytes). Integer samples outside of the range are clipped.
+func (f WavFormat) EncodeSamples(samples []float64) []byte {
+	sampleSize := f.BitsPerSample / 8
+	res := make([]byte, len(samples)*sampleSize)
+	for i, s := range samples {
+		bts := res[i*sampleSize : (i+1)*sampleSize]
+		switch {
+		case f.FormatCode == wavFormatFloat && sampleSize == 4:
+			binary.LittleEndian.PutUint32(bts, math.Float32bits(float32(s)))
+		case f.FormatCode == wavFormatFloat && sampleSize == 8:
+			binary.LittleEndian.PutUint64(bts, math.Float64bits(s))
+		default:
+			max := float64(int64(1)<<uint(8*sampleSize-1)) - 1
+			v := int64(math.Round(math.Max(-1, math.Min(1, s)) * max))
+			if sampleSize == 1 {
+				bts[0] = byte(v + 128)
+				continue
+			}
+			for j := 0; j < sampleSize; j++ {
+				bts[j] = byte(v >> uint(8*j))
+			}
+		}
+	}
+	return res
+}
+
+// WavReader reads sample ranges from an uncompressed WAV file, using random access, so that only the requested range (and the header) is read.
+// For initialization, use NewWavReader() or OpenWav().
+type WavReader struct {
+	Format WavFormat
+	// DataOffset is the byte offset of the audio data
+	DataOffset int64
+	// DataSize is the size of the audio data, in bytes
+	DataSize int64
+
+	r io.ReaderAt
+}
+
+// NewWavReader parses the WAV header from r. If the data is not an uncompressed WAV file, ErrNotPCMWav is returned.
+// If r has a Size() int64 method, the audio data is limited to the size of r, and a data chunk of unknown size (streamed WAV) extends to the end of r.
+func NewWavReader(r io.ReaderAt) (*WavReader, error) {
+	header := make([]byte, 12)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotPCMWav
+		}
+		return nil, err
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return nil, ErrNotPCMWav
+	}
+
+	res := &WavReader{r: r}
+	var fmtFound bool
+	pos := int64(12)
+	for {
+		chunkHeader := make([]byte, 8)
+		if _, err := r.ReadAt(chunkHeader, pos); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("%w : no data chunk", ErrNotPCMWav)
+			}
+			return nil, err
+		}
+		id := string(chunkHeader[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunkHeader[4:8]))
+		pos += 8
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, fmt.Errorf("%w : invalid fmt chunk size %d", ErrNotPCMWav, size)
+			}
+			n := size
+			if n > wavFmtSize {
+				n = wavFmtSize
+			}
+			bts := make([]byte, n)
+			if _, err := r.ReadAt(bts, pos); err != nil {
+				return nil, fmt.Errorf("couldn't read fmt chunk : %v", err)
+			}
+			res.Format = WavFormat{
+				FormatCode:    binary.LittleEndian.Uint16(bts[0:2]),
+				Channels:      int(binary.LittleEndian.Uint16(bts[2:4])),
+				SampleRate:    int(binary.LittleEndian.Uint32(bts[4:8])),
+				BitsPerSample: int(binary.LittleEndian.Uint16(bts[14:16])),
+			}
+			if res.Format.FormatCode == wavFormatExtensible && size >= 26 {
+				// the first two bytes of the sub format GUID hold the format code
+				res.Format.FormatCode = binary.LittleEndian.Uint16(bts[24:26])
+			}
+			if res.Format.FormatCode != wavFormatPCM && res.Format.FormatCode != wavFormatFloat {
+				return nil, fmt.Errorf("%w : unsupported format code %d", ErrNotPCMWav, res.Format.FormatCode)
+			}
+			if res.Format.Channels < 1 || res.Format.SampleRate < 1 || res.Format.BitsPerSample < 8 || res.Format.BitsPerSample%8 != 0 {
+				return nil, fmt.Errorf("%w : unsupported format %#v", ErrNotPCMWav, res.Format)
+			}
+			fmtFound = true
+		case "data":
+			if !fmtFound {
+				return nil, fmt.Errorf("%w : data chunk before fmt chunk", ErrNotPCMWav)
+			}
+			res.DataOffset = pos
+			res.DataSize = size
+			if s, ok := r.(sizer); ok && s.Size() >= 0 {
+				available := s.Size() - pos
+				if available < 0 {
+					available = 0
+				}
+				if size == wavStreamedSize || size > available {
+					res.DataSize = available
+				}
+			}
+			return res, nil
+		}
+		// chunks are word aligned
+		pos += size + size%2
+	}
+}
+
+// Frames returns the number of frames (samples per channel) in the file
+func (w *WavReader) Frames() int64 {
+	return w.DataSize / int64(w.Format.BlockAlign())
+}
+
+// Duration returns the duration of the file, in milliseconds
+func (w *WavReader) Duration() float64 {
+	return float64(w.Frames()) * 1000.0 / float64(w.Format.SampleRate)
+}
+
+// FrameAt returns the index of the first frame at or after the time (in milliseconds), limited to the file length
+func (w *WavReader) FrameAt(ms int64) int64 {
+	frame := FirstSample(ms, w.Format.SampleRate)
+	if frame < 0 {
+		return 0
+	}
+	if frame > w.Frames() {
+		return w.Frames()
+	}
+	return frame
+}
+
+// ReadFrames reads the audio data (raw bytes) for the frames in the range [from, to)
+func (w *WavReader) ReadFrames(from, to int64) ([]byte, error) {
+	if from < 0 || to > w.Frames() || from > to {
+		return nil, fmt.Errorf("invalid frame range %d-%d (file has %d frames)", from, to, w.Frames())
+	}
+	blockAlign := int64(w.Format.BlockAlign())
+	res := make([]byte, (to-from)*blockAlign)
+	if len(res) == 0 {
+		return res, nil
+	}
+	n, err := w.r.ReadAt(res, w.DataOffset+from*blockAlign)
+	if err != nil && !(err == io.EOF && n == len(res)) {
+		return nil, fmt.Errorf("couldn't read audio data : %v", err)
+	}
+	return res, nil
+}
+
+// ReadChunk reads the audio data (raw bytes) for the chunk (in milliseconds). The chunk is limited to the file length.
+func (w *WavReader) ReadChunk(chunk protocol.Chunk) ([]byte, error) {
+	return w.ReadFrames(w.FrameAt(chunk.Start), w.FrameAt(chunk.End))
+}
+
+// WriteWav writes a WAV file with the specified format and audio data (raw bytes)
+func WriteWav(out io.Writer, format WavFormat, data []byte) error {
+	fmtSize := 16
+	if format.FormatCode != wavFormatPCM {
+		// non-PCM formats have an extension size field
+		fmtSize = 18
+	}
+	header := &bytes.Buffer{}
+	header.WriteString("RIFF")
+	binary.Write(header, binary.LittleEndian, uint32(4+8+fmtSize+8+len(data)+len(data)%2))
+	header.WriteString("WAVE")
+	header.WriteString("fmt ")
+	binary.Write(header, binary.LittleEndian, uint32(fmtSize))
+	binary.Write(header, binary.LittleEndian, format.FormatCode)
+	binary.Write(header, binary.LittleEndian, uint16(format.Channels))
+	binary.Write(header, binary.LittleEndian, uint32(format.SampleRate))
+	binary.Write(header, binary.LittleEndian, uint32(format.SampleRate*format.BlockAlign()))
+	binary.Write(header, binary.LittleEndian, uint16(format.BlockAlign()))
+	binary.Write(header, binary.LittleEndian, uint16(format.BitsPerSample))
+	if fmtSize == 18 {
+		binary.Write(header, binary.LittleEndian, uint16(0))
+	}
+	header.WriteString("data")
+	binary.Write(header, binary.LittleEndian, uint32(len(data)))
+	if _, err := out.Write(header.Bytes()); err != nil {
+		return err
+	}
+	if _, err := out.Write(data); err != nil {
+		return err
+	}
+	if len(data)%2 == 1 {
+		_, err := out.Write([]byte{0})
+		return err
+	}
+	return nil
+}
+
+// httpReaderAt reads from a remote file using HTTP Range requests
+type httpReaderAt struct {
+	url string
+	// size of the remote file, from the Content-Range header of the last response (-1 if unknown)
+	size int64
+}
+
+func newHTTPReaderAt(url string) *httpReaderAt {
+	return &httpReaderAt{url: url, size: -1}
+}
+
+// Size returns the size of the remote file, or -1 if it's unknown (before the first read, or if the server doesn't report it)
+func (h *httpReaderAt) Size() int64 {
+	return atomic.LoadInt64(&h.size)
+}
+
+func (h *httpReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	req, err := http.NewRequest("GET", h.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, io.EOF
+	default:
+		return 0, fmt.Errorf("range request for %s returned %s", h.url, resp.Status)
+	}
+	// Content-Range: bytes <first>-<last>/<size>, where size is * if unknown
+	contentRange := resp.Header.Get("Content-Range")
+	if i := strings.LastIndex(contentRange, "/"); i >= 0 {
+		if size, err := strconv.ParseInt(contentRange[i+1:], 10, 64); err == nil {
+			atomic.StoreInt64(&h.size, size)
+		}
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// OpenWav opens a WAV file for reading. The audioFile can be a local file, a file:// URL, or an http(s) URL (the server must support Range requests).
+// The returned close function should be called when the reader is no longer needed.
+func OpenWav(audioFile string) (*WavReader, func() error, error) {
+	if strings.HasPrefix(audioFile, "http://") || strings.HasPrefix(audioFile, "https://") {
+		res, err := NewWavReader(newHTTPReaderAt(audioFile))
+		return res, func() error { return nil }, err
+	}
+	f, err := os.Open(strings.TrimPrefix(audioFile, "file://"))
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	res, err := NewWavReader(io.NewSectionReader(f, 0, info.Size()))
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return res, f.Close, nil
+}
@@ -0,0 +1,237 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stts-se/segment_checker/protocol"
+)
+
+func TestWavReader(t *testing.T) {
+	wav, close, err := OpenWav(path.Join("test_data", "three_sentences.wav"))
+	if err != nil {
+		t.Errorf("got error from OpenWav: %v", err)
+		return
+	}
+	defer close()
+
+	expFormat := WavFormat{FormatCode: 1, Channels: 1, SampleRate: 44100, BitsPerSample: 16}
+	if wav.Format != expFormat {
+		t.Errorf("expected %#v, got %#v", expFormat, wav.Format)
+	}
+	if wav.DataOffset != 44 {
+		t.Errorf("expected data offset %v, got %v", 44, wav.DataOffset)
+	}
+
+	// 1587 ms at 44.1 kHz = 69986.7 samples, the first sample after is 69987
+	data, err := wav.ReadChunk(protocol.Chunk{Start: 0, End: 1587})
+	if err != nil {
+		t.Errorf("got error from ReadChunk: %v", err)
+		return
+	}
+	if exp := 69987 * 2; len(data) != exp {
+		t.Errorf("expected %v bytes, got %v", exp, len(data))
+	}
+
+	// the chunk end is limited to the file length
+	data, err = wav.ReadChunk(protocol.Chunk{Start: 8000, End: 100000})
+	if err != nil {
+		t.Errorf("got error from ReadChunk: %v", err)
+		return
+	}
+	if exp := (wav.Frames() - 352800) * 2; int64(len(data)) != exp {
+		t.Errorf("expected %v bytes, got %v", exp, len(data))
+	}
+}
+
+func TestWavReaderNotWav(t *testing.T) {
+	// a_pause.wav is an mp3 file
+	_, _, err := OpenWav(path.Join("test_data", "a_pause.wav"))
+	if !errors.Is(err, ErrNotPCMWav) {
+		t.Errorf("expected %v, got %v", ErrNotPCMWav, err)
+	}
+}
+
+func TestWavRoundTrip(t *testing.T) {
+	format := WavFormat{FormatCode: 1, Channels: 2, SampleRate: 16000, BitsPerSample: 16}
+	data := []byte{1, 0, 2, 0, 3, 0, 4, 0, 5, 0, 6, 0, 7, 0, 8, 0}
+	buf := &bytes.Buffer{}
+	err := WriteWav(buf, format, data)
+	if err != nil {
+		t.Errorf("got error from WriteWav: %v", err)
+		return
+	}
+	wav, err := NewWavReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Errorf("got error from NewWavReader: %v", err)
+		return
+	}
+	if wav.Format != format {
+		t.Errorf("expected %#v, got %#v", format, wav.Format)
+	}
+	if wav.Frames() != 4 {
+		t.Errorf("expected %v frames, got %v", 4, wav.Frames())
+	}
+	got, err := wav.ReadFrames(1, 3)
+	if err != nil {
+		t.Errorf("got error from ReadFrames: %v", err)
+		return
+	}
+	if !bytes.Equal(got, data[4:12]) {
+		t.Errorf("expected %v, got %v", data[4:12], got)
+	}
+}
+
+func TestWavReaderHeaderSizes(t *testing.T) {
+	format := WavFormat{FormatCode: 1, Channels: 1, SampleRate: 16000, BitsPerSample: 16}
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteWav(buf, format, data); err != nil {
+		t.Fatalf("got error from WriteWav: %v", err)
+	}
+	// the fmt chunk size is at offset 16, the data chunk size at offset 40
+	withSize := func(bts []byte, offset int, size uint32) []byte {
+		res := append([]byte{}, bts...)
+		binary.LittleEndian.PutUint32(res[offset:], size)
+		return res
+	}
+	// a fmt chunk with 60 extra bytes
+	extraFmt := append(withSize(buf.Bytes()[:36], 16, 16+60), make([]byte, 60)...)
+	extraFmt = append(extraFmt, buf.Bytes()[36:]...)
+
+	for _, test := range []struct {
+		name          string
+		wav           []byte
+		expDataOffset int64
+		expDataSize   int64
+	}{
+		{name: "header sizes", wav: buf.Bytes(), expDataOffset: 44, expDataSize: 200},
+		{name: "streamed", wav: withSize(buf.Bytes(), 40, 0xFFFFFFFF), expDataOffset: 44, expDataSize: 200},
+		{name: "truncated", wav: buf.Bytes()[:144], expDataOffset: 44, expDataSize: 100},
+		{name: "extra fmt bytes", wav: extraFmt, expDataOffset: 104, expDataSize: 200},
+	} {
+		wav, err := NewWavReader(bytes.NewReader(test.wav))
+		if err != nil {
+			t.Errorf("%s: got error from NewWavReader: %v", test.name, err)
+			continue
+		}
+		if wav.Format != format || wav.DataOffset != test.expDataOffset || wav.DataSize != test.expDataSize {
+			t.Errorf("%s: expected format %#v, data offset %d and data size %d, got %#v, %d and %d", test.name, format, test.expDataOffset, test.expDataSize, wav.Format, wav.DataOffset, wav.DataSize)
+			continue
+		}
+		got, err := wav.ReadFrames(0, wav.Frames())
+		if err != nil || !bytes.Equal(got, data[:test.expDataSize]) {
+			t.Errorf("%s: expected the audio data to the end of the file, got %d bytes (%v)", test.name, len(got), err)
+		}
+	}
+
+	// the fmt chunk is not read into memory, whatever size it claims
+	if _, err := NewWavReader(bytes.NewReader(withSize(buf.Bytes(), 16, 0xFFFFFFF0))); !errors.Is(err, ErrNotPCMWav) {
+		t.Errorf("expected %v for a fmt chunk size beyond the end of the file, got %v", ErrNotPCMWav, err)
+	}
+
+	// a streamed WAV file, read locally and over HTTP
+	dir, err := ioutil.TempDir("", "wav-test")
+	if err != nil {
+		t.Fatalf("got error from TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "streamed.wav"), withSize(buf.Bytes(), 40, 0xFFFFFFFF), 0644); err != nil {
+		t.Fatalf("got error from WriteFile: %v", err)
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+	for _, audioFile := range []string{filepath.Join(dir, "streamed.wav"), server.URL + "/streamed.wav"} {
+		wav, close, err := OpenWav(audioFile)
+		if err != nil {
+			t.Errorf("got error from OpenWav for %s: %v", audioFile, err)
+			continue
+		}
+		if wav.Frames() != 100 {
+			t.Errorf("expected 100 frames for %s, got %d", audioFile, wav.Frames())
+		}
+		if got, err := wav.ReadFrames(90, 100); err != nil || !bytes.Equal(got, data[180:]) {
+			t.Errorf("expected the last frames of %s, got %v (%v)", audioFile, got, err)
+		}
+		close()
+	}
+}
+
+func TestWavReaderHTTP(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("test_data")))
+	defer server.Close()
+
+	wav, close, err := OpenWav(server.URL + "/three_sentences.wav")
+	if err != nil {
+		t.Errorf("got error from OpenWav: %v", err)
+		return
+	}
+	defer close()
+	got, err := wav.ReadChunk(protocol.Chunk{Start: 1000, End: 1010})
+	if err != nil {
+		t.Errorf("got error from ReadChunk: %v", err)
+		return
+	}
+
+	file, err := ioutil.ReadFile(path.Join("test_data", "three_sentences.wav"))
+	if err != nil {
+		t.Errorf("got error from ReadFile: %v", err)
+		return
+	}
+	// 1000-1010 ms at 44.1 kHz = samples 44100-44541
+	exp := file[44+44100*2 : 44+44541*2]
+	if !bytes.Equal(got, exp) {
+		t.Errorf("expected %d bytes from the source file, got %d different bytes", len(exp), len(got))
+	}
+}
+
+func TestProcessWavChannel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wav-test")
+	if err != nil {
+		t.Errorf("got error from TempDir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// 1 kHz stereo, 16 bit: channel 1 has odd sample values, channel 2 has even values
+	format := WavFormat{FormatCode: 1, Channels: 2, SampleRate: 1000, BitsPerSample: 16}
+	data := []byte{1, 0, 2, 0, 3, 0, 4, 0, 5, 0, 6, 0, 7, 0, 8, 0}
+	audioFile := filepath.Join(dir, "stereo.wav")
+	buf := &bytes.Buffer{}
+	WriteWav(buf, format, data)
+	ioutil.WriteFile(audioFile, buf.Bytes(), 0644)
+
+	btss, err := processWav(audioFile, []protocol.Chunk{{Start: 1, End: 3}}, 2)
+	if err != nil {
+		t.Errorf("got error from processWav: %v", err)
+		return
+	}
+	wav, err := NewWavReader(bytes.NewReader(btss[0]))
+	if err != nil {
+		t.Errorf("got error from NewWavReader: %v", err)
+		return
+	}
+	if wav.Format.Channels != 1 {
+		t.Errorf("expected %v channel, got %v", 1, wav.Format.Channels)
+	}
+	got, _ := wav.ReadFrames(0, wav.Frames())
+	if exp := []byte{4, 0, 6, 0}; !bytes.Equal(got, exp) {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+
+	_, err = processWav(audioFile, []protocol.Chunk{{Start: 1, End: 3}}, 3)
+	if err == nil {
+		t.Errorf("expected error for non-existing channel")
+	}
+}
@@ -0,0 +1,47 @@
+package protocol
+
+// ErrorCode is a stable, machine-readable code for an error sent to the client, so that clients can react on errors without parsing the error message
+type ErrorCode string
+
+const (
+	// ErrorLocked: the segment is locked by another user
+	ErrorLocked ErrorCode = "locked"
+	// ErrorNotLocked: the segment is not locked (by the user)
+	ErrorNotLocked ErrorCode = "not_locked"
+	// ErrorNotFound: the requested segment does not exist
+	ErrorNotFound ErrorCode = "not_found"
+	// ErrorNoMatch: there is no segment matching the query
+	ErrorNoMatch ErrorCode = "no_match"
+	// ErrorInvalidIndex: the request index is not valid
+	ErrorInvalidIndex ErrorCode = "invalid_index"
+	// ErrorInvalidPayload: the request/payload is malformed, or has invalid content
+	ErrorInvalidPayload ErrorCode = "invalid_payload"
+	// ErrorConflict: the request conflicts with the current state (such as logging in twice, or requesting the segment already loaded)
+	ErrorConflict ErrorCode = "conflict"
+	// ErrorUnauthorized: the user is not allowed to perform the request
+	ErrorUnauthorized ErrorCode = "unauthorized"
+	// ErrorExtractionFailed: audio extraction failed
+	ErrorExtractionFailed ErrorCode = "extraction_failed"
+	// ErrorIdleTimeout: the client was disconnected due to inactivity
+	ErrorIdleTimeout ErrorCode = "idle_timeout"
+	// ErrorVersionMismatch: the client's protocol version is not supported by the server
+	ErrorVersionMismatch ErrorCode = "version_mismatch"
+	// ErrorInternal: internal server error
+	ErrorInternal ErrorCode = "internal"
+)
+
+// ErrorCodes lists the error codes with descriptions
+var ErrorCodes = map[ErrorCode]string{
+	ErrorLocked:           "the segment is locked by another user",
+	ErrorNotLocked:        "the segment is not locked (by the user)",
+	ErrorNotFound:         "the requested segment does not exist",
+	ErrorNoMatch:          "there is no segment matching the query",
+	ErrorInvalidIndex:     "the request index is not valid",
+	ErrorInvalidPayload:   "the request/payload is malformed, or has invalid content",
+	ErrorConflict:         "the request conflicts with the current state",
+	ErrorUnauthorized:     "the user is not allowed to perform the request",
+	ErrorExtractionFailed: "audio extraction failed",
+	ErrorIdleTimeout:      "the client was disconnected due to inactivity",
+	ErrorVersionMismatch:  "the client's protocol version is not supported by the server (the client should reload)",
+	ErrorInternal:         "internal server error",
+}
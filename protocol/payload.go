@@ -2,12 +2,15 @@ package protocol
 
 import (
 	"encoding/json"
+	"fmt"
 )
 
 type SourcePayload struct {
 	URL         string  `json:"url"`
 	SegmentType string  `json:"segment_type"`
 	Chunks      []Chunk `json:"chunks"`
+	// Channel is the audio channel, starting at 1 (optional)
+	Channel int `json:"channel,omitempty"`
 }
 
 type SegmentPayload struct {
@@ -15,11 +18,113 @@ type SegmentPayload struct {
 	URL         string `json:"url"`
 	SegmentType string `json:"segment_type"`
 	Chunk       Chunk  `json:"chunk"`
+	// Channel is the audio channel, starting at 1 (optional; if not set, the project default is used)
+	Channel int `json:"channel,omitempty"`
+	// Provenance is set for segments with automatically generated boundaries (not checked by a human)
+	Provenance *Provenance `json:"provenance,omitempty"`
+	// Derivation is set for segments created by an annotator, by splitting, merging or inserting segments
+	Derivation *Derivation `json:"derivation,omitempty"`
+	// Meta holds free-form metadata from the source data, such as speaker, transcript or detector confidence. It is preserved in annotations, and can't be changed by the client.
+	Meta Meta `json:"meta,omitempty"`
+	// Text is an orthographic transcript of the segment (optional). In annotations, it is the text as corrected by the annotators.
+	Text string `json:"text,omitempty"`
+}
+
+// Meta holds free-form segment metadata, as a JSON object
+type Meta map[string]interface{}
+
+// Value returns the metadata value for the key as a string (strings as they are, other values JSON encoded), or false if the key is not set
+func (m Meta) Value(key string) (string, bool) {
+	v, ok := m[key]
+	if !ok {
+		return "", false
+	}
+	if s, isString := v.(string); isString {
+		return s, true
+	}
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v), true
+	}
+	return string(bts), true
+}
+
+// Match returns true if the metadata has the value (as returned by Value) for each key in the filter
+func (m Meta) Match(filter map[string]string) bool {
+	for key, value := range filter {
+		if v, ok := m.Value(key); !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Provenance describes the origin of automatically generated segment boundaries
+type Provenance struct {
+	// Source is the tool that generated the boundaries, e.g. suggest_boundaries
+	Source string `json:"source"`
+	// Method describes how the boundaries were computed
+	Method    string `json:"method,omitempty"`
+	Timestamp string `json:"timestamp"`
+	// Original is the chunk before the boundaries were changed
+	Original *Chunk `json:"original,omitempty"`
+}
+
+// Edit operations, creating new segments from existing ones
+const (
+	// EditSplit splits a segment into two at a time inside the segment
+	EditSplit = "split"
+	// EditMerge merges adjacent segments of the same audio URL and channel into one
+	EditMerge = "merge"
+	// EditInsert inserts a new segment within the audio window of an existing segment
+	EditInsert = "insert"
+)
+
+// EditOperations lists the edit operations
+var EditOperations = []string{EditSplit, EditMerge, EditInsert}
+
+// Derivation describes how a segment was created from other segments by an annotator
+type Derivation struct {
+	// Operation is the edit operation that created the segment (split, merge or insert)
+	Operation string `json:"operation"`
+	// Parents are the segments that the segment was created from: the split segment, the merged segments, or the segment in whose audio window the segment was inserted
+	Parents []string `json:"parents"`
+	// Sources are the segments in the source data that the segment traces back to
+	Sources []string `json:"sources"`
+	// User is the annotator who made the edit
+	User      string `json:"user"`
+	Timestamp string `json:"timestamp"`
+}
+
+// EditPayload requests an edit operation
+type EditPayload struct {
+	// Operation is split, merge or insert
+	Operation string `json:"operation"`
+	// SegmentIDs are the segment to split, the segments to merge (adjacent, in order of start time), or the segment in whose audio window a new segment is inserted
+	SegmentIDs []string `json:"segment_ids"`
+	// At is the split time, in milliseconds (split only)
+	At int64 `json:"at,omitempty"`
+	// Chunk is the new segment, in milliseconds (insert only). It is clipped to the audio window of the segment.
+	Chunk    *Chunk `json:"chunk,omitempty"`
+	UserName string `json:"user_name"`
+	// Context is the left/right context (milliseconds) of the audio window, as for a query (0 for the default context)
+	Context int64 `json:"context,omitempty"`
+}
+
+// EditResultPayload is the result of an edit operation
+type EditResultPayload struct {
+	Operation string `json:"operation"`
+	// Parents are the edited segments. Split and merged segments get status replaced.
+	Parents []string `json:"parents"`
+	// Segments are the new segments, in order of start time
+	Segments []SegmentPayload `json:"segments"`
 }
 
 type SplitRequestPayload struct {
 	URL         string `json:"url"`
 	SegmentType string `json:"segment_type"`
+	// Channel to extract, starting at 1 (0 for all channels)
+	Channel int `json:"channel,omitempty"`
 	// LeftContext in milliseconds
 	LeftContext int64 `json:"left_context"`
 	// RightContext in milliseconds
@@ -36,12 +141,168 @@ type Chunk struct {
 
 type AudioChunk struct {
 	AnnotationPayload
-	// Audio is a base64 string representation of the audio
-	Audio    string `json:"audio,omitempty"`
+	// Audio is a base64 string representation of the audio (audio transport base64)
+	Audio string `json:"audio,omitempty"`
+	// AudioID identifies the binary websocket frame holding the audio (audio transport binary)
+	AudioID string `json:"audio_id,omitempty"`
+	// AudioURL is a short-lived URL from which the audio can be downloaded (audio transport url)
+	AudioURL string `json:"audio_url,omitempty"`
 	FileType string `json:"file_type"`
-	Offset   int64  `json:"offset"`
+	// Offset is the start time of the audio in the source file, in milliseconds (the chunk is relative to the offset)
+	Offset int64 `json:"offset"`
+	// SampleRate is the sample rate of the audio (if known)
+	SampleRate int `json:"sample_rate,omitempty"`
+	// ExactOffset is the time of the first audio sample in the source file, in milliseconds (if SampleAccurate is false, it is the same as Offset, and the audio may start up to a few tens of milliseconds from it)
+	ExactOffset float64 `json:"exact_offset"`
+	// SampleAccurate is true if the audio was extracted with sample accuracy
+	SampleAccurate bool `json:"sample_accurate"`
+	// SourceInfo holds metadata for the source audio file (if known)
+	SourceInfo *AudioInfo `json:"source_info,omitempty"`
+	// Playback is the playback preprocessing applied to the audio, if any
+	Playback *PlaybackConfig `json:"playback,omitempty"`
+	// Contours holds pitch and intensity tracks for the audio, if enabled for the segment type
+	Contours *Contours `json:"contours,omitempty"`
+	// Suggestion holds automatically suggested boundaries for the segment, if enabled for the segment type. Suggestions are not checked by a human, and are not saved unless accepted by the annotator.
+	Suggestion *BoundarySuggestion `json:"suggestion,omitempty"`
+	// Neighbours are the other segments from the same audio (URL and channel) overlapping the audio window, sorted by start time
+	Neighbours []Neighbour `json:"neighbours,omitempty"`
+}
+
+// Neighbour is a segment overlapping the audio window of an AudioChunk
+type Neighbour struct {
+	ID string `json:"id"`
+	// Chunk is the segment (annotated, or from the source data if unchecked). In an AudioChunk, it is relative to the offset, like the AudioChunk's chunk, and may extend outside of the audio.
+	Chunk Chunk `json:"chunk"`
+	// Status is the name of the segment's current status (unchecked for segments without annotation)
+	Status string   `json:"status"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+// BoundarySuggestion holds automatically suggested segment boundaries, at energy onsets/offsets snapped to zero crossings
+type BoundarySuggestion struct {
+	// Chunk is the suggested segment (milliseconds). In an AudioChunk, it is relative to the offset, like the AudioChunk's chunk.
+	Chunk Chunk `json:"chunk"`
+	// Start and End are the exact suggested times (milliseconds) in the source file
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	// StartFound and EndFound are false if no energy onset/offset was found near the boundary (the original boundary is kept)
+	StartFound bool `json:"start_found"`
+	EndFound   bool `json:"end_found"`
+	// Method describes how the suggestion was computed
+	Method string `json:"method"`
+}
+
+// AudioInfo holds audio file metadata
+type AudioInfo struct {
+	// Duration in milliseconds
+	Duration   float64 `json:"duration"`
+	SampleRate int     `json:"sample_rate"`
+	Channels   int     `json:"channels"`
+	// Codec name, using ffmpeg names (e.g. pcm_s16le, mp3)
+	Codec string `json:"codec"`
 }
 
+// PeaksRequestPayload requests waveform peaks for an audio URL
+type PeaksRequestPayload struct {
+	URL string `json:"url"`
+	// Channel is the audio channel, starting at 1 (optional; if not set, the project default is used)
+	Channel int `json:"channel,omitempty"`
+	// Chunk is the time range (milliseconds); if not set, peaks for the whole recording are returned
+	Chunk *Chunk `json:"chunk,omitempty"`
+	// Width is the requested number of peaks. The closest available resolution giving at least Width peaks is used.
+	Width int `json:"width"`
+}
+
+// PeaksPayload holds min/max waveform peaks for (part of) an audio URL
+type PeaksPayload struct {
+	URL     string `json:"url"`
+	Channel int    `json:"channel,omitempty"`
+	// Start is the exact time (milliseconds) of the first peak
+	Start float64 `json:"start"`
+	// PeakDuration is the duration (milliseconds) of each peak
+	PeakDuration   float64 `json:"peak_duration"`
+	SamplesPerPeak int     `json:"samples_per_peak"`
+	SampleRate     int     `json:"sample_rate"`
+	// Duration of the recording, in milliseconds
+	Duration float64 `json:"duration"`
+	// Min and Max hold the min and max sample values (in the range [-1, 1]) for each peak
+	Min []float32 `json:"min"`
+	Max []float32 `json:"max"`
+}
+
+// SpectrogramOptions holds spectrogram settings. Zero values are replaced by defaults.
+type SpectrogramOptions struct {
+	// WindowMs is the analysis window length, in milliseconds (default 5, a broadband spectrogram)
+	WindowMs float64 `json:"window_ms,omitempty"`
+	// StepMs is the time step between frames, in milliseconds (default 2)
+	StepMs float64 `json:"step_ms,omitempty"`
+	// MinFreq is the lowest frequency (Hz) shown (default 0)
+	MinFreq float64 `json:"min_freq,omitempty"`
+	// MaxFreq is the highest frequency (Hz) shown (default 8000, or the Nyquist frequency if lower)
+	MaxFreq float64 `json:"max_freq,omitempty"`
+	// DynamicRange is the intensity range (dB) shown, below the max intensity (default 50)
+	DynamicRange float64 `json:"dynamic_range,omitempty"`
+}
+
+// Spectrogram is an intensity matrix for the audio window of an AudioChunk.
+// Frame i covers the time range [Start + i*StepMs, Start + (i+1)*StepMs), with the analysis window centered in the range.
+// Bin j is centered at frequency MinFreq + j*FreqStep.
+type Spectrogram struct {
+	SpectrogramOptions
+	// Offset and Chunk are the same as for an AudioChunk with the same context: Offset is the window start (milliseconds), and Chunk is the segment relative to Offset
+	Offset int64 `json:"offset"`
+	Chunk  Chunk `json:"chunk"`
+	// Start is the exact time (milliseconds) of the first frame
+	Start float64 `json:"start"`
+	// FreqStep is the frequency step (Hz) between bins
+	FreqStep float64 `json:"freq_step"`
+	Frames   int     `json:"frames"`
+	Bins     int     `json:"bins"`
+	// Data holds the intensity (0-255, where 255 is the max intensity) for each frame and bin: the intensity for frame i, bin j is Data[i*Bins+j]. The data is base64 encoded in JSON.
+	Data []byte `json:"data"`
+}
+
+// ContourOptions holds pitch and intensity analysis settings. Zero values are replaced by defaults.
+type ContourOptions struct {
+	// StepMs is the time step between frames, in milliseconds (default 10)
+	StepMs float64 `json:"step_ms,omitempty"`
+	// PitchFloor is the lowest pitch (Hz) detected (default 75). The analysis window length is 3 periods of the pitch floor.
+	PitchFloor float64 `json:"pitch_floor,omitempty"`
+	// PitchCeiling is the highest pitch (Hz) detected (default 600)
+	PitchCeiling float64 `json:"pitch_ceiling,omitempty"`
+}
+
+// Contours holds pitch and intensity tracks for the audio window of an AudioChunk.
+// Frame i covers the time range [Start + i*StepMs, Start + (i+1)*StepMs), and is measured using an analysis window centered in the range (at Start + (i+0.5)*StepMs).
+type Contours struct {
+	ContourOptions
+	// Offset and Chunk are the same as for an AudioChunk with the same context: Offset is the window start (milliseconds), and Chunk is the segment relative to Offset
+	Offset int64 `json:"offset"`
+	Chunk  Chunk `json:"chunk"`
+	// Start is the exact time (milliseconds) of the first frame
+	Start float64 `json:"start"`
+	// Pitch is the pitch (F0, Hz) for each frame, 0 for unvoiced frames
+	Pitch []float64 `json:"pitch"`
+	// Intensity is the RMS intensity (dB) for each frame, relative to 2e-5 (i.e., dB SPL if sample values are in Pascal, as in Praat)
+	Intensity []float64 `json:"intensity"`
+}
+
+// Audio transports, i.e., how the audio of an AudioChunk is delivered to the client
+const (
+	// AudioTransportBase64: the audio is base64 encoded in the AudioChunk (used by default, for clients not listing any transport in their hello message)
+	AudioTransportBase64 = "base64"
+	// AudioTransportBinary: the audio is sent in a binary websocket frame following the AudioChunk message. The frame starts with the AudioID (AudioIDLength bytes), followed by the audio bytes.
+	AudioTransportBinary = "binary"
+	// AudioTransportURL: the audio can be downloaded from AudioURL (supporting HTTP Range requests) for a limited time
+	AudioTransportURL = "url"
+)
+
+// AudioTransports lists the supported audio transports
+var AudioTransports = []string{AudioTransportBase64, AudioTransportBinary, AudioTransportURL}
+
+// AudioIDLength is the length of the AudioID prefix in binary audio frames
+const AudioIDLength = 36
+
 func (ac AudioChunk) PrettyMarshal() ([]byte, error) {
 	copy := ac
 	copy.Audio = ""
@@ -62,7 +323,20 @@ type AnnotationPayload struct {
 	CurrentStatus Status   `json:"current_status,omitempty"`
 	StatusHistory []Status `json:"status_history,omitempty"`
 	Comment       string   `json:"comment,omitempty"`
-	Index         int64    `json:"index,omitempty"`
+	// TextHistory lists the changes of the text, oldest first (set by the server when an annotation with a changed text is saved)
+	TextHistory []TextEdit `json:"text_history,omitempty"`
+	// ClearText removes the text when the annotation is saved, since an empty text keeps the current text (only used in requests, it is not saved)
+	ClearText bool  `json:"clear_text,omitempty"`
+	Index     int64 `json:"index,omitempty"`
+}
+
+// TextEdit records a change of the segment text
+type TextEdit struct {
+	// Text is the new text
+	Text string `json:"text"`
+	// Source is the annotator who changed the text
+	Source    string `json:"source"`
+	Timestamp string `json:"timestamp"`
 }
 
 func (ap *AnnotationPayload) SetCurrentStatus(s Status) {
@@ -77,6 +351,31 @@ type UnlockPayload struct {
 	UserName  string `json:"user_name"`
 }
 
+// ProtocolVersion is the version of the websocket protocol, to be increased for changes that old clients cannot handle.
+// Version 1 is the original protocol, without the hello handshake.
+const ProtocolVersion = 2
+
+// MinProtocolVersion is the oldest client protocol version supported by the server
+const MinProtocolVersion = 2
+
+// HelloPayload is exchanged when a websocket connection is opened: the client sends its protocol version and capabilities, and the server replies with its own.
+type HelloPayload struct {
+	ProtocolVersion int          `json:"protocol_version"`
+	Capabilities    Capabilities `json:"capabilities"`
+}
+
+// Capabilities describes what a client or the server supports
+type Capabilities struct {
+	// MessageTypes lists the message types the sender can handle
+	MessageTypes []string `json:"message_types,omitempty"`
+	// AudioFormats lists audio file formats (for the server: the formats that will be sent to the client)
+	AudioFormats []string `json:"audio_formats,omitempty"`
+	// Features lists optional features supported by the sender
+	Features []string `json:"features,omitempty"`
+	// AudioTransports lists the audio transports supported by the sender, in order of preference (for the server's hello: the transport selected for this client)
+	AudioTransports []string `json:"audio_transports,omitempty"`
+}
+
 // QueryPayload holds criteria used to search in the database
 type QueryPayload struct {
 	UserName      string `json:"user_name"`
@@ -85,4 +384,23 @@ type QueryPayload struct {
 	RequestIndex  string `json:"request_index"`
 	CurrID        string `json:"curr_id"`
 	Context       int64  `json:"context,omitempty"`
+	// URL limits the query to the segments of one audio URL, stepping through them in order of start time (optional)
+	URL string `json:"url,omitempty"`
+	// Meta limits the query to segments with matching metadata values (optional), see Meta.Match
+	Meta map[string]string `json:"meta,omitempty"`
+	// Text limits the query to segments with a text matching the regular expression (optional)
+	Text string `json:"text,omitempty"`
+	// SegmentType limits the query to segments of one segment type (optional)
+	SegmentType string `json:"segment_type,omitempty"`
+}
+
+// SegmentTypePayload describes a segment type used in the project
+type SegmentTypePayload struct {
+	Name string `json:"name"`
+	// Context is the default audio context, in milliseconds before and after the segment
+	Context int64 `json:"context"`
+	// Labels lists the labels allowed for the segment type (any labels are allowed if empty)
+	Labels []string `json:"labels,omitempty"`
+	// Count is the number of segments of the type (not counting replaced segments)
+	Count int `json:"count"`
 }
@@ -67,3 +67,38 @@ func TestAnnotationPayload(t *testing.T) {
 	}
 
 }
+
+func TestMeta(t *testing.T) {
+	var segment SegmentPayload
+	err := UnmarshalStrict([]byte(`{"id": "s1", "url": "a.wav", "segment_type": "silence", "chunk": {"start": 1, "end": 2}, "meta": {"speaker": "A", "confidence": 0.75, "turn": 3, "tags": ["x"]}}`), &segment)
+	if err != nil {
+		t.Fatalf("UnmarshalStrict failed: %v", err)
+	}
+
+	for key, exp := range map[string]string{"speaker": "A", "confidence": "0.75", "turn": "3", "tags": `["x"]`} {
+		if got, ok := segment.Meta.Value(key); !ok || got != exp {
+			t.Errorf("Expected %s=%v, found %v (%v)", key, exp, got, ok)
+		}
+	}
+	if _, ok := segment.Meta.Value("transcript"); ok {
+		t.Errorf("Expected no value for transcript")
+	}
+
+	for _, test := range []struct {
+		filter map[string]string
+		exp    bool
+	}{
+		{filter: nil, exp: true},
+		{filter: map[string]string{"speaker": "A"}, exp: true},
+		{filter: map[string]string{"speaker": "A", "turn": "3"}, exp: true},
+		{filter: map[string]string{"speaker": "B"}, exp: false},
+		{filter: map[string]string{"speaker": "A", "transcript": ""}, exp: false},
+	} {
+		if got := segment.Meta.Match(test.filter); got != test.exp {
+			t.Errorf("Expected %v for filter %v, found %v", test.exp, test.filter, got)
+		}
+	}
+	if (Meta(nil)).Match(map[string]string{"speaker": "A"}) {
+		t.Errorf("Expected no match for empty metadata")
+	}
+}
@@ -0,0 +1,87 @@
+package protocol
+
+// ProjectConfig holds project settings, read from project.json in the project folder. All settings are optional.
+type ProjectConfig struct {
+	// Name is the display name of the project (default: the name of the project folder)
+	Name string `json:"name,omitempty"`
+	// Context is the default audio context, in milliseconds before and after the segment, for segment types without a configured context (default 1000, and 200 for segment type e). If set, it is used for all segment types without a configured context.
+	Context int64 `json:"context,omitempty"`
+	// Statuses lists the statuses that annotators can set, in the order of the client's save buttons (default: bad sample, skip, ok and text verified)
+	Statuses []StatusConfig `json:"statuses,omitempty"`
+	// Labels lists additional labels that annotators can add to an annotation (besides the labels of the statuses)
+	Labels []string `json:"labels,omitempty"`
+	// Channel is the default audio channel (starting at 1) for segments without a channel. Use 0 (default) for all channels.
+	Channel int `json:"channel,omitempty"`
+	// Playback holds audio preprocessing settings for playback
+	Playback PlaybackConfig `json:"playback,omitempty"`
+	// Contours lists the segment types for which pitch and intensity contours are sent with the audio chunks (for example "e")
+	Contours []string `json:"contours,omitempty"`
+	// Suggestions lists the segment types for which boundary suggestions are sent with the audio chunks
+	Suggestions []string `json:"suggestions,omitempty"`
+	// MetaStats lists the segment metadata keys (for example "speaker") for which the stats are broken down by value
+	MetaStats []string `json:"meta_stats,omitempty"`
+	// Text holds the rules for the segment text (transcript)
+	Text TextRules `json:"text,omitempty"`
+	// SegmentTypes holds settings for each segment type (optional)
+	SegmentTypes map[string]SegmentTypeConfig `json:"segment_types,omitempty"`
+}
+
+// StatusConfig is a status that annotators can set, shown as a save button in the client
+type StatusConfig struct {
+	// Name is the status name, saved as the current status of the annotation
+	Name string `json:"name"`
+	// Label is saved as a label with the status (optional). Annotations with the label are shown, searched and counted by the label, for example status skip with label "bad sample".
+	Label string `json:"label,omitempty"`
+	// Button is the text of the client's save button (default: the label, or the name)
+	Button string `json:"button,omitempty"`
+	// Color is the button and status color, as a CSS color (optional)
+	Color string `json:"color,omitempty"`
+	// Key is the keyboard shortcut for the save button (optional)
+	Key string `json:"key,omitempty"`
+	// Description is shown as a tooltip for the save button (optional)
+	Description string `json:"description,omitempty"`
+}
+
+// DisplayName returns the name the status is shown, searched and counted by: the label, if set, or else the name
+func (s StatusConfig) DisplayName() string {
+	if s.Label != "" {
+		return s.Label
+	}
+	return s.Name
+}
+
+// SegmentTypeConfig holds settings for a segment type
+type SegmentTypeConfig struct {
+	// Context is the default audio context, in milliseconds before and after the segment (0 for the project's default context)
+	Context int64 `json:"context,omitempty"`
+	// Labels lists the labels allowed for the segment type, for example "bad sample". If empty, any labels (of the project) are allowed.
+	Labels []string `json:"labels,omitempty"`
+}
+
+// TextRules are checked when an annotation is saved with a changed text, or with status text verified
+type TextRules struct {
+	// Chars lists the characters allowed in the text, for example "abcdefghijklmnopqrstuvwxyzåäö -" (with a space, if words are separated by spaces). If empty, any characters are allowed.
+	Chars string `json:"chars,omitempty"`
+	// Pattern is a regular expression that the whole text must match (optional)
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// PlaybackConfig holds audio preprocessing settings, applied to extracted audio chunks before they are sent to the client.
+// Preprocessing doesn't change the chunk timing, and is never applied to the source audio or the annotation data.
+type PlaybackConfig struct {
+	// Gain is the gain in dB (ignored if Normalize is set)
+	Gain float64 `json:"gain,omitempty"`
+	// Normalize scales each chunk (including context) to a peak level of -1 dBFS
+	Normalize bool `json:"normalize,omitempty"`
+	// HighPass is the cutoff frequency (Hz) for a high-pass filter (0 for no filter)
+	HighPass float64 `json:"highpass,omitempty"`
+	// SampleRate is the output sample rate (0 to keep the source sample rate)
+	SampleRate int `json:"sample_rate,omitempty"`
+	// FadeMs is the length (milliseconds) of fade in/out at the chunk edges, to avoid clicks
+	FadeMs int64 `json:"fade_ms,omitempty"`
+}
+
+// Enabled returns true if any preprocessing is configured
+func (p PlaybackConfig) Enabled() bool {
+	return p != PlaybackConfig{}
+}
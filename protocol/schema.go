@@ -0,0 +1,259 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Schema is a JSON Schema describing a protocol type. Only the subset of JSON Schema needed for the protocol types is supported.
+type Schema struct {
+	Ref        string             `json:"$ref,omitempty"`
+	Title      string             `json:"title,omitempty"`
+	Type       string             `json:"type,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Items      *Schema            `json:"items,omitempty"`
+	// AdditionalProperties is the schema for map values (*Schema), or false for structs (unknown fields are not allowed)
+	AdditionalProperties interface{} `json:"additionalProperties,omitempty"`
+}
+
+// Schemas returns the schemas for the on-disk and wire formats, by type name
+func Schemas() map[string]*Schema {
+	res := map[string]*Schema{}
+	for _, v := range []interface{}{
+		SourcePayload{},
+		SegmentPayload{},
+		AnnotationPayload{},
+		SplitRequestPayload{},
+		AudioChunk{},
+		UnlockPayload{},
+		QueryPayload{},
+		HelloPayload{},
+		ProjectConfig{},
+		PeaksRequestPayload{},
+		PeaksPayload{},
+		Spectrogram{},
+		Contours{},
+		EditPayload{},
+		EditResultPayload{},
+		SegmentTypePayload{},
+	} {
+		schema := SchemaOf(v)
+		res[schema.Title] = schema
+	}
+	return res
+}
+
+var schemaCache sync.Map // reflect.Type -> *Schema
+
+// SchemaOf generates a JSON Schema for the (Go) type of v, based on the type's json struct tags
+func SchemaOf(v interface{}) *Schema {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return &Schema{}
+	}
+	if cached, ok := schemaCache.Load(t); ok {
+		return cached.(*Schema)
+	}
+	res := schemaOfType(t)
+	schemaCache.Store(t, res)
+	return res
+}
+
+func schemaOfType(t reflect.Type) *Schema {
+	if t == nil {
+		return &Schema{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOfType(t.Elem())
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// byte slices are encoded as base64 strings
+			return &Schema{Type: "string"}
+		}
+		return &Schema{Type: "array", Items: schemaOfType(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaOfType(t.Elem())}
+	case reflect.Struct:
+		res := &Schema{Title: t.Name(), Type: "object", Properties: map[string]*Schema{}, AdditionalProperties: false}
+		addStructProperties(res, t)
+		return res
+	default:
+		// interface{}: any value
+		return &Schema{}
+	}
+}
+
+// addStructProperties adds the fields of struct type t to the schema, flattening embedded structs the same way as encoding/json does
+func addStructProperties(schema *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, skip := jsonFieldName(f)
+		if skip {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && ft.Kind() == reflect.Struct && f.Tag.Get("json") == "" {
+			addStructProperties(schema, ft)
+			continue
+		}
+		schema.Properties[name] = schemaOfType(f.Type)
+	}
+}
+
+// jsonFieldName returns the json name of the struct field, or skip=true if the field is not marshalled
+func jsonFieldName(f reflect.StructField) (string, bool) {
+	if f.PkgPath != "" && !f.Anonymous {
+		// unexported
+		return "", true
+	}
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", true
+	}
+	name := strings.Split(tag, ",")[0]
+	if name == "" {
+		name = f.Name
+	}
+	return name, false
+}
+
+// ValidationError is a schema validation error, with the JSON path to the invalid value
+type ValidationError struct {
+	Path string
+	Msg  string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Msg)
+}
+
+// UnmarshalStrict validates the JSON data against the schema for v's type, and then unmarshals it into v.
+// Unlike json.Unmarshal, unknown fields and values of the wrong type are reported as errors (of type ValidationError).
+func UnmarshalStrict(data []byte, v interface{}) error {
+	if err := SchemaOf(v).Validate(data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Validate checks that the JSON data is valid according to the schema
+func (s *Schema) Validate(data []byte) error {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return ValidationError{Path: "$", Msg: fmt.Sprintf("invalid JSON : %v", err)}
+	}
+	return s.validate("$", v)
+}
+
+var identifierRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+func jsonPath(parent, key string) string {
+	if identifierRE.MatchString(key) {
+		return parent + "." + key
+	}
+	return fmt.Sprintf("%s[%q]", parent, key)
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "null"
+}
+
+func (s *Schema) validate(path string, v interface{}) error {
+	if v == nil {
+		// null is accepted for all types (json.Unmarshal leaves the value unchanged)
+		return nil
+	}
+	typeErr := ValidationError{Path: path, Msg: fmt.Sprintf("expected %s, found %s", s.Type, jsonType(v))}
+	switch s.Type {
+	case "string":
+		if _, ok := v.(string); !ok {
+			return typeErr
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return typeErr
+		}
+	case "number":
+		if _, ok := v.(json.Number); !ok {
+			return typeErr
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return typeErr
+		}
+		if _, err := n.Int64(); err != nil {
+			return ValidationError{Path: path, Msg: fmt.Sprintf("expected integer, found %s", n)}
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return typeErr
+		}
+		for i, item := range items {
+			if s.Items == nil {
+				continue
+			}
+			if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+				return err
+			}
+		}
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return typeErr
+		}
+		keys := []string{}
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if prop, ok := s.Properties[k]; ok {
+				if err := prop.validate(jsonPath(path, k), obj[k]); err != nil {
+					return err
+				}
+			} else if additional, ok := s.AdditionalProperties.(*Schema); ok {
+				if err := additional.validate(jsonPath(path, k), obj[k]); err != nil {
+					return err
+				}
+			} else if s.AdditionalProperties == false {
+				return ValidationError{Path: jsonPath(path, k), Msg: "unknown field"}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSchemaOf(t *testing.T) {
+	schema := SchemaOf(AnnotationPayload{})
+
+	bts, err := json.MarshalIndent(schema, " ", " ")
+	if err != nil {
+		t.Errorf("Marshal failed: %v", err)
+	}
+	t.Logf("%s", bts)
+
+	if schema.Type != "object" {
+		t.Errorf("Expected %v, found %v", "object", schema.Type)
+	}
+
+	// embedded SegmentPayload fields should be flattened
+	gotProps := []string{}
+	for name := range schema.Properties {
+		gotProps = append(gotProps, name)
+	}
+	sort.Strings(gotProps)
+	expProps := []string{"channel", "chunk", "clear_text", "comment", "current_status", "derivation", "id", "index", "labels", "meta", "provenance", "segment_type", "status_history", "text", "text_history", "url"}
+	if !reflect.DeepEqual(expProps, gotProps) {
+		t.Errorf("Expected %v, found %v", expProps, gotProps)
+	}
+
+	if got := schema.Properties["chunk"].Properties["start"].Type; got != "integer" {
+		t.Errorf("Expected %v, found %v", "integer", got)
+	}
+	if got := schema.Properties["labels"].Items.Type; got != "string" {
+		t.Errorf("Expected %v, found %v", "string", got)
+	}
+	if got := schema.Properties["status_history"].Items.Properties["timestamp"].Type; got != "string" {
+		t.Errorf("Expected %v, found %v", "string", got)
+	}
+
+	mapSchema := SchemaOf(map[string]int{})
+	if valueSchema, ok := mapSchema.AdditionalProperties.(*Schema); mapSchema.Type != "object" || !ok || valueSchema.Type != "integer" {
+		t.Errorf("Expected object with integer values, found %#v", mapSchema)
+	}
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	var segment SegmentPayload
+	input := `{"id": "seg_0001", "url": "/audio/seg.wav", "segment_type": "silence", "chunk": {"start": 3935, "end": 5051}}`
+	err := UnmarshalStrict([]byte(input), &segment)
+	if err != nil {
+		t.Errorf("Expected no error, found %v", err)
+	}
+	if segment.Chunk.End != 5051 {
+		t.Errorf("Expected %v, found %v", 5051, segment.Chunk.End)
+	}
+
+	for input, expErr := range map[string]string{
+		`{"uuid": "seg_0001", "url": "/audio/seg.wav"}`:        `$.uuid: unknown field`,
+		`{"id": "seg_0001", "chunk": {"start": "3935"}}`:       `$.chunk.start: expected integer, found string`,
+		`{"id": "seg_0001", "chunk": {"start": 3935.5}}`:       `$.chunk.start: expected integer, found 3935.5`,
+		`{"id": "seg_0001", "chunk": {"start": 1, "stop": 2}}`: `$.chunk.stop: unknown field`,
+		`{"id": 1}`:      `$.id: expected string, found number`,
+		`["seg_0001"]`:   `$: expected object, found array`,
+		`{"id": "seg_00`: `$: invalid JSON : unexpected EOF`,
+	} {
+		var segment SegmentPayload
+		err := UnmarshalStrict([]byte(input), &segment)
+		if err == nil {
+			t.Errorf("Expected error for %s, found nil", input)
+			continue
+		}
+		if err.Error() != expErr {
+			t.Errorf("Expected %v, found %v", expErr, err)
+		}
+	}
+
+	var annotation AnnotationPayload
+	input = `{"id": "seg_0001", "labels": ["bad sample"], "status_history": [{"name": "ok", "source": "anna", "timestamp": "2020-12-08 19:21:43"}, {"name": "ok", "user": "anna"}]}`
+	err = UnmarshalStrict([]byte(input), &annotation)
+	expErr := `$.status_history[1].user: unknown field`
+	if err == nil || err.Error() != expErr {
+		t.Errorf("Expected %v, found %v", expErr, err)
+	}
+}